@@ -1,38 +1,62 @@
 package block
 
 import (
-	"crypto/sha256"
+	"errors"
 	"fmt"
-	"time"
+	"github.com/defaziom/blockchain-go/merkle"
+	"github.com/defaziom/blockchain-go/transaction"
 )
 
+var ErrTransactionNotFound = errors.New("transaction not found in block")
+
 type Block struct {
-	Timestamp     time.Time
-	Data          string
-	PrevBlockHash string
-	BlockHash     string
-	Index         int
-	Nonce         int
-	Difficulty    int
+	BlockHeader
+	Transactions []*transaction.Transaction
+	BlockHash    string
+	Index        int
+}
+
+// CalculateBlockHash hashes the binary encoding of the block header
+func (b *Block) CalculateBlockHash() string {
+	return b.BlockHeader.CalculateHash()
+}
+
+// merkleLeaves returns the entries the Merkle root commits to, which are the witness hashes of the transactions in
+// order. The ids would leave the signatures out of the block hash.
+func (b *Block) merkleLeaves() [][]byte {
+	leaves := make([][]byte, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		leaves[i] = []byte(tx.CalculateWitnessHash())
+	}
+	return leaves
+}
+
+// CalculateMerkleRoot calculates the Merkle root of the transactions in the block
+func (b *Block) CalculateMerkleRoot() string {
+	return merkle.CalculateRoot(b.merkleLeaves())
 }
 
-func (b *Block) IsBlockHashValid() bool {
-	prefix := b.BlockHash[:b.Difficulty]
-	for _, char := range prefix {
-		if char != '0' {
-			return false
+// CreateMerkleProof returns a proof that the transaction with `txId` is committed to by the block's Merkle root. The
+// proof can be checked with merkle.VerifyProof using the witness hash of the transaction as the leaf.
+func (b *Block) CreateMerkleProof(txId string) ([]*merkle.ProofStep, error) {
+	for i, tx := range b.Transactions {
+		if tx.Id == txId {
+			return merkle.CreateProof(b.merkleLeaves(), i)
 		}
 	}
-	return true
+	return nil, ErrTransactionNotFound
 }
 
-func (b *Block) CalculateBlockHash() string {
-	h := sha256.New()
-	h.Write([]byte(b.String()))
-	h.Write([]byte(fmt.Sprint(b.Nonce)))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// GetTransaction returns the transaction with `txId` in the block, or nil if the block has none
+func (b *Block) GetTransaction(txId string) *transaction.Transaction {
+	for _, tx := range b.Transactions {
+		if tx.Id == txId {
+			return tx
+		}
+	}
+	return nil
 }
 
 func (b *Block) String() string {
-	return fmt.Sprintf("Time: %d\t Index: %d Data: %s", b.Timestamp.Unix(), b.Index, b.Data)
+	return fmt.Sprintf("Time: %d\t Index: %d MerkleRoot: %s", b.Timestamp.Unix(), b.Index, b.MerkleRoot)
 }
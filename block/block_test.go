@@ -1,64 +1,95 @@
 package block
 
 import (
+	"github.com/defaziom/blockchain-go/merkle"
+	"github.com/defaziom/blockchain-go/transaction"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestBlock_CalculateBlockHash(t *testing.T) {
 	block := &Block{
-		Timestamp:     time.Time{},
-		Data:          "Test",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         42,
-		Difficulty:    0,
+		BlockHeader: BlockHeader{
+			Timestamp:     time.Time{},
+			PrevBlockHash: "",
+			Nonce:         42,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "Test"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 
 	hash := block.CalculateBlockHash()
 	assert.Equal(t, len(hash), 64, "Hash must be valid SHA256")
-}
-
-func TestBlock_IsBlockHashValid(t *testing.T) {
-
-	block := &Block{
-		Timestamp:     time.Time{},
-		Data:          "Test",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         42,
-		Difficulty:    4,
-	}
-	block.BlockHash = block.CalculateBlockHash()
+	assert.Equal(t, block.BlockHeader.CalculateHash(), hash, "Block hash must be the hash of the header")
 
-	// Change the block hash to be valid
-	goodBlockHash := []byte(block.BlockHash)
-	goodBlockHash = append([]byte{'0', '0', '0', '0'}, goodBlockHash[4:]...)
-	block.BlockHash = string(goodBlockHash)
-	assert.True(t, block.IsBlockHashValid(), "Block hash should be prefixed with 0s equal to the difficulty")
+	block.PrevBlockHash = strings.Repeat("1", 64)
+	assert.NotEqual(t, hash, block.CalculateBlockHash(), "Block hash must cover the previous block hash")
+	block.PrevBlockHash = ""
 
-	// Change the block hash to be invalid
-	badBlockHash := []byte(block.BlockHash)
-	badBlockHash[3] = byte('A')
-	block.BlockHash = string(badBlockHash)
-	assert.False(t, block.IsBlockHashValid(), "Block hash should be invalid")
+	block.Difficulty = 1
+	assert.NotEqual(t, hash, block.CalculateBlockHash(), "Block hash must cover the difficulty")
 }
 
 func TestBlock_String(t *testing.T) {
 
-	expectedString := "Time: -62135596800\t Index: 42 Data: Test"
+	expectedString := "Time: -62135596800\t Index: 42 MerkleRoot: abc"
 	block := &Block{
-		Timestamp:     time.Time{},
-		Data:          "Test",
-		PrevBlockHash: "asdf",
-		BlockHash:     "asdf2",
-		Index:         42,
-		Nonce:         43,
-		Difficulty:    4,
+		BlockHeader: BlockHeader{
+			Timestamp:     time.Time{},
+			MerkleRoot:    "abc",
+			PrevBlockHash: "asdf",
+			Nonce:         43,
+			Difficulty:    4,
+		},
+		Transactions: []*transaction.Transaction{{Id: "Test"}},
+		BlockHash:    "asdf2",
+		Index:        42,
 	}
 	t.Log(block.String())
 	assert.Equal(t, expectedString, block.String(), "Block string should return a string with all fields")
 }
+
+func TestBlock_CalculateMerkleRoot(t *testing.T) {
+	block := &Block{Transactions: []*transaction.Transaction{{Id: "a"}, {Id: "b"}}}
+	root := block.CalculateMerkleRoot()
+	assert.Len(t, root, 64)
+
+	block.Transactions[1].Id = "c"
+	assert.NotEqual(t, root, block.CalculateMerkleRoot(), "Root should change when a transaction changes")
+}
+
+func TestBlock_CalculateMerkleRoot_Signatures(t *testing.T) {
+	tx := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "a", TxOutIndex: 0, Signature: strings.Repeat("cd", 64)}},
+		[]*transaction.TxOut{{Address: "bob", Amount: 10}},
+	)
+	block := &Block{Transactions: []*transaction.Transaction{tx}}
+	block.MerkleRoot = block.CalculateMerkleRoot()
+	hash := block.CalculateBlockHash()
+
+	tx.TxIns[0].Signature = "00"
+
+	assert.Equal(t, tx.Id, tx.CalculateTransactionId())
+	assert.NotEqual(t, block.MerkleRoot, block.CalculateMerkleRoot(), "Root should change when a signature changes")
+	block.MerkleRoot = block.CalculateMerkleRoot()
+	assert.NotEqual(t, hash, block.CalculateBlockHash(), "Block hash should cover signatures")
+}
+
+func TestBlock_CreateMerkleProof(t *testing.T) {
+	block := &Block{Transactions: []*transaction.Transaction{{Id: "a"}, {Id: "b"}, {Id: "c"}}}
+	block.MerkleRoot = block.CalculateMerkleRoot()
+
+	proof, err := block.CreateMerkleProof("c")
+	assert.Nil(t, err)
+	leaf := []byte(block.GetTransaction("c").CalculateWitnessHash())
+	assert.True(t, merkle.VerifyProof(leaf, proof, block.MerkleRoot))
+	assert.False(t, merkle.VerifyProof([]byte("c"), proof, block.MerkleRoot), "Proof should start from the witness hash")
+
+	_, err = block.CreateMerkleProof("d")
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+	assert.Nil(t, block.GetTransaction("d"))
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const BlockVersion = 1
+
+// Layout of an encoded BlockHeader. All integers are little-endian.
+const (
+	versionOffset    = 0                     // uint32
+	prevHashOffset   = versionOffset + 4     // 32 bytes
+	merkleRootOffset = prevHashOffset + 32   // 32 bytes
+	timestampOffset  = merkleRootOffset + 32 // int64, unix milliseconds
+	difficultyOffset = timestampOffset + 8   // uint32
+	nonceOffset      = difficultyOffset + 4  // uint64
+	signerOffset     = nonceOffset + 8       // 32 bytes, all zeros when the header has no signer
+	HeaderSize       = signerOffset + 32     // Size of an encoded BlockHeader in bytes
+)
+
+var ErrInvalidHeader = errors.New("invalid block header")
+
+// BlockHeader contains every field of a block that is covered by the block hash, along with the signatures of
+// engines that seal a header by signing it. The signer is part of the encoded header, so a block can't be sealed again
+// by another validator under the same hash. Signatures are made over the encoded header, so they are not part of it.
+type BlockHeader struct {
+	Version       uint32
+	PrevBlockHash string
+	MerkleRoot    string
+	Timestamp     time.Time
+	Difficulty    int
+	Nonce         int
+	Signer        string  `json:",omitempty"` // Address of the validator that signed the header
+	Signature     string  `json:",omitempty"` // Hex encoded signature of the encoded header made by Signer
+	Commit        *Commit `json:",omitempty"` // Proof that the validators finalized the block
+}
+
+// Commit holds the precommits validators signed for a block in the round it was finalized in
+type Commit struct {
+	Round      int
+	Precommits []*CommitSignature
+}
+
+// CommitSignature is a validator's signed precommit for a block
+type CommitSignature struct {
+	Validator string // Address of the validator
+	Signature string // Hex encoded signature of the precommit
+}
+
+// decodeHash decodes a hex encoded hash. An empty string decodes to all zeros so the genesis block has a previous hash.
+func decodeHash(s string) ([]byte, error) {
+	if s == "" {
+		return make([]byte, sha256.Size), nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("%w: malformed hash %q", ErrInvalidHeader, s)
+	}
+	return b, nil
+}
+
+// decodeSigner decodes the hex encoded public key of a signer. An empty string decodes to all zeros for headers that
+// are not signed.
+func decodeSigner(s string) ([]byte, error) {
+	if s == "" {
+		return make([]byte, HeaderSize-signerOffset), nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != HeaderSize-signerOffset {
+		return nil, fmt.Errorf("%w: malformed signer %q", ErrInvalidHeader, s)
+	}
+	return b, nil
+}
+
+// MarshalBinary encodes the header into its fixed HeaderSize byte layout
+func (h *BlockHeader) MarshalBinary() ([]byte, error) {
+	prevHash, err := decodeHash(h.PrevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := decodeHash(h.MerkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := decodeSigner(h.Signer)
+	if err != nil {
+		return nil, err
+	}
+	if h.Difficulty < 0 || uint64(h.Difficulty) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("%w: difficulty out of range", ErrInvalidHeader)
+	}
+
+	data := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(data[versionOffset:], h.Version)
+	copy(data[prevHashOffset:], prevHash)
+	copy(data[merkleRootOffset:], merkleRoot)
+	binary.LittleEndian.PutUint64(data[timestampOffset:], uint64(h.Timestamp.UnixMilli()))
+	binary.LittleEndian.PutUint32(data[difficultyOffset:], uint32(h.Difficulty))
+	binary.LittleEndian.PutUint64(data[nonceOffset:], uint64(h.Nonce))
+	copy(data[signerOffset:], signer)
+	return data, nil
+}
+
+// UnmarshalBinary decodes a header encoded with MarshalBinary
+func (h *BlockHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != HeaderSize {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidHeader, HeaderSize, len(data))
+	}
+	h.Version = binary.LittleEndian.Uint32(data[versionOffset:])
+	h.PrevBlockHash = hex.EncodeToString(data[prevHashOffset:merkleRootOffset])
+	h.MerkleRoot = hex.EncodeToString(data[merkleRootOffset:timestampOffset])
+	h.Timestamp = time.UnixMilli(int64(binary.LittleEndian.Uint64(data[timestampOffset:])))
+	h.Difficulty = int(binary.LittleEndian.Uint32(data[difficultyOffset:]))
+	h.Nonce = int(int64(binary.LittleEndian.Uint64(data[nonceOffset:])))
+	h.Signer = ""
+	if signer := data[signerOffset:]; !bytes.Equal(signer, make([]byte, len(signer))) {
+		h.Signer = hex.EncodeToString(signer)
+	}
+	return nil
+}
+
+// CalculateHash returns the hex encoded SHA256 of the encoded header, or an empty string if the header can't be
+// encoded
+func (h *BlockHeader) CalculateHash() string {
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,160 @@
+package block
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Golden vectors computed independently from the documented header layout
+var headerGoldenVectors = []struct {
+	name    string
+	header  BlockHeader
+	encoded string
+	hash    string
+}{
+	{
+		name: "populated header",
+		header: BlockHeader{
+			Version:       1,
+			PrevBlockHash: strings.Repeat("11", 32),
+			MerkleRoot:    strings.Repeat("22", 32),
+			Timestamp:     time.UnixMilli(1700000000123),
+			Difficulty:    5,
+			Nonce:         42,
+		},
+		encoded: "01000000" +
+			strings.Repeat("11", 32) +
+			strings.Repeat("22", 32) +
+			"7b68e5cf8b010000" +
+			"05000000" +
+			"2a00000000000000" +
+			strings.Repeat("00", 32),
+		hash: "403fc9629d130804dd3d20c494affc69b07d0954e070e0ca6750604c2cb9521b",
+	},
+	{
+		name: "zero header with empty hashes and negative nonce",
+		header: BlockHeader{
+			Timestamp: time.Time{},
+			Nonce:     -1,
+		},
+		encoded: "00000000" +
+			strings.Repeat("00", 32) +
+			strings.Repeat("00", 32) +
+			"0028d3ed7cc7ffff" +
+			"00000000" +
+			"ffffffffffffffff" +
+			strings.Repeat("00", 32),
+		hash: "20f4d892d8da1b235a53482e1fd99c5e223a292a1efaa4c11f742b6082e1bf7e",
+	},
+	{
+		name: "signed header",
+		header: BlockHeader{
+			Version:       1,
+			PrevBlockHash: strings.Repeat("11", 32),
+			MerkleRoot:    strings.Repeat("22", 32),
+			Timestamp:     time.UnixMilli(1700000000123),
+			Difficulty:    5,
+			Nonce:         42,
+			Signer:        strings.Repeat("33", 32),
+		},
+		encoded: "01000000" +
+			strings.Repeat("11", 32) +
+			strings.Repeat("22", 32) +
+			"7b68e5cf8b010000" +
+			"05000000" +
+			"2a00000000000000" +
+			strings.Repeat("33", 32),
+		hash: "a341f1cbecf0581fd4f0e46a19b5d69cc06dd9d8273c3d8aa214ce00e6165027",
+	},
+}
+
+func TestBlockHeader_MarshalBinary(t *testing.T) {
+	for _, vector := range headerGoldenVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			data, err := vector.header.MarshalBinary()
+			assert.Nil(t, err)
+			assert.Len(t, data, HeaderSize)
+			assert.Equal(t, vector.encoded, hex.EncodeToString(data))
+			assert.Equal(t, vector.hash, vector.header.CalculateHash())
+		})
+	}
+}
+
+func TestBlockHeader_UnmarshalBinary(t *testing.T) {
+	vector := headerGoldenVectors[0]
+	data, _ := hex.DecodeString(vector.encoded)
+
+	header := &BlockHeader{Signer: strings.Repeat("44", 32)}
+	assert.Nil(t, header.UnmarshalBinary(data))
+	assert.Equal(t, vector.header.Version, header.Version)
+	assert.Equal(t, vector.header.PrevBlockHash, header.PrevBlockHash)
+	assert.Equal(t, vector.header.MerkleRoot, header.MerkleRoot)
+	assert.True(t, vector.header.Timestamp.Equal(header.Timestamp))
+	assert.Equal(t, vector.header.Difficulty, header.Difficulty)
+	assert.Equal(t, vector.header.Nonce, header.Nonce)
+	assert.Equal(t, "", header.Signer, "Headers without a signer should decode to an empty signer")
+	assert.Equal(t, vector.hash, header.CalculateHash())
+
+	signed := headerGoldenVectors[2]
+	data, _ = hex.DecodeString(signed.encoded)
+	assert.Nil(t, header.UnmarshalBinary(data))
+	assert.Equal(t, signed.header.Signer, header.Signer)
+	assert.Equal(t, signed.hash, header.CalculateHash())
+
+	assert.ErrorIs(t, header.UnmarshalBinary(data[1:]), ErrInvalidHeader)
+}
+
+func TestBlockHeader_MarshalBinary_Invalid(t *testing.T) {
+	header := headerGoldenVectors[0].header
+	header.PrevBlockHash = "not hex"
+	_, err := header.MarshalBinary()
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.Equal(t, "", header.CalculateHash())
+
+	header = headerGoldenVectors[0].header
+	header.MerkleRoot = "abcd"
+	_, err = header.MarshalBinary()
+	assert.ErrorIs(t, err, ErrInvalidHeader, "Hashes must be 32 bytes")
+
+	header = headerGoldenVectors[0].header
+	header.Signer = "validator"
+	_, err = header.MarshalBinary()
+	assert.ErrorIs(t, err, ErrInvalidHeader, "Signers must be 32 byte public keys")
+
+	header = headerGoldenVectors[0].header
+	header.Difficulty = -1
+	_, err = header.MarshalBinary()
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestBlockHeader_CalculateHash_CoversAllFields(t *testing.T) {
+	base := headerGoldenVectors[0].header
+	baseHash := base.CalculateHash()
+
+	modifications := map[string]func(h *BlockHeader){
+		"Version":       func(h *BlockHeader) { h.Version = 2 },
+		"PrevBlockHash": func(h *BlockHeader) { h.PrevBlockHash = strings.Repeat("33", 32) },
+		"MerkleRoot":    func(h *BlockHeader) { h.MerkleRoot = strings.Repeat("33", 32) },
+		"Timestamp":     func(h *BlockHeader) { h.Timestamp = h.Timestamp.Add(time.Millisecond) },
+		"Difficulty":    func(h *BlockHeader) { h.Difficulty = 6 },
+		"Nonce":         func(h *BlockHeader) { h.Nonce = 43 },
+		"Signer":        func(h *BlockHeader) { h.Signer = strings.Repeat("33", 32) },
+	}
+	for field, modify := range modifications {
+		header := base
+		modify(&header)
+		assert.NotEqual(t, baseHash, header.CalculateHash(), "Hash must change when %s changes", field)
+	}
+}
+
+func TestBlockHeader_CalculateHash_IgnoresSignature(t *testing.T) {
+	header := headerGoldenVectors[2].header
+	header.Signature = strings.Repeat("44", 64)
+	header.Commit = &Commit{Round: 1, Precommits: []*CommitSignature{{Validator: header.Signer}}}
+
+	assert.Equal(t, headerGoldenVectors[2].hash, header.CalculateHash(),
+		"Signature is made over the encoded header, so it can't be part of it")
+}
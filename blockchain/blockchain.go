@@ -1,12 +1,18 @@
 package blockchain
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/storage"
+	"github.com/defaziom/blockchain-go/transaction"
 	"log"
-	"math"
-	"strings"
+	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -55,17 +61,21 @@ func (list *SafeDoublyLinkedBlockList) Last(index int) *SafeDoublyLinkedBlockLis
 	return iter
 }
 
-// ToSlice Converts the list to a slice of blocks by appending all the blocks to a slice.
+// GetAncestor Returns the block `depth` blocks before this element, which makes the list a consensus.ChainReader
+func (list *SafeDoublyLinkedBlockList) GetAncestor(depth int) *block.Block {
+	return list.Last(depth).Value
+}
+
+// ToSlice Converts the list up to and including this element to a slice of blocks, first block first. Only the Prev
+// links are followed, so the slice holds the branch of this element when several blocks were added to the same one.
 func (list *SafeDoublyLinkedBlockList) ToSlice() []*block.Block {
-	slice := make([]*block.Block, 1)
-	node := list.First()
-	list.mu.Lock()
-	defer list.mu.Unlock()
-	slice[0] = node.Value
-	for node.Next != nil {
-		node = node.Next
+	slice := make([]*block.Block, 0)
+	for node := list; node != nil; node = node.Prev {
 		slice = append(slice, node.Value)
 	}
+	for i, j := 0, len(slice)-1; i < j; i, j = i+1, j-1 {
+		slice[i], slice[j] = slice[j], slice[i]
+	}
 	return slice
 }
 
@@ -85,168 +95,353 @@ func DoublyLinkedBlockListCreateFromSlice(blocks []*block.Block) *SafeDoublyLink
 	return newList
 }
 
-var genesisBlock = &block.Block{
-	Timestamp:     time.Now(),
-	Data:          "Genesis",
-	PrevBlockHash: "",
-	BlockHash:     strings.Repeat("0", 64),
-	Index:         0,
-	Nonce:         0,
-	Difficulty:    1,
+var genesisBlock = DefaultGenesis().CreateBlock()
+
+// ChainParams are the rules the chain is validated with
+type ChainParams struct {
+	MedianTimeSpanBlocks int           // Blocks must be timestamped after the median time of this many blocks
+	MaxFutureBlockTime   time.Duration // Blocks can't be timestamped further than this ahead of the node's clock
+	Genesis              *Genesis      // Defines the genesis block the chain starts from and the block reward
+}
+
+// DefaultChainParams returns the parameters used when none are configured
+func DefaultChainParams() *ChainParams {
+	return &ChainParams{
+		MedianTimeSpanBlocks: 11,
+		MaxFutureBlockTime:   2 * time.Minute,
+		Genesis:              DefaultGenesis(),
+	}
 }
 
-const DifficultyAdjustmentIntervalBlocks = 5 // Adjusts blockchain difficulty every N blocks
-const BlockGenerationIntervalSec = 0.5       // Avg interval between added blocks for adjusting difficulty
+// GetBlockSubsidy returns the newly created coins the coinbase of the block at `height` can claim on top of the fees
+func (p *ChainParams) GetBlockSubsidy(height int) int {
+	return p.Genesis.GetBlockSubsidy(height)
+}
 
+// GetGenesisBlock returns the genesis block of the default genesis
 func GetGenesisBlock() *block.Block {
 	return genesisBlock
 }
 
 type BlockChain interface {
-	MineBlock(data string) *block.Block
+	MineBlock(ctx context.Context, minerAddress string, txs []*transaction.Transaction) (*block.Block, error)
+	GetHashRate() float64
 	AddBlock(block *block.Block) error
 	GetBlocks() *SafeDoublyLinkedBlockList
-	GetDifficulty() int
-	GetAdjustedDifficulty() int
-	GetCumulativeDifficulty() float64
+	GetBlockByHash(hash string) *block.Block
+	GetBlockByHeight(height int) *block.Block
+	GetRange(start int, end int) []*block.Block
+	GetCumulativeDifficulty() *big.Int
 	GetLatestBlock() *block.Block
-	ReplaceChain(newChain BlockChain)
+	GetUnspentTxOuts() transaction.UnspentTxOutSet
+	GetUnspentTxOutView() *transaction.UnspentTxOutView
+	ReplaceChain(blocks []*block.Block) error
+	SubscribeReorgs(handler func(event *ReorgEvent))
+	GetMissingAncestor(b *block.Block) string
+	GetBlockLocator(hash string) []string
+	LocateBlocks(locator []string, stopHash string, limit int) []*block.Block
+	CreateHeaderChain(hash string) (*HeaderChain, error)
+	Snapshot() *ChainSnapshot
 }
 
+// BlockChainIml is safe for concurrent use. Every change of the tip is made by a single writer at a time, which
+// publishes a new ChainSnapshot once the change is complete, and readers only ever look at the latest published one.
 type BlockChainIml struct {
-	Blocks *SafeDoublyLinkedBlockList
+	Params        *ChainParams
+	Clock         clock.Clock
+	Engine        consensus.Engine   // Seals and verifies block headers and weighs forks
+	Orphans       *OrphanPool        // Blocks waiting for their parent to arrive
+	Store         storage.BlockStore // Keeps every block added to the tree on disk. Nil keeps the chain in memory only.
+	genesis       *block.Block
+	tree          *BlockTree
+	snapshot      atomic.Pointer[ChainSnapshot]
+	writeMu       sync.Mutex // Held by the writer for the whole change of the tip, reorg handlers included
+	reorgHandlers []func(event *ReorgEvent)
+	tipChanged    chan struct{}
+	tipMu         sync.Mutex
 }
 
+// CreateBlockChain creates a proof-of-work blockchain with the default parameters that reads the system clock
 func CreateBlockChain() *BlockChainIml {
-	return &BlockChainIml{
-		Blocks: &SafeDoublyLinkedBlockList{
-			Prev:  nil,
-			Next:  nil,
-			Value: GetGenesisBlock(),
-		},
+	return CreateBlockChainWithParams(DefaultChainParams(), &clock.SystemClock{}, consensus.CreateProofOfWork())
+}
+
+// CreateBlockChainWithParams creates a blockchain starting from the genesis block of `params`, validated with `params`
+// and `engine`, that tells time with `c`
+func CreateBlockChainWithParams(params *ChainParams, c clock.Clock, engine consensus.Engine) *BlockChainIml {
+	genesis := params.Genesis.CreateBlock()
+	tree := CreateBlockTree(genesis, engine.GetWork(&genesis.BlockHeader))
+	bc := &BlockChainIml{
+		Params:     params,
+		Clock:      c,
+		Engine:     engine,
+		Orphans:    CreateOrphanPool(c, DefaultOrphanPoolConfig()),
+		genesis:    genesis,
+		tree:       tree,
+		tipChanged: make(chan struct{}),
+	}
+	unspent := transaction.UnspentTxOutSet{}.ApplyGenesisTransactions(genesis.Transactions)
+	bc.snapshot.Store(createChainSnapshot(tree.get(genesis.BlockHash), transaction.CreateUnspentTxOutView(unspent)))
+	return bc
+}
+
+// LoadBlockChain creates a blockchain like CreateBlockChainWithParams and adds every block kept in `store` to it again,
+// so each of them is revalidated. Blocks that fail validation are skipped. Blocks added afterwards are appended to
+// `store`.
+func LoadBlockChain(store storage.BlockStore, params *ChainParams, c clock.Clock,
+	engine consensus.Engine) (*BlockChainIml, error) {
+	bc := CreateBlockChainWithParams(params, c, engine)
+	blocks, err := store.GetBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		err = bc.AddBlock(b)
+		if err != nil && !errors.Is(err, ErrKnownBlock) {
+			log.Printf("Skipped stored block %d: %s\n", b.Index, err)
+		}
 	}
+	bc.Store = store
+	log.Printf("Loaded %d stored blocks, the tip is block %d\n", len(blocks), bc.GetLatestBlock().Index)
+	return bc, nil
 }
 
-// MineBlock Mines a block and returns it
-func (bc *BlockChainIml) MineBlock(data string) *block.Block {
+// AddBlock Adds a block to the block tree. A block extending the tip becomes the new tip and spends the outputs used
+// by its transactions. A block on a side branch is kept, and once its branch has more cumulative work than the tip the
+// chain is reorganized onto it. Blocks whose parent is not in the tree are kept in the orphan pool and rejected with
+// ErrUnknownParent. They are added once their parent is.
+func (bc *BlockChainIml) AddBlock(b *block.Block) error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	return bc.addBlockAndOrphans(b)
+}
 
-	lastBlock := bc.GetLatestBlock()
-	b := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          data,
-		PrevBlockHash: lastBlock.BlockHash,
-		BlockHash:     "",
-		Index:         lastBlock.Index + 1,
-		Nonce:         -1,
-		Difficulty:    bc.GetDifficulty(),
+// addBlockAndOrphans is AddBlock for a writer holding writeMu
+func (bc *BlockChainIml) addBlockAndOrphans(b *block.Block) error {
+	err := bc.addBlock(b)
+	if errors.Is(err, ErrUnknownParent) {
+		if b.BlockHash != b.CalculateBlockHash() {
+			return newBlockValidationError(b, ErrInvalidBlockHash, nil)
+		}
+		if bc.Orphans.Add(b) {
+			log.Printf("Added block %d to the orphan pool\n", b.Index)
+		}
+		return err
+	} else if err != nil {
+		return err
 	}
-	blockHash := b.CalculateBlockHash()
-	b.BlockHash = blockHash
+	bc.addOrphans(b.BlockHash)
+	return nil
+}
 
-	for !b.IsBlockHashValid() {
-		b.Nonce += 1
-		blockHash = b.CalculateBlockHash()
-		b.BlockHash = blockHash
+// addOrphans adds the orphans descending from the block with `hash`, which was just added
+func (bc *BlockChainIml) addOrphans(hash string) {
+	parents := []string{hash}
+	for len(parents) > 0 {
+		children := bc.Orphans.TakeChildren(parents[0])
+		parents = parents[1:]
+		for _, child := range children {
+			err := bc.addBlock(child)
+			if err != nil {
+				log.Printf("Dropped orphan block %d: %s\n", child.Index, err)
+				continue
+			}
+			log.Printf("Added orphan block %d\n", child.Index)
+			parents = append(parents, child.BlockHash)
+		}
 	}
+}
 
-	return b
+// GetMissingAncestor returns the hash of the first ancestor of `b` that is neither in the block tree nor in the orphan
+// pool. It is the block to ask peers for so the orphans descending from it can be added.
+func (bc *BlockChainIml) GetMissingAncestor(b *block.Block) string {
+	return bc.Orphans.GetMissingAncestor(b)
 }
 
-// AddBlock Adds a block to the end of the blockchain. Check to see if the new block is valid.
-func (bc *BlockChainIml) AddBlock(block *block.Block) error {
+func (bc *BlockChainIml) addBlock(b *block.Block) error {
+	if bc.tree.get(b.BlockHash) != nil {
+		return ErrKnownBlock
+	}
+	tip := bc.Snapshot().tip
+	parent := bc.tree.get(b.PrevBlockHash)
+	if parent == nil {
+		return ErrUnknownParent
+	}
+	if finality, ok := bc.Engine.(consensus.Finality); ok && finality.IsFinal() && parent != tip {
+		return ErrFinalized
+	}
+	err := bc.validateBlock(b, parent.List, true)
+	if err != nil {
+		return err
+	}
 
-	lastBlock := bc.GetLatestBlock()
-	valid, err := IsNewBlockValid(block, lastBlock)
-	if valid {
-		bc.Blocks = bc.Blocks.Add(block)
+	if parent == tip {
+		view := bc.GetUnspentTxOutView()
+		unspent, err := bc.validateTransactions(b, view)
+		if err != nil {
+			return err
+		}
+		if err = bc.persist(b); err != nil {
+			return err
+		}
+		node := bc.tree.add(b, parent, bc.Engine.GetWork(&b.BlockHeader))
+		node.Spent = view.GetSpentOutputs(b.Transactions)
+		bc.setTip(node, unspent, &ReorgEvent{Applied: []*block.Block{b}})
 		return nil
-	} else {
+	}
+	if err = bc.persist(b); err != nil {
 		return err
 	}
+	node := bc.tree.add(b, parent, bc.Engine.GetWork(&b.BlockHeader))
+	if node.Work.Cmp(tip.Work) <= 0 {
+		log.Printf("Added block %d to a side branch\n", b.Index)
+		return nil
+	}
+	return bc.reorganize(node)
 }
 
-func (bc *BlockChainIml) GetDifficulty() int {
-	latestBlock := bc.GetLatestBlock()
+// persist appends the block to the store, if the chain has one, before it is added to the tree
+func (bc *BlockChainIml) persist(b *block.Block) error {
+	if bc.Store == nil {
+		return nil
+	}
+	if err := bc.Store.Append(b); err != nil {
+		return fmt.Errorf("failed to store block %d: %w", b.Index, err)
+	}
+	return nil
+}
 
-	if latestBlock.Index%DifficultyAdjustmentIntervalBlocks == 0 && latestBlock.Index != 0 {
-		return bc.GetAdjustedDifficulty()
-	} else {
-		return latestBlock.Difficulty
+// reorganize moves the tip onto the branch ending at `newTip` by disconnecting the blocks of the current branch down
+// to the fork point and connecting the blocks of the new one. When a block on the new branch has invalid
+// transactions, it is removed from the tree along with the blocks on top of it and the tip stays where it is. The
+// block is forgotten rather than its hash rejected for good, so a block relayed with other transactions than the ones
+// its miner committed to can't keep the valid block out of the tree.
+func (bc *BlockChainIml) reorganize(newTip *treeNode) error {
+	snapshot := bc.Snapshot()
+	fork := findForkPoint(snapshot.tip, newTip)
+	event := &ReorgEvent{}
+	unspent := snapshot.GetUnspentTxOutView()
+	for node := snapshot.tip; node != fork; node = node.Parent {
+		unspent = unspent.RevertTransactions(node.List.Value.Transactions, node.Spent)
+		event.Reverted = append(event.Reverted, node.List.Value)
+	}
+	for _, node := range getBranch(fork, newTip) {
+		b := node.List.Value
+		spent := unspent.GetSpentOutputs(b.Transactions)
+		updated, err := bc.validateTransactions(b, unspent)
+		if err != nil {
+			log.Println("Did not reorganize onto an invalid branch: " + err.Error())
+			bc.tree.remove(node)
+			return err
+		}
+		node.Spent = spent
+		unspent = updated
+		event.Applied = append(event.Applied, b)
 	}
+	log.Printf("Reorganized onto block %d, reverted %d blocks and applied %d\n", newTip.List.Value.Index,
+		len(event.Reverted), len(event.Applied))
+	bc.setTip(newTip, unspent, event)
+	return nil
+}
 
+// setTip publishes the snapshot of the chain with its tip moved to `node`, whose block leaves `unspent` outputs, and
+// reports the change to the subscribers
+func (bc *BlockChainIml) setTip(node *treeNode, unspent *transaction.UnspentTxOutView, event *ReorgEvent) {
+	bc.snapshot.Store(bc.Snapshot().next(node, unspent))
+	bc.notifyTipChanged()
+	for _, handler := range bc.reorgHandlers {
+		handler(event)
+	}
 }
 
-func (bc *BlockChainIml) GetAdjustedDifficulty() int {
-	latestBlock := bc.GetLatestBlock()
-	prevAdjBlock := bc.Blocks.Last(DifficultyAdjustmentIntervalBlocks).Value
-	timeExpectedSec := BlockGenerationIntervalSec * DifficultyAdjustmentIntervalBlocks
-	timeTaken := latestBlock.Timestamp.Sub(prevAdjBlock.Timestamp).Seconds()
+// SubscribeReorgs registers `handler` to be called with a ReorgEvent after every change of the tip
+func (bc *BlockChainIml) SubscribeReorgs(handler func(event *ReorgEvent)) {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	bc.reorgHandlers = append(bc.reorgHandlers, handler)
+}
 
-	if timeTaken < timeExpectedSec/2 {
-		// Blocks are being generated too quickly, increase the difficulty
-		return prevAdjBlock.Difficulty + 1
-	} else if timeTaken > timeExpectedSec*2 && prevAdjBlock.Difficulty > 1 {
-		// Blocks are being generated too slowly, decrease the difficulty
-		return prevAdjBlock.Difficulty - 1
-	} else {
-		// Blocks are being generated within the tolerance, keep difficulty the same
-		return prevAdjBlock.Difficulty
-	}
+// Snapshot returns the latest snapshot of the main chain. Lookups that must agree with each other, such as getting
+// the tip and then the blocks below it, should be made on the same snapshot.
+func (bc *BlockChainIml) Snapshot() *ChainSnapshot {
+	return bc.snapshot.Load()
 }
 
-func (bc *BlockChainIml) GetCumulativeDifficulty() float64 {
-	difficultySum := 0.0
-	for _, b := range bc.Blocks.ToSlice() {
-		difficultySum += math.Pow(2, float64(b.Difficulty))
-	}
-	return difficultySum
+// GetCumulativeDifficulty returns the total work of every block in the chain as weighed by the consensus engine
+func (bc *BlockChainIml) GetCumulativeDifficulty() *big.Int {
+	return bc.Snapshot().GetCumulativeDifficulty()
+}
+
+// GetGenesisBlock returns the block the chain starts from
+func (bc *BlockChainIml) GetGenesisBlock() *block.Block {
+	return bc.genesis
 }
 
 func (bc *BlockChainIml) GetLatestBlock() *block.Block {
-	return bc.Blocks.Value
+	return bc.Snapshot().GetLatestBlock()
 }
 
 func (bc *BlockChainIml) GetBlocks() *SafeDoublyLinkedBlockList {
-	return bc.Blocks
+	return bc.Snapshot().GetBlocks()
 }
 
-func (bc *BlockChainIml) ReplaceChain(newChain BlockChain) {
-	if IsValidBlockChain(newChain) && newChain.GetCumulativeDifficulty() > bc.GetCumulativeDifficulty() {
-		log.Println("Received blockchain is valid. Replacing current blockchain with received blockchain")
-		bc.Blocks = newChain.GetBlocks()
-	} else {
-		log.Println("Received blockchain is invalid.")
+// GetBlockByHash returns the block with `hash` from the block tree, including blocks on side branches, or nil if it is
+// not known. Blocks are indexed by hash, so the lookup does not depend on the length of the chain.
+func (bc *BlockChainIml) GetBlockByHash(hash string) *block.Block {
+	node := bc.tree.get(hash)
+	if node == nil {
+		return nil
 	}
+	return node.List.Value
 }
 
-// IsNewBlockValid Checks if a new block is valid to go on the end of the blockchain
-func IsNewBlockValid(newBlock *block.Block, prevBlock *block.Block) (bool, error) {
-	if newBlock.Index != prevBlock.Index+1 {
-		return false, errors.New("invalid block index")
-	} else if newBlock.PrevBlockHash != prevBlock.BlockHash {
-		return false, errors.New("invalid prev block hash")
-	} else if newBlock.BlockHash != newBlock.CalculateBlockHash() {
-		return false, errors.New("invalid block hash")
-	} else {
-		return true, nil
-	}
+// GetBlockByHeight returns the block at `height` on the main chain, or nil if the chain is not that long
+func (bc *BlockChainIml) GetBlockByHeight(height int) *block.Block {
+	return bc.Snapshot().GetBlockByHeight(height)
 }
 
-func IsValidGenesisBlock(block *block.Block) bool {
-	return block.BlockHash == GetGenesisBlock().BlockHash
+// GetRange returns the blocks of the main chain from height `start` up to but not including height `end`, first block
+// first. The range is clipped to the heights the chain has.
+func (bc *BlockChainIml) GetRange(start int, end int) []*block.Block {
+	return bc.Snapshot().GetRange(start, end)
 }
 
-func IsValidBlockChain(bc BlockChain) bool {
-	list := bc.GetBlocks()
-	for list.Prev != nil {
-		currentBlock := list.Value
-		prevBlock := list.Prev.Value
-		valid, _ := IsNewBlockValid(currentBlock, prevBlock)
-		if !valid {
-			return false
+// GetUnspentTxOuts returns the set of outputs that can be spent by the next block. The set must not be modified.
+func (bc *BlockChainIml) GetUnspentTxOuts() transaction.UnspentTxOutSet {
+	return bc.Snapshot().GetUnspentTxOuts()
+}
+
+// GetUnspentTxOutView returns the view of the outputs that can be spent by the next block
+func (bc *BlockChainIml) GetUnspentTxOutView() *transaction.UnspentTxOutView {
+	return bc.Snapshot().GetUnspentTxOutView()
+}
+
+// ReplaceChain adds every block of `blocks`, a chain starting from the genesis block, that is not in the block tree
+// yet, which reorganizes the chain onto it if it has more cumulative work than the tip. Blocks are weighed by this
+// chain's consensus engine. When the engine finalizes blocks, the new chain must extend the tip. The blocks are added
+// as one change, so no other block is added in between.
+func (bc *BlockChainIml) ReplaceChain(blocks []*block.Block) error {
+	if len(blocks) == 0 || blocks[0] == nil || !bc.IsValidGenesisBlock(blocks[0]) {
+		log.Println("Received blockchain is invalid: " + ErrInvalidGenesisBlock.Error())
+		return ErrInvalidGenesisBlock
+	}
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	oldTip := bc.Snapshot().tip
+	for _, b := range blocks[1:] {
+		if bc.tree.get(b.BlockHash) != nil {
+			continue
+		}
+		err := bc.addBlockAndOrphans(b)
+		if err != nil {
+			log.Println("Received blockchain is invalid: " + err.Error())
+			return err
 		}
-		list = list.Prev
 	}
-	// Last block should be genesis block
-	return IsValidGenesisBlock(list.Value)
+	if bc.Snapshot().tip == oldTip {
+		log.Println("Received blockchain does not have more cumulative difficulty.")
+		return ErrNotEnoughWork
+	}
+	log.Println("Received blockchain is valid. Reorganized onto received blockchain")
+	return nil
 }
@@ -1,9 +1,15 @@
 package blockchain
 
 import (
-	"fmt"
+	"context"
 	"github.com/defaziom/blockchain-go/block"
-	"math"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/storage"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
+	"math/big"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,22 +17,26 @@ import "github.com/stretchr/testify/assert"
 
 func TestDoublyLinkedBlockList_Add(t *testing.T) {
 	b1 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "first block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "first block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b2 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "second block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "second block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 
 	first := &SafeDoublyLinkedBlockList{
@@ -45,22 +55,26 @@ func TestDoublyLinkedBlockList_Add(t *testing.T) {
 
 func TestDoublyLinkedBlockList_First(t *testing.T) {
 	b1 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "first block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "first block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b2 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "second block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "second block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 
 	expectedFirst := &SafeDoublyLinkedBlockList{
@@ -76,31 +90,37 @@ func TestDoublyLinkedBlockList_First(t *testing.T) {
 func TestDoublyLinkedBlockList_Last(t *testing.T) {
 
 	b1 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "first block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "first block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b2 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "second block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "second block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b3 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "third block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "third block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	testList := &SafeDoublyLinkedBlockList{
 		Prev:  nil,
@@ -122,22 +142,26 @@ func TestDoublyLinkedBlockList_Last(t *testing.T) {
 
 func TestDoublyLinkedBlockList_ToSlice(t *testing.T) {
 	b1 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "first block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "first block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b2 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "second block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "second block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 
 	first := &SafeDoublyLinkedBlockList{
@@ -154,31 +178,37 @@ func TestDoublyLinkedBlockList_ToSlice(t *testing.T) {
 
 func TestDoublyLinkedBlockList_AddFromSlice(t *testing.T) {
 	b1 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "first block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "first block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b2 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "second block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "second block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	b3 := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "third block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "third block"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 
 	expectedBlocks := []*block.Block{b1, b2, b3}
@@ -190,173 +220,340 @@ func TestDoublyLinkedBlockList_AddFromSlice(t *testing.T) {
 
 }
 
-func TestBlockChain_MineBlock(t *testing.T) {
-	const expectedData = "asdf"
+// testMinerAddress is the address block rewards in tests are paid to
+const testMinerAddress = "miner"
 
-	minedBlock := CreateBlockChain().MineBlock(expectedData)
-
-	assert.Equal(t, expectedData, minedBlock.Data, "Block should contain input data")
-	assert.NotEqualf(t, time.Time{}, minedBlock.Timestamp, "Timestamp should be initialized")
-	assert.Equal(t, GetGenesisBlock().BlockHash, minedBlock.PrevBlockHash,
-		"Prev block hash must equal genesis block hash")
-	assert.Equal(t, "0", minedBlock.BlockHash[:minedBlock.Difficulty],
-		"Block hash must be prefixed by leading zeros equal to the difficulty")
-	assert.Equal(t, 1, minedBlock.Index, "Index must be 1")
+// createFundedBlockChain creates a blockchain with one unspent output owned by a wallet and a signed transaction
+// spending it
+func createFundedBlockChain() (*BlockChainIml, *wallet.Wallet, *transaction.Transaction) {
+	blockchain := CreateBlockChain()
+	w, _ := wallet.CreateWallet()
+	funding := &transaction.UnspentTxOut{TxOutId: "funding", TxOutIndex: 0, Address: w.GetAddress(), Amount: 50}
+	unspent := blockchain.GetUnspentTxOuts().Copy()
+	unspent[transaction.OutPoint{TxOutId: "funding", TxOutIndex: 0}] = funding
+	blockchain.setTip(blockchain.Snapshot().tip, transaction.CreateUnspentTxOutView(unspent), &ReorgEvent{})
+	tx, _ := w.CreateTransaction("bob", 20, blockchain.GetUnspentTxOuts())
+	return blockchain, w, tx
 }
 
-func TestBlockChain_IsNewBlockValid(t *testing.T) {
-	prevBlock := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "prev block",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+// mineTestBlock finds a nonce that makes the block hash meet the block difficulty
+func mineTestBlock(b *block.Block) {
+	b.BlockHash = b.CalculateBlockHash()
+	for !consensus.IsHashValid(b.BlockHash, b.Difficulty) {
+		b.Nonce++
+		b.BlockHash = b.CalculateBlockHash()
 	}
-	prevBlock.BlockHash = prevBlock.CalculateBlockHash()
-	newBlock := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "new block",
-		PrevBlockHash: prevBlock.BlockHash,
-		BlockHash:     "",
-		Index:         1,
-		Nonce:         0,
-		Difficulty:    0,
-	}
-	newBlock.BlockHash = newBlock.CalculateBlockHash()
-	valid, err := IsNewBlockValid(newBlock, prevBlock)
-	assert.True(t, valid, "New block should be valid")
-	assert.Nil(t, err)
+}
 
-	newBlock.Index = 42
-	valid, err = IsNewBlockValid(newBlock, prevBlock)
-	assert.False(t, valid, "New block should have invalid index")
-	assert.Equal(t, "invalid block index", err.Error())
-	newBlock.Index = 1
-
-	newBlock.PrevBlockHash = "invalid hash"
-	valid, err = IsNewBlockValid(newBlock, prevBlock)
-	assert.False(t, valid, "New block should have invalid prev hash")
-	assert.Equal(t, "invalid prev block hash", err.Error())
-	newBlock.PrevBlockHash = prevBlock.BlockHash
-
-	newBlock.BlockHash = "invalid hash"
-	valid, err = IsNewBlockValid(newBlock, prevBlock)
-	assert.False(t, valid, "New block should have invalid hash")
-	assert.Equal(t, "invalid block hash", err.Error())
+// mineNextBlock mines a block of `txs` on top of the chain paying the reward to testMinerAddress
+func mineNextBlock(blockchain *BlockChainIml, txs []*transaction.Transaction) *block.Block {
+	b, _ := blockchain.MineBlock(context.Background(), testMinerAddress, txs)
+	return b
+}
+
+// createTestBlock creates a mined block containing a coinbase claiming the default subsidy followed by `txs` that is
+// valid on top of `prev`
+func createTestBlock(prev *SafeDoublyLinkedBlockList, txs []*transaction.Transaction) *block.Block {
+	height := prev.Value.Index + 1
+	coinbase := transaction.CreateCoinbaseTransaction(testMinerAddress,
+		DefaultChainParams().GetBlockSubsidy(height), height)
+	txs = append([]*transaction.Transaction{coinbase}, txs...)
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{
+			Version:       block.BlockVersion,
+			Timestamp:     prev.Value.Timestamp.Add(time.Second),
+			PrevBlockHash: prev.Value.BlockHash,
+			Difficulty:    consensus.GetNextDifficulty(prev, consensus.DifficultyAdjustmentIntervalBlocks),
+		},
+		Transactions: txs,
+		Index:        prev.Value.Index + 1,
+	}
+	b.MerkleRoot = b.CalculateMerkleRoot()
+	mineTestBlock(b)
+	return b
 }
 
 func TestBlockChain_AddBlock(t *testing.T) {
 	blockchain := CreateBlockChain()
 
-	newBlock := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "new block",
-		PrevBlockHash: GetGenesisBlock().BlockHash,
-		BlockHash:     "",
-		Index:         1,
-		Nonce:         0,
-		Difficulty:    4,
-	}
-	newBlock.BlockHash = newBlock.CalculateBlockHash()
+	newBlock := createTestBlock(blockchain.GetBlocks(), []*transaction.Transaction{})
 
 	err := blockchain.AddBlock(newBlock)
 
 	assert.Nil(t, err)
 	assert.Equal(t, newBlock, blockchain.GetLatestBlock(), "The new block should be the added block")
-	assert.Equal(t, newBlock, blockchain.Blocks.Value, "The latest block should be the added block")
+	assert.Equal(t, newBlock, blockchain.GetBlocks().Value, "The latest block should be the added block")
+
+	err = blockchain.AddBlock(newBlock)
+	assert.ErrorIs(t, err, ErrKnownBlock, "The same block can't be added twice")
+
+	orphan := createTestBlock(blockchain.GetBlocks(), []*transaction.Transaction{})
+	orphan.PrevBlockHash = strings.Repeat("1", 64)
+	mineTestBlock(orphan)
+	assert.ErrorIs(t, blockchain.AddBlock(orphan), ErrUnknownParent)
 }
 
-func TestIsValidGenesisBlock(t *testing.T) {
-	assert.True(t, IsValidGenesisBlock(GetGenesisBlock()))
+func TestBlockChain_AddBlock_UpdatesUnspentTxOuts(t *testing.T) {
+	blockchain, _, tx := createFundedBlockChain()
 
-	b := &block.Block{
-		Timestamp:     time.Now(),
-		Data:          "new block",
-		PrevBlockHash: "",
-		BlockHash:     "abc",
-		Index:         1,
-		Nonce:         0,
-		Difficulty:    4,
+	err := blockchain.AddBlock(mineNextBlock(blockchain, []*transaction.Transaction{tx}))
+	assert.Nil(t, err)
+
+	unspent := blockchain.GetUnspentTxOuts()
+	assert.Len(t, unspent, 3)
+	assert.NotContains(t, unspent, transaction.OutPoint{TxOutId: "funding", TxOutIndex: 0},
+		"Spent output should be removed")
+	assert.Equal(t, 20, unspent[tx.OutPoint(0)].Amount)
+	assert.Equal(t, 30, unspent[tx.OutPoint(1)].Amount)
+	coinbase := blockchain.GetLatestBlock().Transactions[0]
+	assert.Equal(t, testMinerAddress, unspent[coinbase.OutPoint(0)].Address, "Block reward should be spendable")
+
+	// Spending the same output in the next block must fail
+	err = blockchain.AddBlock(mineNextBlock(blockchain, []*transaction.Transaction{tx}))
+	assert.ErrorIs(t, err, ErrInvalidTransactions)
+	assert.ErrorIs(t, err, transaction.ErrMissingTxOut)
+}
+
+func TestBlockChain_MineBlock_Difficulty(t *testing.T) {
+	// Blocks on top of an old genesis block would take far longer than expected and lower the difficulty
+	params := DefaultChainParams()
+	params.Genesis.Timestamp = time.Now()
+	blockchain := CreateBlockChainWithParams(params, &clock.SystemClock{}, consensus.CreateProofOfWork())
+
+	// Add 5 blocks
+	for i := 0; i < consensus.DifficultyAdjustmentIntervalBlocks; i++ {
+		b := mineNextBlock(blockchain, nil)
+		assert.Equal(t, GetGenesisBlock().Difficulty, b.Difficulty)
+		_ = blockchain.AddBlock(b)
+	}
+
+	assert.Equal(t, GetGenesisBlock().Difficulty+consensus.MaxDifficultyAdjustmentBits,
+		mineNextBlock(blockchain, nil).Difficulty, "Difficulty should have increased by the maximum adjustment")
+}
+
+// appendUnvalidatedBlock makes the block the new tip without validating it
+func appendUnvalidatedBlock(blockchain *BlockChainIml, b *block.Block) {
+	b.BlockHash = b.CalculateBlockHash()
+	node := blockchain.tree.add(b, blockchain.Snapshot().tip, blockchain.Engine.GetWork(&b.BlockHeader))
+	blockchain.setTip(node, blockchain.GetUnspentTxOutView(), &ReorgEvent{Applied: []*block.Block{b}})
+}
+
+// appendTestBlocks appends blocks mined `interval` apart to the chain without validating them
+func appendTestBlocks(blockchain *BlockChainIml, n int, interval time.Duration, difficulty int) {
+	for i := 0; i < n; i++ {
+		latestBlock := blockchain.GetLatestBlock()
+		appendUnvalidatedBlock(blockchain, &block.Block{
+			BlockHeader: block.BlockHeader{
+				Timestamp:  latestBlock.Timestamp.Add(interval),
+				Difficulty: difficulty,
+			},
+			Index: latestBlock.Index + 1,
+		})
 	}
-	assert.False(t, IsValidGenesisBlock(b))
 }
 
-func TestIsValidBlockChain(t *testing.T) {
+func TestBlockChain_GetCumulativeDifficulty(t *testing.T) {
 	blockchain := CreateBlockChain()
-	_ = blockchain.AddBlock(blockchain.MineBlock("one"))
-	_ = blockchain.AddBlock(blockchain.MineBlock("two"))
-	_ = blockchain.AddBlock(blockchain.MineBlock("three"))
 
-	assert.True(t, IsValidBlockChain(blockchain))
+	b1 := &block.Block{BlockHeader: block.BlockHeader{Difficulty: 1}}
+	b2 := &block.Block{BlockHeader: block.BlockHeader{Difficulty: 2}}
+	b3 := &block.Block{BlockHeader: block.BlockHeader{Difficulty: 200}}
+
+	appendUnvalidatedBlock(blockchain, b1)
+	appendUnvalidatedBlock(blockchain, b2)
+	appendUnvalidatedBlock(blockchain, b3)
+
+	expectedCumulativeDifficulty := new(big.Int).Lsh(big.NewInt(1), uint(GetGenesisBlock().Difficulty))
+	expectedCumulativeDifficulty.Add(expectedCumulativeDifficulty, big.NewInt(2+4))
+	expectedCumulativeDifficulty.Add(expectedCumulativeDifficulty, new(big.Int).Lsh(big.NewInt(1), 200))
 
-	// Tamper with blockchain data
-	blockchain.Blocks.Prev.Value.Data = "fake!"
-	assert.False(t, IsValidBlockChain(blockchain))
+	assert.Equal(t, 0, expectedCumulativeDifficulty.Cmp(blockchain.GetCumulativeDifficulty()),
+		"Cumulative difficulty should be exact even when a float64 can't represent it")
 }
 
-func TestBlockChain_GetDifficulty(t *testing.T) {
+func TestBlockChain_GetBlockByHeight(t *testing.T) {
 	blockchain := CreateBlockChain()
+	a := make([]*block.Block, 2)
+	for i := range a {
+		a[i] = mineNextBlock(blockchain, nil)
+		assert.Nil(t, blockchain.AddBlock(a[i]))
+	}
+	b := createTestBranch(CreateBlockChain(), 3)
+	assert.Nil(t, blockchain.AddBlock(b[0]))
+	assert.Nil(t, blockchain.AddBlock(b[1]))
 
-	assert.Equal(t, GetGenesisBlock().Difficulty, blockchain.GetDifficulty())
+	assert.Equal(t, a[1], blockchain.GetBlockByHeight(2), "Side branch should not be indexed by height")
+	assert.Equal(t, b[1], blockchain.GetBlockByHash(b[1].BlockHash), "Side branch should be indexed by hash")
 
-	// Add 3 blocks
-	for i := 0; i < 3; i++ {
-		_ = blockchain.AddBlock(blockchain.MineBlock(fmt.Sprint(i)))
-	}
+	assert.Nil(t, blockchain.AddBlock(b[2]))
 
-	assert.Equal(t, GetGenesisBlock().Difficulty, blockchain.GetDifficulty())
+	assert.Equal(t, GetGenesisBlock(), blockchain.GetBlockByHeight(0))
+	for i, expected := range b {
+		assert.Equal(t, expected, blockchain.GetBlockByHeight(i+1), "Height index should follow the reorganization")
+	}
+	assert.Nil(t, blockchain.GetBlockByHeight(4))
+	assert.Nil(t, blockchain.GetBlockByHeight(-1))
+	assert.Equal(t, a[0], blockchain.GetBlockByHash(a[0].BlockHash))
+	assert.Nil(t, blockchain.GetBlockByHash("unknown"))
+}
 
-	// Add 2 more blocks
-	for i := 0; i < 2; i++ {
-		_ = blockchain.AddBlock(blockchain.MineBlock(fmt.Sprint(i)))
+func TestBlockChain_GetRange(t *testing.T) {
+	blockchain := CreateBlockChain()
+	blocks := createTestBranch(blockchain, 3)
+	for _, b := range blocks {
+		assert.Nil(t, blockchain.AddBlock(b))
 	}
 
-	assert.Equal(t, GetGenesisBlock().Difficulty+1, blockchain.GetDifficulty(),
-		"Difficulty should have increased by one")
+	assert.Equal(t, blockchain.GetBlocks().ToSlice(), blockchain.GetRange(0, 4))
+	assert.Equal(t, blocks[:2], blockchain.GetRange(1, 3))
+	assert.Equal(t, blocks[1:], blockchain.GetRange(2, 100), "Range should be clipped to the chain")
+	assert.Equal(t, []*block.Block{GetGenesisBlock()}, blockchain.GetRange(-5, 1))
+	assert.Empty(t, blockchain.GetRange(3, 2))
+	assert.Empty(t, blockchain.GetRange(4, 10))
 }
 
-func TestBlockChain_GetAdjustedDifficulty(t *testing.T) {
-	blockchain := CreateBlockChain()
+func TestBlockChain_ReplaceChain(t *testing.T) {
+	blockchain, _, tx := createFundedBlockChain()
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, []*transaction.Transaction{tx}))
 
-	// Add 10 blocks
-	for i := 0; i < 10; i++ {
-		_ = blockchain.AddBlock(blockchain.MineBlock(fmt.Sprint(i)))
+	newChain := CreateBlockChain()
+	for i := 0; i < 3; i++ {
+		_ = newChain.AddBlock(mineNextBlock(newChain, nil))
 	}
-	assert.Equal(t, GetGenesisBlock().Difficulty+1, blockchain.GetAdjustedDifficulty(),
-		"Difficulty should have increased by one")
 
-	// Add 5 blocks with delay
-	for i := 0; i < 5; i++ {
-		_ = blockchain.AddBlock(blockchain.MineBlock(fmt.Sprint(i)))
-		time.Sleep(1500 * time.Millisecond)
-	}
-	assert.Equal(t, GetGenesisBlock().Difficulty, blockchain.GetAdjustedDifficulty(),
-		"Difficulty should have decreased by one")
+	err := blockchain.ReplaceChain(newChain.GetBlocks().ToSlice())
 
-	// Add 5 blocks with smaller delay
-	for i := 0; i < 5; i++ {
-		_ = blockchain.AddBlock(blockchain.MineBlock(fmt.Sprint(i)))
-		time.Sleep(1000 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, newChain.GetLatestBlock(), blockchain.GetLatestBlock())
+	unspent := blockchain.GetUnspentTxOuts()
+	for outPoint := range newChain.GetUnspentTxOuts() {
+		assert.Contains(t, unspent, outPoint, "Outputs of the new chain should be spendable")
 	}
-	assert.Equal(t, GetGenesisBlock().Difficulty, blockchain.GetAdjustedDifficulty(),
-		"Difficulty should have stayed the same")
+	assert.Contains(t, unspent, transaction.OutPoint{TxOutId: "funding", TxOutIndex: 0},
+		"Outputs spent by the disconnected block should be restored")
+	assert.Len(t, unspent, len(newChain.GetUnspentTxOuts())+1)
 }
 
-func TestBlockChain_GetCumulativeDifficulty(t *testing.T) {
+func TestBlockChain_ReplaceChain_Invalid(t *testing.T) {
 	blockchain := CreateBlockChain()
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, nil))
+
+	// A longer chain of blocks that claim work they never did
+	fakeBlocks := []*block.Block{GetGenesisBlock()}
+	for i := 1; i <= 3; i++ {
+		b := &block.Block{
+			BlockHeader: block.BlockHeader{
+				Version:       block.BlockVersion,
+				Timestamp:     GetGenesisBlock().Timestamp,
+				PrevBlockHash: fakeBlocks[i-1].BlockHash,
+				Difficulty:    GetGenesisBlock().Difficulty,
+			},
+			Transactions: []*transaction.Transaction{},
+			Index:        i,
+		}
+		b.MerkleRoot = b.CalculateMerkleRoot()
+		b.BlockHash = b.CalculateBlockHash()
+		for consensus.IsHashValid(b.BlockHash, b.Difficulty) {
+			b.Nonce++
+			b.BlockHash = b.CalculateBlockHash()
+		}
+		fakeBlocks = append(fakeBlocks, b)
+	}
+	latestBlock := blockchain.GetLatestBlock()
 
-	b1 := &block.Block{Difficulty: 1}
-	b2 := &block.Block{Difficulty: 2}
-	b3 := &block.Block{Difficulty: 3}
+	err := blockchain.ReplaceChain(fakeBlocks)
 
-	blockchain.Blocks = blockchain.Blocks.Add(b1)
-	blockchain.Blocks = blockchain.Blocks.Add(b2)
-	blockchain.Blocks = blockchain.Blocks.Add(b3)
+	assert.ErrorIs(t, err, ErrInvalidSeal)
+	assert.ErrorIs(t, err, consensus.ErrInsufficientWork)
+	assert.Equal(t, latestBlock, blockchain.GetLatestBlock(), "Chain should not be replaced")
+
+	// A valid chain without more work
+	shorterChain := CreateBlockChain()
+	err = blockchain.ReplaceChain(shorterChain.GetBlocks().ToSlice())
+	assert.ErrorIs(t, err, ErrNotEnoughWork)
+	assert.Equal(t, latestBlock, blockchain.GetLatestBlock(), "Chain should not be replaced")
+}
 
-	expectedCumulativeDifficulty := math.Pow(2, float64(GetGenesisBlock().Difficulty)) + math.Pow(2, 1) + math.Pow(2,
-		2) + math.Pow(2, 3)
+// noopTransport is a consensus.BFTTransport for a single validator that has no one to send messages to
+type noopTransport struct{}
+
+func (t *noopTransport) Broadcast(msg *consensus.BFTMessage) {}
+
+// createBFTBlockChain creates a blockchain finalized by `w` as the only validator
+func createBFTBlockChain(w *wallet.Wallet) *BlockChainIml {
+	engine := consensus.CreateBFT(DefaultGenesis().ChainId, []string{w.GetAddress()}, w, &noopTransport{}, time.Second)
+	blockchain := CreateBlockChainWithParams(DefaultChainParams(), &clock.SystemClock{}, engine)
+	engine.Chain = blockchain
+	engine.Start()
+	return blockchain
+}
 
-	assert.Equal(t, expectedCumulativeDifficulty, blockchain.GetCumulativeDifficulty())
+// finalizeNextBlock has the only validator of the blockchain finalize a block paying the reward to `minerAddress`
+func finalizeNextBlock(t *testing.T, blockchain *BlockChainIml, minerAddress string) {
+	height := blockchain.GetLatestBlock().Index + 1
+	_, err := blockchain.MineBlock(context.Background(), minerAddress, nil)
+	assert.ErrorIs(t, err, ErrTipChanged, "Finalized block should be added by the engine")
+	assert.Equal(t, height, blockchain.GetLatestBlock().Index)
+}
+
+func TestBlockChain_ReplaceChain_Finalized(t *testing.T) {
+	w, _ := wallet.CreateWallet()
+	longerChain := createBFTBlockChain(w)
+	finalizeNextBlock(t, longerChain, testMinerAddress)
+	finalizeNextBlock(t, longerChain, testMinerAddress)
+
+	blockchain := createBFTBlockChain(w)
+	assert.Nil(t, blockchain.ReplaceChain(longerChain.GetBlocks().ToSlice()),
+		"Chain extending the finalized tip should be accepted")
+
+	forked := createBFTBlockChain(w)
+	finalizeNextBlock(t, forked, "another miner")
+	latestBlock := forked.GetLatestBlock()
+	assert.ErrorIs(t, forked.ReplaceChain(longerChain.GetBlocks().ToSlice()), ErrFinalized)
+	assert.Equal(t, latestBlock, forked.GetLatestBlock(), "Finalized blocks should never be replaced")
+}
+
+// getBlockHashes returns the hash of each block
+func getBlockHashes(blocks []*block.Block) []string {
+	hashes := make([]string, len(blocks))
+	for i, b := range blocks {
+		hashes[i] = b.BlockHash
+	}
+	return hashes
+}
+
+func TestLoadBlockChain(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.OpenBlockStore(dir)
+	assert.Nil(t, err)
+	blockchain, err := LoadBlockChain(store, DefaultChainParams(), &clock.SystemClock{}, consensus.CreateProofOfWork())
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, blockchain.AddBlock(mineNextBlock(blockchain, nil)))
+	}
+	sideBlock := createTestBranch(CreateBlockChain(), 1)[0]
+	assert.Nil(t, blockchain.AddBlock(sideBlock))
+	// A block that is stored but no longer valid, such as one written by an older version of the node
+	invalid := createTestBlock(blockchain.GetBlocks(), nil)
+	invalid.Transactions[0].TxOuts[0].Amount++
+	invalid.BlockHash = invalid.CalculateBlockHash()
+	assert.Nil(t, store.Append(invalid))
+	assert.Nil(t, store.Close())
+
+	store, err = storage.OpenBlockStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	loaded, err := LoadBlockChain(store, DefaultChainParams(), &clock.SystemClock{}, consensus.CreateProofOfWork())
+
+	assert.Nil(t, err)
+	assert.Equal(t, getBlockHashes(blockchain.GetBlocks().ToSlice()), getBlockHashes(loaded.GetBlocks().ToSlice()),
+		"Chain should be reloaded")
+	assert.Equal(t, blockchain.GetUnspentTxOuts(), loaded.GetUnspentTxOuts())
+	assert.NotNil(t, loaded.GetBlockByHash(sideBlock.BlockHash), "Side branches should be reloaded")
+	assert.Nil(t, loaded.GetBlockByHash(invalid.BlockHash), "Stored blocks should be revalidated")
+
+	next := mineNextBlock(loaded, nil)
+	assert.Nil(t, loaded.AddBlock(next))
+	_, err = store.GetBlockByHash(next.BlockHash)
+	assert.Nil(t, err, "Blocks added after loading should be stored")
 }
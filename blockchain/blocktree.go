@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"errors"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/transaction"
+	"math/big"
+	"sync"
+)
+
+var (
+	ErrUnknownParent = errors.New("parent block is not known")
+	ErrKnownBlock    = errors.New("block is already known")
+)
+
+// ReorgEvent reports a change of the tip. Blocks on the old branch are reverted from the old tip down to the fork
+// point, then the blocks on the new branch are applied from the fork point up to the new tip. A block extending the
+// tip is a reorg that reverts nothing.
+type ReorgEvent struct {
+	Reverted []*block.Block // In the order they were disconnected, old tip first
+	Applied  []*block.Block // In the order they were connected, new tip last
+}
+
+// treeNode is a block in the BlockTree
+type treeNode struct {
+	List     *SafeDoublyLinkedBlockList // The block as the tip of its branch, so its ancestors can be walked
+	Parent   *treeNode
+	Children []*treeNode                 // Blocks on top of the block, guarded by the mutex of the tree
+	Work     *big.Int                    // Cumulative work of the branch ending at the block
+	Spent    []*transaction.UnspentTxOut // Outputs the block spent, restored when it is disconnected
+}
+
+// BlockTree holds every block with a valid header by hash, including the blocks on side branches. Blocks are only
+// added by the writer of the chain, but can be looked up by any reader.
+type BlockTree struct {
+	nodes map[string]*treeNode
+	mu    sync.RWMutex
+}
+
+// CreateBlockTree creates a tree with the genesis block as its root
+func CreateBlockTree(genesis *block.Block, work *big.Int) *BlockTree {
+	return &BlockTree{
+		nodes: map[string]*treeNode{
+			genesis.BlockHash: {List: &SafeDoublyLinkedBlockList{Value: genesis}, Work: work},
+		},
+	}
+}
+
+// get returns the node of the block with `hash`, or nil if it is not in the tree
+func (tree *BlockTree) get(hash string) *treeNode {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.nodes[hash]
+}
+
+// add adds the block as a child of `parent` weighing `work` on top of it
+func (tree *BlockTree) add(b *block.Block, parent *treeNode, work *big.Int) *treeNode {
+	node := &treeNode{
+		List:   parent.List.Add(b),
+		Parent: parent,
+		Work:   new(big.Int).Add(parent.Work, work),
+	}
+	tree.mu.Lock()
+	tree.nodes[b.BlockHash] = node
+	parent.Children = append(parent.Children, node)
+	tree.mu.Unlock()
+	return node
+}
+
+// remove removes the block of `node` and every block on top of it from the tree, so blocks with their hashes can be
+// added again
+func (tree *BlockTree) remove(node *treeNode) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	siblings := make([]*treeNode, 0, len(node.Parent.Children))
+	for _, sibling := range node.Parent.Children {
+		if sibling != node {
+			siblings = append(siblings, sibling)
+		}
+	}
+	node.Parent.Children = siblings
+	removed := []*treeNode{node}
+	for len(removed) > 0 {
+		next := removed[len(removed)-1]
+		removed = removed[:len(removed)-1]
+		delete(tree.nodes, next.List.Value.BlockHash)
+		removed = append(removed, next.Children...)
+	}
+}
+
+// findForkPoint returns the last block two branches have in common
+func findForkPoint(a *treeNode, b *treeNode) *treeNode {
+	for a != b {
+		if a.List.Value.Index >= b.List.Value.Index {
+			a = a.Parent
+		} else {
+			b = b.Parent
+		}
+	}
+	return a
+}
+
+// getBranch returns the nodes after `fork` up to and including `tip`, in chain order
+func getBranch(fork *treeNode, tip *treeNode) []*treeNode {
+	var branch []*treeNode
+	for node := tip; node != fork; node = node.Parent {
+		branch = append(branch, node)
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch
+}
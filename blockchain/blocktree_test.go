@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// createTestBranch creates `n` valid blocks on top of the blocks of `blockchain` without adding them to it
+func createTestBranch(blockchain *BlockChainIml, n int) []*block.Block {
+	branch := createTestChainFrom(blockchain.GetBlocks().ToSlice()[1:])
+	blocks := make([]*block.Block, n)
+	for i := range blocks {
+		blocks[i] = createTestBlock(branch.GetBlocks(), nil)
+		_ = branch.AddBlock(blocks[i])
+	}
+	return blocks
+}
+
+// createTestChainFrom creates a chain by adding `blocks` on top of the genesis block
+func createTestChainFrom(blocks []*block.Block) *BlockChainIml {
+	blockchain := CreateBlockChain()
+	for _, b := range blocks {
+		_ = blockchain.AddBlock(b)
+	}
+	return blockchain
+}
+
+func TestBlockChain_AddBlock_Reorg(t *testing.T) {
+	blockchain := CreateBlockChain()
+	var events []*ReorgEvent
+	blockchain.SubscribeReorgs(func(event *ReorgEvent) {
+		events = append(events, event)
+	})
+	a1 := mineNextBlock(blockchain, nil)
+	assert.Nil(t, blockchain.AddBlock(a1))
+	assert.Equal(t, []*ReorgEvent{{Applied: []*block.Block{a1}}}, events,
+		"Extending the tip should apply the block")
+
+	branch := createTestBranch(CreateBlockChain(), 2)
+	assert.Nil(t, blockchain.AddBlock(branch[0]))
+	assert.Equal(t, a1, blockchain.GetLatestBlock(), "Branch without more work should be kept on the side")
+	assert.Len(t, events, 1)
+
+	assert.Nil(t, blockchain.AddBlock(branch[1]))
+
+	assert.Equal(t, branch[1], blockchain.GetLatestBlock(), "Branch with more work should become the chain")
+	assert.Equal(t, []*block.Block{GetGenesisBlock(), branch[0], branch[1]}, blockchain.GetBlocks().ToSlice())
+	assert.Equal(t, &ReorgEvent{Reverted: []*block.Block{a1}, Applied: branch}, events[1])
+	assert.Equal(t, createTestChainFrom(branch).GetUnspentTxOuts(), blockchain.GetUnspentTxOuts(),
+		"Unspent outputs should match the new branch")
+
+	// Going back to the first branch reverts the second one
+	a2 := createTestBranch(createTestChainFrom([]*block.Block{a1}), 2)
+	assert.Nil(t, blockchain.AddBlock(a2[0]))
+	assert.Nil(t, blockchain.AddBlock(a2[1]))
+	assert.Equal(t, &ReorgEvent{Reverted: []*block.Block{branch[1], branch[0]}, Applied: []*block.Block{a1, a2[0],
+		a2[1]}}, events[2])
+	assert.Equal(t, createTestChainFrom(append([]*block.Block{a1}, a2...)).GetUnspentTxOuts(),
+		blockchain.GetUnspentTxOuts())
+}
+
+func TestBlockChain_AddBlock_InvalidBranch(t *testing.T) {
+	blockchain := CreateBlockChain()
+	tip := mineNextBlock(blockchain, nil)
+	assert.Nil(t, blockchain.AddBlock(tip))
+
+	// The header of a block is checked when it arrives, its transactions only once its branch has more work
+	invalid := createTestBlock(CreateBlockChain().GetBlocks(), []*transaction.Transaction{transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "missing", TxOutIndex: 0}}, []*transaction.TxOut{{Address: "bob", Amount: 1}})})
+	assert.Nil(t, blockchain.AddBlock(invalid))
+	invalidList := blockchain.tree.get(invalid.BlockHash).List
+	child := createTestBlock(invalidList, nil)
+
+	err := blockchain.AddBlock(child)
+
+	assert.ErrorIs(t, err, ErrInvalidTransactions)
+	assert.Equal(t, tip, blockchain.GetLatestBlock(), "Chain should not be reorganized onto an invalid branch")
+
+	assert.Nil(t, blockchain.GetBlockByHash(invalid.BlockHash), "Invalid block should be removed from the tree")
+	assert.Nil(t, blockchain.GetBlockByHash(child.BlockHash), "Blocks on top of it should be removed too")
+	grandchild := createTestBlock(invalidList.Add(child), nil)
+	assert.ErrorIs(t, blockchain.AddBlock(grandchild), ErrUnknownParent,
+		"Blocks on top of an invalid block should not be added")
+	assert.Equal(t, tip, blockchain.GetLatestBlock())
+}
+
+func TestBlockChain_AddBlock_MutatedSideBlock(t *testing.T) {
+	blockchain, _, tx := createFundedBlockChain()
+	genesis := blockchain.GetBlocks()
+	tip := mineNextBlock(blockchain, nil)
+	assert.Nil(t, blockchain.AddBlock(tip))
+
+	// A peer relays a copy of an honest side branch block whose transaction has another signature
+	honest := createTestBlock(genesis, []*transaction.Transaction{tx})
+	mutatedTx := *tx
+	mutatedTx.TxIns = []*transaction.TxIn{{TxOutId: tx.TxIns[0].TxOutId, TxOutIndex: tx.TxIns[0].TxOutIndex,
+		Signature: "00"}}
+	mutated := createTestBlock(genesis, []*transaction.Transaction{&mutatedTx})
+	mutated.Timestamp = honest.Timestamp
+	mutated.MerkleRoot = mutated.CalculateMerkleRoot()
+	mineTestBlock(mutated)
+	assert.NotEqual(t, honest.BlockHash, mutated.BlockHash, "Block hash should cover the signatures")
+
+	assert.Nil(t, blockchain.AddBlock(mutated))
+	assert.Nil(t, blockchain.AddBlock(honest), "Honest block should not be taken for the mutated one")
+
+	// The mutated branch fails once it has more work, and is forgotten
+	err := blockchain.AddBlock(createTestBlock(blockchain.tree.get(mutated.BlockHash).List, nil))
+	assert.ErrorIs(t, err, transaction.ErrInvalidSignature)
+	assert.Equal(t, tip, blockchain.GetLatestBlock())
+	assert.Nil(t, blockchain.GetBlockByHash(mutated.BlockHash))
+
+	// The honest branch can still become the chain
+	child := createTestBlock(blockchain.tree.get(honest.BlockHash).List, nil)
+	assert.Nil(t, blockchain.AddBlock(child))
+	assert.Equal(t, []*block.Block{GetGenesisBlock(), honest, child}, blockchain.GetBlocks().ToSlice())
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"math/bits"
+	"os"
+	"time"
+)
+
+var ErrInvalidGenesis = errors.New("invalid genesis")
+
+// Allocation is an output created by the genesis block, spendable from the start of the chain
+type Allocation struct {
+	Address string
+	Amount  int
+}
+
+// Genesis defines the genesis block of a chain along with the parameters the chain runs with. It is loaded from a
+// JSON genesis file, and every node of a chain must be started with the same one.
+type Genesis struct {
+	ChainId                     string
+	Timestamp                   time.Time
+	InitialDifficulty           int // Difficulty of the genesis block, kept by proof-of-work until the first retarget
+	RetargetIntervalBlocks      int // The proof-of-work difficulty is retargeted every N blocks
+	InitialBlockReward          int // Subsidy the coinbase of a block can claim before the first halving
+	RewardHalvingIntervalBlocks int // The subsidy is halved every N blocks, or never when 0
+	Allocations                 []*Allocation
+}
+
+// DefaultGenesis returns the genesis used when no genesis file is given
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		ChainId:                     "blockchain-go",
+		Timestamp:                   time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		InitialDifficulty:           4,
+		RetargetIntervalBlocks:      consensus.DifficultyAdjustmentIntervalBlocks,
+		InitialBlockReward:          50,
+		RewardHalvingIntervalBlocks: 100000,
+		Allocations:                 []*Allocation{},
+	}
+}
+
+// LoadGenesis reads and validates the genesis file at `path`
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	genesis := &Genesis{}
+	err = json.Unmarshal(data, genesis)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidGenesis, err)
+	}
+	err = genesis.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return genesis, nil
+}
+
+// Validate checks that the genesis defines a chain a node can run
+func (g *Genesis) Validate() error {
+	if g.ChainId == "" {
+		return fmt.Errorf("%w: missing chain id", ErrInvalidGenesis)
+	}
+	if g.Timestamp.IsZero() {
+		return fmt.Errorf("%w: missing timestamp", ErrInvalidGenesis)
+	}
+	if g.InitialDifficulty < 0 || g.InitialDifficulty > consensus.MaxDifficulty {
+		return fmt.Errorf("%w: initial difficulty must be between 0 and %d", ErrInvalidGenesis,
+			consensus.MaxDifficulty)
+	}
+	if g.RetargetIntervalBlocks <= 0 {
+		return fmt.Errorf("%w: retarget interval must be positive", ErrInvalidGenesis)
+	}
+	if g.InitialBlockReward < 0 || g.RewardHalvingIntervalBlocks < 0 {
+		return fmt.Errorf("%w: block reward and halving interval can't be negative", ErrInvalidGenesis)
+	}
+	for _, allocation := range g.Allocations {
+		if allocation.Address == "" || allocation.Amount <= 0 {
+			return fmt.Errorf("%w: allocations need an address and a positive amount", ErrInvalidGenesis)
+		}
+	}
+	return nil
+}
+
+// GetBlockSubsidy returns the newly created coins the coinbase of the block at `height` can claim on top of the fees
+func (g *Genesis) GetBlockSubsidy(height int) int {
+	if g.RewardHalvingIntervalBlocks <= 0 {
+		return g.InitialBlockReward
+	}
+	halvings := height / g.RewardHalvingIntervalBlocks
+	// Shifting by the width of an int or more is the same as halving the subsidy to nothing
+	if halvings >= bits.UintSize-1 {
+		return 0
+	}
+	return g.InitialBlockReward >> halvings
+}
+
+// CreateBlock builds the genesis block. The allocations are the outputs of its only transaction, which has the shape
+// of a coinbase. The genesis block has no parent, so its previous hash is the hash of the chain id and the rules the
+// genesis sets instead, which gives chains with different ids or rules different genesis blocks. Nodes agree on the
+// rules by agreeing on the genesis block.
+func (g *Genesis) CreateBlock() *block.Block {
+	rulesHash := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d/%d", g.ChainId, g.RetargetIntervalBlocks,
+		g.InitialBlockReward, g.RewardHalvingIntervalBlocks)))
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{
+			Version:       block.BlockVersion,
+			Timestamp:     g.Timestamp,
+			PrevBlockHash: hex.EncodeToString(rulesHash[:]),
+			Difficulty:    g.InitialDifficulty,
+		},
+		Transactions: []*transaction.Transaction{},
+		Index:        0,
+	}
+	if len(g.Allocations) > 0 {
+		txOuts := make([]*transaction.TxOut, len(g.Allocations))
+		for i, allocation := range g.Allocations {
+			txOuts[i] = &transaction.TxOut{Address: allocation.Address, Amount: allocation.Amount}
+		}
+		b.Transactions = append(b.Transactions,
+			transaction.CreateTransaction([]*transaction.TxIn{{TxOutId: "", TxOutIndex: 0}}, txOuts))
+	}
+	b.MerkleRoot = b.CalculateMerkleRoot()
+	b.BlockHash = b.CalculateBlockHash()
+	return b
+}
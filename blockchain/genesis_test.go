@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadGenesis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	_ = os.WriteFile(path, []byte(`{
+		"ChainId": "testnet",
+		"Timestamp": "2024-01-01T00:00:00Z",
+		"InitialDifficulty": 8,
+		"RetargetIntervalBlocks": 10,
+		"InitialBlockReward": 25,
+		"RewardHalvingIntervalBlocks": 1000,
+		"Allocations": [{"Address": "alice", "Amount": 100}]
+	}`), 0644)
+
+	genesis, err := LoadGenesis(path)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Genesis{
+		ChainId:                     "testnet",
+		Timestamp:                   time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		InitialDifficulty:           8,
+		RetargetIntervalBlocks:      10,
+		InitialBlockReward:          25,
+		RewardHalvingIntervalBlocks: 1000,
+		Allocations:                 []*Allocation{{Address: "alice", Amount: 100}},
+	}, genesis)
+
+	_ = os.WriteFile(path, []byte(`{"ChainId": "testnet"`), 0644)
+	_, err = LoadGenesis(path)
+	assert.ErrorIs(t, err, ErrInvalidGenesis, "Malformed genesis file should be rejected")
+}
+
+func TestGenesis_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(g *Genesis)
+	}{
+		{"missing chain id", func(g *Genesis) { g.ChainId = "" }},
+		{"missing timestamp", func(g *Genesis) { g.Timestamp = time.Time{} }},
+		{"negative difficulty", func(g *Genesis) { g.InitialDifficulty = -1 }},
+		{"difficulty too high", func(g *Genesis) { g.InitialDifficulty = consensus.MaxDifficulty + 1 }},
+		{"zero retarget interval", func(g *Genesis) { g.RetargetIntervalBlocks = 0 }},
+		{"negative block reward", func(g *Genesis) { g.InitialBlockReward = -1 }},
+		{"negative halving interval", func(g *Genesis) { g.RewardHalvingIntervalBlocks = -1 }},
+		{"allocation without amount", func(g *Genesis) { g.Allocations = []*Allocation{{Address: "alice"}} }},
+		{"allocation without address", func(g *Genesis) { g.Allocations = []*Allocation{{Amount: 1}} }},
+	}
+	assert.Nil(t, DefaultGenesis().Validate())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			genesis := DefaultGenesis()
+			test.modify(genesis)
+			assert.ErrorIs(t, genesis.Validate(), ErrInvalidGenesis)
+		})
+	}
+}
+
+func TestGenesis_CreateBlock(t *testing.T) {
+	b := DefaultGenesis().CreateBlock()
+
+	assert.Equal(t, b, DefaultGenesis().CreateBlock(), "Genesis block should be the same every time")
+	assert.Equal(t, b.CalculateBlockHash(), b.BlockHash)
+	assert.Equal(t, DefaultGenesis().InitialDifficulty, b.Difficulty)
+	assert.Empty(t, b.Transactions)
+
+	other := DefaultGenesis()
+	other.ChainId = "other"
+	assert.NotEqual(t, b.BlockHash, other.CreateBlock().BlockHash, "Chain id should change the genesis hash")
+	allocated := DefaultGenesis()
+	allocated.Allocations = []*Allocation{{Address: "alice", Amount: 100}}
+	assert.NotEqual(t, b.BlockHash, allocated.CreateBlock().BlockHash, "Allocations should change the genesis hash")
+	rewarded := DefaultGenesis()
+	rewarded.InitialBlockReward++
+	assert.NotEqual(t, b.BlockHash, rewarded.CreateBlock().BlockHash, "Block reward should change the genesis hash")
+	halved := DefaultGenesis()
+	halved.RewardHalvingIntervalBlocks++
+	assert.NotEqual(t, b.BlockHash, halved.CreateBlock().BlockHash,
+		"Halving interval should change the genesis hash")
+	retargeted := DefaultGenesis()
+	retargeted.RetargetIntervalBlocks++
+	assert.NotEqual(t, b.BlockHash, retargeted.CreateBlock().BlockHash,
+		"Retarget interval should change the genesis hash")
+}
+
+func TestGenesis_GetBlockSubsidy(t *testing.T) {
+	genesis := &Genesis{InitialBlockReward: 50, RewardHalvingIntervalBlocks: 10}
+
+	assert.Equal(t, 50, genesis.GetBlockSubsidy(1))
+	assert.Equal(t, 50, genesis.GetBlockSubsidy(9))
+	assert.Equal(t, 25, genesis.GetBlockSubsidy(10), "Subsidy should halve after the interval")
+	assert.Equal(t, 12, genesis.GetBlockSubsidy(20), "Halving should round down")
+	assert.Equal(t, 0, genesis.GetBlockSubsidy(60), "Subsidy should eventually run out")
+	assert.Equal(t, 0, genesis.GetBlockSubsidy(10*1000), "Subsidy should not wrap around after many halvings")
+	genesis.RewardHalvingIntervalBlocks = 0
+	assert.Equal(t, 50, genesis.GetBlockSubsidy(10*1000), "Subsidy should never halve without an interval")
+}
+
+func TestCreateBlockChainWithParams_Allocations(t *testing.T) {
+	w, _ := wallet.CreateWallet()
+	params := DefaultChainParams()
+	params.Genesis.Allocations = []*Allocation{{Address: w.GetAddress(), Amount: 100}, {Address: "bob", Amount: 5}}
+	blockchain := CreateBlockChainWithParams(params, &clock.SystemClock{}, consensus.CreateProofOfWork())
+	genesis := blockchain.GetGenesisBlock()
+
+	assert.Len(t, blockchain.GetUnspentTxOuts(), 2)
+	outPoint := genesis.Transactions[0].OutPoint(0)
+	assert.Equal(t, &transaction.UnspentTxOut{TxOutId: outPoint.TxOutId, TxOutIndex: 0, Address: w.GetAddress(),
+		Amount: 100}, blockchain.GetUnspentTxOuts()[outPoint])
+
+	tx := transaction.CreateTransaction([]*transaction.TxIn{{TxOutId: outPoint.TxOutId, TxOutIndex: 0}},
+		[]*transaction.TxOut{{Address: "carol", Amount: 100}})
+	_ = w.SignTransaction(tx, blockchain.GetUnspentTxOuts())
+	assert.Nil(t, blockchain.AddBlock(mineNextBlock(blockchain, []*transaction.Transaction{tx})),
+		"Allocations should be spendable")
+}
@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"math/big"
+	"sync"
+)
+
+var ErrUnconnectedHeaders = errors.New("headers do not extend the header chain")
+
+// HeaderChain is a branch of headers validated ahead of the blocks they belong to, so a node catching up knows which
+// blocks to download, and from how many peers at once, before it downloads any of them. The branch grows from a block
+// of the block tree, and each header is kept as a block without transactions.
+type HeaderChain struct {
+	bc      *BlockChainIml
+	base    *SafeDoublyLinkedBlockList // Block of the block tree the headers grow from
+	tip     *SafeDoublyLinkedBlockList // Last header
+	headers []*block.Block             // Headers after base, first header first
+	work    *big.Int                   // Cumulative work of the branch ending at the last header
+	mu      sync.RWMutex
+}
+
+// CreateHeaderChain creates an empty header chain growing from the block with `hash`, which must be in the block tree
+func (bc *BlockChainIml) CreateHeaderChain(hash string) (*HeaderChain, error) {
+	node := bc.tree.get(hash)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownParent, hash)
+	}
+	return &HeaderChain{
+		bc:   bc,
+		base: node.List,
+		tip:  node.List,
+		work: new(big.Int).Set(node.Work),
+	}, nil
+}
+
+// AddHeaders validates `headers`, which must follow each other and the last header of the chain, against the same
+// header rules blocks are checked with and adds them to the chain. Headers are added up to the first invalid one.
+func (hc *HeaderChain) AddHeaders(headers []*block.BlockHeader) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, header := range headers {
+		if header.PrevBlockHash != hc.tip.Value.BlockHash {
+			return fmt.Errorf("%w: header %s follows %s", ErrUnconnectedHeaders, header.CalculateHash(),
+				header.PrevBlockHash)
+		}
+		b := &block.Block{
+			BlockHeader: *header,
+			BlockHash:   header.CalculateHash(),
+			Index:       hc.tip.Value.Index + 1,
+		}
+		if err := hc.bc.validateHeader(b, hc.tip, true); err != nil {
+			return err
+		}
+		// The list is linked to the tree by its Prev link only, so the tree is left as it is
+		hc.tip = &SafeDoublyLinkedBlockList{Prev: hc.tip, Value: b}
+		hc.headers = append(hc.headers, b)
+		hc.work.Add(hc.work, hc.bc.Engine.GetWork(header))
+	}
+	return nil
+}
+
+// GetBase returns the block the headers grow from
+func (hc *HeaderChain) GetBase() *block.Block {
+	return hc.base.Value
+}
+
+// GetTip returns the last header as a block without transactions, or the block the headers grow from if there are none
+func (hc *HeaderChain) GetTip() *block.Block {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.tip.Value
+}
+
+// GetHeaders returns the headers of the chain as blocks without transactions, first header first
+func (hc *HeaderChain) GetHeaders() []*block.Block {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return append([]*block.Block{}, hc.headers...)
+}
+
+// GetWork returns the cumulative work of the branch ending at the last header as weighed by the consensus engine
+func (hc *HeaderChain) GetWork() *big.Int {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return new(big.Int).Set(hc.work)
+}
+
+// GetLocator returns the block locator of the branch ending at the last header
+func (hc *HeaderChain) GetLocator() []string {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return getLocator(hc.tip)
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// getHeaders returns the headers of `blocks`
+func getHeaders(blocks []*block.Block) []*block.BlockHeader {
+	headers := make([]*block.BlockHeader, len(blocks))
+	for i, b := range blocks {
+		headers[i] = &b.BlockHeader
+	}
+	return headers
+}
+
+func TestHeaderChain_AddHeaders(t *testing.T) {
+	synced := CreateBlockChain()
+	blocks := createTestBranch(synced, 12)
+	for _, b := range blocks {
+		assert.Nil(t, synced.AddBlock(b))
+	}
+	blockchain := createTestChainFrom(blocks[:2])
+
+	headerChain, err := blockchain.CreateHeaderChain(blocks[1].BlockHash)
+	assert.Nil(t, err)
+	assert.Nil(t, headerChain.AddHeaders(getHeaders(blocks[2:7])))
+	assert.Nil(t, headerChain.AddHeaders(getHeaders(blocks[7:])))
+
+	assert.Equal(t, blocks[1], headerChain.GetBase())
+	headers := headerChain.GetHeaders()
+	assert.Len(t, headers, 10)
+	for i, header := range headers {
+		assert.Equal(t, blocks[i+2].BlockHash, header.BlockHash)
+		assert.Equal(t, blocks[i+2].Index, header.Index)
+		assert.Empty(t, header.Transactions, "Headers should be kept without the transactions of their blocks")
+	}
+	assert.Equal(t, blocks[11].BlockHash, headerChain.GetTip().BlockHash)
+	assert.Equal(t, synced.GetCumulativeDifficulty(), headerChain.GetWork())
+	assert.Equal(t, synced.GetBlockLocator(blocks[11].BlockHash), headerChain.GetLocator())
+	assert.Equal(t, blocks[1], blockchain.GetLatestBlock(), "Adding headers should not change the chain")
+}
+
+func TestHeaderChain_AddHeaders_Invalid(t *testing.T) {
+	blockchain := CreateBlockChain()
+	blocks := createTestBranch(blockchain, 3)
+	invalid := blocks[2].BlockHeader
+	invalid.Version++
+
+	headerChain, _ := blockchain.CreateHeaderChain(GetGenesisBlock().BlockHash)
+	assert.ErrorIs(t, headerChain.AddHeaders(getHeaders(blocks[1:])), ErrUnconnectedHeaders)
+	assert.ErrorIs(t, headerChain.AddHeaders([]*block.BlockHeader{&blocks[0].BlockHeader, &blocks[1].BlockHeader,
+		&invalid}), ErrInvalidVersion)
+	assert.Equal(t, blocks[1].BlockHash, headerChain.GetTip().BlockHash, "Headers before the invalid one are added")
+
+	_, err := blockchain.CreateHeaderChain("unknown")
+	assert.ErrorIs(t, err, ErrUnknownParent)
+}
@@ -0,0 +1,62 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+)
+
+const (
+	locatorDenseHashes = 10  // Number of blocks below the start of a locator that are all listed before spacing out
+	MaxLocatorHashes   = 101 // Enough for a locator of any chain shorter than 2^90 blocks
+)
+
+// GetBlockLocator returns the block locator of the branch ending at the block with `hash`, or nil if the block is not
+// in the block tree. The locator lists the hashes of the block and its last ancestors, then of ancestors twice as far
+// apart at each step, and ends with the genesis block. A peer finds the fork point of its main chain with the branch
+// by looking up the hashes in order, while the locator only grows with the log of the height.
+func (bc *BlockChainIml) GetBlockLocator(hash string) []string {
+	node := bc.tree.get(hash)
+	if node == nil {
+		return nil
+	}
+	return getLocator(node.List)
+}
+
+// getLocator returns the block locator of the branch ending at `tip`
+func getLocator(tip *SafeDoublyLinkedBlockList) []string {
+	var locator []string
+	step := 1
+	for tip.Prev != nil {
+		locator = append(locator, tip.Value.BlockHash)
+		if len(locator) >= locatorDenseHashes {
+			step *= 2
+		}
+		for i := 0; i < step && tip.Prev != nil; i++ {
+			tip = tip.Prev
+		}
+	}
+	return append(locator, tip.Value.BlockHash)
+}
+
+// LocateBlocks returns the blocks of the main chain a peer whose branch is described by `locator` is missing. They
+// are the blocks after the first locator hash on the main chain, or after the genesis block if none is, up to the
+// block with `stopHash` and at most `limit` of them. Hashes past MaxLocatorHashes are ignored.
+func (bc *BlockChainIml) LocateBlocks(locator []string, stopHash string, limit int) []*block.Block {
+	snapshot := bc.Snapshot()
+	if len(locator) > MaxLocatorHashes {
+		locator = locator[:MaxLocatorHashes]
+	}
+	fork := 0
+	for _, hash := range locator {
+		if node := bc.tree.get(hash); node != nil && snapshot.isOnMainChain(node) {
+			fork = node.List.Value.Index
+			break
+		}
+	}
+	blocks := snapshot.GetRange(fork+1, fork+1+limit)
+	for i, b := range blocks {
+		if b.BlockHash == stopHash {
+			return blocks[:i+1]
+		}
+	}
+	return blocks
+}
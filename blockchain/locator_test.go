@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockChain_GetBlockLocator(t *testing.T) {
+	blockchain := CreateBlockChain()
+	for _, b := range createTestBranch(blockchain, 30) {
+		assert.Nil(t, blockchain.AddBlock(b))
+	}
+
+	locator := blockchain.GetBlockLocator(blockchain.GetLatestBlock().BlockHash)
+
+	heights := make([]int, len(locator))
+	for i, hash := range locator {
+		heights[i] = blockchain.GetBlockByHash(hash).Index
+	}
+	assert.Equal(t, []int{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0}, heights,
+		"Locator should list the last blocks, then blocks twice as far apart at each step, then the genesis block")
+	assert.Equal(t, []string{GetGenesisBlock().BlockHash}, blockchain.GetBlockLocator(GetGenesisBlock().BlockHash))
+	assert.Nil(t, blockchain.GetBlockLocator("unknown"))
+}
+
+func TestBlockChain_LocateBlocks(t *testing.T) {
+	blockchain := CreateBlockChain()
+	blocks := createTestBranch(blockchain, 20)
+	for _, b := range blocks {
+		assert.Nil(t, blockchain.AddBlock(b))
+	}
+	behind := createTestChainFrom(blocks[:10])
+	forked := createTestChainFrom(blocks[:5])
+	assert.Nil(t, forked.AddBlock(mineNextBlock(forked, nil)))
+	locator := behind.GetBlockLocator(behind.GetLatestBlock().BlockHash)
+
+	tests := []struct {
+		name     string
+		locator  []string
+		stopHash string
+		limit    int
+		expected []*block.Block
+	}{
+		{"peer behind", locator, "", 500, blocks[10:]},
+		{"limit", locator, "", 5, blocks[10:15]},
+		{"stop hash", locator, blocks[12].BlockHash, 500, blocks[10:13]},
+		{"peer on a fork", forked.GetBlockLocator(forked.GetLatestBlock().BlockHash), "", 500, blocks[5:]},
+		{"no known hash", []string{"unknown"}, "", 500, blocks},
+		{"peer up to date", blockchain.GetBlockLocator(blocks[19].BlockHash), "", 500, []*block.Block{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, blockchain.LocateBlocks(test.locator, test.stopHash, test.limit))
+		})
+	}
+}
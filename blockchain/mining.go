@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"log"
+	"time"
+)
+
+var ErrTipChanged = errors.New("tip changed while mining")
+
+// MineBlock Mines a block containing the transactions on top of the current tip and returns it. The block starts with
+// a coinbase transaction paying the block subsidy and the fees of the transactions to `minerAddress`. The header is
+// prepared and sealed by the consensus engine. Mining stops with the context's error when `ctx` is done, or with
+// ErrTipChanged when a block is added or the chain is replaced, since the block could no longer be added.
+func (bc *BlockChainIml) MineBlock(ctx context.Context, minerAddress string, txs []*transaction.Transaction) (
+	*block.Block, error) {
+
+	tipChanged := bc.getTipChanged()
+	snapshot := bc.Snapshot()
+	tip := snapshot.GetBlocks()
+	b := bc.createBlockTemplate(snapshot, minerAddress, txs)
+	err := bc.Engine.Prepare(tip, &b.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	sealCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-tipChanged:
+			cancel()
+		case <-sealCtx.Done():
+		}
+	}()
+	err = bc.Engine.Seal(sealCtx, tip, b)
+	if err != nil {
+		select {
+		case <-tipChanged:
+			return nil, ErrTipChanged
+		default:
+			return nil, err
+		}
+	}
+
+	b.BlockHash = b.CalculateBlockHash()
+	log.Printf("Mined block %d\n", b.Index)
+	return b, nil
+}
+
+// GetHashRate returns the hashes per second of the last mining run, or 0 if the consensus engine doesn't hash
+func (bc *BlockChainIml) GetHashRate() float64 {
+	if hr, ok := bc.Engine.(consensus.HashRater); ok {
+		return hr.GetHashRate()
+	}
+	return 0
+}
+
+// createBlockTemplate creates the unsealed block on top of the tip of `snapshot` that MineBlock has the consensus
+// engine prepare and seal
+func (bc *BlockChainIml) createBlockTemplate(snapshot *ChainSnapshot, minerAddress string,
+	txs []*transaction.Transaction) *block.Block {
+	tip := snapshot.GetBlocks()
+	lastBlock := tip.Value
+	height := lastBlock.Index + 1
+
+	// Invalid transactions make the block invalid whatever the coinbase pays, so their fees don't matter
+	fees, err := snapshot.GetUnspentTxOuts().CalculateFees(txs)
+	if err != nil {
+		log.Println("Mining a block with invalid transactions: " + err.Error())
+		fees = 0
+	}
+	coinbase := transaction.CreateCoinbaseTransaction(minerAddress, bc.Params.GetBlockSubsidy(height)+fees, height)
+
+	// The header only encodes millisecond precision
+	timestamp := bc.Clock.Now().Truncate(time.Millisecond)
+	minTimestamp := GetMedianTimePast(tip, bc.Params.MedianTimeSpanBlocks).Add(time.Millisecond)
+	if timestamp.Before(minTimestamp) {
+		timestamp = minTimestamp
+	}
+
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{
+			Version:       block.BlockVersion,
+			Timestamp:     timestamp,
+			PrevBlockHash: lastBlock.BlockHash,
+		},
+		Transactions: append([]*transaction.Transaction{coinbase}, txs...),
+		BlockHash:    "",
+		Index:        height,
+	}
+	b.MerkleRoot = b.CalculateMerkleRoot()
+	return b
+}
+
+// getTipChanged returns a channel that is closed the next time the tip changes
+func (bc *BlockChainIml) getTipChanged() <-chan struct{} {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	if bc.tipChanged == nil {
+		bc.tipChanged = make(chan struct{})
+	}
+	return bc.tipChanged
+}
+
+// notifyTipChanged wakes up everything waiting on the channel returned by getTipChanged
+func (bc *BlockChainIml) notifyTipChanged() {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	if bc.tipChanged != nil {
+		close(bc.tipChanged)
+	}
+	bc.tipChanged = make(chan struct{})
+}
@@ -0,0 +1,155 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestBlockChain_MineBlock(t *testing.T) {
+	blockchain, _, tx := createFundedBlockChain()
+	expectedTxs := []*transaction.Transaction{tx}
+
+	minedBlock := mineNextBlock(blockchain, expectedTxs)
+
+	assert.Equal(t, expectedTxs, minedBlock.Transactions[1:], "Block should contain input transactions")
+	coinbase := minedBlock.Transactions[0]
+	assert.True(t, coinbase.IsCoinbase(), "Block should start with a coinbase transaction")
+	assert.Equal(t, testMinerAddress, coinbase.TxOuts[0].Address, "Reward should be paid to the miner")
+	assert.Equal(t, blockchain.Params.Genesis.InitialBlockReward, coinbase.TxOuts[0].Amount)
+	assert.NotEqualf(t, time.Time{}, minedBlock.Timestamp, "Timestamp should be initialized")
+	assert.Equal(t, GetGenesisBlock().BlockHash, minedBlock.PrevBlockHash,
+		"Prev block hash must equal genesis block hash")
+	assert.GreaterOrEqual(t, consensus.LeadingZeroBits(minedBlock.BlockHash), minedBlock.Difficulty,
+		"Block hash must be prefixed by leading zero bits equal to the difficulty")
+	assert.Equal(t, 1, minedBlock.Index, "Index must be 1")
+}
+
+func TestBlockChain_MineBlock_CollectsFees(t *testing.T) {
+	blockchain, w, _ := createFundedBlockChain()
+	tx := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "funding", TxOutIndex: 0}},
+		[]*transaction.TxOut{{Address: "bob", Amount: 45}},
+	)
+	_ = w.SignTransaction(tx, blockchain.GetUnspentTxOuts())
+
+	minedBlock := mineNextBlock(blockchain, []*transaction.Transaction{tx})
+
+	assert.Equal(t, blockchain.Params.Genesis.InitialBlockReward+5, minedBlock.Transactions[0].TxOuts[0].Amount,
+		"Reward should include the fee left over by the transaction")
+	assert.Nil(t, blockchain.AddBlock(minedBlock))
+	reward := blockchain.GetUnspentTxOuts()[minedBlock.Transactions[0].OutPoint(0)]
+	assert.Equal(t, blockchain.Params.Genesis.InitialBlockReward+5, reward.Amount)
+}
+
+func TestBlockChain_MineBlock_MedianTimePast(t *testing.T) {
+	blockchain := CreateBlockChainWithParams(DefaultChainParams(), clock.CreateTestClock(GetGenesisBlock().Timestamp),
+		consensus.CreateProofOfWork())
+	appendTestBlocks(blockchain, 2, time.Minute, GetGenesisBlock().Difficulty)
+
+	b := mineNextBlock(blockchain, nil)
+
+	assert.True(t, b.Timestamp.After(GetMedianTimePast(blockchain.GetBlocks(), blockchain.Params.MedianTimeSpanBlocks)),
+		"Mined block should be timestamped after the median time past even if the clock is behind")
+}
+
+func TestBlockChain_MineBlock_Workers(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		engine := consensus.CreateProofOfWork()
+		engine.Workers = workers
+		blockchain := CreateBlockChainWithParams(DefaultChainParams(), &clock.SystemClock{}, engine)
+
+		b, err := blockchain.MineBlock(context.Background(), testMinerAddress, nil)
+
+		assert.Nil(t, err)
+		assert.Nil(t, blockchain.AddBlock(b), "Block mined with %d workers should be valid", workers)
+		assert.Greater(t, blockchain.GetHashRate(), 0.0, "Hash rate should be reported")
+	}
+}
+
+func TestBlockChain_MineBlock_Cancelled(t *testing.T) {
+	blockchain := CreateBlockChain()
+	// Nothing can find a hash with this many leading zero bits
+	appendTestBlocks(blockchain, 1, time.Second, consensus.MaxDifficulty)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	b, err := blockchain.MineBlock(ctx, testMinerAddress, nil)
+
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Greater(t, blockchain.GetHashRate(), 0.0, "Hash rate should be reported for a cancelled run")
+}
+
+func TestBlockChain_MineBlock_TipChanged(t *testing.T) {
+	blockchain := CreateBlockChain()
+	appendTestBlocks(blockchain, 1, time.Second, consensus.MaxDifficulty)
+	errs := make(chan error)
+	go func() {
+		_, err := blockchain.MineBlock(context.Background(), testMinerAddress, nil)
+		errs <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	blockchain.notifyTipChanged()
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrTipChanged)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mining did not stop when the tip changed")
+	}
+}
+
+func TestBlockChain_AddBlock_NotifiesTipChanged(t *testing.T) {
+	blockchain := CreateBlockChain()
+	tipChanged := blockchain.getTipChanged()
+
+	assert.Nil(t, blockchain.AddBlock(createTestBlock(blockchain.GetBlocks(), []*transaction.Transaction{})))
+
+	select {
+	case <-tipChanged:
+	default:
+		t.Fatal("Adding a block should close the tip changed channel")
+	}
+	assert.NotEqual(t, tipChanged, blockchain.getTipChanged(), "A new channel should wait for the next change")
+}
+
+func TestBlockChain_MineBlock_ProofOfAuthority(t *testing.T) {
+	testClock := clock.CreateTestClock(GetGenesisBlock().Timestamp.Add(time.Hour))
+	w0, _ := wallet.CreateWallet()
+	w1, _ := wallet.CreateWallet()
+	validators := []string{w0.GetAddress(), w1.GetAddress()}
+	blockchain0 := CreateBlockChainWithParams(DefaultChainParams(), testClock,
+		consensus.CreateProofOfAuthority(validators, w0, time.Second, testClock))
+	blockchain1 := CreateBlockChainWithParams(DefaultChainParams(), testClock,
+		consensus.CreateProofOfAuthority(validators, w1, time.Second, testClock))
+
+	// Validator 1 is in turn for the first block
+	b, err := blockchain1.MineBlock(context.Background(), testMinerAddress, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, w1.GetAddress(), b.Signer)
+	assert.Nil(t, blockchain1.AddBlock(b))
+	assert.Nil(t, blockchain0.AddBlock(b), "Other validators should accept the block")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = blockchain1.MineBlock(ctx, testMinerAddress, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Validator should not mine out of turn")
+
+	testClock.Advance(time.Second)
+	b, err = blockchain0.MineBlock(context.Background(), testMinerAddress, nil)
+	assert.Nil(t, err)
+	unsigned := *b
+	unsigned.Signature = ""
+	assert.ErrorIs(t, blockchain1.AddBlock(&unsigned), ErrInvalidSeal)
+	assert.ErrorIs(t, blockchain1.AddBlock(&unsigned), consensus.ErrInvalidSignature)
+	assert.Nil(t, blockchain1.AddBlock(b))
+	assert.Equal(t, big.NewInt(3), blockchain1.GetCumulativeDifficulty(), "Every block should weigh the same")
+}
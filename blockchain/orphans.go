@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"sync"
+	"time"
+)
+
+// OrphanPoolConfig limits what the orphan pool holds
+type OrphanPoolConfig struct {
+	MaxOrphans int           // Once full, the oldest orphan is dropped to make room for a new one
+	Expiry     time.Duration // Orphans whose parent hasn't arrived after this long are dropped
+}
+
+// DefaultOrphanPoolConfig returns the limits used when none are configured
+func DefaultOrphanPoolConfig() *OrphanPoolConfig {
+	return &OrphanPoolConfig{
+		MaxOrphans: 100,
+		Expiry:     10 * time.Minute,
+	}
+}
+
+// orphan is a block in the orphan pool along with when it arrived
+type orphan struct {
+	Block   *block.Block
+	AddedAt time.Time
+}
+
+// OrphanPool holds blocks whose parent is not known yet until their parent arrives
+type OrphanPool struct {
+	Clock    clock.Clock
+	Config   *OrphanPoolConfig
+	orphans  map[string]*orphan
+	byParent map[string][]*orphan
+	mu       sync.Mutex
+}
+
+// CreateOrphanPool creates an empty orphan pool that tells the age of orphans with `c`
+func CreateOrphanPool(c clock.Clock, config *OrphanPoolConfig) *OrphanPool {
+	return &OrphanPool{
+		Clock:    c,
+		Config:   config,
+		orphans:  map[string]*orphan{},
+		byParent: map[string][]*orphan{},
+	}
+}
+
+// Add adds the block to the pool, dropping the oldest orphan when the pool is full. It returns false if the block is
+// already in the pool.
+func (pool *OrphanPool) Add(b *block.Block) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.evictExpired()
+	if _, exists := pool.orphans[b.BlockHash]; exists {
+		return false
+	}
+	if len(pool.orphans) >= pool.Config.MaxOrphans {
+		var oldest *orphan
+		for _, o := range pool.orphans {
+			if oldest == nil || o.AddedAt.Before(oldest.AddedAt) {
+				oldest = o
+			}
+		}
+		if oldest != nil {
+			pool.remove(oldest)
+		}
+	}
+	o := &orphan{Block: b, AddedAt: pool.Clock.Now()}
+	pool.orphans[b.BlockHash] = o
+	pool.byParent[b.PrevBlockHash] = append(pool.byParent[b.PrevBlockHash], o)
+	return true
+}
+
+// Contains checks if the block with `hash` is in the pool
+func (pool *OrphanPool) Contains(hash string) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	_, exists := pool.orphans[hash]
+	return exists
+}
+
+// Len returns the number of orphans in the pool
+func (pool *OrphanPool) Len() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.orphans)
+}
+
+// GetMissingAncestor follows the parents of `b` through the pool and returns the hash of the first one that is not in
+// it
+func (pool *OrphanPool) GetMissingAncestor(b *block.Block) string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	hash := b.PrevBlockHash
+	for o, exists := pool.orphans[hash]; exists; o, exists = pool.orphans[hash] {
+		hash = o.Block.PrevBlockHash
+	}
+	return hash
+}
+
+// TakeChildren removes the orphans whose parent is the block with `hash` from the pool and returns them in the order
+// they arrived
+func (pool *OrphanPool) TakeChildren(hash string) []*block.Block {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	children := make([]*block.Block, 0, len(pool.byParent[hash]))
+	for _, o := range pool.byParent[hash] {
+		delete(pool.orphans, o.Block.BlockHash)
+		children = append(children, o.Block)
+	}
+	delete(pool.byParent, hash)
+	return children
+}
+
+// EvictExpired drops orphans that have been in the pool longer than the configured expiry
+func (pool *OrphanPool) EvictExpired() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.evictExpired()
+}
+
+func (pool *OrphanPool) evictExpired() {
+	cutoff := pool.Clock.Now().Add(-pool.Config.Expiry)
+	for _, o := range pool.orphans {
+		if o.AddedAt.Before(cutoff) {
+			pool.remove(o)
+		}
+	}
+}
+
+// remove removes the orphan from the pool
+func (pool *OrphanPool) remove(o *orphan) {
+	delete(pool.orphans, o.Block.BlockHash)
+	siblings := pool.byParent[o.Block.PrevBlockHash]
+	for i, sibling := range siblings {
+		if sibling == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(pool.byParent, o.Block.PrevBlockHash)
+	} else {
+		pool.byParent[o.Block.PrevBlockHash] = siblings
+	}
+}
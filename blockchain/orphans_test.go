@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// createTestOrphan creates a block with `hash` whose parent is the block with `prevHash`
+func createTestOrphan(hash string, prevHash string) *block.Block {
+	return &block.Block{BlockHash: hash, BlockHeader: block.BlockHeader{PrevBlockHash: prevHash}}
+}
+
+func TestOrphanPool_Add(t *testing.T) {
+	c := clock.CreateTestClock(time.Unix(1000, 0))
+	pool := CreateOrphanPool(c, &OrphanPoolConfig{MaxOrphans: 2, Expiry: time.Minute})
+
+	assert.True(t, pool.Add(createTestOrphan("a", "genesis")))
+	assert.False(t, pool.Add(createTestOrphan("a", "genesis")), "Orphan already in the pool should not be added")
+	c.Advance(time.Second)
+	assert.True(t, pool.Add(createTestOrphan("b", "a")))
+	c.Advance(time.Second)
+	assert.True(t, pool.Add(createTestOrphan("c", "b")))
+
+	assert.Equal(t, 2, pool.Len())
+	assert.False(t, pool.Contains("a"), "Oldest orphan should be dropped when the pool is full")
+	assert.True(t, pool.Contains("b"))
+	assert.True(t, pool.Contains("c"))
+	assert.Empty(t, pool.TakeChildren("genesis"))
+}
+
+func TestOrphanPool_EvictExpired(t *testing.T) {
+	c := clock.CreateTestClock(time.Unix(1000, 0))
+	pool := CreateOrphanPool(c, &OrphanPoolConfig{MaxOrphans: 10, Expiry: time.Minute})
+	pool.Add(createTestOrphan("old", "genesis"))
+	c.Advance(time.Minute / 2)
+	pool.Add(createTestOrphan("recent", "genesis"))
+
+	c.Advance(time.Minute / 2)
+	pool.EvictExpired()
+	assert.True(t, pool.Contains("old"), "Orphan should be kept until its expiry")
+
+	c.Advance(time.Second)
+	pool.EvictExpired()
+	assert.False(t, pool.Contains("old"))
+	assert.Equal(t, []*block.Block{createTestOrphan("recent", "genesis")}, pool.TakeChildren("genesis"))
+}
+
+func TestOrphanPool_GetMissingAncestor(t *testing.T) {
+	pool := CreateOrphanPool(&clock.SystemClock{}, DefaultOrphanPoolConfig())
+	pool.Add(createTestOrphan("b", "a"))
+	pool.Add(createTestOrphan("c", "b"))
+
+	assert.Equal(t, "a", pool.GetMissingAncestor(createTestOrphan("d", "c")))
+	assert.Equal(t, "x", pool.GetMissingAncestor(createTestOrphan("y", "x")))
+}
+
+func TestOrphanPool_TakeChildren(t *testing.T) {
+	pool := CreateOrphanPool(&clock.SystemClock{}, DefaultOrphanPoolConfig())
+	first, second := createTestOrphan("b1", "a"), createTestOrphan("b2", "a")
+	pool.Add(first)
+	pool.Add(second)
+	pool.Add(createTestOrphan("c", "b1"))
+
+	assert.Equal(t, []*block.Block{first, second}, pool.TakeChildren("a"))
+	assert.Empty(t, pool.TakeChildren("a"), "Children should be removed from the pool")
+	assert.Equal(t, 1, pool.Len())
+}
+
+func TestBlockChain_AddBlock_Orphans(t *testing.T) {
+	blockchain := CreateBlockChain()
+	blocks := createTestBranch(blockchain, 3)
+
+	assert.ErrorIs(t, blockchain.AddBlock(blocks[2]), ErrUnknownParent)
+	assert.ErrorIs(t, blockchain.AddBlock(blocks[1]), ErrUnknownParent)
+	assert.Equal(t, blocks[0].BlockHash, blockchain.GetMissingAncestor(blocks[2]),
+		"Missing ancestor should be found through the orphans")
+	assert.Equal(t, GetGenesisBlock(), blockchain.GetLatestBlock())
+
+	assert.Nil(t, blockchain.AddBlock(blocks[0]))
+
+	assert.Equal(t, blocks[2], blockchain.GetLatestBlock(), "Orphans should be added once their parent is")
+	assert.Equal(t, 0, blockchain.Orphans.Len())
+
+	forged := createTestBlock(blockchain.GetBlocks(), nil)
+	forged.PrevBlockHash = "unknown"
+	assert.ErrorIs(t, blockchain.AddBlock(forged), ErrInvalidBlockHash,
+		"Blocks with an invalid hash should not be kept as orphans")
+	assert.Equal(t, 0, blockchain.Orphans.Len())
+}
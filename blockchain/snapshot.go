@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/transaction"
+	"math/big"
+)
+
+// ChainSnapshot is an immutable view of the main chain at one tip. Readers get the latest snapshot without waiting for
+// the writer, and every lookup on a snapshot sees the same chain however far the tip has moved on since.
+type ChainSnapshot struct {
+	tip           *treeNode
+	mainChain     []*treeNode // Blocks of the tip's branch indexed by height
+	unspentTxOuts *transaction.UnspentTxOutView
+}
+
+// createChainSnapshot creates the snapshot of a chain holding only its genesis block
+func createChainSnapshot(genesis *treeNode, unspent *transaction.UnspentTxOutView) *ChainSnapshot {
+	return &ChainSnapshot{
+		tip:           genesis,
+		mainChain:     []*treeNode{genesis},
+		unspentTxOuts: unspent,
+	}
+}
+
+// next returns the snapshot of the chain once the tip moved to `tip`, whose block leaves `unspent` outputs. Only the
+// blocks above the fork point with the main chain of this snapshot are visited, so extending the tip costs O(1) and a
+// reorganization costs O(depth). The height index is shared with this snapshot while the tip is only extended, since
+// appending never changes the heights this snapshot can see, and copied when a reorganization replaces some of them.
+func (s *ChainSnapshot) next(tip *treeNode, unspent *transaction.UnspentTxOutView) *ChainSnapshot {
+	var branch []*treeNode
+	node := tip
+	for ; !s.isOnMainChain(node); node = node.Parent {
+		branch = append(branch, node)
+	}
+	height := node.List.Value.Index + 1
+	mainChain := s.mainChain
+	if height < len(mainChain) {
+		mainChain = append(make([]*treeNode, 0, height+len(branch)), s.mainChain[:height]...)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		mainChain = append(mainChain, branch[i])
+	}
+	return &ChainSnapshot{
+		tip:           tip,
+		mainChain:     mainChain,
+		unspentTxOuts: unspent,
+	}
+}
+
+// isOnMainChain checks if `node` is in the height index
+func (s *ChainSnapshot) isOnMainChain(node *treeNode) bool {
+	height := node.List.Value.Index
+	return height < len(s.mainChain) && s.mainChain[height] == node
+}
+
+// GetLatestBlock returns the tip
+func (s *ChainSnapshot) GetLatestBlock() *block.Block {
+	return s.tip.List.Value
+}
+
+// GetBlocks returns the tip as the end of its branch, so the main chain can be walked back to the genesis block
+func (s *ChainSnapshot) GetBlocks() *SafeDoublyLinkedBlockList {
+	return s.tip.List
+}
+
+// GetBlockByHeight returns the block at `height` on the main chain, or nil if the chain is not that long
+func (s *ChainSnapshot) GetBlockByHeight(height int) *block.Block {
+	if height < 0 || height >= len(s.mainChain) {
+		return nil
+	}
+	return s.mainChain[height].List.Value
+}
+
+// GetRange returns the blocks of the main chain from height `start` up to but not including height `end`, first block
+// first. The range is clipped to the heights the chain has.
+func (s *ChainSnapshot) GetRange(start int, end int) []*block.Block {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s.mainChain) {
+		end = len(s.mainChain)
+	}
+	if start >= end {
+		return []*block.Block{}
+	}
+	blocks := make([]*block.Block, end-start)
+	for i, node := range s.mainChain[start:end] {
+		blocks[i] = node.List.Value
+	}
+	return blocks
+}
+
+// GetUnspentTxOuts returns the set of outputs that can be spent by the block after the tip. The set is flattened from
+// the view of the tip the first time it is asked for, and is shared by every reader of the snapshot, so it must not be
+// modified.
+func (s *ChainSnapshot) GetUnspentTxOuts() transaction.UnspentTxOutSet {
+	return s.unspentTxOuts.Flatten()
+}
+
+// GetUnspentTxOutView returns the view of the outputs that can be spent by the block after the tip, which can be
+// extended without copying the outputs
+func (s *ChainSnapshot) GetUnspentTxOutView() *transaction.UnspentTxOutView {
+	return s.unspentTxOuts
+}
+
+// GetCumulativeDifficulty returns the total work of every block in the chain as weighed by the consensus engine
+func (s *ChainSnapshot) GetCumulativeDifficulty() *big.Int {
+	return new(big.Int).Set(s.tip.Work)
+}
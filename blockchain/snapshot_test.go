@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestChainSnapshot_Reorg(t *testing.T) {
+	blockchain := CreateBlockChain()
+	a1 := mineNextBlock(blockchain, nil)
+	assert.Nil(t, blockchain.AddBlock(a1))
+	snapshot := blockchain.Snapshot()
+	unspent := snapshot.GetUnspentTxOuts()
+
+	branch := createTestBranch(CreateBlockChain(), 2)
+	assert.Nil(t, blockchain.ReplaceChain(append([]*block.Block{GetGenesisBlock()}, branch...)))
+
+	assert.Equal(t, a1, snapshot.GetLatestBlock(), "Snapshot should keep the tip it was taken at")
+	assert.Equal(t, a1, snapshot.GetBlockByHeight(1), "Reorganizing should not change the heights of a snapshot")
+	assert.Nil(t, snapshot.GetBlockByHeight(2))
+	assert.Equal(t, []*block.Block{GetGenesisBlock(), a1}, snapshot.GetRange(0, 10))
+	assert.Equal(t, unspent, snapshot.GetUnspentTxOuts())
+
+	latest := blockchain.Snapshot()
+	assert.Equal(t, branch[1], latest.GetLatestBlock())
+	assert.Equal(t, append([]*block.Block{GetGenesisBlock()}, branch...), latest.GetRange(0, 10))
+	assert.Equal(t, latest.GetBlocks().ToSlice(), latest.GetRange(0, 10))
+}
+
+func TestChainSnapshot_Extend(t *testing.T) {
+	blockchain := CreateBlockChain()
+	snapshot := blockchain.Snapshot()
+	blocks := createTestBranch(blockchain, 2)
+	for _, b := range blocks {
+		assert.Nil(t, blockchain.AddBlock(b))
+	}
+
+	assert.Equal(t, []*block.Block{GetGenesisBlock()}, snapshot.GetRange(0, 10),
+		"Extending the tip should not change a snapshot")
+	assert.Equal(t, blocks[1], blockchain.Snapshot().GetBlockByHeight(2))
+}
+
+func TestBlockChain_ConcurrentAccess(t *testing.T) {
+	blockchain := CreateBlockChain()
+	done := make(chan struct{})
+	var writers, readers sync.WaitGroup
+
+	// A miner extends the tip while a peer sends a competing chain
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; i < 10; i++ {
+			b := mineNextBlock(blockchain, nil)
+			if b != nil {
+				_ = blockchain.AddBlock(b)
+			}
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		branch := createTestBranch(CreateBlockChain(), 12)
+		_ = blockchain.ReplaceChain(append([]*block.Block{GetGenesisBlock()}, branch...))
+	}()
+
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := blockchain.Snapshot()
+				latest := snapshot.GetLatestBlock()
+				blocks := snapshot.GetRange(0, latest.Index+1)
+				assert.Len(t, blocks, latest.Index+1, "Snapshot should hold every block up to its tip")
+				assert.Equal(t, latest, blocks[len(blocks)-1])
+				for j := 1; j < len(blocks); j++ {
+					assert.Equal(t, blocks[j-1].BlockHash, blocks[j].PrevBlockHash, "Snapshot should hold one branch")
+				}
+				assert.NotNil(t, blockchain.GetBlockByHash(latest.BlockHash))
+				_ = snapshot.GetUnspentTxOuts().FindByAddress(testMinerAddress)
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	assert.Equal(t, blockchain.GetBlocks().ToSlice(), blockchain.GetRange(0, blockchain.GetLatestBlock().Index+1))
+}
@@ -0,0 +1,193 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/transaction"
+	"sort"
+	"time"
+)
+
+// The consensus rules a block can break. A BlockValidationError wraps one of these.
+var (
+	ErrInvalidGenesisBlock = errors.New("invalid genesis block")
+	ErrInvalidVersion      = errors.New("unsupported block version")
+	ErrInvalidIndex        = errors.New("invalid block index")
+	ErrInvalidPrevHash     = errors.New("invalid prev block hash")
+	ErrInvalidHeader       = errors.New("malformed block header")
+	ErrInvalidBlockHash    = errors.New("invalid block hash")
+	ErrInvalidSeal         = errors.New("block header rejected by the consensus engine")
+	ErrInvalidTimestamp    = errors.New("invalid block timestamp")
+	ErrInvalidMerkleRoot   = errors.New("invalid merkle root")
+	ErrInvalidTransactions = errors.New("invalid transactions")
+	ErrInvalidReward       = errors.New("coinbase pays more than the block subsidy plus fees")
+	ErrNotEnoughWork       = errors.New("chain does not have more cumulative difficulty")
+	ErrFinalized           = errors.New("chain does not contain the finalized tip")
+)
+
+// BlockValidationError reports the block that failed validation and the rule it broke. errors.Is matches both the
+// rule and the cause.
+type BlockValidationError struct {
+	Index     int
+	BlockHash string
+	Rule      error // One of the rule errors above
+	Cause     error // What caused the rule to be broken, if known
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.Cause == nil {
+		return fmt.Sprintf("block %d %s: %s", e.Index, e.BlockHash, e.Rule.Error())
+	}
+	return fmt.Sprintf("block %d %s: %s: %s", e.Index, e.BlockHash, e.Rule.Error(), e.Cause.Error())
+}
+
+func (e *BlockValidationError) Is(target error) bool {
+	return target == e.Rule
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Cause
+}
+
+func newBlockValidationError(b *block.Block, rule error, cause error) *BlockValidationError {
+	return &BlockValidationError{Index: b.Index, BlockHash: b.BlockHash, Rule: rule, Cause: cause}
+}
+
+// GetMedianTimePast returns the median timestamp of the last `span` blocks up to and including `tip`
+func GetMedianTimePast(tip *SafeDoublyLinkedBlockList, span int) time.Time {
+	timestamps := make([]time.Time, 0, span)
+	for node := tip; node != nil && len(timestamps) < span; node = node.Prev {
+		timestamps = append(timestamps, node.Value.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i].Before(timestamps[j])
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// IsNewBlockValid Checks if a new block is valid to go on the end of the chain ending at `prev`. `unspent` is the set
+// of outputs the transactions in the block are allowed to spend. The returned error is a *BlockValidationError
+// wrapping the rule that was broken.
+func (bc *BlockChainIml) IsNewBlockValid(newBlock *block.Block, prev *SafeDoublyLinkedBlockList,
+	unspent transaction.UnspentTxOutSet) (bool, error) {
+	return bc.isNewBlockValid(newBlock, prev, transaction.CreateUnspentTxOutView(unspent), true)
+}
+
+// ValidateProposal Checks if a block proposed to the validators is valid on top of the tip. The header is not checked
+// by the consensus engine, since it is only sealed once the validators agree on the block.
+func (bc *BlockChainIml) ValidateProposal(b *block.Block) error {
+	snapshot := bc.Snapshot()
+	_, err := bc.isNewBlockValid(b, snapshot.GetBlocks(), snapshot.GetUnspentTxOutView(), false)
+	return err
+}
+
+// isNewBlockValid checks the block against every rule of IsNewBlockValid, leaving out the seal unless `verifySeal`
+func (bc *BlockChainIml) isNewBlockValid(newBlock *block.Block, prev *SafeDoublyLinkedBlockList,
+	unspent *transaction.UnspentTxOutView, verifySeal bool) (bool, error) {
+	err := bc.validateBlock(newBlock, prev, verifySeal)
+	if err != nil {
+		return false, err
+	}
+	_, err = bc.validateTransactions(newBlock, unspent)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// validateBlock checks the rules of IsNewBlockValid that don't depend on the outputs the transactions spend, so
+// blocks on side branches can be checked before their transactions can be
+func (bc *BlockChainIml) validateBlock(newBlock *block.Block, prev *SafeDoublyLinkedBlockList, verifySeal bool) error {
+	if err := bc.validateHeader(newBlock, prev, verifySeal); err != nil {
+		return err
+	} else if newBlock.MerkleRoot != newBlock.CalculateMerkleRoot() {
+		return newBlockValidationError(newBlock, ErrInvalidMerkleRoot, nil)
+	}
+	return nil
+}
+
+// validateHeader checks the rules of IsNewBlockValid that only depend on the header, so headers can be checked before
+// the transactions of their blocks are downloaded
+func (bc *BlockChainIml) validateHeader(newBlock *block.Block, prev *SafeDoublyLinkedBlockList,
+	verifySeal bool) error {
+	prevBlock := prev.Value
+	if newBlock.Version != block.BlockVersion {
+		return newBlockValidationError(newBlock, ErrInvalidVersion, nil)
+	} else if newBlock.Index != prevBlock.Index+1 {
+		return newBlockValidationError(newBlock, ErrInvalidIndex, nil)
+	} else if newBlock.PrevBlockHash != prevBlock.BlockHash {
+		return newBlockValidationError(newBlock, ErrInvalidPrevHash, nil)
+	} else if _, err := newBlock.BlockHeader.MarshalBinary(); err != nil {
+		return newBlockValidationError(newBlock, ErrInvalidHeader, err)
+	} else if newBlock.BlockHash != newBlock.CalculateBlockHash() {
+		return newBlockValidationError(newBlock, ErrInvalidBlockHash, nil)
+	} else if err := bc.verifySeal(newBlock, prev, verifySeal); err != nil {
+		return newBlockValidationError(newBlock, ErrInvalidSeal, err)
+	} else if !newBlock.Timestamp.After(GetMedianTimePast(prev, bc.Params.MedianTimeSpanBlocks)) {
+		return newBlockValidationError(newBlock, ErrInvalidTimestamp,
+			errors.New("timestamp is not after the median time of the previous blocks"))
+	} else if newBlock.Timestamp.After(bc.Clock.Now().Add(bc.Params.MaxFutureBlockTime)) {
+		return newBlockValidationError(newBlock, ErrInvalidTimestamp,
+			errors.New("timestamp is too far in the future"))
+	}
+	return nil
+}
+
+// validateTransactions checks the transactions of the block against the outputs they can spend and the coinbase
+// against the block subsidy, and returns the outputs after the transactions are applied
+func (bc *BlockChainIml) validateTransactions(newBlock *block.Block,
+	unspent *transaction.UnspentTxOutView) (*transaction.UnspentTxOutView, error) {
+	updated, fees, err := unspent.ApplyBlockTransactions(newBlock.Transactions, newBlock.Index)
+	if err != nil {
+		return nil, newBlockValidationError(newBlock, ErrInvalidTransactions, err)
+	}
+	maxReward := bc.Params.GetBlockSubsidy(newBlock.Index) + fees
+	if reward := newBlock.Transactions[0].TxOuts[0].Amount; reward > maxReward {
+		return nil, newBlockValidationError(newBlock, ErrInvalidReward,
+			fmt.Errorf("coinbase pays %d, at most %d allowed", reward, maxReward))
+	}
+	return updated, nil
+}
+
+// verifySeal checks the header of the block with the consensus engine if `verify` is set
+func (bc *BlockChainIml) verifySeal(newBlock *block.Block, prev *SafeDoublyLinkedBlockList, verify bool) error {
+	if !verify {
+		return nil
+	}
+	return bc.Engine.VerifyHeader(prev, &newBlock.BlockHeader)
+}
+
+// IsValidGenesisBlock checks that `b` is the genesis block of the chain
+func (bc *BlockChainIml) IsValidGenesisBlock(b *block.Block) bool {
+	return b.BlockHash == bc.genesis.BlockHash
+}
+
+// IsValidBlockChain checks every block in `chain` against the same rules as IsNewBlockValid
+func (bc *BlockChainIml) IsValidBlockChain(chain BlockChain) bool {
+	_, err := bc.validateBlocks(chain.GetBlocks().ToSlice())
+	return err == nil
+}
+
+// validateBlocks validates every block in the chain starting from genesis and returns the resulting unspent outputs
+func (bc *BlockChainIml) validateBlocks(blocks []*block.Block) (*transaction.UnspentTxOutView, error) {
+	// First block should be genesis block
+	if len(blocks) == 0 || blocks[0] == nil || !bc.IsValidGenesisBlock(blocks[0]) {
+		return nil, ErrInvalidGenesisBlock
+	}
+	validated := &SafeDoublyLinkedBlockList{Value: blocks[0]}
+	unspent := transaction.CreateUnspentTxOutView(
+		transaction.UnspentTxOutSet{}.ApplyGenesisTransactions(blocks[0].Transactions))
+	for _, b := range blocks[1:] {
+		err := bc.validateBlock(b, validated, true)
+		if err != nil {
+			return nil, err
+		}
+		unspent, err = bc.validateTransactions(b, unspent)
+		if err != nil {
+			return nil, err
+		}
+		validated = validated.Add(b)
+	}
+	return unspent, nil
+}
@@ -0,0 +1,287 @@
+package blockchain
+
+import (
+	"errors"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsNewBlockValid(t *testing.T) {
+	blockchain := CreateBlockChainWithParams(DefaultChainParams(), clock.CreateTestClock(GetGenesisBlock().Timestamp),
+		consensus.CreateProofOfWork())
+	prev := blockchain.GetBlocks()
+
+	newBlock := createTestBlock(prev, []*transaction.Transaction{})
+	valid, err := blockchain.IsNewBlockValid(newBlock, prev, transaction.UnspentTxOutSet{})
+	assert.True(t, valid, "New block should be valid")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name         string
+		modify       func(b *block.Block)
+		remine       bool
+		expectedRule error
+	}{
+		{"unsupported version", func(b *block.Block) { b.Version = 2 }, true, ErrInvalidVersion},
+		{"invalid index", func(b *block.Block) { b.Index = 42 }, false, ErrInvalidIndex},
+		{"invalid prev hash", func(b *block.Block) { b.PrevBlockHash = strings.Repeat("1", 64) }, true,
+			ErrInvalidPrevHash},
+		{"malformed header", func(b *block.Block) { b.MerkleRoot = "invalid root" }, false, ErrInvalidHeader},
+		{"invalid hash", func(b *block.Block) { b.BlockHash = strings.Repeat("0", 64) }, false,
+			ErrInvalidBlockHash},
+		{"hash does not meet difficulty", func(b *block.Block) {
+			for consensus.IsHashValid(b.BlockHash, b.Difficulty) {
+				b.Nonce++
+				b.BlockHash = b.CalculateBlockHash()
+			}
+		}, false, consensus.ErrInsufficientWork},
+		{"difficulty too low", func(b *block.Block) { b.Difficulty = 0 }, true, consensus.ErrInvalidDifficulty},
+		{"difficulty too high", func(b *block.Block) { b.Difficulty = 5 }, true, consensus.ErrInvalidDifficulty},
+		{"timestamp before prev block", func(b *block.Block) { b.Timestamp = prev.Value.Timestamp.Add(-time.Second) },
+			true, ErrInvalidTimestamp},
+		{"timestamp equal to median time past", func(b *block.Block) { b.Timestamp = prev.Value.Timestamp }, true,
+			ErrInvalidTimestamp},
+		{"timestamp too far in the future", func(b *block.Block) {
+			b.Timestamp = blockchain.Clock.Now().Add(blockchain.Params.MaxFutureBlockTime + time.Millisecond)
+		}, true, ErrInvalidTimestamp},
+		{"invalid merkle root", func(b *block.Block) { b.MerkleRoot = strings.Repeat("0", 64) }, true,
+			ErrInvalidMerkleRoot},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := createTestBlock(prev, []*transaction.Transaction{})
+			test.modify(b)
+			if test.remine {
+				mineTestBlock(b)
+			}
+
+			valid, err := blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+
+			assert.False(t, valid)
+			assert.ErrorIs(t, err, test.expectedRule)
+			var validationErr *BlockValidationError
+			assert.True(t, errors.As(err, &validationErr), "Error should be a BlockValidationError")
+			assert.Equal(t, b.Index, validationErr.Index)
+		})
+	}
+}
+
+func TestIsNewBlockValid_Transactions(t *testing.T) {
+	blockchain, w, tx := createFundedBlockChain()
+	prev := blockchain.GetBlocks()
+	unspent := blockchain.GetUnspentTxOuts()
+
+	valid, err := blockchain.IsNewBlockValid(createTestBlock(prev, []*transaction.Transaction{tx}), prev, unspent)
+	assert.True(t, valid, "Block spending an unspent output should be valid")
+	assert.Nil(t, err)
+
+	doubleSpend, _ := w.CreateTransaction("carol", 50, unspent)
+	valid, err = blockchain.IsNewBlockValid(createTestBlock(prev, []*transaction.Transaction{tx, doubleSpend}), prev, unspent)
+	assert.False(t, valid, "Block spending the same output twice should be invalid")
+	assert.ErrorIs(t, err, ErrInvalidTransactions)
+	assert.ErrorIs(t, err, transaction.ErrDoubleSpend)
+
+	missing := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "missing", TxOutIndex: 0}},
+		[]*transaction.TxOut{{Address: "carol", Amount: 50}},
+	)
+	valid, err = blockchain.IsNewBlockValid(createTestBlock(prev, []*transaction.Transaction{missing}), prev, unspent)
+	assert.False(t, valid, "Block spending a missing output should be invalid")
+	assert.ErrorIs(t, err, transaction.ErrMissingTxOut)
+
+	unsigned := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "funding", TxOutIndex: 0}},
+		[]*transaction.TxOut{{Address: "carol", Amount: 50}},
+	)
+	valid, err = blockchain.IsNewBlockValid(createTestBlock(prev, []*transaction.Transaction{unsigned}), prev, unspent)
+	assert.False(t, valid, "Block spending an output without the owner's signature should be invalid")
+	assert.ErrorIs(t, err, transaction.ErrInvalidSignature)
+
+	thief, _ := wallet.CreateWallet()
+	_ = thief.SignTransaction(unsigned, transaction.UnspentTxOutSet{
+		unsigned.TxIns[0].OutPoint(): {Address: thief.GetAddress()},
+	})
+	valid, err = blockchain.IsNewBlockValid(createTestBlock(prev, []*transaction.Transaction{unsigned}), prev, unspent)
+	assert.False(t, valid, "Block spending an output signed by another key should be invalid")
+	assert.ErrorIs(t, err, transaction.ErrInvalidSignature)
+}
+
+func TestIsNewBlockValid_Coinbase(t *testing.T) {
+	blockchain := CreateBlockChain()
+	prev := blockchain.GetBlocks()
+	subsidy := blockchain.Params.GetBlockSubsidy(1)
+	tests := []struct {
+		name          string
+		txs           []*transaction.Transaction
+		expectedRule  error
+		expectedCause error
+	}{
+		{"missing coinbase", []*transaction.Transaction{}, ErrInvalidTransactions, transaction.ErrMissingCoinbase},
+		{"coinbase for another height",
+			[]*transaction.Transaction{transaction.CreateCoinbaseTransaction(testMinerAddress, subsidy, 2)},
+			ErrInvalidTransactions, transaction.ErrInvalidCoinbase},
+		{"reward above subsidy",
+			[]*transaction.Transaction{transaction.CreateCoinbaseTransaction(testMinerAddress, subsidy+1, 1)},
+			ErrInvalidReward, nil},
+		{"second coinbase", []*transaction.Transaction{
+			transaction.CreateCoinbaseTransaction(testMinerAddress, subsidy, 1),
+			transaction.CreateCoinbaseTransaction("thief", subsidy, 1),
+		}, ErrInvalidTransactions, transaction.ErrMissingTxOut},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := createTestBlock(prev, []*transaction.Transaction{})
+			b.Transactions = test.txs
+			b.MerkleRoot = b.CalculateMerkleRoot()
+			mineTestBlock(b)
+
+			valid, err := blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+
+			assert.False(t, valid)
+			assert.ErrorIs(t, err, test.expectedRule)
+			if test.expectedCause != nil {
+				assert.ErrorIs(t, err, test.expectedCause)
+			}
+		})
+	}
+
+	// Claiming less than allowed is fine
+	b := createTestBlock(prev, []*transaction.Transaction{})
+	b.Transactions = []*transaction.Transaction{transaction.CreateCoinbaseTransaction(testMinerAddress, 1, 1)}
+	b.MerkleRoot = b.CalculateMerkleRoot()
+	mineTestBlock(b)
+	valid, err := blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.True(t, valid, "Coinbase claiming less than the subsidy should be valid")
+	assert.Nil(t, err)
+}
+
+func TestIsNewBlockValid_MedianTimePast(t *testing.T) {
+	params := DefaultChainParams()
+	blockchain := CreateBlockChainWithParams(params, clock.CreateTestClock(GetGenesisBlock().Timestamp.Add(time.Hour)),
+		consensus.CreateProofOfWork())
+	appendTestBlocks(blockchain, params.MedianTimeSpanBlocks-1, time.Second, GetGenesisBlock().Difficulty)
+	prev := blockchain.GetBlocks()
+	medianTimePast := GetGenesisBlock().Timestamp.Add(time.Duration(params.MedianTimeSpanBlocks/2) * time.Second)
+	assert.Equal(t, medianTimePast, GetMedianTimePast(prev, params.MedianTimeSpanBlocks))
+
+	// A block before its parent is still accepted as long as it is after the median time past
+	b := createTestBlock(prev, []*transaction.Transaction{})
+	b.Timestamp = medianTimePast.Add(time.Millisecond)
+	mineTestBlock(b)
+	valid, err := blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.True(t, valid, "Block after the median time past should be valid")
+	assert.Nil(t, err)
+
+	b.Timestamp = medianTimePast
+	mineTestBlock(b)
+	valid, err = blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.False(t, valid, "Block at the median time past should be invalid")
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+}
+
+func TestIsNewBlockValid_FutureDrift(t *testing.T) {
+	params := DefaultChainParams()
+	params.MaxFutureBlockTime = 10 * time.Second
+	testClock := clock.CreateTestClock(GetGenesisBlock().Timestamp)
+	blockchain := CreateBlockChainWithParams(params, testClock, consensus.CreateProofOfWork())
+	prev := blockchain.GetBlocks()
+
+	b := createTestBlock(prev, []*transaction.Transaction{})
+	b.Timestamp = testClock.Now().Add(params.MaxFutureBlockTime)
+	mineTestBlock(b)
+	valid, err := blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.True(t, valid, "Block at the drift limit should be valid")
+	assert.Nil(t, err)
+
+	b.Timestamp = b.Timestamp.Add(time.Millisecond)
+	mineTestBlock(b)
+	valid, err = blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.False(t, valid, "Block beyond the drift limit should be invalid")
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	// The same block becomes valid once the node's clock catches up
+	testClock.Advance(time.Second)
+	valid, err = blockchain.IsNewBlockValid(b, prev, transaction.UnspentTxOutSet{})
+	assert.True(t, valid, "Block should be valid once it is within the drift limit")
+	assert.Nil(t, err)
+}
+
+func TestGetMedianTimePast(t *testing.T) {
+	blockchain := CreateBlockChain()
+	genesisTime := GetGenesisBlock().Timestamp
+	assert.Equal(t, genesisTime, GetMedianTimePast(blockchain.GetBlocks(), 11), "A lone block is its own median")
+
+	appendTestBlocks(blockchain, 2, time.Second, 1)
+	blockchain.GetBlocks().Prev.Value.Timestamp = genesisTime.Add(10 * time.Second)
+	assert.Equal(t, genesisTime.Add(2*time.Second), GetMedianTimePast(blockchain.GetBlocks(), 11),
+		"Median should be taken over sorted timestamps")
+	assert.Equal(t, genesisTime.Add(10*time.Second), GetMedianTimePast(blockchain.GetBlocks(), 2),
+		"Only the last `span` blocks should be used")
+}
+
+func TestBlockChain_IsValidGenesisBlock(t *testing.T) {
+	blockchain := CreateBlockChain()
+	assert.True(t, blockchain.IsValidGenesisBlock(GetGenesisBlock()))
+
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Now(),
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    4,
+		},
+		Transactions: []*transaction.Transaction{},
+		BlockHash:    "abc",
+		Index:        1,
+	}
+	assert.False(t, blockchain.IsValidGenesisBlock(b))
+	params := DefaultChainParams()
+	params.Genesis.ChainId = "other"
+	assert.False(t, blockchain.IsValidGenesisBlock(params.Genesis.CreateBlock()),
+		"Genesis block of another chain should not be valid")
+}
+
+func TestIsValidBlockChain(t *testing.T) {
+	blockchain := CreateBlockChain()
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, nil))
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, nil))
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, nil))
+
+	assert.True(t, blockchain.IsValidBlockChain(blockchain))
+
+	// Tamper with blockchain data
+	blockchain.GetBlocks().Prev.Value.Transactions = []*transaction.Transaction{transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: "fake!", TxOutIndex: 0}}, []*transaction.TxOut{{Address: "fake!", Amount: 1}})}
+	assert.False(t, blockchain.IsValidBlockChain(blockchain))
+
+	// The same rules as for new blocks apply to every block in the chain
+	blockchain = CreateBlockChain()
+	_ = blockchain.AddBlock(mineNextBlock(blockchain, nil))
+	lowDifficulty := createTestBlock(blockchain.GetBlocks(), []*transaction.Transaction{})
+	lowDifficulty.Difficulty = consensus.MinDifficulty
+	mineTestBlock(lowDifficulty)
+	appendUnvalidatedBlock(blockchain, lowDifficulty)
+	assert.False(t, blockchain.IsValidBlockChain(blockchain))
+}
+
+func TestBlockChain_ValidateProposal(t *testing.T) {
+	w, _ := wallet.CreateWallet()
+	engine := consensus.CreateBFT(DefaultGenesis().ChainId, []string{w.GetAddress()}, w, nil, time.Second)
+	blockchain := CreateBlockChainWithParams(DefaultChainParams(), &clock.SystemClock{}, engine)
+	proposal := createTestBlock(blockchain.GetBlocks(), nil)
+
+	assert.Nil(t, blockchain.ValidateProposal(proposal), "Proposal should be valid before it is committed")
+	assert.ErrorIs(t, blockchain.AddBlock(proposal), consensus.ErrMissingCommit,
+		"Block should not be added before it is committed")
+
+	proposal.PrevBlockHash = strings.Repeat("1", 64)
+	proposal.BlockHash = proposal.CalculateBlockHash()
+	assert.ErrorIs(t, blockchain.ValidateProposal(proposal), ErrInvalidPrevHash)
+}
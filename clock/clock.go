@@ -0,0 +1,50 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Code that depends on the time takes a Clock so tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock that reads the system time
+type SystemClock struct {
+}
+
+func (c *SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// TestClock is a Clock that only moves when it is told to. It is safe for concurrent use.
+type TestClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+// CreateTestClock creates a TestClock stopped at `now`
+func CreateTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to `now`
+func (c *TestClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by `d`
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,25 @@
+package clock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSystemClock_Now(t *testing.T) {
+	c := &SystemClock{}
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+}
+
+func TestTestClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := CreateTestClock(start)
+	assert.Equal(t, start, c.Now())
+	assert.Equal(t, start, c.Now(), "Clock should not move on its own")
+
+	c.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), c.Now())
+
+	c.Set(start)
+	assert.Equal(t, start, c.Now())
+}
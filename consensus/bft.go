@@ -0,0 +1,568 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/wallet"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingCommit      = errors.New("header has no commit")
+	ErrInsufficientCommit = errors.New("commit is not signed by enough validators")
+	ErrInvalidMessage     = errors.New("invalid consensus message")
+)
+
+// BFTMessageType is the kind of message validators exchange in a round
+type BFTMessageType int
+
+const (
+	PROPOSAL  BFTMessageType = iota // A block proposed by the proposer of the round
+	PREVOTE                         // A validator's vote for the proposed block, or for nothing
+	PRECOMMIT                       // A validator's vote to finalize the block 2f+1 validators prevoted for
+)
+
+// BFTMessage is a proposal or vote signed by a validator. A vote with an empty BlockHash is a vote for nothing.
+type BFTMessage struct {
+	Type       BFTMessageType
+	Height     int
+	Round      int
+	BlockHash  string
+	Block      *block.Block `json:",omitempty"` // The proposed block
+	ValidRound int          // Round the proposed block got 2f+1 prevotes in, or -1 if it hasn't
+	Validator  string
+	Signature  string
+}
+
+// signedData returns what the validator signs for the chain with `chainId`. A precommit signs the same data a Commit is
+// verified against. The chain id keeps the messages and commits of one chain from verifying on another chain with the
+// same validators.
+func (msg *BFTMessage) signedData(chainId string) []byte {
+	data := fmt.Sprintf("%s/%d/%d/%d/%s", chainId, msg.Type, msg.Height, msg.Round, msg.BlockHash)
+	if msg.Type == PROPOSAL {
+		data += fmt.Sprintf("/%d", msg.ValidRound)
+	}
+	return []byte(data)
+}
+
+// BFTTransport sends messages to the other validators
+type BFTTransport interface {
+	Broadcast(msg *BFTMessage)
+}
+
+// BFTMessageHandler handles the messages received from other validators
+type BFTMessageHandler interface {
+	HandleMessage(msg *BFTMessage) error
+}
+
+// BFTChain is the chain a BFT engine finalizes blocks on
+type BFTChain interface {
+	GetLatestBlock() *block.Block
+	// ValidateProposal checks that a block proposed on top of the tip is valid apart from the commit finalizing it
+	ValidateProposal(b *block.Block) error
+	AddBlock(b *block.Block) error
+}
+
+// bftStep is the step of the round a validator is in
+type bftStep int
+
+const (
+	stepPropose bftStep = iota
+	stepPrevote
+	stepPrecommit
+)
+
+// voteKey identifies the votes of one type in one round
+type voteKey struct {
+	Type  BFTMessageType
+	Round int
+}
+
+// BFT finalizes blocks with rounds of propose, prevote and precommit among a fixed set of validators, tolerating f
+// faulty validators out of 3f+1. A block is final once 2f+1 validators precommit it, so the chain is never
+// reorganized. Finalized blocks are added to Chain by the engine. Seal only offers a block for the engine to propose,
+// and stops when a block is finalized and changes the tip.
+type BFT struct {
+	ChainId    string         // Id of the chain the messages and commits of the validators are signed for
+	Validators []string       // Addresses of the validators. The proposer of a round is picked from them in turn.
+	Wallet     *wallet.Wallet // Signs the messages of this validator. Nodes that only verify headers don't need one.
+	Chain      BFTChain       // Must be set before Start
+	Transport  BFTTransport
+	Timeout    time.Duration // How long a step waits for messages in the first round. Grows by as much every round.
+	// OnFinalized is called with every block the engine adds to the chain
+	OnFinalized func(b *block.Block)
+
+	running     bool
+	height      int
+	round       int
+	step        bftStep
+	lockedBlock *block.Block
+	lockedRound int
+	validBlock  *block.Block
+	validRound  int
+	polkaSeen   bool // 2f+1 prevotes for the proposal of the round were seen
+	timeouts    map[voteKey]bool
+	proposals   map[int]*BFTMessage
+	votes       map[voteKey]map[string]*BFTMessage
+	validity    map[string]error // Result of validating each proposed block of the height
+	candidate   *block.Block     // Block offered by Seal
+	future      []*BFTMessage    // Messages for the height after the current one
+	outbox      []*BFTMessage
+	finalized   []*block.Block
+	mu          sync.Mutex
+}
+
+// CreateBFT creates a stopped BFT engine for `validators` of the chain with `chainId` that signs with `w` and sends
+// messages with `transport`
+func CreateBFT(chainId string, validators []string, w *wallet.Wallet, transport BFTTransport,
+	timeout time.Duration) *BFT {
+	return &BFT{
+		ChainId:    chainId,
+		Validators: validators,
+		Wallet:     w,
+		Transport:  transport,
+		Timeout:    timeout,
+	}
+}
+
+// quorum returns the number of validators that must agree, which is 2f+1 of 3f+1
+func (bft *BFT) quorum() int {
+	return len(bft.Validators)*2/3 + 1
+}
+
+// getProposer returns the validator that proposes the block in `round` of `height`
+func (bft *BFT) getProposer(height int, round int) string {
+	return bft.Validators[(height+round)%len(bft.Validators)]
+}
+
+// Start starts taking part in the rounds of the height after the tip of Chain
+func (bft *BFT) Start() {
+	bft.mu.Lock()
+	bft.running = true
+	bft.startHeight()
+	bft.mu.Unlock()
+	bft.flush()
+}
+
+// Stop stops taking part in rounds. Messages and timeouts are ignored until the engine is started again.
+func (bft *BFT) Stop() {
+	bft.mu.Lock()
+	defer bft.mu.Unlock()
+	bft.running = false
+}
+
+// HandleMessage verifies a message from another validator and takes part in its round
+func (bft *BFT) HandleMessage(msg *BFTMessage) error {
+	bft.mu.Lock()
+	err := bft.handle(msg)
+	bft.mu.Unlock()
+	bft.flush()
+	return err
+}
+
+// flush sends the messages and reports the blocks that were queued while the lock was held
+func (bft *BFT) flush() {
+	bft.mu.Lock()
+	outbox, finalized := bft.outbox, bft.finalized
+	bft.outbox, bft.finalized = nil, nil
+	bft.mu.Unlock()
+
+	for _, msg := range outbox {
+		bft.Transport.Broadcast(msg)
+	}
+	if bft.OnFinalized != nil {
+		for _, b := range finalized {
+			bft.OnFinalized(b)
+		}
+	}
+}
+
+// verifyMessage checks that the message is signed by a validator and that a proposal comes from the proposer
+func (bft *BFT) verifyMessage(msg *BFTMessage) error {
+	if !containsValidator(bft.Validators, msg.Validator) {
+		return fmt.Errorf("%w: %q is not a validator", ErrInvalidMessage, msg.Validator)
+	}
+	if !wallet.VerifySignature(msg.Validator, msg.signedData(bft.ChainId), msg.Signature) {
+		return fmt.Errorf("%w: invalid signature of %s", ErrInvalidMessage, msg.Validator)
+	}
+	if msg.Type == PROPOSAL {
+		if msg.Validator != bft.getProposer(msg.Height, msg.Round) {
+			return fmt.Errorf("%w: proposal from %s out of turn", ErrInvalidMessage, msg.Validator)
+		}
+		if msg.Block == nil || msg.Block.Index != msg.Height || msg.Block.BlockHash != msg.BlockHash ||
+			msg.Block.CalculateBlockHash() != msg.BlockHash {
+			return fmt.Errorf("%w: proposal does not match its block", ErrInvalidMessage)
+		}
+	}
+	return nil
+}
+
+// handle verifies and records a message, then applies the rules of its round
+func (bft *BFT) handle(msg *BFTMessage) error {
+	if !bft.running {
+		return nil
+	}
+	err := bft.verifyMessage(msg)
+	if err != nil {
+		return err
+	}
+	bft.syncHeight()
+	if msg.Height == bft.height+1 {
+		bft.future = append(bft.future, msg)
+		return nil
+	} else if msg.Height != bft.height {
+		return nil
+	}
+	bft.record(msg)
+	bft.process(msg.Round)
+	return nil
+}
+
+// record stores the first message of each validator for its type and round
+func (bft *BFT) record(msg *BFTMessage) {
+	if msg.Type == PROPOSAL {
+		if _, exists := bft.proposals[msg.Round]; !exists {
+			bft.proposals[msg.Round] = msg
+		}
+		return
+	}
+	key := voteKey{Type: msg.Type, Round: msg.Round}
+	if bft.votes[key] == nil {
+		bft.votes[key] = map[string]*BFTMessage{}
+	}
+	if _, exists := bft.votes[key][msg.Validator]; !exists {
+		bft.votes[key][msg.Validator] = msg
+	}
+}
+
+// send signs a message of this validator, records it and queues it to be broadcast
+func (bft *BFT) send(msg *BFTMessage) {
+	msg.Height = bft.height
+	msg.Round = bft.round
+	msg.Validator = bft.Wallet.GetAddress()
+	msg.Signature = bft.Wallet.Sign(msg.signedData(bft.ChainId))
+	bft.record(msg)
+	bft.outbox = append(bft.outbox, msg)
+}
+
+// countVotes counts the votes of a type in `round` for `blockHash`
+func (bft *BFT) countVotes(msgType BFTMessageType, round int, blockHash string) int {
+	count := 0
+	for _, vote := range bft.votes[voteKey{Type: msgType, Round: round}] {
+		if vote.BlockHash == blockHash {
+			count++
+		}
+	}
+	return count
+}
+
+// countRoundValidators counts the validators that sent any message in `round`
+func (bft *BFT) countRoundValidators(round int) int {
+	validators := map[string]bool{}
+	if proposal, exists := bft.proposals[round]; exists {
+		validators[proposal.Validator] = true
+	}
+	for _, msgType := range []BFTMessageType{PREVOTE, PRECOMMIT} {
+		for validator := range bft.votes[voteKey{Type: msgType, Round: round}] {
+			validators[validator] = true
+		}
+	}
+	return len(validators)
+}
+
+// isValid checks if the proposed block can be added on top of the tip
+func (bft *BFT) isValid(b *block.Block) bool {
+	err, checked := bft.validity[b.BlockHash]
+	if !checked {
+		err = bft.Chain.ValidateProposal(b)
+		if err != nil {
+			log.Println("Proposed block is invalid: " + err.Error())
+		}
+		bft.validity[b.BlockHash] = err
+	}
+	return err == nil
+}
+
+// isLockedOnOther checks if this validator locked on a block other than `b` in a round after `round`
+func (bft *BFT) isLockedOnOther(b *block.Block, round int) bool {
+	return bft.lockedRound > round && bft.lockedBlock.BlockHash != b.BlockHash
+}
+
+// syncHeight moves on to the height after the tip when blocks were added to the chain from somewhere else
+func (bft *BFT) syncHeight() {
+	if bft.Chain.GetLatestBlock().Index+1 > bft.height {
+		bft.startHeight()
+	}
+}
+
+// startHeight starts the first round of the height after the tip and replays the messages received for it
+func (bft *BFT) startHeight() {
+	bft.height = bft.Chain.GetLatestBlock().Index + 1
+	bft.lockedBlock, bft.lockedRound = nil, -1
+	bft.validBlock, bft.validRound = nil, -1
+	bft.proposals = map[int]*BFTMessage{}
+	bft.votes = map[voteKey]map[string]*BFTMessage{}
+	bft.validity = map[string]error{}
+	if bft.candidate != nil && bft.candidate.Index != bft.height {
+		bft.candidate = nil
+	}
+	bft.startRound(0)
+
+	future := bft.future
+	bft.future = nil
+	rounds := map[int]bool{bft.round: true}
+	for _, msg := range future {
+		if msg.Height == bft.height {
+			bft.record(msg)
+			rounds[msg.Round] = true
+		} else if msg.Height > bft.height {
+			bft.future = append(bft.future, msg)
+		}
+	}
+	for round := range rounds {
+		bft.process(round)
+	}
+}
+
+// startRound starts `round` of the current height by proposing a block if this validator is the proposer
+func (bft *BFT) startRound(round int) {
+	bft.round = round
+	bft.step = stepPropose
+	bft.polkaSeen = false
+	bft.timeouts = map[voteKey]bool{}
+	if bft.isProposer() {
+		bft.propose()
+	}
+	bft.schedule(stepPropose)
+}
+
+// isProposer checks if this validator proposes the block of the current round
+func (bft *BFT) isProposer() bool {
+	return bft.Wallet != nil && bft.getProposer(bft.height, bft.round) == bft.Wallet.GetAddress()
+}
+
+// propose proposes the block that got 2f+1 prevotes in an earlier round, or otherwise the block offered by Seal
+func (bft *BFT) propose() {
+	if _, proposed := bft.proposals[bft.round]; proposed {
+		return
+	}
+	b, validRound := bft.validBlock, bft.validRound
+	if b == nil {
+		b = bft.candidate
+	}
+	if b == nil {
+		return
+	}
+	bft.send(&BFTMessage{Type: PROPOSAL, BlockHash: b.BlockHash, Block: b, ValidRound: validRound})
+}
+
+// schedule starts the timeout of `step` in the current round
+func (bft *BFT) schedule(step bftStep) {
+	height, round := bft.height, bft.round
+	timeout := bft.Timeout * time.Duration(round+1)
+	time.AfterFunc(timeout, func() {
+		bft.mu.Lock()
+		bft.onTimeout(step, height, round)
+		bft.mu.Unlock()
+		bft.flush()
+	})
+}
+
+// onTimeout gives up waiting for messages in `step` of the round, if the round is still in that step
+func (bft *BFT) onTimeout(step bftStep, height int, round int) {
+	if !bft.running {
+		return
+	}
+	bft.syncHeight()
+	if height != bft.height || round != bft.round {
+		return
+	}
+	switch {
+	case step == stepPropose && bft.step == stepPropose:
+		bft.prevote("")
+	case step == stepPrevote && bft.step == stepPrevote:
+		bft.precommit("")
+	case step == stepPrecommit:
+		bft.startRound(round + 1)
+	}
+	bft.process(bft.round)
+}
+
+func (bft *BFT) prevote(blockHash string) {
+	bft.step = stepPrevote
+	if bft.Wallet != nil && containsValidator(bft.Validators, bft.Wallet.GetAddress()) {
+		bft.send(&BFTMessage{Type: PREVOTE, BlockHash: blockHash, ValidRound: -1})
+	}
+}
+
+func (bft *BFT) precommit(blockHash string) {
+	bft.step = stepPrecommit
+	if bft.Wallet != nil && containsValidator(bft.Validators, bft.Wallet.GetAddress()) {
+		bft.send(&BFTMessage{Type: PRECOMMIT, BlockHash: blockHash, ValidRound: -1})
+	}
+}
+
+// process applies the rules of the round until none of them applies anymore
+func (bft *BFT) process(round int) {
+	for bft.running && bft.applyRule(round) {
+	}
+}
+
+// applyRule applies the first rule of `round` that applies given the messages received so far and reports if one did
+func (bft *BFT) applyRule(round int) bool {
+	quorum := bft.quorum()
+	proposal := bft.proposals[round]
+
+	// A block precommitted by 2f+1 validators in any round is final
+	if proposal != nil && bft.countVotes(PRECOMMIT, round, proposal.BlockHash) >= quorum &&
+		bft.isValid(proposal.Block) {
+		bft.finalize(proposal, round)
+		return true
+	}
+	// f+1 validators are in a later round, so at least one correct validator is
+	if round > bft.round && bft.countRoundValidators(round) > len(bft.Validators)-quorum {
+		bft.startRound(round)
+		return true
+	}
+	if round != bft.round {
+		return false
+	}
+
+	if bft.step == stepPropose && proposal != nil {
+		if proposal.ValidRound == -1 {
+			if bft.isValid(proposal.Block) && !bft.isLockedOnOther(proposal.Block, -1) {
+				bft.prevote(proposal.BlockHash)
+			} else {
+				bft.prevote("")
+			}
+			return true
+		} else if proposal.ValidRound < round &&
+			bft.countVotes(PREVOTE, proposal.ValidRound, proposal.BlockHash) >= quorum {
+			if bft.isValid(proposal.Block) && !bft.isLockedOnOther(proposal.Block, proposal.ValidRound) {
+				bft.prevote(proposal.BlockHash)
+			} else {
+				bft.prevote("")
+			}
+			return true
+		}
+	}
+	prevotes := len(bft.votes[voteKey{Type: PREVOTE, Round: round}])
+	if bft.step == stepPrevote && prevotes >= quorum && !bft.timeouts[voteKey{Type: PREVOTE, Round: round}] {
+		bft.timeouts[voteKey{Type: PREVOTE, Round: round}] = true
+		bft.schedule(stepPrevote)
+		return true
+	}
+	if proposal != nil && bft.step >= stepPrevote && !bft.polkaSeen &&
+		bft.countVotes(PREVOTE, round, proposal.BlockHash) >= quorum && bft.isValid(proposal.Block) {
+		bft.polkaSeen = true
+		if bft.step == stepPrevote {
+			bft.lockedBlock, bft.lockedRound = proposal.Block, round
+			bft.precommit(proposal.BlockHash)
+		}
+		bft.validBlock, bft.validRound = proposal.Block, round
+		return true
+	}
+	if bft.step == stepPrevote && bft.countVotes(PREVOTE, round, "") >= quorum {
+		bft.precommit("")
+		return true
+	}
+	precommits := len(bft.votes[voteKey{Type: PRECOMMIT, Round: round}])
+	if precommits >= quorum && !bft.timeouts[voteKey{Type: PRECOMMIT, Round: round}] {
+		bft.timeouts[voteKey{Type: PRECOMMIT, Round: round}] = true
+		bft.schedule(stepPrecommit)
+		return true
+	}
+	return false
+}
+
+// finalize adds the proposed block to the chain with the precommits it got in `round` and moves on to the next height
+func (bft *BFT) finalize(proposal *BFTMessage, round int) {
+	b := *proposal.Block
+	b.Commit = &block.Commit{Round: round}
+	for _, validator := range bft.Validators {
+		vote, voted := bft.votes[voteKey{Type: PRECOMMIT, Round: round}][validator]
+		if voted && vote.BlockHash == proposal.BlockHash {
+			b.Commit.Precommits = append(b.Commit.Precommits,
+				&block.CommitSignature{Validator: validator, Signature: vote.Signature})
+		}
+	}
+
+	err := bft.Chain.AddBlock(&b)
+	if err != nil {
+		log.Println("Failed to add finalized block: " + err.Error())
+	} else {
+		log.Printf("Finalized block %d in round %d\n", b.Index, round)
+		bft.finalized = append(bft.finalized, &b)
+	}
+	bft.startHeight()
+}
+
+// Prepare clears the difficulty, since headers are not hashed
+func (bft *BFT) Prepare(chain ChainReader, header *block.BlockHeader) error {
+	header.Difficulty = 0
+	return nil
+}
+
+// Seal offers `b` for this validator to propose and waits for `ctx` to be done. The block is only added to the chain
+// once the validators finalize it, which the engine does itself, so Seal never returns a sealed block.
+func (bft *BFT) Seal(ctx context.Context, chain ChainReader, b *block.Block) error {
+	if bft.Wallet == nil || !containsValidator(bft.Validators, bft.Wallet.GetAddress()) {
+		return ErrNotValidator
+	}
+	candidate := *b
+	candidate.BlockHash = candidate.CalculateBlockHash()
+
+	bft.mu.Lock()
+	bft.candidate = &candidate
+	if bft.running && candidate.Index == bft.height && bft.step == stepPropose && bft.isProposer() {
+		bft.propose()
+		bft.process(bft.round)
+	}
+	bft.mu.Unlock()
+	bft.flush()
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// VerifyHeader checks that the header carries a commit signed by 2f+1 validators for the chain
+func (bft *BFT) VerifyHeader(chain ChainReader, header *block.BlockHeader) error {
+	if header.Commit == nil {
+		return ErrMissingCommit
+	}
+	precommit := &BFTMessage{
+		Type:      PRECOMMIT,
+		Height:    chain.GetAncestor(0).Index + 1,
+		Round:     header.Commit.Round,
+		BlockHash: header.CalculateHash(),
+	}
+	signed := map[string]bool{}
+	for _, signature := range header.Commit.Precommits {
+		if !containsValidator(bft.Validators, signature.Validator) {
+			return fmt.Errorf("%w: %q", ErrUnknownValidator, signature.Validator)
+		}
+		if !wallet.VerifySignature(signature.Validator, precommit.signedData(bft.ChainId), signature.Signature) {
+			return fmt.Errorf("%w: precommit of %s", ErrInvalidSignature, signature.Validator)
+		}
+		signed[signature.Validator] = true
+	}
+	if len(signed) < bft.quorum() {
+		return fmt.Errorf("%w: %d of %d", ErrInsufficientCommit, len(signed), bft.quorum())
+	}
+	return nil
+}
+
+// GetWork returns 1 for every header
+func (bft *BFT) GetWork(header *block.BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// IsFinal returns true, since a block is only added once it is final
+func (bft *BFT) IsFinal() bool {
+	return true
+}
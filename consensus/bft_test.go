@@ -0,0 +1,303 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTimeout = 50 * time.Millisecond
+	testChainId = "testnet"
+)
+
+// testBFTChain is a BFTChain over a slice of blocks that verifies the commit of every block added to it
+type testBFTChain struct {
+	blocks testChain
+	engine *BFT
+	mu     sync.Mutex
+}
+
+func (c *testBFTChain) GetLatestBlock() *block.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks.GetAncestor(0)
+}
+
+func (c *testBFTChain) ValidateProposal(b *block.Block) error {
+	tip := c.GetLatestBlock()
+	if b.Index != tip.Index+1 || b.PrevBlockHash != tip.BlockHash {
+		return errors.New("proposal does not extend the tip")
+	}
+	return nil
+}
+
+func (c *testBFTChain) AddBlock(b *block.Block) error {
+	if err := c.ValidateProposal(b); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.engine.VerifyHeader(c.blocks, &b.BlockHeader); err != nil {
+		return err
+	}
+	c.blocks = append(c.blocks, b)
+	return nil
+}
+
+// testBFTNetwork delivers the messages of each engine to the other engines that are online
+type testBFTNetwork struct {
+	engines []*BFT
+	online  []bool
+}
+
+// testBFTTransport broadcasts the messages of one engine on a testBFTNetwork
+type testBFTTransport struct {
+	network *testBFTNetwork
+	from    int
+}
+
+func (t *testBFTTransport) Broadcast(msg *BFTMessage) {
+	for i, engine := range t.network.engines {
+		if i != t.from && t.network.online[i] {
+			go func(engine *BFT) {
+				_ = engine.HandleMessage(msg)
+			}(engine)
+		}
+	}
+}
+
+// createTestBFTNetwork creates `n` validators with an engine and a chain each, where the validators in `offline`
+// never receive or send messages
+func createTestBFTNetwork(n int, offline ...int) ([]*wallet.Wallet, []*testBFTChain, *testBFTNetwork) {
+	wallets := make([]*wallet.Wallet, n)
+	validators := make([]string, n)
+	for i := range wallets {
+		wallets[i], _ = wallet.CreateWallet()
+		validators[i] = wallets[i].GetAddress()
+	}
+	network := &testBFTNetwork{engines: make([]*BFT, n), online: make([]bool, n)}
+	chains := make([]*testBFTChain, n)
+	for i, w := range wallets {
+		network.online[i] = true
+		network.engines[i] = CreateBFT(testChainId, validators, w, &testBFTTransport{network: network, from: i}, testTimeout)
+		chains[i] = &testBFTChain{blocks: createTestChain(0, 0, 0), engine: network.engines[i]}
+		network.engines[i].Chain = chains[i]
+	}
+	for _, i := range offline {
+		network.online[i] = false
+	}
+	return wallets, chains, network
+}
+
+// startTestBFTNetwork starts the online engines and has each of them offer a block until `ctx` is done
+func startTestBFTNetwork(ctx context.Context, chains []*testBFTChain, network *testBFTNetwork) {
+	for i, engine := range network.engines {
+		if !network.online[i] {
+			continue
+		}
+		engine.Start()
+		tip := chains[i].GetLatestBlock()
+		b := &block.Block{
+			BlockHeader: block.BlockHeader{
+				Version:       block.BlockVersion,
+				Timestamp:     tip.Timestamp.Add(time.Duration(i+1) * time.Second),
+				PrevBlockHash: tip.BlockHash,
+			},
+			Index: tip.Index + 1,
+		}
+		go func(engine *BFT, chain testChain) {
+			_ = engine.Seal(ctx, chain, b)
+		}(engine, chains[i].blocks)
+	}
+}
+
+// waitForHeight waits until every chain of an online validator reaches `height`
+func waitForHeight(t *testing.T, chains []*testBFTChain, network *testBFTNetwork, height int) {
+	assert.Eventually(t, func() bool {
+		for i, chain := range chains {
+			if network.online[i] && chain.GetLatestBlock().Index < height {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "Every validator should finalize a block at height %d", height)
+}
+
+// signCommit creates a commit of `round` for the header at `height` of the chain with `chainId`, signed by each of
+// `wallets`
+func signCommit(chainId string, header *block.BlockHeader, height int, round int,
+	wallets ...*wallet.Wallet) *block.Commit {
+	precommit := &BFTMessage{Type: PRECOMMIT, Height: height, Round: round, BlockHash: header.CalculateHash()}
+	commit := &block.Commit{Round: round}
+	for _, w := range wallets {
+		commit.Precommits = append(commit.Precommits,
+			&block.CommitSignature{Validator: w.GetAddress(), Signature: w.Sign(precommit.signedData(chainId))})
+	}
+	return commit
+}
+
+func TestBFT_Finalize(t *testing.T) {
+	_, chains, network := createTestBFTNetwork(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func() {
+		for _, engine := range network.engines {
+			engine.Stop()
+		}
+	}()
+
+	startTestBFTNetwork(ctx, chains, network)
+	waitForHeight(t, chains, network, 1)
+
+	finalized := chains[0].GetLatestBlock()
+	for _, chain := range chains {
+		assert.Equal(t, finalized.BlockHash, chain.GetLatestBlock().BlockHash,
+			"Every validator should finalize the same block")
+	}
+	assert.Equal(t, 0, finalized.Commit.Round, "Block should be finalized in the first round")
+	assert.GreaterOrEqual(t, len(finalized.Commit.Precommits), 3)
+	verifier := CreateBFT(testChainId, network.engines[0].Validators, nil, nil, testTimeout)
+	assert.Nil(t, verifier.VerifyHeader(createTestChain(0, 0, 0), &finalized.BlockHeader),
+		"Commit should be verified by nodes that are not validators")
+}
+
+func TestBFT_Finalize_OfflineProposer(t *testing.T) {
+	// Validator 1 proposes the first round of height 1
+	_, chains, network := createTestBFTNetwork(4, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func() {
+		for _, engine := range network.engines {
+			engine.Stop()
+		}
+	}()
+
+	startTestBFTNetwork(ctx, chains, network)
+	waitForHeight(t, chains, network, 1)
+
+	finalized := chains[0].GetLatestBlock()
+	assert.Equal(t, 1, finalized.Commit.Round, "Validators should move on to the next round without a proposal")
+	for i, chain := range chains {
+		if network.online[i] {
+			assert.Equal(t, finalized.BlockHash, chain.GetLatestBlock().BlockHash)
+		}
+	}
+}
+
+func TestBFT_HandleMessage_Invalid(t *testing.T) {
+	wallets, _, network := createTestBFTNetwork(4)
+	engine := network.engines[0]
+	engine.Start()
+	defer engine.Stop()
+	outsider, _ := wallet.CreateWallet()
+
+	signFor := func(chainId string, w *wallet.Wallet, msg *BFTMessage) *BFTMessage {
+		msg.Validator = w.GetAddress()
+		msg.Signature = w.Sign(msg.signedData(chainId))
+		return msg
+	}
+	sign := func(w *wallet.Wallet, msg *BFTMessage) *BFTMessage {
+		return signFor(testChainId, w, msg)
+	}
+	b := &block.Block{Index: 1}
+	b.BlockHash = b.CalculateBlockHash()
+
+	tests := []struct {
+		name string
+		msg  *BFTMessage
+	}{
+		{"not a validator", sign(outsider, &BFTMessage{Type: PREVOTE, Height: 1})},
+		{"forged signature", &BFTMessage{Type: PREVOTE, Height: 1, Validator: wallets[2].GetAddress(),
+			Signature: sign(wallets[3], &BFTMessage{Type: PREVOTE, Height: 1}).Signature}},
+		{"proposal out of turn", sign(wallets[2], &BFTMessage{Type: PROPOSAL, Height: 1, BlockHash: b.BlockHash,
+			Block: b, ValidRound: -1})},
+		{"signed for another chain", signFor("mainnet", wallets[2], &BFTMessage{Type: PREVOTE, Height: 1})},
+		{"proposal without block", sign(wallets[1], &BFTMessage{Type: PROPOSAL, Height: 1, BlockHash: b.BlockHash,
+			ValidRound: -1})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.ErrorIs(t, engine.HandleMessage(test.msg), ErrInvalidMessage)
+		})
+	}
+}
+
+func TestBFT_Seal_NotValidator(t *testing.T) {
+	_, _, network := createTestBFTNetwork(1)
+	outsider, _ := wallet.CreateWallet()
+	chain := createTestChain(0, 0, 0)
+
+	engine := CreateBFT(testChainId, network.engines[0].Validators, outsider, nil, testTimeout)
+	assert.ErrorIs(t, engine.Seal(context.Background(), chain, &block.Block{Index: 1}), ErrNotValidator)
+	engine = CreateBFT(testChainId, network.engines[0].Validators, nil, nil, testTimeout)
+	assert.ErrorIs(t, engine.Seal(context.Background(), chain, &block.Block{Index: 1}), ErrNotValidator)
+}
+
+func TestBFT_VerifyHeader(t *testing.T) {
+	wallets, _, network := createTestBFTNetwork(4)
+	verifier := network.engines[0]
+	chain := createTestChain(0, 0, 0)
+	outsider, _ := wallet.CreateWallet()
+	header := func(commit func(h *block.BlockHeader) *block.Commit) *block.BlockHeader {
+		h := &block.BlockHeader{Version: block.BlockVersion, Timestamp: time.Unix(2000, 0)}
+		h.Commit = commit(h)
+		return h
+	}
+
+	tests := []struct {
+		name        string
+		header      *block.BlockHeader
+		expectedErr error
+	}{
+		{"valid", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit(testChainId, h, 1, 2, wallets[0], wallets[1], wallets[3])
+		}), nil},
+		{"missing commit", header(func(h *block.BlockHeader) *block.Commit { return nil }), ErrMissingCommit},
+		{"too few precommits", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit(testChainId, h, 1, 0, wallets[0], wallets[1])
+		}), ErrInsufficientCommit},
+		{"repeated precommits", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit(testChainId, h, 1, 0, wallets[0], wallets[1], wallets[1])
+		}), ErrInsufficientCommit},
+		{"unknown validator", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit(testChainId, h, 1, 0, wallets[0], wallets[1], outsider)
+		}), ErrUnknownValidator},
+		{"wrong height", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit(testChainId, h, 2, 0, wallets[0], wallets[1], wallets[2])
+		}), ErrInvalidSignature},
+		{"another chain", header(func(h *block.BlockHeader) *block.Commit {
+			return signCommit("mainnet", h, 1, 0, wallets[0], wallets[1], wallets[2])
+		}), ErrInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.ErrorIs(t, verifier.VerifyHeader(chain, test.header), test.expectedErr)
+		})
+	}
+
+	forged := header(func(h *block.BlockHeader) *block.Commit {
+		return signCommit(testChainId, h, 1, 0, wallets[0], wallets[1], wallets[2])
+	})
+	forged.Commit.Round = 1
+	assert.ErrorIs(t, verifier.VerifyHeader(chain, forged), ErrInvalidSignature,
+		"Changing the round of a commit should invalidate its precommits")
+	forged = header(func(h *block.BlockHeader) *block.Commit {
+		return signCommit(testChainId, h, 1, 0, wallets[0], wallets[1], wallets[2])
+	})
+	forged.MerkleRoot = forged.CalculateHash()
+	assert.ErrorIs(t, verifier.VerifyHeader(chain, forged), ErrInvalidSignature,
+		"Changing a header after it is committed should invalidate the commit")
+}
+
+func TestBFT_GetWork(t *testing.T) {
+	engine := CreateBFT(testChainId, nil, nil, nil, testTimeout)
+	assert.Equal(t, big.NewInt(1), engine.GetWork(&block.BlockHeader{Difficulty: 10}))
+	assert.True(t, engine.IsFinal())
+}
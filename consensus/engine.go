@@ -0,0 +1,39 @@
+package consensus
+
+import (
+	"context"
+	"github.com/defaziom/blockchain-go/block"
+	"math/big"
+)
+
+// ChainReader gives an engine access to the chain a header is prepared, sealed or verified on top of
+type ChainReader interface {
+	// GetAncestor returns the block `depth` blocks before the tip, which is the tip itself at depth 0. Depths beyond
+	// the first block return the first block.
+	GetAncestor(depth int) *block.Block
+}
+
+// Engine decides who may seal a block, how a sealed header is verified and which fork of the chain is preferred
+type Engine interface {
+	// Prepare fills in the consensus fields of a header that is to be sealed on top of `chain`
+	Prepare(chain ChainReader, header *block.BlockHeader) error
+	// Seal sets the fields of the prepared header of `b` that prove it was produced according to the engine's rules.
+	// It stops with the context's error when `ctx` is done.
+	Seal(ctx context.Context, chain ChainReader, b *block.Block) error
+	// VerifyHeader checks that `header` was prepared and sealed according to the engine's rules on top of `chain`
+	VerifyHeader(chain ChainReader, header *block.BlockHeader) error
+	// GetWork returns the weight `header` adds to its chain. The fork with the most cumulative work is preferred.
+	GetWork(header *block.BlockHeader) *big.Int
+}
+
+// HashRater is implemented by engines that seal headers by hashing them
+type HashRater interface {
+	// GetHashRate returns the hashes per second of the last call to Seal
+	GetHashRate() float64
+}
+
+// Finality is implemented by engines that only add blocks to the chain once they are final
+type Finality interface {
+	// IsFinal reports if blocks in the chain can never be replaced by a fork
+	IsFinal() bool
+}
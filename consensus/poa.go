@@ -0,0 +1,128 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/wallet"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrNotValidator     = errors.New("wallet is not one of the validators")
+	ErrUnknownValidator = errors.New("header is not signed by a validator")
+	ErrOutOfTurn        = errors.New("header is signed by a validator out of turn")
+	ErrInvalidSignature = errors.New("invalid header signature")
+	ErrBlockTooSoon     = errors.New("header is timestamped before the block period passed")
+)
+
+// ProofOfAuthority lets a fixed set of validators take turns sealing blocks by signing them. The block at height h is
+// sealed by validator h % len(Validators). Every block weighs the same, so the longest chain is preferred.
+type ProofOfAuthority struct {
+	Validators []string       // Addresses of the validators in the order they take turns
+	Wallet     *wallet.Wallet // Signs the headers this node seals. Nodes that only verify headers don't need one.
+	Period     time.Duration  // Blocks must be timestamped at least this long after their parent
+	Clock      clock.Clock
+}
+
+// CreateProofOfAuthority creates a proof-of-authority engine for `validators` that seals headers with `w` no sooner
+// than `period` after the previous block
+func CreateProofOfAuthority(validators []string, w *wallet.Wallet, period time.Duration,
+	c clock.Clock) *ProofOfAuthority {
+	return &ProofOfAuthority{
+		Validators: validators,
+		Wallet:     w,
+		Period:     period,
+		Clock:      c,
+	}
+}
+
+// GetInTurnValidator returns the address of the validator that seals the block after the tip of `chain`
+func (poa *ProofOfAuthority) GetInTurnValidator(chain ChainReader) string {
+	if len(poa.Validators) == 0 {
+		return ""
+	}
+	height := chain.GetAncestor(0).Index + 1
+	return poa.Validators[height%len(poa.Validators)]
+}
+
+// containsValidator checks if `address` is one of the validators
+func containsValidator(validators []string, address string) bool {
+	for _, validator := range validators {
+		if validator == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare delays the timestamp of the header until the block period has passed. Headers are not hashed, so the
+// difficulty is zero.
+func (poa *ProofOfAuthority) Prepare(chain ChainReader, header *block.BlockHeader) error {
+	header.Difficulty = 0
+	if earliest := chain.GetAncestor(0).Timestamp.Add(poa.Period); header.Timestamp.Before(earliest) {
+		header.Timestamp = earliest
+	}
+	return nil
+}
+
+// Seal signs the header with the wallet once its timestamp is reached. When it is not the wallet's turn, Seal waits
+// for `ctx` to be done, since only the validator in turn can seal a block on top of `chain`.
+func (poa *ProofOfAuthority) Seal(ctx context.Context, chain ChainReader, b *block.Block) error {
+	header := &b.BlockHeader
+	if poa.Wallet == nil || !containsValidator(poa.Validators, poa.Wallet.GetAddress()) {
+		return ErrNotValidator
+	}
+	if poa.GetInTurnValidator(chain) != poa.Wallet.GetAddress() {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if wait := header.Timestamp.Sub(poa.Clock.Now()); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The signer is committed to by the signed header
+	header.Signer = poa.Wallet.GetAddress()
+	data, err := header.MarshalBinary()
+	if err != nil {
+		header.Signer = ""
+		return err
+	}
+	header.Signature = poa.Wallet.Sign(data)
+	return nil
+}
+
+// VerifyHeader checks that the header is signed by the validator in turn and timestamped after the block period
+func (poa *ProofOfAuthority) VerifyHeader(chain ChainReader, header *block.BlockHeader) error {
+	if !containsValidator(poa.Validators, header.Signer) {
+		return fmt.Errorf("%w: %q", ErrUnknownValidator, header.Signer)
+	}
+	if inTurn := poa.GetInTurnValidator(chain); header.Signer != inTurn {
+		return fmt.Errorf("%w: expected %s, got %s", ErrOutOfTurn, inTurn, header.Signer)
+	}
+	data, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !wallet.VerifySignature(header.Signer, data, header.Signature) {
+		return ErrInvalidSignature
+	}
+	if header.Timestamp.Before(chain.GetAncestor(0).Timestamp.Add(poa.Period)) {
+		return ErrBlockTooSoon
+	}
+	return nil
+}
+
+// GetWork returns 1 for every header
+func (poa *ProofOfAuthority) GetWork(header *block.BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
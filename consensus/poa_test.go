@@ -0,0 +1,159 @@
+package consensus
+
+import (
+	"context"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testPeriod = time.Second
+
+// createTestValidators creates `n` validator wallets and an engine for each of them
+func createTestValidators(n int, c clock.Clock) ([]*wallet.Wallet, []*ProofOfAuthority) {
+	wallets := make([]*wallet.Wallet, n)
+	validators := make([]string, n)
+	for i := range wallets {
+		wallets[i], _ = wallet.CreateWallet()
+		validators[i] = wallets[i].GetAddress()
+	}
+	engines := make([]*ProofOfAuthority, n)
+	for i, w := range wallets {
+		engines[i] = CreateProofOfAuthority(validators, w, testPeriod, c)
+	}
+	return wallets, engines
+}
+
+// createPreparedBlock creates a block with a header prepared by `engine` on top of `chain`
+func createPreparedBlock(engine Engine, chain ChainReader) *block.Block {
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{Version: block.BlockVersion, Timestamp: chain.GetAncestor(0).Timestamp},
+		Index:       chain.GetAncestor(0).Index + 1,
+	}
+	_ = engine.Prepare(chain, &b.BlockHeader)
+	return b
+}
+
+func TestProofOfAuthority_GetInTurnValidator(t *testing.T) {
+	_, engines := createTestValidators(3, &clock.SystemClock{})
+	poa := engines[0]
+
+	for n := 0; n < 6; n++ {
+		chain := createTestChain(n, time.Second, 0)
+		assert.Equal(t, poa.Validators[(n+1)%3], poa.GetInTurnValidator(chain),
+			"Validators should take turns in order")
+	}
+	assert.Equal(t, "", CreateProofOfAuthority(nil, nil, 0, &clock.SystemClock{}).GetInTurnValidator(
+		createTestChain(0, 0, 0)))
+}
+
+func TestProofOfAuthority_Prepare(t *testing.T) {
+	chain := createTestChain(1, time.Second, 4)
+	_, engines := createTestValidators(1, &clock.SystemClock{})
+
+	header := &block.BlockHeader{Timestamp: chain.GetAncestor(0).Timestamp.Add(time.Millisecond), Difficulty: 4}
+	assert.Nil(t, engines[0].Prepare(chain, header))
+	assert.Equal(t, chain.GetAncestor(0).Timestamp.Add(testPeriod), header.Timestamp,
+		"Timestamp should be delayed until the block period passed")
+	assert.Equal(t, 0, header.Difficulty)
+
+	later := chain.GetAncestor(0).Timestamp.Add(time.Hour)
+	header.Timestamp = later
+	assert.Nil(t, engines[0].Prepare(chain, header))
+	assert.Equal(t, later, header.Timestamp, "Timestamps after the block period should be kept")
+}
+
+func TestProofOfAuthority_Seal(t *testing.T) {
+	chain := createTestChain(0, 0, 0)
+	c := clock.CreateTestClock(chain.GetAncestor(0).Timestamp.Add(testPeriod))
+	wallets, engines := createTestValidators(2, c)
+	inTurn, outOfTurn := engines[1], engines[0]
+
+	b := createPreparedBlock(inTurn, chain)
+	assert.Nil(t, inTurn.Seal(context.Background(), chain, b))
+	assert.Equal(t, wallets[1].GetAddress(), b.Signer)
+	for _, engine := range engines {
+		assert.Nil(t, engine.VerifyHeader(chain, &b.BlockHeader), "Every validator should accept the sealed header")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	b = createPreparedBlock(outOfTurn, chain)
+	assert.ErrorIs(t, outOfTurn.Seal(ctx, chain, b), context.DeadlineExceeded,
+		"Validator should wait for its turn")
+	assert.Equal(t, "", b.Signature)
+
+	outsider, _ := wallet.CreateWallet()
+	notValidator := CreateProofOfAuthority(inTurn.Validators, outsider, testPeriod, c)
+	assert.ErrorIs(t, notValidator.Seal(context.Background(), chain, b), ErrNotValidator)
+	verifier := CreateProofOfAuthority(inTurn.Validators, nil, testPeriod, c)
+	assert.ErrorIs(t, verifier.Seal(context.Background(), chain, b), ErrNotValidator)
+}
+
+func TestProofOfAuthority_Seal_WaitsForTimestamp(t *testing.T) {
+	chain := createTestChain(0, 0, 0)
+	c := clock.CreateTestClock(chain.GetAncestor(0).Timestamp)
+	_, engines := createTestValidators(1, c)
+	b := createPreparedBlock(engines[0], chain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, engines[0].Seal(ctx, chain, b), context.DeadlineExceeded,
+		"Header should not be sealed before its timestamp")
+
+	c.Set(b.Timestamp)
+	assert.Nil(t, engines[0].Seal(context.Background(), chain, b))
+}
+
+func TestProofOfAuthority_VerifyHeader(t *testing.T) {
+	chain := createTestChain(0, 0, 0)
+	c := clock.CreateTestClock(chain.GetAncestor(0).Timestamp.Add(time.Hour))
+	wallets, engines := createTestValidators(2, c)
+	verifier := engines[0]
+	sealHeader := func(w *wallet.Wallet, modify func(h *block.BlockHeader)) *block.BlockHeader {
+		header := &createPreparedBlock(verifier, chain).BlockHeader
+		modify(header)
+		header.Signer = w.GetAddress()
+		data, _ := header.MarshalBinary()
+		header.Signature = w.Sign(data)
+		return header
+	}
+	outsider, _ := wallet.CreateWallet()
+
+	tests := []struct {
+		name        string
+		header      *block.BlockHeader
+		expectedErr error
+	}{
+		{"valid", sealHeader(wallets[1], func(h *block.BlockHeader) {}), nil},
+		{"unknown validator", sealHeader(outsider, func(h *block.BlockHeader) {}), ErrUnknownValidator},
+		{"out of turn", sealHeader(wallets[0], func(h *block.BlockHeader) {}), ErrOutOfTurn},
+		{"before block period", sealHeader(wallets[1], func(h *block.BlockHeader) {
+			h.Timestamp = h.Timestamp.Add(-time.Millisecond)
+		}), ErrBlockTooSoon},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.ErrorIs(t, verifier.VerifyHeader(chain, test.header), test.expectedErr)
+		})
+	}
+
+	forged := sealHeader(wallets[1], func(h *block.BlockHeader) {})
+	forged.MerkleRoot = forged.CalculateHash()
+	assert.ErrorIs(t, verifier.VerifyHeader(chain, forged), ErrInvalidSignature,
+		"Changing a header after it is signed should invalidate the signature")
+
+	forged = sealHeader(outsider, func(h *block.BlockHeader) {})
+	forged.Signer = wallets[1].GetAddress()
+	assert.ErrorIs(t, verifier.VerifyHeader(chain, forged), ErrInvalidSignature,
+		"Header signed by another key on behalf of the validator in turn should be invalid")
+}
+
+func TestProofOfAuthority_GetWork(t *testing.T) {
+	_, engines := createTestValidators(1, &clock.SystemClock{})
+	assert.Equal(t, big.NewInt(1), engines[0].GetWork(&block.BlockHeader{Difficulty: 10}))
+}
@@ -0,0 +1,208 @@
+package consensus
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"log"
+	"math"
+	"math/big"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInsufficientWork  = errors.New("block hash does not meet difficulty")
+	ErrInvalidDifficulty = errors.New("invalid block difficulty")
+)
+
+// MaxDifficulty is the number of bits in a block hash. No hash can have more leading zero bits than that.
+const MaxDifficulty = 256
+
+const DifficultyAdjustmentIntervalBlocks = 5 // Adjusts blockchain difficulty every N blocks
+const BlockGenerationIntervalSec = 0.5       // Avg interval between added blocks for adjusting difficulty
+const MaxDifficultyAdjustmentBits = 2        // Limits a single adjustment to scaling the work per block by 4x
+const MinDifficulty = 1                      // Difficulty never drops below this many leading zero bits
+
+const miningCheckIntervalHashes = 1024 // Workers check if sealing was stopped every N hashes
+
+// ProofOfWork seals a header by searching for a nonce that gives its hash at least Difficulty leading zero bits. The
+// difficulty is retargeted every RetargetIntervalBlocks blocks and the chain with the most expected hashes is
+// preferred.
+type ProofOfWork struct {
+	Workers                int           // Number of goroutines Seal searches for a nonce with
+	RetargetIntervalBlocks int           // Adjusts the difficulty every N blocks
+	hashRate               atomic.Uint64 // float64 bits of the hashes per second of the last call to Seal
+}
+
+// CreateProofOfWork creates a proof-of-work engine that seals with one worker per CPU and retargets every
+// DifficultyAdjustmentIntervalBlocks blocks
+func CreateProofOfWork() *ProofOfWork {
+	return &ProofOfWork{Workers: runtime.NumCPU(), RetargetIntervalBlocks: DifficultyAdjustmentIntervalBlocks}
+}
+
+// LeadingZeroBits counts the leading zero bits of a hex encoded hash. A malformed hash has no leading zero bits.
+func LeadingZeroBits(hash string) int {
+	data, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0
+	}
+	zeros := 0
+	for _, b := range data {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// IsHashValid checks that the hash has at least `difficulty` leading zero bits
+func IsHashValid(hash string, difficulty int) bool {
+	return LeadingZeroBits(hash) >= difficulty
+}
+
+// GetNextDifficulty returns the difficulty required for the block after the tip of `chain`. The difficulty is
+// adjusted every `interval` blocks.
+func GetNextDifficulty(chain ChainReader, interval int) int {
+	latestBlock := chain.GetAncestor(0)
+
+	if latestBlock.Index%interval == 0 && latestBlock.Index != 0 {
+		return GetAdjustedDifficulty(chain, interval)
+	} else {
+		return latestBlock.Difficulty
+	}
+}
+
+// GetAdjustedDifficulty scales the difficulty in proportion to how long the last `interval` blocks up to the tip of
+// `chain` took to mine
+func GetAdjustedDifficulty(chain ChainReader, interval int) int {
+	latestBlock := chain.GetAncestor(0)
+	prevAdjBlock := chain.GetAncestor(interval)
+	timeExpectedSec := BlockGenerationIntervalSec * float64(interval)
+	timeTakenSec := latestBlock.Timestamp.Sub(prevAdjBlock.Timestamp).Seconds()
+
+	// Every bit of difficulty halves the hash target, so scaling the target by timeTaken/timeExpected changes the
+	// difficulty by log2(timeExpected/timeTaken) bits
+	adjustment := MaxDifficultyAdjustmentBits
+	if timeTakenSec > 0 {
+		adjustment = int(math.Round(math.Log2(timeExpectedSec / timeTakenSec)))
+	}
+	if adjustment > MaxDifficultyAdjustmentBits {
+		adjustment = MaxDifficultyAdjustmentBits
+	} else if adjustment < -MaxDifficultyAdjustmentBits {
+		adjustment = -MaxDifficultyAdjustmentBits
+	}
+
+	difficulty := latestBlock.Difficulty + adjustment
+	if difficulty < MinDifficulty {
+		return MinDifficulty
+	} else if difficulty > MaxDifficulty {
+		return MaxDifficulty
+	}
+	return difficulty
+}
+
+// Prepare sets the difficulty the header must be sealed at
+func (pow *ProofOfWork) Prepare(chain ChainReader, header *block.BlockHeader) error {
+	header.Difficulty = GetNextDifficulty(chain, pow.getRetargetInterval())
+	return nil
+}
+
+// getRetargetInterval returns the configured retarget interval, falling back to DifficultyAdjustmentIntervalBlocks for
+// engines that were not created with CreateProofOfWork
+func (pow *ProofOfWork) getRetargetInterval() int {
+	if pow.RetargetIntervalBlocks <= 0 {
+		return DifficultyAdjustmentIntervalBlocks
+	}
+	return pow.RetargetIntervalBlocks
+}
+
+// Seal searches for a nonce that makes the hash of the header meet its difficulty. Worker i tries the nonces
+// i, i+Workers, i+2*Workers, ... so the workers never hash the same header twice.
+func (pow *ProofOfWork) Seal(ctx context.Context, chain ChainReader, b *block.Block) error {
+	header := &b.BlockHeader
+	workers := pow.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	template := *header
+	found := make(chan int, workers)
+	hashCounts := make([]uint64, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			h := template
+			for h.Nonce = worker; ; h.Nonce += workers {
+				if hashCounts[worker]%miningCheckIntervalHashes == 0 && ctx.Err() != nil {
+					return
+				}
+				hashCounts[worker]++
+				if IsHashValid(h.CalculateHash(), h.Difficulty) {
+					found <- h.Nonce
+					return
+				}
+			}
+		}(i)
+	}
+
+	var err error
+	select {
+	case header.Nonce = <-found:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	cancel()
+	wg.Wait()
+
+	hashes := uint64(0)
+	for _, count := range hashCounts {
+		hashes += count
+	}
+	if elapsed := time.Since(start); elapsed > 0 && hashes > 0 {
+		pow.hashRate.Store(math.Float64bits(float64(hashes) / elapsed.Seconds()))
+	}
+	if err == nil {
+		log.Printf("Sealed header with %d hashes at %.0f H/s\n", hashes, pow.GetHashRate())
+	}
+	return err
+}
+
+// VerifyHeader checks that the hash of `header` meets its difficulty and that the difficulty is the one required
+// after the tip of `chain`
+func (pow *ProofOfWork) VerifyHeader(chain ChainReader, header *block.BlockHeader) error {
+	if !IsHashValid(header.CalculateHash(), header.Difficulty) {
+		return ErrInsufficientWork
+	}
+	if expected := GetNextDifficulty(chain, pow.getRetargetInterval()); header.Difficulty != expected {
+		return fmt.Errorf("%w: expected %d, got %d", ErrInvalidDifficulty, expected, header.Difficulty)
+	}
+	return nil
+}
+
+// GetWork returns the expected number of hashes needed to seal the header, which is 2^Difficulty
+func (pow *ProofOfWork) GetWork(header *block.BlockHeader) *big.Int {
+	difficulty := header.Difficulty
+	if difficulty < 0 {
+		difficulty = 0
+	} else if difficulty > MaxDifficulty {
+		difficulty = MaxDifficulty
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// GetHashRate returns the hashes per second of the last call to Seal
+func (pow *ProofOfWork) GetHashRate() float64 {
+	return math.Float64frombits(pow.hashRate.Load())
+}
@@ -0,0 +1,178 @@
+package consensus
+
+import (
+	"context"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChain is a ChainReader over a slice of blocks ending at the tip
+type testChain []*block.Block
+
+func (c testChain) GetAncestor(depth int) *block.Block {
+	if depth >= len(c) {
+		return c[0]
+	}
+	return c[len(c)-1-depth]
+}
+
+// createTestChain creates a chain of `n` blocks after a first block, timestamped `interval` apart
+func createTestChain(n int, interval time.Duration, difficulty int) testChain {
+	chain := testChain{{BlockHeader: block.BlockHeader{Timestamp: time.Unix(1000, 0), Difficulty: difficulty}}}
+	for i := 1; i <= n; i++ {
+		chain = append(chain, &block.Block{
+			BlockHeader: block.BlockHeader{
+				Timestamp:  chain[i-1].Timestamp.Add(interval),
+				Difficulty: difficulty,
+			},
+			Index: i,
+		})
+	}
+	return chain
+}
+
+// createTestBlock creates a block with an unsealed header at the difficulty required on top of `chain`
+func createTestBlock(chain ChainReader) *block.Block {
+	b := &block.Block{
+		BlockHeader: block.BlockHeader{
+			Version:   block.BlockVersion,
+			Timestamp: chain.GetAncestor(0).Timestamp.Add(time.Second),
+		},
+		Index: chain.GetAncestor(0).Index + 1,
+	}
+	_ = CreateProofOfWork().Prepare(chain, &b.BlockHeader)
+	return b
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	assert.Equal(t, 0, LeadingZeroBits("ff"))
+	assert.Equal(t, 1, LeadingZeroBits("7f"))
+	assert.Equal(t, 8, LeadingZeroBits("00ff"))
+	assert.Equal(t, 15, LeadingZeroBits("0001"))
+	assert.Equal(t, 256, LeadingZeroBits(strings.Repeat("0", 64)))
+	assert.Equal(t, 0, LeadingZeroBits("zz"))
+}
+
+func TestIsHashValid(t *testing.T) {
+	assert.True(t, IsHashValid("0003"+strings.Repeat("f", 60), 14),
+		"Hash should be prefixed with 0 bits equal to the difficulty")
+	assert.False(t, IsHashValid("0004"+strings.Repeat("f", 60), 14), "Hash should be invalid")
+	assert.False(t, IsHashValid("not a hash", 1), "Malformed hash should be invalid")
+}
+
+func TestGetNextDifficulty(t *testing.T) {
+	interval := DifficultyAdjustmentIntervalBlocks
+	chain := createTestChain(interval-1, 0, 10)
+	assert.Equal(t, 10, GetNextDifficulty(chain, interval), "Difficulty should only change at the adjustment interval")
+
+	chain = createTestChain(interval, 0, 10)
+	assert.Equal(t, 10+MaxDifficultyAdjustmentBits, GetNextDifficulty(chain, interval),
+		"Difficulty should have increased by the maximum adjustment")
+
+	assert.Equal(t, 10, GetNextDifficulty(createTestChain(0, 0, 10), interval), "First block should not be adjusted")
+}
+
+func TestProofOfWork_RetargetIntervalBlocks(t *testing.T) {
+	pow := CreateProofOfWork()
+	pow.RetargetIntervalBlocks = 3
+	header := &block.BlockHeader{}
+
+	_ = pow.Prepare(createTestChain(3, 0, 10), header)
+	assert.Equal(t, 10+MaxDifficultyAdjustmentBits, header.Difficulty, "Difficulty should be retargeted every 3 blocks")
+	_ = pow.Prepare(createTestChain(DifficultyAdjustmentIntervalBlocks, 0, 10), header)
+	assert.Equal(t, 10, header.Difficulty)
+}
+
+func TestGetAdjustedDifficulty(t *testing.T) {
+	expectedInterval := time.Duration(BlockGenerationIntervalSec * float64(time.Second))
+	tests := []struct {
+		name               string
+		interval           time.Duration
+		difficulty         int
+		expectedDifficulty int
+	}{
+		{"on time", expectedInterval, 10, 10},
+		{"slightly fast", expectedInterval * 4 / 5, 10, 10},
+		{"twice as fast", expectedInterval / 2, 10, 11},
+		{"four times as fast", expectedInterval / 4, 10, 12},
+		{"instant is limited", 0, 10, 10 + MaxDifficultyAdjustmentBits},
+		{"twice as slow", expectedInterval * 2, 10, 9},
+		{"ten times as slow is limited", expectedInterval * 10, 10, 10 - MaxDifficultyAdjustmentBits},
+		{"never below minimum", expectedInterval * 10, MinDifficulty, MinDifficulty},
+		{"never above maximum", 0, MaxDifficulty, MaxDifficulty},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := createTestChain(DifficultyAdjustmentIntervalBlocks*2, test.interval, test.difficulty)
+			assert.Equal(t, test.expectedDifficulty, GetAdjustedDifficulty(chain, DifficultyAdjustmentIntervalBlocks))
+		})
+	}
+}
+
+func TestProofOfWork_Seal(t *testing.T) {
+	chain := createTestChain(1, time.Second, 8)
+	for _, workers := range []int{1, 4} {
+		pow := CreateProofOfWork()
+		pow.Workers = workers
+		b := createTestBlock(chain)
+
+		err := pow.Seal(context.Background(), chain, b)
+
+		assert.Nil(t, err)
+		assert.Nil(t, pow.VerifyHeader(chain, &b.BlockHeader), "Header sealed with %d workers should be valid", workers)
+		assert.Greater(t, pow.GetHashRate(), 0.0, "Hash rate should be reported")
+	}
+}
+
+func TestProofOfWork_Seal_Cancelled(t *testing.T) {
+	// Nothing can find a hash with this many leading zero bits
+	chain := createTestChain(1, time.Second, MaxDifficulty)
+	pow := CreateProofOfWork()
+	b := createTestBlock(chain)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := pow.Seal(ctx, chain, b)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Greater(t, pow.GetHashRate(), 0.0, "Hash rate should be reported for a cancelled run")
+}
+
+func TestProofOfWork_VerifyHeader(t *testing.T) {
+	chain := createTestChain(1, time.Second, 4)
+	pow := CreateProofOfWork()
+	b := createTestBlock(chain)
+	_ = pow.Seal(context.Background(), chain, b)
+	assert.Nil(t, pow.VerifyHeader(chain, &b.BlockHeader))
+
+	unsealed := b.BlockHeader
+	for IsHashValid(unsealed.CalculateHash(), unsealed.Difficulty) {
+		unsealed.Nonce++
+	}
+	assert.ErrorIs(t, pow.VerifyHeader(chain, &unsealed), ErrInsufficientWork)
+
+	for _, difficulty := range []int{0, 5} {
+		wrongDifficulty := &block.Block{BlockHeader: b.BlockHeader}
+		wrongDifficulty.Difficulty = difficulty
+		_ = pow.Seal(context.Background(), chain, wrongDifficulty)
+		assert.ErrorIs(t, pow.VerifyHeader(chain, &wrongDifficulty.BlockHeader), ErrInvalidDifficulty,
+			"Header sealed at difficulty %d should be invalid", difficulty)
+	}
+}
+
+func TestProofOfWork_GetWork(t *testing.T) {
+	pow := CreateProofOfWork()
+	header := &block.BlockHeader{Difficulty: 3}
+	assert.Equal(t, big.NewInt(8), pow.GetWork(header))
+
+	header.Difficulty = -1
+	assert.Equal(t, big.NewInt(1), pow.GetWork(header))
+
+	header.Difficulty = MaxDifficulty + 1
+	assert.Equal(t, new(big.Int).Lsh(big.NewInt(1), MaxDifficulty), pow.GetWork(header),
+		"Work should not exceed what is possible for a hash")
+}
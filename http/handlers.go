@@ -2,28 +2,57 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/defaziom/blockchain-go/block"
 	"github.com/defaziom/blockchain-go/blockchain"
 	"github.com/defaziom/blockchain-go/database"
+	"github.com/defaziom/blockchain-go/ibd"
+	"github.com/defaziom/blockchain-go/mempool"
+	"github.com/defaziom/blockchain-go/merkle"
+	"github.com/defaziom/blockchain-go/miner"
 	"github.com/defaziom/blockchain-go/tcp"
+	"github.com/defaziom/blockchain-go/transaction"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
-type MineBlockRequest struct {
-	Data string
+type MerkleProofResponse struct {
+	BlockHash  string
+	MerkleRoot string
+	TxId       string
+	TxHash     string // Witness hash of the transaction, the leaf the proof starts from
+	Proof      []*merkle.ProofStep
 }
 
-// BlocksHandler GET /blocks
+// BlocksHandler GET /blocks?start={first height}&end={height after the last}. Both bounds are optional and default to
+// the whole chain.
 func BlocksHandler(bc blockchain.BlockChain) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodGet {
 			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
 			return
 		}
-		// Return list of all blocks stored on the chain
-		resp, err := json.Marshal(bc.GetBlocks().ToSlice())
+		// The range is read from one snapshot, so the blocks are consistent even if the tip moves meanwhile
+		snapshot := bc.Snapshot()
+		start, end := 0, snapshot.GetLatestBlock().Index+1
+		var err error
+		if param := req.URL.Query().Get("start"); param != "" {
+			if start, err = strconv.Atoi(param); err != nil {
+				http.Error(w, "Start height must be int", http.StatusBadRequest)
+				return
+			}
+		}
+		if param := req.URL.Query().Get("end"); param != "" {
+			if end, err = strconv.Atoi(param); err != nil {
+				http.Error(w, "End height must be int", http.StatusBadRequest)
+				return
+			}
+		}
+		// Return list of the blocks stored on the chain in the range
+		resp, err := json.Marshal(snapshot.GetRange(start, end))
 		if err != nil {
 			http.Error(w, "Error", http.StatusInternalServerError)
 		}
@@ -34,29 +63,111 @@ func BlocksHandler(bc blockchain.BlockChain) http.Handler {
 	})
 }
 
-func MineBlockHandler(bc blockchain.BlockChain, pc chan tcp.Peer) http.Handler {
+// BlockHandler GET /blocks/block?hash={block hash} or GET /blocks/block?height={block height}
+func BlockHandler(bc blockchain.BlockChain) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
+		if req.Method != http.MethodGet {
 			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
 			return
 		}
 
-		body, err := io.ReadAll(req.Body)
+		var b *block.Block
+		if hash := req.URL.Query().Get("hash"); hash != "" {
+			b = bc.GetBlockByHash(hash)
+		} else {
+			height, err := strconv.Atoi(req.URL.Query().Get("height"))
+			if err != nil {
+				http.Error(w, "Block hash or height must be given", http.StatusBadRequest)
+				return
+			}
+			b = bc.GetBlockByHeight(height)
+		}
+		if b == nil {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+
+		resp, err := json.Marshal(b)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(resp)
 		if err != nil {
-			log.Printf("Failed to read request body: %s\n", err)
+			log.Println(err.Error())
 			http.Error(w, "Error", http.StatusInternalServerError)
+		}
+	})
+}
+
+// MerkleProofHandler GET /blocks/proof?index={block index}&tx={transaction id}
+func MerkleProofHandler(bc blockchain.BlockChain) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
 			return
 		}
 
-		mineBlockRequest := &MineBlockRequest{}
-		err = json.Unmarshal(body, mineBlockRequest)
+		index, err := strconv.Atoi(req.URL.Query().Get("index"))
 		if err != nil {
-			log.Printf("Failed to unmarshal request: %s\n", err)
-			http.Error(w, "Error", http.StatusBadRequest)
+			http.Error(w, "Block index must be int", http.StatusBadRequest)
 			return
 		}
+		txId := req.URL.Query().Get("tx")
 
-		newBlock := bc.MineBlock(mineBlockRequest.Data)
+		b := bc.GetBlockByHeight(index)
+		if b == nil {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+
+		proof, err := b.CreateMerkleProof(txId)
+		if err != nil {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+			return
+		}
+
+		resp, err := json.Marshal(&MerkleProofResponse{
+			BlockHash:  b.BlockHash,
+			MerkleRoot: b.MerkleRoot,
+			TxId:       txId,
+			TxHash:     b.GetTransaction(txId).CalculateWitnessHash(),
+			Proof:      proof,
+		})
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(resp)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
+		}
+	})
+}
+
+// MineBlockHandler POST /blocks/mine. Mines a block of transactions from the mempool and pays the block reward to
+// `minerAddress`. The block is broadcast over the sessions of `sm`.
+func MineBlockHandler(bc blockchain.BlockChain, mp mempool.Mempool, pc chan tcp.Peer, sm *tcp.SessionManager,
+	minerAddress string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Mining stops if the client goes away
+		newBlock, err := bc.MineBlock(req.Context(), minerAddress, mp.SelectBlockTransactions())
+		if errors.Is(err, blockchain.ErrTipChanged) {
+			http.Error(w, "A new block arrived while mining, try again", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("Stopped mining: %s\n", err)
+			http.Error(w, "Mining stopped", http.StatusServiceUnavailable)
+			return
+		}
 		err = bc.AddBlock(newBlock)
 		if err != nil {
 			log.Printf("Failed to add new block to blockchain: %s\n", err)
@@ -67,24 +178,164 @@ func MineBlockHandler(bc blockchain.BlockChain, pc chan tcp.Peer) http.Handler {
 
 		log.Println("Successfully mined a new block!")
 
-		peerConnList, err := database.GetAllPeerConnInfo()
+		// Broadcast the newly mined block to all peers
+		tcp.BroadCastBlockToRegisteredPeers(newBlock, sm, pc)
+	})
+}
+
+// TransactionsHandler GET /transactions lists the mempool, POST /transactions adds a transaction to it and broadcasts
+// it over the sessions of `sm`
+func TransactionsHandler(mp mempool.Mempool, pc chan tcp.Peer, sm *tcp.SessionManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			resp, err := json.Marshal(mp.GetTransactions())
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Error", http.StatusInternalServerError)
+				return
+			}
+			_, err = w.Write(resp)
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Error", http.StatusInternalServerError)
+			}
+		case http.MethodPost:
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				log.Printf("Failed to read request body: %s\n", err)
+				http.Error(w, "Error", http.StatusInternalServerError)
+				return
+			}
+
+			tx := &transaction.Transaction{}
+			err = json.Unmarshal(body, tx)
+			if err != nil {
+				log.Printf("Failed to unmarshal request: %s\n", err)
+				http.Error(w, "Error", http.StatusBadRequest)
+				return
+			}
+
+			err = mp.AddTransaction(tx)
+			if err != nil {
+				log.Printf("Received invalid transaction: %s\n", err)
+				http.Error(w, "Invalid transaction: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+
+			log.Println("Added transaction to mempool: " + tx.Id)
+
+			// Broadcast the transaction so every peer can mine it
+			tcp.BroadCastTransactionToRegisteredPeers(tx, sm, pc)
+		default:
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// MinerStartHandler POST /miner/start
+func MinerStartHandler(m miner.Miner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		err := m.Start()
 		if err != nil {
-			log.Printf("Failed to get list of registered peers: %s\n", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeMinerStatus(w, m)
+	})
+}
+
+// MinerStopHandler POST /miner/stop
+func MinerStopHandler(m miner.Miner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		err := m.Stop()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeMinerStatus(w, m)
+	})
+}
+
+// MinerStatusHandler GET /miner/status
+func MinerStatusHandler(m miner.Miner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		writeMinerStatus(w, m)
+	})
+}
+
+func writeMinerStatus(w http.ResponseWriter, m miner.Miner) {
+	resp, err := json.Marshal(m.GetStatus())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resp)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Error", http.StatusInternalServerError)
+	}
+}
+
+// SyncStatusHandler GET /sync/status
+func SyncStatusHandler(d ibd.Downloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		resp, err := json.Marshal(d.GetStatus())
+		if err != nil {
+			log.Println(err.Error())
 			http.Error(w, "Error", http.StatusInternalServerError)
 			return
 		}
-		peers, err := tcp.GetPeers(peerConnList, &tcp.TcpDialer{})
+		_, err = w.Write(resp)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
+		}
+	})
+}
 
+// SessionsHandler GET /peers/sessions
+func SessionsHandler(sm *tcp.SessionManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		resp, err := json.Marshal(sm.GetStatus())
 		if err != nil {
-			log.Println("Failed to get peers: " + err.Error())
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
 			return
 		}
-		// Broadcast the newly mined block to all peers
-		tcp.BroadCastBlockToPeers(newBlock, peers, pc)
+		_, err = w.Write(resp)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Error", http.StatusInternalServerError)
+		}
 	})
 }
 
-func PeersHandler() http.Handler {
+// PeersHandler GET /peers lists the registered peers, POST /peers registers a peer and tells `d` to sync with it if
+// it is waiting for a peer
+func PeersHandler(d ibd.Downloader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case http.MethodGet:
@@ -131,11 +382,13 @@ func PeersHandler() http.Handler {
 			if err != nil {
 				log.Println(err.Error())
 				http.Error(w, "Error", http.StatusInternalServerError)
+				return
 			}
 
 			w.WriteHeader(http.StatusCreated)
 
 			log.Println(fmt.Sprintf("Registered peer with IP=%s and port=%d", peerConnInfo.Ip, peerConnInfo.Port))
+			d.Notify()
 		default:
 			http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
 			return
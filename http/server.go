@@ -3,15 +3,27 @@ package http
 import (
 	"fmt"
 	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/ibd"
+	"github.com/defaziom/blockchain-go/mempool"
+	"github.com/defaziom/blockchain-go/miner"
 	"github.com/defaziom/blockchain-go/tcp"
 	"log"
 	"net/http"
 )
 
-func StartServer(port int, pc chan tcp.Peer, bc blockchain.BlockChain) {
+func StartServer(port int, pc chan tcp.Peer, sm *tcp.SessionManager, bc blockchain.BlockChain, mp mempool.Mempool,
+	m miner.Miner, minerAddress string, d ibd.Downloader) {
 	http.Handle("/blocks", LogMethodAndEndpoint(JsonResponse(BlocksHandler(bc))))
-	http.Handle("/blocks/mine", LogMethodAndEndpoint(JsonResponse(MineBlockHandler(bc, pc))))
-	http.Handle("/peers", LogMethodAndEndpoint(JsonResponse(PeersHandler())))
+	http.Handle("/blocks/block", LogMethodAndEndpoint(JsonResponse(BlockHandler(bc))))
+	http.Handle("/blocks/proof", LogMethodAndEndpoint(JsonResponse(MerkleProofHandler(bc))))
+	http.Handle("/blocks/mine", LogMethodAndEndpoint(JsonResponse(MineBlockHandler(bc, mp, pc, sm, minerAddress))))
+	http.Handle("/transactions", LogMethodAndEndpoint(JsonResponse(TransactionsHandler(mp, pc, sm))))
+	http.Handle("/miner/start", LogMethodAndEndpoint(JsonResponse(MinerStartHandler(m))))
+	http.Handle("/miner/stop", LogMethodAndEndpoint(JsonResponse(MinerStopHandler(m))))
+	http.Handle("/miner/status", LogMethodAndEndpoint(JsonResponse(MinerStatusHandler(m))))
+	http.Handle("/sync/status", LogMethodAndEndpoint(JsonResponse(SyncStatusHandler(d))))
+	http.Handle("/peers", LogMethodAndEndpoint(JsonResponse(PeersHandler(d))))
+	http.Handle("/peers/sessions", LogMethodAndEndpoint(JsonResponse(SessionsHandler(sm))))
 	log.Println(fmt.Sprintf("Starting HTTP server on %d", port))
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
 }
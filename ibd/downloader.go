@@ -0,0 +1,591 @@
+package ibd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/tcp"
+	"log"
+	"sync"
+	"time"
+)
+
+// State is the step of the initial block download the node is at
+type State string
+
+const (
+	StateWaiting State = "waiting" // Looking for a peer ahead of the node
+	StateHeaders State = "headers" // Downloading and validating the headers of the best peer
+	StateBlocks  State = "blocks"  // Downloading the blocks of the validated headers from every peer
+	StateDone    State = "done"    // Caught up with the peers, blocks are served normally
+)
+
+var (
+	ErrNoPeers            = errors.New("no peer to download from")
+	ErrTimeout            = errors.New("peer did not answer in time")
+	ErrUnexpectedResponse = errors.New("peer sent an unexpected response")
+	ErrInvalidBody        = errors.New("peer sent a block that does not match its header")
+)
+
+// Config controls how blocks are downloaded
+type Config struct {
+	MaxInFlightPerPeer int           // Blocks asked from one peer at a time
+	DownloadWindow     int           // Blocks past the tip that can be downloaded before the blocks below are added
+	RequestTimeout     time.Duration // Time a peer has to answer a request before it is dropped
+	RetryInterval      time.Duration // Time between looking for peers while the node is behind
+	MaxTipAge          time.Duration // The node is behind while its tip is older than this
+}
+
+// DefaultConfig returns the settings used when none are configured
+func DefaultConfig() *Config {
+	return &Config{
+		MaxInFlightPerPeer: 16,
+		DownloadWindow:     1024,
+		RequestTimeout:     10 * time.Second,
+		RetryInterval:      5 * time.Second,
+		MaxTipAge:          24 * time.Hour,
+	}
+}
+
+// Status is a snapshot of the progress of the initial block download
+type Status struct {
+	State                State
+	InitialBlockDownload bool
+	Peers                int     // Peers blocks are being downloaded from
+	BlockHeight          int     // Height of the tip
+	HeaderHeight         int     // Height of the last validated header
+	InFlight             int     // Blocks asked for and not received yet
+	Progress             float64 // Share of the blocks of the validated headers that were added, from 0 to 1
+}
+
+// Downloader catches a node up with its peers when it starts far behind them
+type Downloader interface {
+	Start()
+	// Notify tells the downloader a peer that may be ahead of the node was found, so it syncs again if it is waiting
+	// for one
+	Notify()
+	IsInitialBlockDownload() bool
+	GetStatus() *Status
+}
+
+// DownloaderIml downloads the headers of the peer with the best chain first and validates them, then downloads the
+// blocks of the headers from every peer at once and adds them in order. The node is in initial block download until
+// its tip is recent or a peer it can sync with is not ahead of it, and it stays out of it from then on. A node without
+// a peer to sync with leaves it too, so it serves its blocks, but syncs again once it is notified of a peer.
+type DownloaderIml struct {
+	BlockChain blockchain.BlockChain
+	Clock      clock.Clock
+	Config     *Config
+	// GetPeers connects to the peers to download from. The peers are closed once the download is done.
+	GetPeers    func() ([]tcp.Peer, error)
+	state       State
+	caughtUp    bool
+	idle        bool          // No peer could be synced with, so the node serves its blocks until one is found
+	notify      chan struct{} // Wakes the idle downloader started by Start
+	headerChain *blockchain.HeaderChain
+	download    *download
+	mu          sync.Mutex
+}
+
+// CreateDownloader creates a Downloader of blocks for `bc` from the peers returned by `getPeers`
+func CreateDownloader(bc blockchain.BlockChain, c clock.Clock, config *Config,
+	getPeers func() ([]tcp.Peer, error)) *DownloaderIml {
+	return &DownloaderIml{
+		BlockChain: bc,
+		Clock:      c,
+		Config:     config,
+		GetPeers:   getPeers,
+		state:      StateWaiting,
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+// Start syncs with the peers in a new goroutine until the node is caught up. While there is no peer to sync with it
+// waits to be notified of one.
+func (d *DownloaderIml) Start() {
+	go func() {
+		for !d.isCaughtUp() {
+			if err := d.Sync(); err != nil {
+				log.Println("Initial block download failed: " + err.Error())
+			}
+			if d.IsInitialBlockDownload() {
+				time.Sleep(d.Config.RetryInterval)
+			} else if !d.isCaughtUp() {
+				log.Println("Waiting for a peer to sync with")
+				<-d.notify
+			}
+		}
+		log.Println("Caught up with peers")
+	}()
+}
+
+// Notify wakes the downloader if it is waiting for a peer to sync with
+func (d *DownloaderIml) Notify() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// IsInitialBlockDownload checks if the node is still catching up with its peers
+func (d *DownloaderIml) IsInitialBlockDownload() bool {
+	return !d.isCaughtUp() && !d.isIdle()
+}
+
+// isCaughtUp checks if the node left initial block download for good
+func (d *DownloaderIml) isCaughtUp() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.caughtUp && d.Clock.Now().Sub(d.BlockChain.GetLatestBlock().Timestamp) < d.Config.MaxTipAge {
+		d.setCaughtUp()
+	}
+	return d.caughtUp
+}
+
+// isIdle checks if the node is waiting for a peer to sync with
+func (d *DownloaderIml) isIdle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.idle
+}
+
+// setIdle records whether the node found no peer to sync with
+func (d *DownloaderIml) setIdle(idle bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.idle = idle
+}
+
+// setCaughtUp leaves initial block download for good. The caller holds mu.
+func (d *DownloaderIml) setCaughtUp() {
+	d.caughtUp = true
+	d.state = StateDone
+}
+
+// GetStatus returns the progress of the initial block download
+func (d *DownloaderIml) GetStatus() *Status {
+	ibd := d.IsInitialBlockDownload()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := &Status{
+		State:                d.state,
+		InitialBlockDownload: ibd,
+		BlockHeight:          d.BlockChain.GetLatestBlock().Index,
+	}
+	status.HeaderHeight = status.BlockHeight
+	if d.headerChain != nil {
+		base, tip := d.headerChain.GetBase().Index, d.headerChain.GetTip().Index
+		status.HeaderHeight = tip
+		if tip > base {
+			status.Progress = float64(status.BlockHeight-base) / float64(tip-base)
+		}
+	}
+	if status.Progress > 1 || d.caughtUp {
+		status.Progress = 1
+	}
+	if d.download != nil {
+		status.Peers, status.InFlight = d.download.getStatus()
+	}
+	return status
+}
+
+// setState moves the download to `state` unless the node already caught up
+func (d *DownloaderIml) setState(state State) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.caughtUp {
+		d.state = state
+	}
+}
+
+// Sync downloads the blocks the peers have beyond the tip. The headers are synced from the peer that announced the
+// highest chain in its handshake, and the blocks from every peer that can serve them.
+func (d *DownloaderIml) Sync() error {
+	peers, err := d.GetPeers()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, peer := range peers {
+			if !peer.IsClosed() {
+				_ = peer.SendAckMsg()
+				_ = peer.ClosePeer()
+			}
+		}
+	}()
+
+	var best tcp.Peer
+	var sources []tcp.Peer
+	for _, peer := range peers {
+		remote := peer.GetRemote()
+		if remote == nil || !peer.Supports(tcp.GET_HEADERS) || !peer.Supports(tcp.GET_DATA) {
+			continue
+		}
+		sources = append(sources, peer)
+		if best == nil || remote.BestHeight > best.GetRemote().BestHeight {
+			best = peer
+		}
+	}
+	// A node without a peer to sync with serves its blocks until it finds one, since it would otherwise never serve them
+	if best == nil {
+		log.Println("No peer to sync with")
+		d.setIdle(true)
+		return nil
+	} else if best.GetRemote().BestHeight <= d.BlockChain.GetLatestBlock().Index {
+		log.Println("No peer is ahead of the node")
+		d.mu.Lock()
+		d.setCaughtUp()
+		d.mu.Unlock()
+		return nil
+	}
+	d.setIdle(false)
+
+	d.setState(StateHeaders)
+	headerChain, err := d.syncHeaders(best)
+	if err != nil {
+		d.setState(StateWaiting)
+		return err
+	}
+	if headerChain.GetWork().Cmp(d.BlockChain.GetCumulativeDifficulty()) > 0 {
+		d.setState(StateBlocks)
+		err = d.downloadBlocks(headerChain, sources)
+		if err != nil {
+			d.setState(StateWaiting)
+			return err
+		}
+	}
+
+	if d.BlockChain.GetLatestBlock().Index >= best.GetRemote().BestHeight {
+		d.mu.Lock()
+		d.setCaughtUp()
+		d.mu.Unlock()
+	} else {
+		d.setState(StateWaiting)
+	}
+	return nil
+}
+
+// syncHeaders downloads and validates the headers `peer` has beyond the tip
+func (d *DownloaderIml) syncHeaders(peer tcp.Peer) (*blockchain.HeaderChain, error) {
+	locator := d.BlockChain.GetBlockLocator(d.BlockChain.GetLatestBlock().BlockHash)
+	var headerChain *blockchain.HeaderChain
+	for {
+		if err := peer.SendGetHeadersMsg(locator, ""); err != nil {
+			return nil, err
+		}
+		msg, err := receive(peer, tcp.RESPONSE_HEADERS, d.Config.RequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if headerChain == nil {
+			// The headers start after the fork point of the main chain with the chain of the peer
+			base := d.BlockChain.GetLatestBlock().BlockHash
+			if len(msg.Headers) > 0 {
+				base = msg.Headers[0].PrevBlockHash
+			}
+			if headerChain, err = d.BlockChain.CreateHeaderChain(base); err != nil {
+				return nil, err
+			}
+			d.mu.Lock()
+			d.headerChain = headerChain
+			d.mu.Unlock()
+		}
+		if err = headerChain.AddHeaders(msg.Headers); err != nil {
+			return nil, err
+		}
+		log.Printf("Validated headers up to height %d\n", headerChain.GetTip().Index)
+		if len(msg.Headers) < tcp.MaxHeadersPerBatch {
+			return headerChain, nil
+		}
+		locator = headerChain.GetLocator()
+	}
+}
+
+// downloadBlocks downloads the blocks of the headers of `headerChain` from `peers` at once and adds them in order
+func (d *DownloaderIml) downloadBlocks(headerChain *blockchain.HeaderChain, peers []tcp.Peer) error {
+	dl := createDownload(headerChain.GetHeaders(), d.Config.DownloadWindow, len(peers))
+	for i, header := range dl.headers {
+		// Blocks the node has on a side branch are not downloaded again
+		if b := d.BlockChain.GetBlockByHash(header.BlockHash); b != nil {
+			dl.received[i] = b
+		}
+	}
+	d.mu.Lock()
+	d.download = dl
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.download = nil
+		d.mu.Unlock()
+	}()
+
+	var workers sync.WaitGroup
+	for _, peer := range peers {
+		workers.Add(1)
+		go func(peer tcp.Peer) {
+			defer workers.Done()
+			d.fetchBlocks(dl, peer)
+		}(peer)
+	}
+	err := d.addBlocks(dl)
+	dl.finish()
+	workers.Wait()
+	return err
+}
+
+// fetchBlocks asks `peer` for the blocks of the download until they are all received. The peer is dropped when it
+// fails to answer in time, does not send any of the blocks asked for or sends one that does not match its header.
+func (d *DownloaderIml) fetchBlocks(dl *download, peer tcp.Peer) {
+	defer dl.dropPeer()
+	for {
+		indexes := dl.take(d.Config.MaxInFlightPerPeer)
+		if indexes == nil {
+			return
+		}
+		hashes := make([]string, len(indexes))
+		for i, index := range indexes {
+			hashes[i] = dl.headers[index].BlockHash
+		}
+		err := peer.SendGetDataMsg(hashes)
+		var msg *tcp.PeerMsg
+		if err == nil {
+			msg, err = receive(peer, tcp.RESPONSE_BLOCKS, d.Config.RequestTimeout)
+		}
+		if err == nil {
+			err = dl.deliver(indexes, msg.Data, peer)
+		}
+		if err != nil {
+			log.Printf("Dropping peer from the block download: %s\n", err)
+			dl.release(indexes)
+			_ = peer.ClosePeer()
+			return
+		}
+	}
+}
+
+// addBlocks adds the blocks of the download to the chain in order as they are received. A block the chain rejects is
+// asked for again and the peer that sent it is dropped, so one bad peer does not fail the download.
+func (d *DownloaderIml) addBlocks(dl *download) error {
+	for {
+		b, sender, err := dl.nextBlock()
+		if err != nil || b == nil {
+			return err
+		}
+		err = d.BlockChain.AddBlock(b)
+		if err == nil || errors.Is(err, blockchain.ErrKnownBlock) {
+			dl.added()
+			continue
+		} else if sender == nil {
+			// The node had the block on a side branch, so no peer can send a better one
+			return err
+		}
+		log.Printf("Dropping peer from the block download: %s\n", err)
+		dl.reject()
+		_ = sender.ClosePeer()
+	}
+}
+
+// checkBody checks that `b` is the block of `header`: its header hashes to the header's hash, and its transactions
+// have their own ids and hash to its Merkle root
+func checkBody(b *block.Block, header *block.Block) error {
+	if b.Index != header.Index || b.CalculateBlockHash() != header.BlockHash {
+		return fmt.Errorf("%w: header of block %d", ErrInvalidBody, header.Index)
+	}
+	for _, tx := range b.Transactions {
+		if tx.Id != tx.CalculateTransactionId() {
+			return fmt.Errorf("%w: id of transaction %s in block %d", ErrInvalidBody, tx.Id, header.Index)
+		}
+	}
+	if b.MerkleRoot != b.CalculateMerkleRoot() {
+		return fmt.Errorf("%w: merkle root of block %d", ErrInvalidBody, header.Index)
+	}
+	return nil
+}
+
+// receive waits up to `timeout` for the next msg from `peer`, which must be of `msgType`. The peer is closed if it
+// does not answer in time.
+func receive(peer tcp.Peer, msgType tcp.PeerMsgType, timeout time.Duration) (*tcp.PeerMsg, error) {
+	type result struct {
+		msg *tcp.PeerMsg
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msg, err := peer.ReceiveMsg()
+		results <- result{msg, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return nil, r.err
+		} else if r.msg == nil {
+			return nil, tcp.ErrPeerDisconnected
+		} else if r.msg.Type != msgType {
+			return nil, fmt.Errorf("%w: got %d instead of %d", ErrUnexpectedResponse, r.msg.Type, msgType)
+		}
+		return r.msg, nil
+	case <-timer.C:
+		_ = peer.ClosePeer()
+		return nil, ErrTimeout
+	}
+}
+
+// download tracks which blocks of a list of headers were asked for and received
+type download struct {
+	headers  []*block.Block
+	window   int
+	next     int                  // Index of the first header whose block was not added yet
+	inFlight map[int]bool         // Indexes of the blocks asked for and not received yet
+	received map[int]*block.Block // Blocks received and not added yet by the index of their header
+	senders  map[int]tcp.Peer     // Peers that sent the received blocks by the index of their header
+	peers    int                  // Peers still downloading
+	done     bool
+	mu       sync.Mutex
+	cond     *sync.Cond
+}
+
+// createDownload creates the download of the blocks of `headers` from `peers` peers
+func createDownload(headers []*block.Block, window int, peers int) *download {
+	dl := &download{
+		headers:  headers,
+		window:   window,
+		inFlight: map[int]bool{},
+		received: map[int]*block.Block{},
+		senders:  map[int]tcp.Peer{},
+		peers:    peers,
+	}
+	dl.cond = sync.NewCond(&dl.mu)
+	return dl
+}
+
+// take marks up to `n` blocks of the window that were neither asked for nor received as asked for and returns their
+// indexes, first block first. It waits while every block of the window is, and returns nil once the download is done.
+func (dl *download) take(n int) []int {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for !dl.done {
+		var indexes []int
+		end := dl.next + dl.window
+		if end > len(dl.headers) {
+			end = len(dl.headers)
+		}
+		for i := dl.next; i < end && len(indexes) < n; i++ {
+			if !dl.inFlight[i] && dl.received[i] == nil {
+				indexes = append(indexes, i)
+				dl.inFlight[i] = true
+			}
+		}
+		if len(indexes) > 0 {
+			return indexes
+		}
+		dl.cond.Wait()
+	}
+	return nil
+}
+
+// deliver stores the blocks `peer` sent for the blocks at `indexes`. The blocks that were not received can be asked
+// for again. None are stored and an error is returned if a block does not match its header, or if none of the blocks
+// were received.
+func (dl *download) deliver(indexes []int, blocks []*block.Block, peer tcp.Peer) error {
+	byHash := make(map[string]*block.Block, len(blocks))
+	for _, b := range blocks {
+		byHash[b.BlockHash] = b
+	}
+	received := map[int]*block.Block{}
+	for _, i := range indexes {
+		if b := byHash[dl.headers[i].BlockHash]; b != nil {
+			if err := checkBody(b, dl.headers[i]); err != nil {
+				return err
+			}
+			received[i] = b
+		}
+	}
+	if len(received) == 0 {
+		return fmt.Errorf("%w: none of the blocks asked for", ErrUnexpectedResponse)
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for _, i := range indexes {
+		delete(dl.inFlight, i)
+	}
+	for i, b := range received {
+		dl.received[i] = b
+		dl.senders[i] = peer
+	}
+	dl.cond.Broadcast()
+	return nil
+}
+
+// release lets the blocks at `indexes` be asked for again
+func (dl *download) release(indexes []int) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for _, i := range indexes {
+		delete(dl.inFlight, i)
+	}
+	dl.cond.Broadcast()
+}
+
+// dropPeer records that a peer stopped downloading
+func (dl *download) dropPeer() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.peers--
+	dl.cond.Broadcast()
+}
+
+// nextBlock waits for the block after the last one added and returns it with the peer that sent it, which is nil for
+// blocks the node already had, or nil once every block was added. An error is returned if every peer was dropped
+// before the block was received.
+func (dl *download) nextBlock() (*block.Block, tcp.Peer, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for dl.next < len(dl.headers) {
+		if b := dl.received[dl.next]; b != nil {
+			return b, dl.senders[dl.next], nil
+		} else if dl.peers == 0 {
+			return nil, nil, fmt.Errorf("%w: block %d is missing", ErrNoPeers, dl.headers[dl.next].Index)
+		}
+		dl.cond.Wait()
+	}
+	return nil, nil, nil
+}
+
+// added records that the block returned by nextBlock was added
+func (dl *download) added() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	delete(dl.received, dl.next)
+	delete(dl.senders, dl.next)
+	dl.next++
+	// The window moved, so more blocks can be asked for
+	dl.cond.Broadcast()
+}
+
+// reject lets the block returned by nextBlock be asked for again
+func (dl *download) reject() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	delete(dl.received, dl.next)
+	delete(dl.senders, dl.next)
+	dl.cond.Broadcast()
+}
+
+// finish ends the download, so the peers stop asking for blocks
+func (dl *download) finish() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.done = true
+	dl.cond.Broadcast()
+}
+
+// getStatus returns the number of peers downloading and of blocks in flight
+func (dl *download) getStatus() (int, int) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.peers, len(dl.inFlight)
+}
@@ -0,0 +1,315 @@
+package ibd
+
+import (
+	"context"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/tcp"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer is a peer serving the blocks of its chain the way the tasks of a caught up node do
+type testServer struct {
+	bc *blockchain.BlockChainIml
+	// silent servers answer GET_HEADERS but never GET_DATA
+	silent bool
+	// badHeaders servers send headers that do not follow each other
+	badHeaders bool
+	// badBodies servers send blocks whose coinbase pays someone else
+	badBodies bool
+}
+
+func (s *testServer) serve(pc chan tcp.Peer) {
+	for peer := range pc {
+		go func(peer tcp.Peer) {
+			for {
+				msg, err := peer.ReceiveMsg()
+				if err != nil || msg == nil {
+					return
+				}
+				switch msg.Type {
+				case tcp.GET_HEADERS:
+					var headers []*block.BlockHeader
+					for _, b := range s.bc.LocateBlocks(msg.Locator, msg.StopHash, tcp.MaxHeadersPerBatch) {
+						headers = append(headers, &b.BlockHeader)
+					}
+					if s.badHeaders && len(headers) > 2 {
+						headers = append(headers[:1], headers[2:]...)
+					}
+					_ = peer.SendHeadersMsg(headers)
+				case tcp.GET_DATA:
+					if s.silent {
+						continue
+					}
+					var blocks []*block.Block
+					for _, hash := range msg.Hashes {
+						b := s.bc.GetBlockByHash(hash)
+						if s.badBodies {
+							b = mutateBody(b)
+						}
+						blocks = append(blocks, b)
+					}
+					_ = peer.SendBlocksMsg(blocks, "")
+				case tcp.ACK:
+					_ = peer.ClosePeer()
+					return
+				}
+			}
+		}(peer)
+	}
+}
+
+// mutateBody returns a copy of `b` whose coinbase pays "thief", with its id updated
+func mutateBody(b *block.Block) *block.Block {
+	mutated := *b
+	coinbase := *b.Transactions[0]
+	coinbase.TxOuts = []*transaction.TxOut{{Address: "thief", Amount: coinbase.TxOuts[0].Amount}}
+	coinbase.Id = coinbase.CalculateTransactionId()
+	mutated.Transactions = append([]*transaction.Transaction{&coinbase}, b.Transactions[1:]...)
+	return &mutated
+}
+
+// rejectingChain is a chain that rejects the first block at `height` it is given
+type rejectingChain struct {
+	*blockchain.BlockChainIml
+	height   int
+	rejected bool
+}
+
+func (c *rejectingChain) AddBlock(b *block.Block) error {
+	if b.Index == c.height && !c.rejected {
+		c.rejected = true
+		return blockchain.ErrInvalidTransactions
+	}
+	return c.BlockChainIml.AddBlock(b)
+}
+
+// createTestChain creates a chain of `n` blocks after the genesis block
+func createTestChain(t *testing.T, n int) *blockchain.BlockChainIml {
+	bc := blockchain.CreateBlockChain()
+	for i := 0; i < n; i++ {
+		b, err := bc.MineBlock(context.Background(), "miner", nil)
+		assert.Nil(t, err)
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	return bc
+}
+
+// startTestServers starts `servers` on a pipe network and returns a function connecting a node following `bc` to all
+// of them
+func startTestServers(bc *blockchain.BlockChainIml, servers []*testServer) func() ([]tcp.Peer, error) {
+	genesisHash := bc.GetGenesisBlock().BlockHash
+	network := tcp.CreatePipeNetwork()
+	for i, server := range servers {
+		server := server
+		pc := make(chan tcp.Peer)
+		network.Listen(fmt.Sprintf("10.0.0.%d:3000", i+1), pc, tcp.CreateNodeInfo("test", genesisHash, func() int {
+			return server.bc.GetLatestBlock().Index
+		}))
+		go server.serve(pc)
+	}
+	node := tcp.CreateNodeInfo("test", genesisHash, func() int {
+		return bc.GetLatestBlock().Index
+	})
+	return func() ([]tcp.Peer, error) {
+		var peers []tcp.Peer
+		for i := range servers {
+			conn, err := network.Dial(fmt.Sprintf("10.0.0.%d:3000", i+1))
+			if err != nil {
+				return nil, err
+			}
+			peer := &tcp.PeerConn{Conn: conn}
+			if err = peer.Handshake(node); err != nil {
+				return nil, err
+			}
+			peers = append(peers, peer)
+		}
+		return peers, nil
+	}
+}
+
+// createTestDownloader creates a Downloader for `bc` whose clock is far enough ahead for the tip to be old
+func createTestDownloader(bc blockchain.BlockChain, getPeers func() ([]tcp.Peer, error)) *DownloaderIml {
+	config := &Config{
+		MaxInFlightPerPeer: 2,
+		DownloadWindow:     8,
+		RequestTimeout:     200 * time.Millisecond,
+		RetryInterval:      10 * time.Millisecond,
+		MaxTipAge:          time.Hour,
+	}
+	c := clock.CreateTestClock(time.Now().Add(2 * time.Hour))
+	return CreateDownloader(bc, c, config, getPeers)
+}
+
+func TestDownloaderIml_Sync(t *testing.T) {
+	chain := createTestChain(t, 30)
+	var servers []*testServer
+	for i := 0; i < 3; i++ {
+		server := &testServer{bc: blockchain.CreateBlockChain()}
+		for _, b := range chain.GetRange(1, 31) {
+			assert.Nil(t, server.bc.AddBlock(b))
+		}
+		servers = append(servers, server)
+	}
+	bc := blockchain.CreateBlockChain()
+	d := createTestDownloader(bc, startTestServers(bc, servers))
+	assert.True(t, d.IsInitialBlockDownload())
+	assert.Equal(t, &Status{State: StateWaiting, InitialBlockDownload: true}, d.GetStatus())
+
+	err := d.Sync()
+
+	assert.Nil(t, err)
+	assert.Equal(t, chain.GetRange(0, 31), bc.GetRange(0, 31))
+	assert.False(t, d.IsInitialBlockDownload(), "Node should leave initial block download once it caught up")
+	assert.Equal(t, &Status{State: StateDone, BlockHeight: 30, HeaderHeight: 30, Progress: 1}, d.GetStatus())
+}
+
+func TestDownloaderIml_Sync_Timeout(t *testing.T) {
+	chain := createTestChain(t, 10)
+	silent := &testServer{bc: chain, silent: true}
+	bc := blockchain.CreateBlockChain()
+	d := createTestDownloader(bc, startTestServers(bc, []*testServer{silent, {bc: chain}}))
+
+	err := d.Sync()
+
+	assert.Nil(t, err)
+	assert.Equal(t, chain.GetLatestBlock(), bc.GetLatestBlock(), "Blocks should be asked again from the other peer")
+
+	// Every peer is dropped if none of them sends the blocks
+	bc = blockchain.CreateBlockChain()
+	d = createTestDownloader(bc, startTestServers(bc, []*testServer{silent}))
+
+	err = d.Sync()
+
+	assert.ErrorIs(t, err, ErrNoPeers)
+	assert.Equal(t, 0, bc.GetLatestBlock().Index)
+	assert.True(t, d.IsInitialBlockDownload())
+	assert.Equal(t, StateWaiting, d.GetStatus().State)
+	assert.Equal(t, 10, d.GetStatus().HeaderHeight, "Headers should be validated before blocks are downloaded")
+}
+
+func TestDownloaderIml_Sync_InvalidHeaders(t *testing.T) {
+	chain := createTestChain(t, 3)
+	bc := blockchain.CreateBlockChain()
+	d := createTestDownloader(bc, startTestServers(bc, []*testServer{{bc: chain, badHeaders: true}}))
+
+	err := d.Sync()
+
+	assert.ErrorIs(t, err, blockchain.ErrUnconnectedHeaders)
+	assert.Equal(t, 0, bc.GetLatestBlock().Index, "No block should be downloaded for invalid headers")
+	assert.True(t, d.IsInitialBlockDownload())
+}
+
+func TestDownloaderIml_Sync_InvalidBodies(t *testing.T) {
+	chain := createTestChain(t, 10)
+	b := chain.GetLatestBlock()
+	dl := createDownload([]*block.Block{b}, 1, 1)
+	assert.ErrorIs(t, dl.deliver([]int{0}, []*block.Block{mutateBody(b)}, nil), ErrInvalidBody,
+		"Block should be checked against its header before the chain sees it")
+	assert.Nil(t, dl.deliver([]int{0}, []*block.Block{b}, nil))
+
+	bad := &testServer{bc: chain, badBodies: true}
+	bc := blockchain.CreateBlockChain()
+	d := createTestDownloader(bc, startTestServers(bc, []*testServer{bad, {bc: chain}}))
+
+	err := d.Sync()
+
+	assert.Nil(t, err)
+	assert.Equal(t, chain.GetRange(0, 11), bc.GetRange(0, 11), "Blocks should be asked again from the honest peer")
+
+	// Blocks that don't match their headers are never added
+	bc = blockchain.CreateBlockChain()
+	d = createTestDownloader(bc, startTestServers(bc, []*testServer{bad}))
+
+	err = d.Sync()
+
+	assert.ErrorIs(t, err, ErrNoPeers)
+	assert.Equal(t, 0, bc.GetLatestBlock().Index)
+}
+
+func TestDownloaderIml_Sync_RejectedBlock(t *testing.T) {
+	chain := createTestChain(t, 10)
+	bc := &rejectingChain{BlockChainIml: blockchain.CreateBlockChain(), height: 5}
+	d := createTestDownloader(bc, startTestServers(bc.BlockChainIml, []*testServer{{bc: chain}, {bc: chain}}))
+
+	err := d.Sync()
+
+	assert.Nil(t, err, "Only the peer that sent the rejected block should be dropped")
+	assert.True(t, bc.rejected)
+	assert.Equal(t, chain.GetRange(0, 11), bc.GetRange(0, 11))
+
+	// The download fails once every peer is dropped
+	bc = &rejectingChain{BlockChainIml: blockchain.CreateBlockChain(), height: 5}
+	d = createTestDownloader(bc, startTestServers(bc.BlockChainIml, []*testServer{{bc: chain}}))
+
+	err = d.Sync()
+
+	assert.ErrorIs(t, err, ErrNoPeers)
+	assert.Equal(t, 4, bc.GetLatestBlock().Index)
+}
+
+func TestDownloaderIml_Start_PeerRegistered(t *testing.T) {
+	chain := createTestChain(t, 10)
+	bc := blockchain.CreateBlockChain()
+	connect := startTestServers(bc, []*testServer{{bc: chain}})
+	var registered int32
+	d := createTestDownloader(bc, func() ([]tcp.Peer, error) {
+		if atomic.LoadInt32(&registered) == 0 {
+			return nil, nil
+		}
+		return connect()
+	})
+
+	d.Start()
+
+	// The node serves its blocks while it has no peer, and keeps waiting for one
+	assert.Eventually(t, func() bool {
+		return !d.IsInitialBlockDownload()
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, StateDone, d.GetStatus().State)
+
+	atomic.StoreInt32(&registered, 1)
+	d.Notify()
+
+	assert.Eventually(t, func() bool {
+		return bc.GetLatestBlock().BlockHash == chain.GetLatestBlock().BlockHash
+	}, 5*time.Second, 10*time.Millisecond, "Blocks should be downloaded from the peer registered later")
+	assert.Eventually(t, func() bool {
+		return d.GetStatus().State == StateDone
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, d.IsInitialBlockDownload())
+}
+
+func TestDownloaderIml_IsInitialBlockDownload(t *testing.T) {
+	chain := createTestChain(t, 2)
+
+	// A node whose tip is recent is caught up
+	d := CreateDownloader(chain, clock.CreateTestClock(time.Now()), DefaultConfig(), nil)
+	assert.False(t, d.IsInitialBlockDownload())
+
+	// So is a node no peer is ahead of, however old its tip
+	d = createTestDownloader(chain, startTestServers(chain, []*testServer{{bc: createTestChain(t, 1)}}))
+	assert.True(t, d.IsInitialBlockDownload())
+	assert.Nil(t, d.Sync())
+	assert.False(t, d.IsInitialBlockDownload())
+
+	// And a node without peers, which would otherwise never serve its blocks
+	d = createTestDownloader(chain, func() ([]tcp.Peer, error) {
+		return nil, nil
+	})
+	assert.Nil(t, d.Sync())
+	assert.False(t, d.IsInitialBlockDownload())
+
+	// A node that fails to connect to its peers stays in initial block download
+	d = createTestDownloader(chain, func() ([]tcp.Peer, error) {
+		return nil, tcp.ErrNoListener
+	})
+	assert.ErrorIs(t, d.Sync(), tcp.ErrNoListener)
+	assert.True(t, d.IsInitialBlockDownload())
+}
@@ -1,20 +1,57 @@
 package main
 
 import (
+	"flag"
+	"github.com/defaziom/blockchain-go/block"
 	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
 	"github.com/defaziom/blockchain-go/database"
 	"github.com/defaziom/blockchain-go/http"
+	"github.com/defaziom/blockchain-go/ibd"
+	"github.com/defaziom/blockchain-go/mempool"
+	"github.com/defaziom/blockchain-go/miner"
+	"github.com/defaziom/blockchain-go/storage"
 	"github.com/defaziom/blockchain-go/task"
 	"github.com/defaziom/blockchain-go/tcp"
+	"github.com/defaziom/blockchain-go/wallet"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const defaultWalletPath = "wallet.key"
+
 func main() {
-	args := os.Args[1:]
+	mine := flag.Bool("mine", false, "Start mining in the background on startup")
+	miningWorkers := flag.Int("mining-workers", runtime.NumCPU(), "Number of goroutines to mine with")
+	consensusMode := flag.String("consensus", "pow", "Consensus engine, pow for proof-of-work, poa for "+
+		"proof-of-authority or bft for byzantine fault tolerant finality")
+	validators := flag.String("validators", "", "Comma separated addresses of the proof-of-authority or bft "+
+		"validators in the order they take turns")
+	blockPeriod := flag.Duration("block-period", 5*time.Second, "Minimum time between proof-of-authority blocks")
+	roundTimeout := flag.Duration("round-timeout", time.Second, "How long bft validators wait for each step of "+
+		"the first round of a height")
+	dataDir := flag.String("data-dir", "", "Directory to keep the blockchain in across restarts. The blockchain is "+
+		"kept in memory only when it is not set.")
+	genesisPath := flag.String("genesis", "", "Genesis file defining the chain to join. The default genesis is "+
+		"used when it is not set.")
+	maxFutureBlockTime := flag.Duration("max-future-block-time", blockchain.DefaultChainParams().MaxFutureBlockTime,
+		"How far ahead of the node's clock blocks can be timestamped")
+	flag.Usage = func() {
+		log.Println("Usage: blockchain-go [-mine] [-mining-workers n] [-consensus pow|poa|bft] " +
+			"[-validators addresses] [-block-period duration] [-round-timeout duration] [-data-dir path] " +
+			"[-genesis path] [-max-future-block-time duration] http_port tcp_port [wallet_path]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
 	if len(args) < 2 {
-		log.Fatalln("Usage: blockchain-go http_port tcp_port")
+		flag.Usage()
+		os.Exit(1)
 	}
 	httpPort, err := strconv.Atoi(args[0])
 	if err != nil {
@@ -24,10 +61,101 @@ func main() {
 	if err != nil {
 		log.Fatalln("TCP port must be int")
 	}
-	theBlockChain := blockchain.CreateBlockChain()
+	walletPath := defaultWalletPath
+	if len(args) > 2 {
+		walletPath = args[2]
+	}
+	minerWallet, err := wallet.LoadOrCreateWallet(walletPath)
+	if err != nil {
+		log.Fatalln("Failed to load wallet: " + err.Error())
+	}
+	log.Println("Block rewards are paid to " + minerWallet.GetAddress())
+	if *maxFutureBlockTime < 0 {
+		log.Fatalln("Max future block time must not be negative")
+	}
+	params := blockchain.DefaultChainParams()
+	params.MaxFutureBlockTime = *maxFutureBlockTime
+	if *genesisPath != "" {
+		params.Genesis, err = blockchain.LoadGenesis(*genesisPath)
+		if err != nil {
+			log.Fatalln("Failed to load genesis: " + err.Error())
+		}
+	}
 	pc := make(chan tcp.Peer)
+	transport := tcp.CreateConsensusTransport(pc)
+	var engine consensus.Engine
+	var bft *consensus.BFT
+	switch *consensusMode {
+	case "pow":
+		pow := consensus.CreateProofOfWork()
+		pow.Workers = *miningWorkers
+		pow.RetargetIntervalBlocks = params.Genesis.RetargetIntervalBlocks
+		engine = pow
+	case "poa":
+		if *validators == "" {
+			log.Fatalln("Proof-of-authority requires -validators")
+		}
+		engine = consensus.CreateProofOfAuthority(strings.Split(*validators, ","), minerWallet, *blockPeriod,
+			&clock.SystemClock{})
+	case "bft":
+		if *validators == "" {
+			log.Fatalln("BFT consensus requires -validators")
+		}
+		bft = consensus.CreateBFT(params.Genesis.ChainId, strings.Split(*validators, ","), minerWallet, transport,
+			*roundTimeout)
+		engine = bft
+	default:
+		log.Fatalln("Unknown consensus engine: " + *consensusMode)
+	}
+	var theBlockChain *blockchain.BlockChainIml
+	if *dataDir == "" {
+		theBlockChain = blockchain.CreateBlockChainWithParams(params, &clock.SystemClock{}, engine)
+	} else {
+		store, err := storage.OpenBlockStore(*dataDir)
+		if err != nil {
+			log.Fatalln("Failed to open block store: " + err.Error())
+		}
+		defer store.Close()
+		theBlockChain, err = blockchain.LoadBlockChain(store, params, &clock.SystemClock{}, engine)
+		if err != nil {
+			log.Fatalln("Failed to load blockchain: " + err.Error())
+		}
+	}
+	localNode := tcp.CreateNodeInfo(params.Genesis.ChainId, theBlockChain.GetGenesisBlock().BlockHash, func() int {
+		return theBlockChain.GetLatestBlock().Index
+	})
+	localNode.Sessions = tcp.DefaultSessionConfig()
+	log.Printf("Following chain %s with genesis block %s as node %s\n", params.Genesis.ChainId,
+		localNode.GenesisHash, localNode.NodeId)
+	sessions := tcp.CreateSessionManager(pc, localNode.Sessions, localNode)
+	theMempool := mempool.CreateMempool(theBlockChain, &clock.SystemClock{}, mempool.DefaultConfig())
+	theMiner := miner.CreateMiner(theBlockChain, theMempool, minerWallet.GetAddress(), func(b *block.Block) {
+		tcp.BroadCastBlockToRegisteredPeers(b, sessions, pc)
+	})
 	_ = database.GetDatabase()
-	go tcp.StartServer(tcpPort, pc)
-	go task.StartTasks(pc, theBlockChain)
-	http.StartServer(httpPort, pc, theBlockChain)
+	go tcp.StartServer(tcpPort, pc, localNode)
+	var consensusHandler consensus.BFTMessageHandler
+	if bft != nil {
+		bft.Chain = theBlockChain
+		transport.Sessions = sessions
+		bft.OnFinalized = func(b *block.Block) {
+			tcp.BroadCastBlockToRegisteredPeers(b, sessions, pc)
+		}
+		consensusHandler = bft
+	}
+	// The download gets connections of its own, since the msgs of the sessions are answered by their jobs
+	getPeers := func() ([]tcp.Peer, error) {
+		return tcp.GetRegisteredPeers(localNode)
+	}
+	downloader := ibd.CreateDownloader(theBlockChain, &clock.SystemClock{}, ibd.DefaultConfig(), getPeers)
+	go task.StartTasks(pc, theBlockChain, theMempool, consensusHandler, downloader)
+	sessions.Start()
+	downloader.Start()
+	if bft != nil {
+		bft.Start()
+	}
+	if *mine {
+		_ = theMiner.Start()
+	}
+	http.StartServer(httpPort, pc, sessions, theBlockChain, theMempool, theMiner, minerWallet.GetAddress(), downloader)
 }
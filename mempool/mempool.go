@@ -0,0 +1,311 @@
+package mempool
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/transaction"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlreadyInPool      = errors.New("transaction is already in the mempool")
+	ErrCoinbaseNotAllowed = errors.New("coinbase transactions can't be added to the mempool")
+	ErrMempoolFull        = errors.New("mempool is full and the transaction does not pay a high enough fee")
+)
+
+// Config limits what the mempool holds
+type Config struct {
+	MaxTransactions      int           // Once full, a new transaction must pay more than the cheapest one to get in
+	Expiry               time.Duration // Transactions that haven't been mined after this long are dropped
+	MaxBlockTransactions int           // Most transactions SelectBlockTransactions picks for a block
+}
+
+// DefaultConfig returns the limits used when none are configured
+func DefaultConfig() *Config {
+	return &Config{
+		MaxTransactions:      5000,
+		Expiry:               24 * time.Hour,
+		MaxBlockTransactions: 1000,
+	}
+}
+
+// Mempool holds valid transactions that are waiting to be mined
+type Mempool interface {
+	AddTransaction(tx *transaction.Transaction) error
+	GetTransactions() []*transaction.Transaction
+	SelectBlockTransactions() []*transaction.Transaction
+	HandleReorg(event *blockchain.ReorgEvent)
+	EvictExpired()
+}
+
+// entry is a transaction in the mempool along with what it takes to rank and expire it
+type entry struct {
+	Tx      *transaction.Transaction
+	Fee     int
+	AddedAt time.Time
+}
+
+// MempoolIml keeps transactions in the order they arrived, so a transaction always comes after the transactions
+// whose outputs it spends
+type MempoolIml struct {
+	BlockChain blockchain.BlockChain
+	Clock      clock.Clock
+	Config     *Config
+	entries    []*entry
+	byId       map[string]*entry
+	unspent    *transaction.UnspentTxOutView // Outputs of the tip with every transaction in the pool applied
+	mu         sync.Mutex
+}
+
+// CreateMempool creates an empty mempool that validates transactions against the tip of `bc` and follows its reorgs
+func CreateMempool(bc blockchain.BlockChain, c clock.Clock, config *Config) *MempoolIml {
+	mp := &MempoolIml{
+		BlockChain: bc,
+		Clock:      c,
+		Config:     config,
+		entries:    []*entry{},
+		byId:       map[string]*entry{},
+		unspent:    bc.GetUnspentTxOutView().Extend(),
+	}
+	bc.SubscribeReorgs(mp.HandleReorg)
+	return mp
+}
+
+// calculateFee returns what the inputs of `tx` hold beyond its outputs. The transaction must already be valid
+// against `unspent`.
+func calculateFee(tx *transaction.Transaction, unspent transaction.UnspentTxOutLookup) int {
+	fee := 0
+	for _, txIn := range tx.TxIns {
+		uTxOut, _ := unspent.Get(txIn.OutPoint())
+		fee += uTxOut.Amount
+	}
+	for _, txOut := range tx.TxOuts {
+		fee -= txOut.Amount
+	}
+	return fee
+}
+
+// AddTransaction validates the transaction against the tip and the transactions already in the pool and adds it.
+// When the pool is full the transaction paying the lowest fee is evicted to make room, as long as the new one pays
+// more.
+func (mp *MempoolIml) AddTransaction(tx *transaction.Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.evictExpired()
+	if _, exists := mp.byId[tx.Id]; exists {
+		return ErrAlreadyInPool
+	}
+	if tx.IsCoinbase() {
+		return ErrCoinbaseNotAllowed
+	}
+	evicted := false
+	if len(mp.entries) >= mp.Config.MaxTransactions {
+		// The fee decides if the transaction gets in, so it is validated before anything is evicted
+		err := transaction.ValidateTransaction(tx, mp.unspent)
+		if err != nil {
+			return err
+		}
+		cheapest := mp.entries[0]
+		for _, candidate := range mp.entries[1:] {
+			if candidate.Fee < cheapest.Fee {
+				cheapest = candidate
+			}
+		}
+		if cheapest.Fee >= calculateFee(tx, mp.unspent) {
+			return ErrMempoolFull
+		}
+		// Transactions spending the outputs of the evicted one are dropped by the rebuild, so the new one has to be
+		// validated again
+		mp.removeEntries(map[string]bool{cheapest.Tx.Id: true})
+		mp.rebuild()
+		evicted = true
+	}
+
+	fee, err := mp.unspent.ApplyTransaction(tx)
+	if err != nil && evicted {
+		return fmt.Errorf("transaction depends on an evicted transaction: %w", err)
+	} else if err != nil {
+		return err
+	}
+	e := &entry{Tx: tx, Fee: fee, AddedAt: mp.Clock.Now()}
+	mp.entries = append(mp.entries, e)
+	mp.byId[tx.Id] = e
+	return nil
+}
+
+// GetTransactions returns every transaction in the pool in the order they arrived
+func (mp *MempoolIml) GetTransactions() []*transaction.Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	txs := make([]*transaction.Transaction, len(mp.entries))
+	for i, e := range mp.entries {
+		txs[i] = e.Tx
+	}
+	return txs
+}
+
+// candidate is a transaction of the pool that can be picked for a block once the transactions it spends from in the
+// pool are
+type candidate struct {
+	*entry
+	order    int          // Position in the pool, which breaks ties between equal fees
+	waiting  int          // Parents in the pool that were not picked yet
+	children []*candidate // Transactions of the pool spending from this one
+}
+
+// candidateHeap holds the candidates whose parents were all picked, highest fee first
+type candidateHeap []*candidate
+
+func (h candidateHeap) Len() int { return len(h) }
+
+func (h candidateHeap) Less(i, j int) bool {
+	if h[i].Fee != h[j].Fee {
+		return h[i].Fee > h[j].Fee
+	}
+	return h[i].order < h[j].order
+}
+
+func (h candidateHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *candidateHeap) Push(x any) { *h = append(*h, x.(*candidate)) }
+
+func (h *candidateHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// SelectBlockTransactions picks the transactions for the next block, highest fee first. A transaction is only picked
+// once the transactions it spends from are, so the result is always valid on top of the tip. The pool is walked once
+// in arrival order to link transactions to their parents, and the picked transactions are applied to a single copy of
+// the outputs of the tip.
+func (mp *MempoolIml) SelectBlockTransactions() []*transaction.Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.evictExpired()
+
+	candidates := make(map[string]*candidate, len(mp.entries))
+	ready := make(candidateHeap, 0)
+	for i, e := range mp.entries {
+		c := &candidate{entry: e, order: i}
+		candidates[e.Tx.Id] = c
+		linked := make(map[string]bool)
+		for _, txIn := range e.Tx.TxIns {
+			if parent, ok := candidates[txIn.TxOutId]; ok && !linked[txIn.TxOutId] {
+				linked[txIn.TxOutId] = true
+				parent.children = append(parent.children, c)
+				c.waiting++
+			}
+		}
+		if c.waiting == 0 {
+			ready = append(ready, c)
+		}
+	}
+	heap.Init(&ready)
+
+	unspent := mp.BlockChain.GetUnspentTxOutView().Extend()
+	selected := make([]*transaction.Transaction, 0)
+	for ready.Len() > 0 && len(selected) < mp.Config.MaxBlockTransactions {
+		c := heap.Pop(&ready).(*candidate)
+		// Transactions that are not valid on the tip are skipped along with every transaction spending from them
+		if _, err := unspent.ApplyTransaction(c.Tx); err != nil {
+			continue
+		}
+		selected = append(selected, c.Tx)
+		for _, child := range c.children {
+			child.waiting--
+			if child.waiting == 0 {
+				heap.Push(&ready, child)
+			}
+		}
+	}
+	return selected
+}
+
+// HandleReorg returns the transactions of reverted blocks to the pool and drops the ones that are included in the
+// applied blocks or conflict with them
+func (mp *MempoolIml) HandleReorg(event *blockchain.ReorgEvent) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	included := make(map[string]bool)
+	for _, b := range event.Applied {
+		for _, tx := range b.Transactions {
+			included[tx.Id] = true
+		}
+	}
+	// Reverted transactions were valid before the pool's, which may spend from them, so they go first, oldest block
+	// first
+	returned := make([]*entry, 0)
+	for i := len(event.Reverted) - 1; i >= 0; i-- {
+		for _, tx := range event.Reverted[i].Transactions {
+			if _, exists := mp.byId[tx.Id]; exists || tx.IsCoinbase() || included[tx.Id] {
+				continue
+			}
+			e := &entry{Tx: tx, AddedAt: mp.Clock.Now()}
+			returned = append(returned, e)
+			mp.byId[tx.Id] = e
+		}
+	}
+	mp.entries = append(returned, mp.entries...)
+	mp.removeEntries(included)
+	mp.rebuild()
+}
+
+// EvictExpired drops transactions that have been in the pool longer than the configured expiry
+func (mp *MempoolIml) EvictExpired() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.evictExpired()
+}
+
+func (mp *MempoolIml) evictExpired() {
+	expired := make(map[string]bool)
+	cutoff := mp.Clock.Now().Add(-mp.Config.Expiry)
+	for _, e := range mp.entries {
+		if e.AddedAt.Before(cutoff) {
+			expired[e.Tx.Id] = true
+		}
+	}
+	if len(expired) > 0 {
+		mp.removeEntries(expired)
+		mp.rebuild()
+	}
+}
+
+// removeEntries removes the transactions with the ids from the pool without revalidating the rest
+func (mp *MempoolIml) removeEntries(ids map[string]bool) {
+	kept := make([]*entry, 0, len(mp.entries))
+	for _, e := range mp.entries {
+		if ids[e.Tx.Id] {
+			delete(mp.byId, e.Tx.Id)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	mp.entries = kept
+}
+
+// rebuild validates every transaction in the pool again on top of the current tip and drops the ones that are no
+// longer valid, along with any that spend from them
+func (mp *MempoolIml) rebuild() {
+	unspent := mp.BlockChain.GetUnspentTxOutView().Extend()
+	kept := make([]*entry, 0, len(mp.entries))
+	for _, e := range mp.entries {
+		fee, err := unspent.ApplyTransaction(e.Tx)
+		if err != nil {
+			delete(mp.byId, e.Tx.Id)
+			continue
+		}
+		e.Fee = fee
+		kept = append(kept, e)
+	}
+	mp.entries = kept
+	mp.unspent = unspent
+}
@@ -0,0 +1,228 @@
+package mempool
+
+import (
+	"context"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const testOutputs = 5       // Number of outputs the test wallet can spend
+const testOutputAmount = 10 // Amount held by each of them
+
+// mineTestBlock mines a block of `txs` on top of the chain paying the reward to `minerAddress`
+func mineTestBlock(bc *blockchain.BlockChainIml, minerAddress string, txs []*transaction.Transaction) *block.Block {
+	b, _ := bc.MineBlock(context.Background(), minerAddress, txs)
+	return b
+}
+
+// createFundedMempool creates an empty mempool on top of a chain where the wallet owns testOutputs outputs
+func createFundedMempool(config *Config) (*MempoolIml, *blockchain.BlockChainIml, *wallet.Wallet, *clock.TestClock) {
+	bc := blockchain.CreateBlockChain()
+	w, _ := wallet.CreateWallet()
+	coinbaseBlock := mineTestBlock(bc, w.GetAddress(), nil)
+	_ = bc.AddBlock(coinbaseBlock)
+
+	coinbase := coinbaseBlock.Transactions[0]
+	txOuts := make([]*transaction.TxOut, testOutputs)
+	for i := range txOuts {
+		txOuts[i] = &transaction.TxOut{Address: w.GetAddress(), Amount: testOutputAmount}
+	}
+	split := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: coinbase.Id, TxOutIndex: 0}}, txOuts)
+	_ = w.SignTransaction(split, bc.GetUnspentTxOuts())
+	_ = bc.AddBlock(mineTestBlock(bc, "miner", []*transaction.Transaction{split}))
+
+	c := clock.CreateTestClock(time.Unix(1000, 0))
+	return CreateMempool(bc, c, config), bc, w, c
+}
+
+// createTestTransaction spends the output at `outPoint` owned by `w`, leaving `fee` to the miner
+func createTestTransaction(w *wallet.Wallet, outPoint transaction.OutPoint, amount int, fee int,
+	unspent transaction.UnspentTxOutSet) *transaction.Transaction {
+	tx := transaction.CreateTransaction(
+		[]*transaction.TxIn{{TxOutId: outPoint.TxOutId, TxOutIndex: outPoint.TxOutIndex}},
+		[]*transaction.TxOut{{Address: w.GetAddress(), Amount: amount - fee}},
+	)
+	_ = w.SignTransaction(tx, unspent)
+	return tx
+}
+
+// getTestOutPoint returns the OutPoint of the `i`th output the wallet was funded with
+func getTestOutPoint(bc *blockchain.BlockChainIml, i int) transaction.OutPoint {
+	return bc.GetLatestBlock().Transactions[1].OutPoint(i)
+}
+
+func TestMempoolIml_AddTransaction(t *testing.T) {
+	mp, bc, w, _ := createFundedMempool(DefaultConfig())
+	unspent := bc.GetUnspentTxOuts()
+
+	tx := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	assert.Nil(t, mp.AddTransaction(tx))
+	assert.Equal(t, []*transaction.Transaction{tx}, mp.GetTransactions())
+
+	assert.ErrorIs(t, mp.AddTransaction(tx), ErrAlreadyInPool)
+
+	conflict := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 2, unspent)
+	assert.ErrorIs(t, mp.AddTransaction(conflict), transaction.ErrMissingTxOut,
+		"Transaction spending an output already spent in the pool should be rejected")
+
+	thief, _ := wallet.CreateWallet()
+	stolen := createTestTransaction(thief, getTestOutPoint(bc, 1), testOutputAmount, 1, unspent)
+	assert.ErrorIs(t, mp.AddTransaction(stolen), transaction.ErrInvalidSignature)
+
+	coinbase := transaction.CreateCoinbaseTransaction(w.GetAddress(), 50, bc.GetLatestBlock().Index+1)
+	assert.ErrorIs(t, mp.AddTransaction(coinbase), ErrCoinbaseNotAllowed)
+
+	// A transaction can spend an output created by a transaction in the pool
+	child := createTestTransaction(w, tx.OutPoint(0), tx.TxOuts[0].Amount, 1,
+		transaction.UnspentTxOutSet{tx.OutPoint(0): {Address: w.GetAddress()}})
+	assert.Nil(t, mp.AddTransaction(child))
+	assert.Len(t, mp.GetTransactions(), 2)
+}
+
+func TestMempoolIml_AddTransaction_Full(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxTransactions = 2
+	mp, bc, w, _ := createFundedMempool(config)
+	unspent := bc.GetUnspentTxOuts()
+
+	cheap := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	expensive := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 3, unspent)
+	assert.Nil(t, mp.AddTransaction(cheap))
+	assert.Nil(t, mp.AddTransaction(expensive))
+
+	tooCheap := createTestTransaction(w, getTestOutPoint(bc, 2), testOutputAmount, 1, unspent)
+	assert.ErrorIs(t, mp.AddTransaction(tooCheap), ErrMempoolFull)
+
+	better := createTestTransaction(w, getTestOutPoint(bc, 2), testOutputAmount, 2, unspent)
+	assert.Nil(t, mp.AddTransaction(better))
+	assert.Equal(t, []*transaction.Transaction{expensive, better}, mp.GetTransactions(),
+		"The transaction paying the lowest fee should be evicted")
+}
+
+func TestMempoolIml_SelectBlockTransactions(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBlockTransactions = 3
+	mp, bc, w, _ := createFundedMempool(config)
+	unspent := bc.GetUnspentTxOuts()
+
+	low := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	high := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 4, unspent)
+	// The child pays the highest fee but can't go in before its parent
+	child := createTestTransaction(w, low.OutPoint(0), low.TxOuts[0].Amount, 5,
+		transaction.UnspentTxOutSet{low.OutPoint(0): {Address: w.GetAddress()}})
+	lowest := createTestTransaction(w, getTestOutPoint(bc, 2), testOutputAmount, 0, unspent)
+	for _, tx := range []*transaction.Transaction{low, high, child, lowest} {
+		assert.Nil(t, mp.AddTransaction(tx))
+	}
+
+	selected := mp.SelectBlockTransactions()
+
+	assert.Equal(t, []*transaction.Transaction{high, low, child}, selected)
+	b := mineTestBlock(bc, "miner", selected)
+	assert.Nil(t, bc.AddBlock(b), "Selected transactions should make a valid block")
+	assert.Equal(t, bc.Params.Genesis.InitialBlockReward+10, b.Transactions[0].TxOuts[0].Amount,
+		"Miner should collect the fees of the selected transactions")
+}
+
+func TestMempoolIml_SelectBlockTransactions_Descendants(t *testing.T) {
+	mp, bc, w, _ := createFundedMempool(DefaultConfig())
+	unspent := bc.GetUnspentTxOuts()
+	utxos := len(unspent)
+
+	parent := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	child := createTestTransaction(w, parent.OutPoint(0), parent.TxOuts[0].Amount, 1,
+		transaction.UnspentTxOutSet{parent.OutPoint(0): {Address: w.GetAddress()}})
+	grandchild := createTestTransaction(w, child.OutPoint(0), child.TxOuts[0].Amount, 6,
+		transaction.UnspentTxOutSet{child.OutPoint(0): {Address: w.GetAddress()}})
+	first := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 2, unspent)
+	second := createTestTransaction(w, getTestOutPoint(bc, 2), testOutputAmount, 2, unspent)
+	for _, tx := range []*transaction.Transaction{parent, child, grandchild, first, second} {
+		assert.Nil(t, mp.AddTransaction(tx))
+	}
+	assert.Len(t, bc.GetUnspentTxOuts(), utxos, "Outputs of the tip should not be modified by the pool")
+
+	selected := mp.SelectBlockTransactions()
+
+	assert.Equal(t, []*transaction.Transaction{first, second, parent, child, grandchild}, selected,
+		"Transactions should be picked once their ancestors are, and equal fees in arrival order")
+	assert.Len(t, bc.GetUnspentTxOuts(), utxos, "Outputs of the tip should not be modified by the selection")
+	assert.Nil(t, bc.AddBlock(mineTestBlock(bc, "miner", selected)))
+}
+
+func TestMempoolIml_HandleReorg_BlockAdded(t *testing.T) {
+	mp, bc, w, _ := createFundedMempool(DefaultConfig())
+	unspent := bc.GetUnspentTxOuts()
+
+	mined := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	pending := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 1, unspent)
+	child := createTestTransaction(w, mined.OutPoint(0), mined.TxOuts[0].Amount, 1,
+		transaction.UnspentTxOutSet{mined.OutPoint(0): {Address: w.GetAddress()}})
+	for _, tx := range []*transaction.Transaction{mined, pending, child} {
+		assert.Nil(t, mp.AddTransaction(tx))
+	}
+	// Mined by someone else along with a transaction conflicting with one in the pool
+	conflict := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 2, unspent)
+	b := mineTestBlock(bc, "miner", []*transaction.Transaction{mined, conflict})
+
+	assert.Nil(t, bc.AddBlock(b))
+
+	assert.Equal(t, []*transaction.Transaction{child}, mp.GetTransactions(),
+		"Mined and conflicting transactions should be evicted")
+}
+
+func TestMempoolIml_HandleReorg(t *testing.T) {
+	mp, bc, w, _ := createFundedMempool(DefaultConfig())
+	unspent := bc.GetUnspentTxOuts()
+	outPoint0, outPoint1 := getTestOutPoint(bc, 0), getTestOutPoint(bc, 1)
+
+	// A competing chain that shares the funding blocks but not the block mined below
+	competingChain := blockchain.CreateBlockChain()
+	for _, b := range bc.GetBlocks().ToSlice()[1:] {
+		assert.Nil(t, competingChain.AddBlock(b))
+	}
+
+	disconnected := createTestTransaction(w, outPoint0, testOutputAmount, 1, unspent)
+	b := mineTestBlock(bc, "miner", []*transaction.Transaction{disconnected})
+	assert.Nil(t, bc.AddBlock(b))
+	pending := createTestTransaction(w, disconnected.OutPoint(0), disconnected.TxOuts[0].Amount, 1,
+		transaction.UnspentTxOutSet{disconnected.OutPoint(0): {Address: w.GetAddress()}})
+	assert.Nil(t, mp.AddTransaction(pending))
+	replacedByConflict := createTestTransaction(w, outPoint1, testOutputAmount, 1, unspent)
+	assert.Nil(t, mp.AddTransaction(replacedByConflict))
+
+	conflict := createTestTransaction(w, outPoint1, testOutputAmount, 2, unspent)
+	conflictBlock := mineTestBlock(competingChain, "other", []*transaction.Transaction{conflict})
+	assert.Nil(t, competingChain.AddBlock(conflictBlock))
+	assert.Nil(t, competingChain.AddBlock(mineTestBlock(competingChain, "other", nil)))
+
+	assert.Nil(t, bc.ReplaceChain(competingChain.GetBlocks().ToSlice()))
+
+	assert.Equal(t, []*transaction.Transaction{disconnected, pending}, mp.GetTransactions(),
+		"Transactions of disconnected blocks should return to the pool and conflicts should be evicted")
+}
+
+func TestMempoolIml_EvictExpired(t *testing.T) {
+	mp, bc, w, c := createFundedMempool(DefaultConfig())
+	unspent := bc.GetUnspentTxOuts()
+
+	old := createTestTransaction(w, getTestOutPoint(bc, 0), testOutputAmount, 1, unspent)
+	assert.Nil(t, mp.AddTransaction(old))
+	c.Advance(mp.Config.Expiry / 2)
+	recent := createTestTransaction(w, getTestOutPoint(bc, 1), testOutputAmount, 1, unspent)
+	assert.Nil(t, mp.AddTransaction(recent))
+
+	c.Advance(mp.Config.Expiry / 2)
+	mp.EvictExpired()
+	assert.Len(t, mp.GetTransactions(), 2, "Transactions should be kept until they expire")
+
+	c.Advance(time.Second)
+	mp.EvictExpired()
+	assert.Equal(t, []*transaction.Transaction{recent}, mp.GetTransactions())
+}
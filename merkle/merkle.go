@@ -0,0 +1,113 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Leaves and inner nodes are hashed with different prefixes so an inner node can never be passed off as a leaf
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+var ErrIndexOutOfRange = errors.New("leaf index out of range")
+
+// ProofStep is the sibling hash at one level on the path from a leaf up to the root
+type ProofStep struct {
+	Hash string
+	// Left is true when the sibling is the left child, i.e. it is hashed before the current node
+	Left bool
+}
+
+func hashLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// nextLevel hashes the nodes of a level pairwise. A node without a sibling is promoted to the next level unchanged.
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, hashNode(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+func hashLeaves(leaves [][]byte) [][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = hashLeaf(leaf)
+	}
+	return level
+}
+
+// CalculateRoot returns the hex encoded Merkle root of the leaves. The root of zero leaves is the hash of nothing.
+func CalculateRoot(leaves [][]byte) string {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return hex.EncodeToString(empty[:])
+	}
+	level := hashLeaves(leaves)
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// CreateProof returns the sibling hashes needed to recompute the root from the leaf at `index`
+func CreateProof(leaves [][]byte, index int) ([]*ProofStep, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, ErrIndexOutOfRange
+	}
+	proof := make([]*ProofStep, 0)
+	level := hashLeaves(leaves)
+	for len(level) > 1 {
+		if index%2 == 1 {
+			proof = append(proof, &ProofStep{Hash: hex.EncodeToString(level[index-1]), Left: true})
+		} else if index+1 < len(level) {
+			proof = append(proof, &ProofStep{Hash: hex.EncodeToString(level[index+1]), Left: false})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyProof checks that `leaf` is included in the tree with the hex encoded `root`. It needs nothing but the proof,
+// so a client can run it without access to the chain.
+func VerifyProof(leaf []byte, proof []*ProofStep, root string) bool {
+	expectedRoot, err := hex.DecodeString(root)
+	if err != nil {
+		return false
+	}
+	current := hashLeaf(leaf)
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+		if step.Left {
+			current = hashNode(sibling, current)
+		} else {
+			current = hashNode(current, sibling)
+		}
+	}
+	return bytes.Equal(current, expectedRoot)
+}
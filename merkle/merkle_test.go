@@ -0,0 +1,64 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func createTestLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	return leaves
+}
+
+func TestCalculateRoot(t *testing.T) {
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", CalculateRoot(nil),
+		"Root of no leaves should be the hash of nothing")
+
+	leaves := createTestLeaves(3)
+	root := CalculateRoot(leaves)
+	assert.Len(t, root, 64)
+	assert.Equal(t, root, CalculateRoot(createTestLeaves(3)), "Root should be deterministic")
+
+	leaves[1] = []byte("changed")
+	assert.NotEqual(t, root, CalculateRoot(leaves), "Root should change when a leaf changes")
+
+	assert.NotEqual(t, CalculateRoot(createTestLeaves(2)), CalculateRoot(createTestLeaves(3)),
+		"Root should change when a leaf is added")
+}
+
+func TestCreateProof_VerifyProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := createTestLeaves(n)
+		root := CalculateRoot(leaves)
+		for i := range leaves {
+			proof, err := CreateProof(leaves, i)
+			assert.Nil(t, err)
+			assert.True(t, VerifyProof(leaves[i], proof, root), "Proof for leaf %d of %d should be valid", i, n)
+			assert.False(t, VerifyProof([]byte("not a leaf"), proof, root),
+				"Proof should not be valid for another leaf")
+		}
+	}
+
+	_, err := CreateProof(createTestLeaves(2), 2)
+	assert.ErrorIs(t, err, ErrIndexOutOfRange)
+}
+
+func TestVerifyProof_Tampered(t *testing.T) {
+	leaves := createTestLeaves(4)
+	root := CalculateRoot(leaves)
+	proof, _ := CreateProof(leaves, 1)
+
+	proof[0].Left = !proof[0].Left
+	assert.False(t, VerifyProof(leaves[1], proof, root), "Proof with a swapped sibling should be invalid")
+	proof[0].Left = !proof[0].Left
+
+	proof[1].Hash = proof[0].Hash
+	assert.False(t, VerifyProof(leaves[1], proof, root), "Proof with a wrong sibling should be invalid")
+
+	assert.False(t, VerifyProof(leaves[1], nil, root), "Empty proof should only be valid for a single leaf")
+	assert.False(t, VerifyProof(leaves[1], proof, "not hex"))
+}
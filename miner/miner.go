@@ -0,0 +1,154 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/mempool"
+	"log"
+	"sync"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("miner is already running")
+	ErrNotRunning     = errors.New("miner is not running")
+)
+
+// Status is a snapshot of what the miner is doing
+type Status struct {
+	Running      bool
+	MinerAddress string
+	BlocksMined  int
+	HashRate     float64 // Hashes per second of the last mining run
+	Error        string  // Why the miner stopped on its own, empty if it did not
+}
+
+// Miner keeps mining blocks on top of the chain in the background
+type Miner interface {
+	Start() error
+	Stop() error
+	GetStatus() *Status
+}
+
+// MinerIml mines blocks of transactions from the mempool, or empty blocks when the mempool is empty. When a block
+// from a peer changes the tip, the block being mined is dropped and mining restarts on the new tip.
+type MinerIml struct {
+	BlockChain   blockchain.BlockChain
+	Mempool      mempool.Mempool
+	MinerAddress string
+	// Broadcast is called with every block the miner adds to the chain
+	Broadcast   func(b *block.Block)
+	blocksMined int
+	err         error // Error the last run stopped with
+	cancel      context.CancelFunc
+	done        chan struct{}
+	mu          sync.Mutex
+}
+
+// CreateMiner creates a stopped miner that pays block rewards to `minerAddress`
+func CreateMiner(bc blockchain.BlockChain, mp mempool.Mempool, minerAddress string,
+	broadcast func(b *block.Block)) *MinerIml {
+	return &MinerIml{
+		BlockChain:   bc,
+		Mempool:      mp,
+		MinerAddress: minerAddress,
+		Broadcast:    broadcast,
+	}
+}
+
+// Start starts mining in a new goroutine
+func (m *MinerIml) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return ErrAlreadyRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.err = nil
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go m.run(ctx, m.done)
+	log.Println("Started miner")
+	return nil
+}
+
+// Stop stops mining and waits for the block being mined to be dropped
+func (m *MinerIml) Stop() error {
+	m.mu.Lock()
+	if m.cancel == nil {
+		m.mu.Unlock()
+		return ErrNotRunning
+	}
+	m.cancel()
+	done := m.done
+	m.cancel = nil
+	m.done = nil
+	m.mu.Unlock()
+
+	<-done
+	log.Println("Stopped miner")
+	return nil
+}
+
+// GetStatus returns whether the miner is running and how it has done so far
+func (m *MinerIml) GetStatus() *Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := &Status{
+		Running:      m.cancel != nil,
+		MinerAddress: m.MinerAddress,
+		BlocksMined:  m.blocksMined,
+		HashRate:     m.BlockChain.GetHashRate(),
+	}
+	if m.err != nil {
+		status.Error = m.err.Error()
+	}
+	return status
+}
+
+// stopOnError marks the miner as stopped after the run closing `done` failed with `err`, so it can be started again
+func (m *MinerIml) stopOnError(err error, done chan struct{}) {
+	log.Println("Miner stopped: " + err.Error())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The run may have been stopped and another one started meanwhile
+	if m.done == done {
+		m.cancel()
+		m.cancel = nil
+		m.done = nil
+		m.err = err
+	}
+}
+
+// run mines one block after another until `ctx` is cancelled
+func (m *MinerIml) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		b, err := m.BlockChain.MineBlock(ctx, m.MinerAddress, m.Mempool.SelectBlockTransactions())
+		if errors.Is(err, blockchain.ErrTipChanged) {
+			log.Println("Tip changed while mining, restarting on the new tip")
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil {
+				m.stopOnError(err, done)
+			}
+			return
+		}
+
+		err = m.BlockChain.AddBlock(b)
+		if err != nil {
+			// Another block may have been added between mining and adding, so try again on the new tip
+			log.Println("Failed to add mined block: " + err.Error())
+			continue
+		}
+		m.mu.Lock()
+		m.blocksMined++
+		m.mu.Unlock()
+		log.Printf("Mined block %d\n", b.Index)
+
+		if m.Broadcast != nil {
+			m.Broadcast(b)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package miner
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/mempool"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForBlocks waits until the miner has mined `n` blocks
+func waitForBlocks(t *testing.T, m *MinerIml, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for m.GetStatus().BlocksMined < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Miner did not mine %d blocks in time", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMinerIml_StartStop(t *testing.T) {
+	bc := blockchain.CreateBlockChain()
+	mp := mempool.CreateMempool(bc, &clock.SystemClock{}, mempool.DefaultConfig())
+	var broadcast []*block.Block
+	mu := sync.Mutex{}
+	m := CreateMiner(bc, mp, "miner", func(b *block.Block) {
+		mu.Lock()
+		defer mu.Unlock()
+		broadcast = append(broadcast, b)
+	})
+
+	assert.False(t, m.GetStatus().Running)
+	assert.ErrorIs(t, m.Stop(), ErrNotRunning)
+
+	assert.Nil(t, m.Start())
+	assert.ErrorIs(t, m.Start(), ErrAlreadyRunning)
+	assert.True(t, m.GetStatus().Running)
+	waitForBlocks(t, m, 3)
+	assert.Nil(t, m.Stop())
+
+	status := m.GetStatus()
+	assert.False(t, status.Running)
+	assert.Equal(t, "miner", status.MinerAddress)
+	assert.Greater(t, status.HashRate, 0.0)
+	assert.Equal(t, status.BlocksMined, bc.GetLatestBlock().Index, "Every mined block should be added to the chain")
+	mu.Lock()
+	assert.Len(t, broadcast, status.BlocksMined, "Every mined block should be broadcast")
+	mu.Unlock()
+	assert.True(t, blockchain.CreateBlockChain().IsValidBlockChain(bc))
+
+	// No blocks are mined once stopped, and the miner can be started again
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, status.BlocksMined, m.GetStatus().BlocksMined)
+	assert.Nil(t, m.Start())
+	waitForBlocks(t, m, status.BlocksMined+1)
+	assert.Nil(t, m.Stop())
+}
+
+func TestMinerIml_Start_Error(t *testing.T) {
+	// The miner can't seal blocks since it is not one of the validators
+	engine := consensus.CreateProofOfAuthority([]string{"validator"}, nil, 0, &clock.SystemClock{})
+	bc := blockchain.CreateBlockChainWithParams(blockchain.DefaultChainParams(), &clock.SystemClock{}, engine)
+	mp := mempool.CreateMempool(bc, &clock.SystemClock{}, mempool.DefaultConfig())
+	m := CreateMiner(bc, mp, "miner", nil)
+
+	assert.Nil(t, m.Start())
+
+	assert.Eventually(t, func() bool {
+		return !m.GetStatus().Running
+	}, time.Second, time.Millisecond, "Miner should stop once mining fails")
+	assert.Contains(t, m.GetStatus().Error, consensus.ErrNotValidator.Error())
+	assert.ErrorIs(t, m.Stop(), ErrNotRunning)
+	assert.Nil(t, m.Start(), "Miner should be able to start again")
+	_ = m.Stop()
+}
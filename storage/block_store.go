@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	blockFileName = "blocks.dat"
+	walFileName   = "blocks.wal"
+	// recordHeaderSize is the size of the length and checksum written ahead of each block
+	recordHeaderSize = 8
+)
+
+var (
+	ErrBlockNotFound = errors.New("block is not in the store")
+	ErrCorruptRecord = errors.New("corrupt block record")
+)
+
+// BlockStore keeps blocks on disk in the order they are appended
+type BlockStore interface {
+	Append(b *block.Block) error
+	GetBlockByHash(hash string) (*block.Block, error)
+	GetBlocksByHeight(height int) ([]*block.Block, error)
+	GetBlocks() ([]*block.Block, error)
+	Close() error
+}
+
+// recordLocation is where a block's record starts in the block file and how long it is
+type recordLocation struct {
+	Offset int64
+	Size   int64
+}
+
+// BlockStoreIml appends blocks to a single file as length-prefixed, checksummed JSON records. The file is only ever
+// appended to, and every append goes through a write-ahead log first. Blocks are indexed by hash and by height in
+// memory, and the index is rebuilt by scanning the file when the store is opened.
+type BlockStoreIml struct {
+	file     *os.File
+	wal      *writeAheadLog
+	size     int64 // Offset of the end of the last complete record
+	order    []recordLocation
+	byHash   map[string]recordLocation
+	byHeight map[int][]string
+	mu       sync.Mutex
+}
+
+// OpenBlockStore opens the block store in `dir`, creating the directory and an empty store if they don't exist. An
+// append that was cut short is redone from the write-ahead log, and a partial record at the end of the block file is
+// dropped.
+func OpenBlockStore(dir string) (*BlockStoreIml, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := openWriteAheadLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	store := &BlockStoreIml{
+		file:     file,
+		wal:      wal,
+		byHash:   map[string]recordLocation{},
+		byHeight: map[int][]string{},
+	}
+	if err = store.recover(); err == nil {
+		err = store.scan()
+	}
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// encodeRecord encodes the block as a record of the block file
+func encodeRecord(b *block.Block) ([]byte, error) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	return record, nil
+}
+
+// decodeRecord checks the length and checksum of the record and returns its payload
+func decodeRecord(record []byte) ([]byte, error) {
+	if len(record) < recordHeaderSize {
+		return nil, ErrCorruptRecord
+	}
+	payload := record[recordHeaderSize:]
+	if int(binary.BigEndian.Uint32(record)) != len(payload) {
+		return nil, ErrCorruptRecord
+	}
+	if binary.BigEndian.Uint32(record[4:]) != crc32.ChecksumIEEE(payload) {
+		return nil, ErrCorruptRecord
+	}
+	return payload, nil
+}
+
+// recover redoes the append logged in the write-ahead log, if any
+func (store *BlockStoreIml) recover() error {
+	offset, record, err := store.wal.pending()
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		log.Printf("Redoing the append of a block record at offset %d\n", offset)
+		if err = store.write(offset, record); err != nil {
+			return err
+		}
+	}
+	return store.wal.commit()
+}
+
+// write writes the record at `offset` of the block file, dropping whatever follows it, and syncs the file
+func (store *BlockStoreIml) write(offset int64, record []byte) error {
+	if err := store.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := store.file.WriteAt(record, offset); err != nil {
+		return err
+	}
+	return store.file.Sync()
+}
+
+// scan reads every record of the block file to rebuild the index
+func (store *BlockStoreIml) scan() error {
+	info, err := store.file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, recordHeaderSize)
+	offset := int64(0)
+	for offset < info.Size() {
+		b, size, err := store.readRecord(offset, info.Size(), header)
+		if errors.Is(err, ErrCorruptRecord) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			log.Printf("Dropping partial block record at offset %d: %s\n", offset, err)
+			if err = store.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		store.index(b, recordLocation{Offset: offset, Size: size})
+		offset += size
+	}
+	store.size = offset
+	return nil
+}
+
+// readRecord reads the record starting at `offset` of a block file ending at `end`, using `header` as a buffer for its
+// header, and returns the block along with the size of the record
+func (store *BlockStoreIml) readRecord(offset int64, end int64, header []byte) (*block.Block, int64, error) {
+	if _, err := store.file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	size := int64(recordHeaderSize) + int64(binary.BigEndian.Uint32(header))
+	if offset+size > end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	b, err := store.read(recordLocation{Offset: offset, Size: size})
+	return b, size, err
+}
+
+// read reads and decodes the record at `location`
+func (store *BlockStoreIml) read(location recordLocation) (*block.Block, error) {
+	record := make([]byte, location.Size)
+	if _, err := store.file.ReadAt(record, location.Offset); err != nil {
+		return nil, err
+	}
+	payload, err := decodeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	b := &block.Block{}
+	if err = json.Unmarshal(payload, b); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptRecord, err)
+	}
+	return b, nil
+}
+
+// index adds the block stored at `location` to the index
+func (store *BlockStoreIml) index(b *block.Block, location recordLocation) {
+	store.order = append(store.order, location)
+	store.byHash[b.BlockHash] = location
+	store.byHeight[b.Index] = append(store.byHeight[b.Index], b.BlockHash)
+}
+
+// Append writes the block at the end of the block file and syncs it. The record is synced to the write-ahead log before
+// it is written to the block file, so an append cut short by a crash is redone when the store is opened again.
+// Appending a block that is already stored does nothing.
+func (store *BlockStoreIml) Append(b *block.Block) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, exists := store.byHash[b.BlockHash]; exists {
+		return nil
+	}
+	record, err := encodeRecord(b)
+	if err != nil {
+		return err
+	}
+	if err = store.wal.begin(store.size, record); err != nil {
+		return err
+	}
+	if err = store.write(store.size, record); err != nil {
+		return err
+	}
+	if err = store.wal.commit(); err != nil {
+		return err
+	}
+	store.index(b, recordLocation{Offset: store.size, Size: int64(len(record))})
+	store.size += int64(len(record))
+	return nil
+}
+
+// GetBlockByHash reads the block with `hash` from the block file
+func (store *BlockStoreIml) GetBlockByHash(hash string) (*block.Block, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	location, exists := store.byHash[hash]
+	if !exists {
+		return nil, ErrBlockNotFound
+	}
+	return store.read(location)
+}
+
+// GetBlocksByHeight reads every block stored at `height`, including blocks on side branches, in the order they were
+// appended
+func (store *BlockStoreIml) GetBlocksByHeight(height int) ([]*block.Block, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blocks := make([]*block.Block, 0, len(store.byHeight[height]))
+	for _, hash := range store.byHeight[height] {
+		b, err := store.read(store.byHash[hash])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// GetBlocks reads every stored block in the order they were appended, so each block comes after its parent
+func (store *BlockStoreIml) GetBlocks() ([]*block.Block, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blocks := make([]*block.Block, 0, len(store.order))
+	for _, location := range store.order {
+		b, err := store.read(location)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// Close closes the block file and the write-ahead log
+func (store *BlockStoreIml) Close() error {
+	walErr := store.wal.close()
+	if err := store.file.Close(); err != nil {
+		return err
+	}
+	return walErr
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestBlocks creates a chain of `n` blocks on top of a made up genesis block
+func createTestBlocks(n int) []*block.Block {
+	blocks := make([]*block.Block, n)
+	prevHash := strings.Repeat("00", 32)
+	for i := range blocks {
+		blocks[i] = &block.Block{
+			BlockHeader: block.BlockHeader{
+				Version:       block.BlockVersion,
+				Timestamp:     time.Unix(int64(1000+i), 0).UTC(),
+				PrevBlockHash: prevHash,
+			},
+			Index: i + 1,
+		}
+		blocks[i].BlockHash = blocks[i].CalculateBlockHash()
+		prevHash = blocks[i].BlockHash
+	}
+	return blocks
+}
+
+// openTestBlockStore opens a block store in `dir` holding `blocks`
+func openTestBlockStore(t *testing.T, dir string, blocks []*block.Block) *BlockStoreIml {
+	store, err := OpenBlockStore(dir)
+	assert.Nil(t, err)
+	for _, b := range blocks {
+		assert.Nil(t, store.Append(b))
+	}
+	return store
+}
+
+func TestBlockStoreIml_Append(t *testing.T) {
+	dir := t.TempDir()
+	blocks := createTestBlocks(3)
+	store := openTestBlockStore(t, dir, blocks)
+	assert.Nil(t, store.Append(blocks[1]), "Appending a stored block should do nothing")
+	assert.Nil(t, store.Close())
+
+	store, err := OpenBlockStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	stored, err := store.GetBlocks()
+	assert.Nil(t, err)
+	assert.Equal(t, blocks, stored, "Blocks should be reloaded in the order they were appended")
+	b, err := store.GetBlockByHash(blocks[1].BlockHash)
+	assert.Nil(t, err)
+	assert.Equal(t, blocks[1], b)
+	_, err = store.GetBlockByHash("unknown")
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+}
+
+func TestBlockStoreIml_GetBlocksByHeight(t *testing.T) {
+	blocks := createTestBlocks(2)
+	sideBlock := createTestBlocks(1)[0]
+	sideBlock.Timestamp = sideBlock.Timestamp.Add(time.Second)
+	sideBlock.BlockHash = sideBlock.CalculateBlockHash()
+	store := openTestBlockStore(t, t.TempDir(), append(blocks, sideBlock))
+	defer store.Close()
+
+	atHeight, err := store.GetBlocksByHeight(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []*block.Block{blocks[0], sideBlock}, atHeight, "Every block at the height should be returned")
+	atHeight, err = store.GetBlocksByHeight(3)
+	assert.Nil(t, err)
+	assert.Empty(t, atHeight)
+}
+
+func TestOpenBlockStore_PartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	blocks := createTestBlocks(2)
+	assert.Nil(t, openTestBlockStore(t, dir, blocks).Close())
+	path := filepath.Join(dir, blockFileName)
+	info, _ := os.Stat(path)
+	// Cut the last record short as if the node crashed while writing it without a write-ahead log
+	assert.Nil(t, os.Truncate(path, info.Size()-5))
+
+	store, err := OpenBlockStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	stored, _ := store.GetBlocks()
+	assert.Equal(t, blocks[:1], stored, "Partial record should be dropped")
+	next := createTestBlocks(3)[2]
+	assert.Nil(t, store.Append(next))
+	stored, _ = store.GetBlocks()
+	assert.Equal(t, []*block.Block{blocks[0], next}, stored, "Blocks should be appended after the last whole record")
+}
+
+func TestOpenBlockStore_RedoAppend(t *testing.T) {
+	dir := t.TempDir()
+	blocks := createTestBlocks(2)
+	store := openTestBlockStore(t, dir, blocks[:1])
+	// Crash after logging the second append but before it reached the block file
+	record, _ := encodeRecord(blocks[1])
+	assert.Nil(t, store.wal.begin(store.size, record))
+	assert.Nil(t, store.file.Truncate(store.size+3))
+	assert.Nil(t, store.Close())
+
+	store, err := OpenBlockStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	stored, _ := store.GetBlocks()
+	assert.Equal(t, blocks, stored, "Logged append should be redone")
+	info, _ := os.Stat(filepath.Join(dir, walFileName))
+	assert.Equal(t, int64(0), info.Size(), "Write-ahead log should be cleared")
+}
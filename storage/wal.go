@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// walHeaderSize is the size of the offset written ahead of the record in the write-ahead log
+const walHeaderSize = 8
+
+// writeAheadLog holds the record being appended to the block file until the append is synced, so an append cut short
+// by a crash can be redone when the store is opened again
+type writeAheadLog struct {
+	file *os.File
+}
+
+// openWriteAheadLog opens the log at `path`, creating it if it does not exist
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+// begin logs that `record` is about to be written at `offset` of the block file and syncs the log
+func (wal *writeAheadLog) begin(offset int64, record []byte) error {
+	data := make([]byte, walHeaderSize+len(record))
+	binary.BigEndian.PutUint64(data, uint64(offset))
+	copy(data[walHeaderSize:], record)
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wal.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// commit clears the log once the record is synced to the block file
+func (wal *writeAheadLog) commit() error {
+	return wal.file.Truncate(0)
+}
+
+// pending returns the record logged by an append that may not have completed, along with the offset it belongs at.
+// It returns a nil record when the log is empty or was itself cut short, in which case the block file was not
+// written to.
+func (wal *writeAheadLog) pending() (int64, []byte, error) {
+	data, err := io.ReadAll(io.NewSectionReader(wal.file, 0, 1<<62))
+	if err != nil || len(data) < walHeaderSize {
+		return 0, nil, err
+	}
+	record := data[walHeaderSize:]
+	if _, err := decodeRecord(record); err != nil {
+		return 0, nil, nil
+	}
+	return int64(binary.BigEndian.Uint64(data)), record, nil
+}
+
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
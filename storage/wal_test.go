@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAheadLog_Pending(t *testing.T) {
+	wal, err := openWriteAheadLog(filepath.Join(t.TempDir(), walFileName))
+	assert.Nil(t, err)
+	defer wal.close()
+	record, _ := encodeRecord(createTestBlocks(1)[0])
+
+	_, pending, err := wal.pending()
+	assert.Nil(t, err)
+	assert.Nil(t, pending, "Empty log should have nothing pending")
+
+	assert.Nil(t, wal.begin(42, record))
+	offset, pending, err := wal.pending()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), offset)
+	assert.Equal(t, record, pending)
+
+	assert.Nil(t, wal.begin(42, record[:len(record)-1]))
+	_, pending, err = wal.pending()
+	assert.Nil(t, err)
+	assert.Nil(t, pending, "Log cut short should be ignored")
+
+	assert.Nil(t, wal.begin(42, record))
+	assert.Nil(t, wal.commit())
+	_, pending, _ = wal.pending()
+	assert.Nil(t, pending, "Committed append should not be pending")
+}
@@ -5,20 +5,34 @@ import (
 	"fmt"
 	"github.com/defaziom/blockchain-go/block"
 	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/ibd"
+	"github.com/defaziom/blockchain-go/mempool"
 	"github.com/defaziom/blockchain-go/tcp"
 	"log"
 )
 
-func StartTasks(pc chan tcp.Peer, bc blockchain.BlockChain) {
+// StartTasks starts a job for every Peer placed in the Peer channel. Consensus messages are passed to `ch`, which is
+// nil when the node does not take part in BFT consensus. Blocks are not served while `d` is in initial block download,
+// and always are when it is nil. `d` is notified of the peers that announce a chain higher than the tip in their
+// handshake.
+func StartTasks(pc chan tcp.Peer, bc blockchain.BlockChain, mp mempool.Mempool, ch consensus.BFTMessageHandler,
+	d ibd.Downloader) {
 	for peer := range pc {
 		if peer.IsClosed() {
 			continue
 		}
+		if remote := peer.GetRemote(); d != nil && remote != nil && remote.BestHeight > bc.GetLatestBlock().Index {
+			d.Notify()
+		}
 		jobExecutor := PeerJobExecutor{
 			Peer: peer,
 			Job: &PeerJob{
 				BlockChain: bc,
 				Peer:       peer,
+				Mempool:    mp,
+				Consensus:  ch,
+				Downloader: d,
 			},
 		}
 		go func() {
@@ -57,6 +71,21 @@ type PeerJobExecutor struct {
 type PeerJob struct {
 	tcp.Peer
 	blockchain.BlockChain
+	Mempool    mempool.Mempool
+	Consensus  consensus.BFTMessageHandler
+	Downloader ibd.Downloader
+}
+
+// syncingMsgTypes are the msgs that are not answered while the node is in initial block download, either because they
+// ask for blocks or because they announce blocks the download will get
+var syncingMsgTypes = map[tcp.PeerMsgType]bool{
+	tcp.QUERY_ALL:           true,
+	tcp.QUERY_LATEST:        true,
+	tcp.QUERY_BLOCK:         true,
+	tcp.GET_BLOCKS:          true,
+	tcp.GET_HEADERS:         true,
+	tcp.GET_DATA:            true,
+	tcp.RESPONSE_BLOCKCHAIN: true,
 }
 
 // PeerMsgTask is a Task created from a message from a peer
@@ -110,6 +139,13 @@ func (pj *PeerJob) GetNextTask() (Task, error) {
 
 	var t Task
 
+	if syncingMsgTypes[msg.Type] && pj.Downloader != nil && pj.Downloader.IsInitialBlockDownload() {
+		return &Syncing{
+			Msg:  msg,
+			Peer: pj.Peer,
+		}, nil
+	}
+
 	switch msg.Type {
 	case tcp.ACK:
 		t = &Ack{
@@ -118,7 +154,7 @@ func (pj *PeerJob) GetNextTask() (Task, error) {
 		}
 	case tcp.QUERY_ALL:
 		t = &QueryAll{
-			Blocks: pj.BlockChain.GetBlocks().ToSlice(),
+			Blocks: pj.BlockChain.GetRange(0, pj.BlockChain.GetLatestBlock().Index+1),
 			PeerMsgTask: &PeerMsgTask{
 				Msg:  msg,
 				Peer: pj.Peer,
@@ -132,6 +168,56 @@ func (pj *PeerJob) GetNextTask() (Task, error) {
 			},
 			Block: pj.BlockChain.GetLatestBlock(),
 		}
+	case tcp.QUERY_BLOCK:
+		t = &QueryBlock{
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+			Block: pj.BlockChain.GetBlockByHash(msg.BlockHash),
+		}
+	case tcp.GET_BLOCKS:
+		t = &GetBlocks{
+			Blocks: pj.BlockChain.LocateBlocks(msg.Locator, msg.StopHash, tcp.MaxBlocksPerBatch),
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
+	case tcp.GET_HEADERS:
+		t = &GetHeaders{
+			Blocks: pj.BlockChain.LocateBlocks(msg.Locator, msg.StopHash, tcp.MaxHeadersPerBatch),
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
+	case tcp.GET_DATA:
+		hashes := msg.Hashes
+		if len(hashes) > tcp.MaxBlocksPerBatch {
+			hashes = hashes[:tcp.MaxBlocksPerBatch]
+		}
+		var blocks []*block.Block
+		for _, hash := range hashes {
+			if b := pj.BlockChain.GetBlockByHash(hash); b != nil {
+				blocks = append(blocks, b)
+			}
+		}
+		t = &GetData{
+			Blocks: blocks,
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
+	case tcp.RESPONSE_BLOCKS:
+		t = &ResponseBlocks{
+			BlockChain: pj.BlockChain,
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
 	case tcp.RESPONSE_BLOCKCHAIN:
 		t = &ResponseBlockChain{
 			BlockChain: pj.BlockChain,
@@ -140,6 +226,22 @@ func (pj *PeerJob) GetNextTask() (Task, error) {
 				Peer: pj.Peer,
 			},
 		}
+	case tcp.RESPONSE_TRANSACTION:
+		t = &ResponseTransaction{
+			Mempool: pj.Mempool,
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
+	case tcp.PROPOSAL, tcp.PREVOTE, tcp.PRECOMMIT:
+		t = &ConsensusMsg{
+			Consensus: pj.Consensus,
+			PeerMsgTask: &PeerMsgTask{
+				Msg:  msg,
+				Peer: pj.Peer,
+			},
+		}
 	default:
 		return nil, errors.New("received unknown msg type")
 	}
@@ -151,6 +253,10 @@ type Ack PeerMsgTask
 
 func (task *Ack) Execute() error {
 	log.Println("Received ACK!")
+	// A session stays open for the next exchange of msgs
+	if task.Peer.IsPersistent() {
+		return nil
+	}
 	err := task.Peer.ClosePeer()
 	if err != nil {
 		log.Println("Failed to close peer: ", err.Error())
@@ -174,6 +280,30 @@ func (task *QueryLatest) Execute() error {
 	return nil
 }
 
+type QueryBlock struct {
+	Block *block.Block // nil if the block asked for is not known
+	*PeerMsgTask
+}
+
+func (task *QueryBlock) Execute() error {
+	if task.Block == nil {
+		// End the interaction since the peer can't add its orphans without the block
+		log.Println("Peer asked for unknown block " + task.Msg.BlockHash)
+		err := task.Peer.SendAckMsg()
+		if err != nil {
+			log.Println("Failed to send ack msg", err.Error())
+			return err
+		}
+		return nil
+	}
+	err := task.Peer.SendResponseBlockChainMsg([]*block.Block{task.Block})
+	if err != nil {
+		log.Println("Failed to send response blockchain msg", err.Error())
+		return err
+	}
+	return nil
+}
+
 type QueryAll struct {
 	Blocks []*block.Block
 	*PeerMsgTask
@@ -191,6 +321,117 @@ func (task *QueryAll) Execute() error {
 	return nil
 }
 
+type GetBlocks struct {
+	Blocks []*block.Block // Blocks of the main chain after the fork point with the branch of the peer
+	*PeerMsgTask
+}
+
+func (task *GetBlocks) Execute() error {
+	// Send the blocks the peer is missing. The peer asks for the next batch if this one is full.
+	log.Printf("Sending %d blocks\n", len(task.Blocks))
+	err := task.Peer.SendBlocksMsg(task.Blocks, task.Msg.StopHash)
+	if err != nil {
+		log.Println("Failed to send blocks msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type GetHeaders struct {
+	Blocks []*block.Block // Blocks of the main chain after the fork point with the branch of the peer
+	*PeerMsgTask
+}
+
+func (task *GetHeaders) Execute() error {
+	// Send the headers of the blocks the peer is missing. The peer asks for the next batch if this one is full.
+	log.Printf("Sending %d headers\n", len(task.Blocks))
+	headers := make([]*block.BlockHeader, len(task.Blocks))
+	for i, b := range task.Blocks {
+		headers[i] = &b.BlockHeader
+	}
+	err := task.Peer.SendHeadersMsg(headers)
+	if err != nil {
+		log.Println("Failed to send headers msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type GetData struct {
+	Blocks []*block.Block // Blocks asked for that the node has, in the order they were asked for
+	*PeerMsgTask
+}
+
+func (task *GetData) Execute() error {
+	// Send the blocks asked for, leaving out the ones the node does not have
+	log.Printf("Sending %d blocks\n", len(task.Blocks))
+	err := task.Peer.SendBlocksMsg(task.Blocks, "")
+	if err != nil {
+		log.Println("Failed to send blocks msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type Syncing PeerMsgTask
+
+func (task *Syncing) Execute() error {
+	// The chain is not served until it caught up with the peers, so the peer is told the interaction is over
+	log.Println("Not serving blocks during initial block download")
+	err := task.Peer.SendAckMsg()
+	if err != nil {
+		log.Println("Failed to send ACK msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type ResponseBlocks struct {
+	*PeerMsgTask
+	blockchain.BlockChain
+}
+
+func (task *ResponseBlocks) Execute() error {
+	receivedBlocks := task.Msg.Data
+	log.Printf("Got %d blocks\n", len(receivedBlocks))
+
+	// A full batch that does not end at the stop hash means the peer has more blocks to send
+	last := len(receivedBlocks) - 1
+	more := len(receivedBlocks) == tcp.MaxBlocksPerBatch && receivedBlocks[last].BlockHash != task.Msg.StopHash
+
+	// Blocks come in chain order from the fork point, so each one connects to the one before it
+	for _, b := range receivedBlocks {
+		err := task.BlockChain.AddBlock(b)
+		if errors.Is(err, blockchain.ErrKnownBlock) {
+			continue
+		} else if err != nil {
+			log.Println("Did not add block: " + err.Error())
+			more = false
+			break
+		}
+	}
+
+	if more {
+		// Ask for the next batch from the last block received, which may still be on a side branch
+		log.Println("Querying peer for the next blocks")
+		err := task.Peer.SendGetBlocksMsg(task.BlockChain.GetBlockLocator(receivedBlocks[last].BlockHash),
+			task.Msg.StopHash)
+		if err != nil {
+			log.Println("Failed to query peer for blocks: " + err.Error())
+			return err
+		}
+		return nil
+	}
+
+	// Send ACK message to notify the peer we are finished
+	err := task.Peer.SendAckMsg()
+	if err != nil {
+		log.Println("Failed to send ack msg", err.Error())
+		return err
+	}
+	return nil
+}
+
 type ResponseBlockChain struct {
 	*PeerMsgTask
 	blockchain.BlockChain
@@ -202,40 +443,79 @@ func (task *ResponseBlockChain) Execute() error {
 
 	if len(receivedBlocks) == 0 {
 		log.Println("Got zero blocks")
-	} else {
-		latestBlockReceived := receivedBlocks[len(receivedBlocks)-1]
-		latestBlockHeld := task.BlockChain.GetLatestBlock()
-		if latestBlockReceived.Index > latestBlockHeld.Index {
-			log.Println(fmt.Sprintf("Blockchain possible behind. We got: %d Peer got: %d", latestBlockHeld.Index,
-				latestBlockReceived.Index))
-
-			if latestBlockHeld.BlockHash == latestBlockReceived.PrevBlockHash {
-				// The block received is the next block in the chain
-				log.Println("Adding block to the blockchain")
-				err := task.BlockChain.AddBlock(latestBlockReceived)
-				if err != nil {
-					log.Println("Received invalid block: " + err.Error())
-				}
-			} else if len(receivedBlocks) == 1 {
-				// We have to query the chain from our peer
-				log.Println("Querying peer for entire blockchain")
-				err := task.Peer.SendQueryAllMsg()
-				if err != nil {
-					log.Println("Failed to query peer for entire chain: " + err.Error())
-					return err
-				}
-				return nil
-			} else {
-				// Received chain is longer than our own chain
-				log.Println("Replacing blockchain")
-				receivedChainList := blockchain.DoublyLinkedBlockListCreateFromSlice(receivedBlocks)
-				receivedBlockChain := &blockchain.BlockChainIml{Blocks: receivedChainList}
-				task.BlockChain.ReplaceChain(receivedBlockChain)
+	} else if len(receivedBlocks) == 1 {
+		// Blocks on side branches are kept too, so the chain can reorganize onto them once they have more work
+		latestBlockReceived := receivedBlocks[0]
+		err := task.BlockChain.AddBlock(latestBlockReceived)
+		if errors.Is(err, blockchain.ErrUnknownParent) {
+			// The block waits in the orphan pool while the blocks between the fork point and it are asked for
+			log.Println("Querying peer for the blocks up to " + latestBlockReceived.BlockHash)
+			locator := task.BlockChain.GetBlockLocator(task.BlockChain.GetLatestBlock().BlockHash)
+			err = task.Peer.SendGetBlocksMsg(locator, latestBlockReceived.BlockHash)
+			if err != nil {
+				log.Println("Failed to query peer for blocks: " + err.Error())
+				return err
 			}
+			return nil
+		} else if err != nil {
+			log.Println("Did not add block: " + err.Error())
+		}
+	} else {
+		log.Println("Adding the blocks of the received chain")
+		err := task.BlockChain.ReplaceChain(receivedBlocks)
+		if err != nil {
+			log.Println("Did not replace blockchain: " + err.Error())
+		}
+	}
+
+	// Send ACK message to notify the peer we are finished
+	err := task.Peer.SendAckMsg()
+	if err != nil {
+		log.Println("Failed to send ack msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type ResponseTransaction struct {
+	*PeerMsgTask
+	Mempool mempool.Mempool
+}
+
+func (task *ResponseTransaction) Execute() error {
+	for _, tx := range task.Msg.Transactions {
+		err := task.Mempool.AddTransaction(tx)
+		if err != nil {
+			log.Println("Did not add transaction to mempool: " + err.Error())
 		} else {
-			log.Println("Received chain is not longer than our own chain. Do nothing.")
+			log.Println("Added transaction to mempool: " + tx.Id)
 		}
+	}
 
+	// Send ACK message to notify the peer we are finished
+	err := task.Peer.SendAckMsg()
+	if err != nil {
+		log.Println("Failed to send ack msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+type ConsensusMsg struct {
+	*PeerMsgTask
+	Consensus consensus.BFTMessageHandler
+}
+
+func (task *ConsensusMsg) Execute() error {
+	if task.Msg.Consensus == nil {
+		log.Println("Got consensus msg without content")
+	} else if task.Consensus == nil {
+		log.Println("Not taking part in consensus. Ignoring msg.")
+	} else {
+		err := task.Consensus.HandleMessage(task.Msg.Consensus)
+		if err != nil {
+			log.Println("Did not handle consensus msg: " + err.Error())
+		}
 	}
 
 	// Send ACK message to notify the peer we are finished
@@ -1,12 +1,23 @@
 package task
 
 import (
+	"context"
+	"fmt"
 	"github.com/defaziom/blockchain-go/block"
 	"github.com/defaziom/blockchain-go/blockchain"
+	"github.com/defaziom/blockchain-go/clock"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/database"
+	"github.com/defaziom/blockchain-go/ibd"
+	"github.com/defaziom/blockchain-go/mempool"
+	"github.com/defaziom/blockchain-go/miner"
 	"github.com/defaziom/blockchain-go/tcp"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/defaziom/blockchain-go/wallet"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 type MockJob struct {
@@ -39,6 +50,11 @@ type MockPeer struct {
 	tcp.Peer
 }
 
+// Supports returns true, since the mock speaks the latest protocol version
+func (m *MockPeer) Supports(msgType tcp.PeerMsgType) bool {
+	return true
+}
+
 func (m *MockPeer) SendResponseBlockChainMsg(blocks []*block.Block) error {
 	a := m.Called(blocks)
 	return a.Error(0)
@@ -49,11 +65,31 @@ func (m *MockPeer) SendQueryAllMsg() error {
 	return a.Error(0)
 }
 
+func (m *MockPeer) SendGetBlocksMsg(locator []string, stopHash string) error {
+	a := m.Called(locator, stopHash)
+	return a.Error(0)
+}
+
+func (m *MockPeer) SendBlocksMsg(blocks []*block.Block, stopHash string) error {
+	a := m.Called(blocks, stopHash)
+	return a.Error(0)
+}
+
+func (m *MockPeer) SendHeadersMsg(headers []*block.BlockHeader) error {
+	a := m.Called(headers)
+	return a.Error(0)
+}
+
 func (m *MockPeer) SendAckMsg() error {
 	a := m.Called()
 	return a.Error(0)
 }
 
+func (m *MockPeer) IsPersistent() bool {
+	a := m.Called()
+	return a.Bool(0)
+}
+
 func (m *MockPeer) IsClosed() bool {
 	a := m.Called()
 	return a.Get(0).(bool)
@@ -84,14 +120,63 @@ func (m *MockBlockChain) GetLatestBlock() *block.Block {
 	return a.Get(0).(*block.Block)
 }
 
+func (m *MockBlockChain) GetBlockByHash(hash string) *block.Block {
+	a := m.Called(hash)
+	return a.Get(0).(*block.Block)
+}
+
+func (m *MockBlockChain) GetRange(start int, end int) []*block.Block {
+	a := m.Called(start, end)
+	return a.Get(0).([]*block.Block)
+}
+
+func (m *MockBlockChain) GetBlockLocator(hash string) []string {
+	a := m.Called(hash)
+	return a.Get(0).([]string)
+}
+
+func (m *MockBlockChain) LocateBlocks(locator []string, stopHash string, limit int) []*block.Block {
+	a := m.Called(locator, stopHash, limit)
+	return a.Get(0).([]*block.Block)
+}
+
 func (m *MockBlockChain) AddBlock(b *block.Block) error {
 	a := m.Called(b)
 	return a.Error(0)
 }
 
-func (m *MockBlockChain) ReplaceChain(bc blockchain.BlockChain) {
-	_ = m.Called(bc)
-	return
+func (m *MockBlockChain) ReplaceChain(blocks []*block.Block) error {
+	a := m.Called(blocks)
+	return a.Error(0)
+}
+
+type MockDownloader struct {
+	mock.Mock
+	ibd.Downloader
+}
+
+func (m *MockDownloader) IsInitialBlockDownload() bool {
+	a := m.Called()
+	return a.Bool(0)
+}
+
+type MockMempool struct {
+	mock.Mock
+	mempool.Mempool
+}
+
+func (m *MockMempool) AddTransaction(tx *transaction.Transaction) error {
+	a := m.Called(tx)
+	return a.Error(0)
+}
+
+type MockConsensusHandler struct {
+	mock.Mock
+}
+
+func (m *MockConsensusHandler) HandleMessage(msg *consensus.BFTMessage) error {
+	a := m.Called(msg)
+	return a.Error(0)
 }
 
 func TestPeerJobExecutor_Start(t *testing.T) {
@@ -109,12 +194,16 @@ func TestPeerJobExecutor_Start(t *testing.T) {
 }
 
 func TestPeerJob_GetNextTask(t *testing.T) {
-	testBlock := &block.Block{Data: "test"}
+	testBlock := &block.Block{Transactions: []*transaction.Transaction{{Id: "test"}}}
 	mPeer := &MockPeer{}
 	mIsClosed := mPeer.On("IsClosed").Return(false)
 	mBc := &MockBlockChain{}
-	mBc.On("GetBlocks").Return(&blockchain.SafeDoublyLinkedBlockList{Value: testBlock})
 	mBc.On("GetLatestBlock").Return(testBlock)
+	mBc.On("GetRange", 0, 1).Return([]*block.Block{testBlock})
+	mBc.On("GetBlockByHash", "test").Return(testBlock)
+	mBc.On("GetBlockByHash", "unknown").Return((*block.Block)(nil))
+	mBc.On("LocateBlocks", []string{"test"}, "stop", tcp.MaxBlocksPerBatch).Return([]*block.Block{testBlock})
+	mBc.On("LocateBlocks", []string{"test"}, "", tcp.MaxHeadersPerBatch).Return([]*block.Block{testBlock})
 
 	peerJob := &PeerJob{
 		Peer:       mPeer,
@@ -135,28 +224,110 @@ func TestPeerJob_GetNextTask(t *testing.T) {
 	task, _ = peerJob.GetNextTask()
 	_ = task.(*QueryLatest)
 
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.QUERY_BLOCK, BlockHash: "test"}, nil)
+	task, _ = peerJob.GetNextTask()
+	assert.Equal(t, testBlock, task.(*QueryBlock).Block)
+
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.GET_BLOCKS, Locator: []string{"test"}, StopHash: "stop"}, nil)
+	task, _ = peerJob.GetNextTask()
+	assert.Equal(t, []*block.Block{testBlock}, task.(*GetBlocks).Blocks)
+
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.GET_HEADERS, Locator: []string{"test"}}, nil)
+	task, _ = peerJob.GetNextTask()
+	assert.Equal(t, []*block.Block{testBlock}, task.(*GetHeaders).Blocks)
+
+	// Blocks the node does not have are left out
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.GET_DATA, Hashes: []string{"unknown", "test"}}, nil)
+	task, _ = peerJob.GetNextTask()
+	assert.Equal(t, []*block.Block{testBlock}, task.(*GetData).Blocks)
+
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.RESPONSE_BLOCKS}, nil)
+	task, _ = peerJob.GetNextTask()
+	_ = task.(*ResponseBlocks)
+
 	mReceiveMsg.Unset()
 	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.RESPONSE_BLOCKCHAIN}, nil)
 	task, _ = peerJob.GetNextTask()
 	_ = task.(*ResponseBlockChain)
 
+	mReceiveMsg.Unset()
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.RESPONSE_TRANSACTION}, nil)
+	task, _ = peerJob.GetNextTask()
+	_ = task.(*ResponseTransaction)
+
+	for _, msgType := range []tcp.PeerMsgType{tcp.PROPOSAL, tcp.PREVOTE, tcp.PRECOMMIT} {
+		mReceiveMsg.Unset()
+		mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: msgType}, nil)
+		task, _ = peerJob.GetNextTask()
+		_ = task.(*ConsensusMsg)
+	}
+
 	mIsClosed.Unset()
 	mPeer.On("IsClosed").Return(true)
 	task, _ = peerJob.GetNextTask()
 	assert.Nil(t, task)
 }
 
+func TestPeerJob_GetNextTask_Syncing(t *testing.T) {
+	mPeer := &MockPeer{}
+	mPeer.On("IsClosed").Return(false)
+	mDownloader := &MockDownloader{}
+	mIsIbd := mDownloader.On("IsInitialBlockDownload").Return(true)
+	peerJob := &PeerJob{
+		Peer:       mPeer,
+		BlockChain: &MockBlockChain{},
+		Downloader: mDownloader,
+	}
+
+	// Blocks are neither served nor taken from announcements during initial block download
+	for _, msgType := range []tcp.PeerMsgType{tcp.QUERY_ALL, tcp.QUERY_LATEST, tcp.QUERY_BLOCK, tcp.GET_BLOCKS,
+		tcp.GET_HEADERS, tcp.GET_DATA, tcp.RESPONSE_BLOCKCHAIN} {
+		mReceiveMsg := mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: msgType}, nil)
+		task, _ := peerJob.GetNextTask()
+		_ = task.(*Syncing)
+		mReceiveMsg.Unset()
+	}
+
+	// Other msgs are handled as usual
+	mReceiveMsg := mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.ACK}, nil)
+	task, _ := peerJob.GetNextTask()
+	_ = task.(*Ack)
+	mReceiveMsg.Unset()
+
+	// Blocks are served once the node caught up
+	mIsIbd.Unset()
+	mDownloader.On("IsInitialBlockDownload").Return(false)
+	mPeer.On("ReceiveMsg").Return(&tcp.PeerMsg{Type: tcp.RESPONSE_BLOCKCHAIN}, nil)
+	task, _ = peerJob.GetNextTask()
+	_ = task.(*ResponseBlockChain)
+}
+
 func TestAck_Execute(t *testing.T) {
 	mPeer := &MockPeer{}
+	mPeer.On("IsPersistent").Return(false)
 	mPeer.On("ClosePeer").Return(nil)
 
 	ackTask := &Ack{Peer: mPeer}
 	_ = ackTask.Execute()
 	mPeer.AssertExpectations(t)
+
+	// A session stays open
+	mPeer = &MockPeer{}
+	mPeer.On("IsPersistent").Return(true)
+
+	ackTask = &Ack{Peer: mPeer}
+	_ = ackTask.Execute()
+	mPeer.AssertExpectations(t)
+	mPeer.AssertNotCalled(t, "ClosePeer")
 }
 
 func TestQueryLatest_Execute(t *testing.T) {
-	testBlock := &block.Block{Data: "test"}
+	testBlock := &block.Block{Transactions: []*transaction.Transaction{{Id: "test"}}}
 
 	mPeer := &MockPeer{}
 	mPeer.On("SendResponseBlockChainMsg", []*block.Block{testBlock}).Return(nil)
@@ -169,8 +340,31 @@ func TestQueryLatest_Execute(t *testing.T) {
 	mPeer.AssertExpectations(t)
 }
 
+func TestQueryBlock_Execute(t *testing.T) {
+	testBlock := &block.Block{Transactions: []*transaction.Transaction{{Id: "test"}}}
+
+	mPeer := &MockPeer{}
+	mPeer.On("SendResponseBlockChainMsg", []*block.Block{testBlock}).Return(nil)
+	queryBlockTask := &QueryBlock{
+		Block:       testBlock,
+		PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{BlockHash: "test"}},
+	}
+	_ = queryBlockTask.Execute()
+	mPeer.AssertExpectations(t)
+
+	// The interaction ends when the block is not known
+	mPeer = &MockPeer{}
+	mPeer.On("SendAckMsg").Return(nil)
+	queryBlockTask = &QueryBlock{
+		PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{BlockHash: "unknown"}},
+	}
+	_ = queryBlockTask.Execute()
+	mPeer.AssertExpectations(t)
+	mPeer.AssertNotCalled(t, "SendResponseBlockChainMsg", mock.Anything)
+}
+
 func TestQueryAll_Execute(t *testing.T) {
-	testBlocks := []*block.Block{{Data: "test"}}
+	testBlocks := []*block.Block{{Transactions: []*transaction.Transaction{{Id: "test"}}}}
 
 	mPeer := &MockPeer{}
 	mPeer.On("SendResponseBlockChainMsg", testBlocks).Return(nil)
@@ -184,6 +378,141 @@ func TestQueryAll_Execute(t *testing.T) {
 	mPeer.AssertExpectations(t)
 }
 
+func TestGetBlocks_Execute(t *testing.T) {
+	testBlocks := []*block.Block{{Index: 1}, {Index: 2}}
+
+	mPeer := &MockPeer{}
+	mPeer.On("SendBlocksMsg", testBlocks, "stop").Return(nil)
+
+	getBlocksTask := &GetBlocks{
+		Blocks:      testBlocks,
+		PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{StopHash: "stop"}},
+	}
+	_ = getBlocksTask.Execute()
+
+	mPeer.AssertExpectations(t)
+}
+
+func TestGetHeaders_Execute(t *testing.T) {
+	testBlocks := []*block.Block{{Index: 1, BlockHeader: block.BlockHeader{Nonce: 1}},
+		{Index: 2, BlockHeader: block.BlockHeader{Nonce: 2}}}
+
+	mPeer := &MockPeer{}
+	mPeer.On("SendHeadersMsg", []*block.BlockHeader{&testBlocks[0].BlockHeader, &testBlocks[1].BlockHeader}).
+		Return(nil)
+
+	getHeadersTask := &GetHeaders{
+		Blocks:      testBlocks,
+		PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{}},
+	}
+	_ = getHeadersTask.Execute()
+
+	mPeer.AssertExpectations(t)
+}
+
+func TestGetData_Execute(t *testing.T) {
+	testBlocks := []*block.Block{{Index: 1}, {Index: 2}}
+
+	mPeer := &MockPeer{}
+	mPeer.On("SendBlocksMsg", testBlocks, "").Return(nil)
+
+	getDataTask := &GetData{
+		Blocks:      testBlocks,
+		PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{}},
+	}
+	_ = getDataTask.Execute()
+
+	mPeer.AssertExpectations(t)
+}
+
+func TestSyncing_Execute(t *testing.T) {
+	mPeer := &MockPeer{}
+	mPeer.On("SendAckMsg").Return(nil)
+
+	syncingTask := &Syncing{Peer: mPeer, Msg: &tcp.PeerMsg{Type: tcp.QUERY_ALL}}
+	_ = syncingTask.Execute()
+
+	mPeer.AssertExpectations(t)
+	mPeer.AssertNotCalled(t, "SendResponseBlockChainMsg", mock.Anything)
+}
+
+func TestResponseBlocks_Execute(t *testing.T) {
+	// createBatch creates a batch of `n` blocks after the fork point
+	createBatch := func(n int) []*block.Block {
+		blocks := make([]*block.Block, n)
+		for i := range blocks {
+			blocks[i] = &block.Block{Index: i + 1, BlockHash: fmt.Sprint(i + 1)}
+		}
+		return blocks
+	}
+
+	t.Run("Last batch", func(t *testing.T) {
+		receivedBlocks := createBatch(3)
+		mPeer := &MockPeer{}
+		mPeer.On("SendAckMsg").Return(nil)
+		mBlockChain := &MockBlockChain{}
+		mBlockChain.On("AddBlock", receivedBlocks[0]).Return(blockchain.ErrKnownBlock)
+		mBlockChain.On("AddBlock", receivedBlocks[1]).Return(nil)
+		mBlockChain.On("AddBlock", receivedBlocks[2]).Return(nil)
+		task := &ResponseBlocks{BlockChain: mBlockChain,
+			PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{Data: receivedBlocks}}}
+
+		_ = task.Execute()
+
+		mBlockChain.AssertExpectations(t)
+		mPeer.AssertExpectations(t)
+	})
+
+	t.Run("Full batch", func(t *testing.T) {
+		receivedBlocks := createBatch(tcp.MaxBlocksPerBatch)
+		last := receivedBlocks[len(receivedBlocks)-1].BlockHash
+		mPeer := &MockPeer{}
+		mPeer.On("SendGetBlocksMsg", []string{last, "genesis"}, "stop").Return(nil)
+		mBlockChain := &MockBlockChain{}
+		mBlockChain.On("AddBlock", mock.Anything).Return(nil)
+		mBlockChain.On("GetBlockLocator", last).Return([]string{last, "genesis"})
+		task := &ResponseBlocks{BlockChain: mBlockChain,
+			PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{Data: receivedBlocks, StopHash: "stop"}}}
+
+		_ = task.Execute()
+
+		mBlockChain.AssertNumberOfCalls(t, "AddBlock", tcp.MaxBlocksPerBatch)
+		mPeer.AssertExpectations(t)
+		mPeer.AssertNotCalled(t, "SendAckMsg")
+	})
+
+	t.Run("Full batch ending at the stop hash", func(t *testing.T) {
+		receivedBlocks := createBatch(tcp.MaxBlocksPerBatch)
+		mPeer := &MockPeer{}
+		mPeer.On("SendAckMsg").Return(nil)
+		mBlockChain := &MockBlockChain{}
+		mBlockChain.On("AddBlock", mock.Anything).Return(nil)
+		task := &ResponseBlocks{BlockChain: mBlockChain, PeerMsgTask: &PeerMsgTask{Peer: mPeer,
+			Msg: &tcp.PeerMsg{Data: receivedBlocks, StopHash: receivedBlocks[len(receivedBlocks)-1].BlockHash}}}
+
+		_ = task.Execute()
+
+		mPeer.AssertExpectations(t)
+		mPeer.AssertNotCalled(t, "SendGetBlocksMsg", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Invalid block", func(t *testing.T) {
+		receivedBlocks := createBatch(tcp.MaxBlocksPerBatch)
+		mPeer := &MockPeer{}
+		mPeer.On("SendAckMsg").Return(nil)
+		mBlockChain := &MockBlockChain{}
+		mBlockChain.On("AddBlock", receivedBlocks[0]).Return(blockchain.ErrInvalidBlockHash)
+		task := &ResponseBlocks{BlockChain: mBlockChain,
+			PeerMsgTask: &PeerMsgTask{Peer: mPeer, Msg: &tcp.PeerMsg{Data: receivedBlocks}}}
+
+		_ = task.Execute()
+
+		mBlockChain.AssertNumberOfCalls(t, "AddBlock", 1)
+		mPeer.AssertExpectations(t)
+		mPeer.AssertNotCalled(t, "SendGetBlocksMsg", mock.Anything, mock.Anything)
+	})
+}
+
 func TestResponseBlockChain_Execute(t *testing.T) {
 
 	responseBlockChain := &ResponseBlockChain{
@@ -205,32 +534,12 @@ func TestResponseBlockChain_Execute(t *testing.T) {
 		mPeer.AssertExpectations(t)
 	})
 
-	// Test received chain is not longer than own chain
-	t.Run("Received chain is not longer than own chain", func(t *testing.T) {
-		receivedBlocks := []*block.Block{{Index: 0}, {Index: 1}}
-		latestBlock := &block.Block{Index: 42}
-		mPeer := &MockPeer{}
-		mPeer.On("SendAckMsg").Return(nil)
-		mBlockChain := &MockBlockChain{}
-		mBlockChain.On("GetLatestBlock").Return(latestBlock)
-		responseBlockChain.PeerMsgTask.Msg.Data = receivedBlocks
-		responseBlockChain.PeerMsgTask.Peer = mPeer
-		responseBlockChain.BlockChain = mBlockChain
-
-		_ = responseBlockChain.Execute()
-
-		mBlockChain.AssertExpectations(t)
-		mPeer.AssertExpectations(t)
-	})
-
-	// Test block received is next block in chain
-	t.Run("Block received is next block in chain", func(t *testing.T) {
-		receivedBlocks := []*block.Block{{Index: 1, PrevBlockHash: "abc"}}
-		latestBlock := &block.Block{Index: 0, BlockHash: "abc"}
+	// Test block received on a side branch
+	t.Run("Block received on a side branch", func(t *testing.T) {
+		receivedBlocks := []*block.Block{{Index: 1, BlockHeader: block.BlockHeader{PrevBlockHash: "abc"}}}
 		mPeer := &MockPeer{}
 		mPeer.On("SendAckMsg").Return(nil)
 		mBlockChain := &MockBlockChain{}
-		mBlockChain.On("GetLatestBlock").Return(latestBlock)
 		mBlockChain.On("AddBlock", receivedBlocks[0]).Return(nil)
 		responseBlockChain.PeerMsgTask.Peer = mPeer
 		responseBlockChain.BlockChain = mBlockChain
@@ -242,14 +551,17 @@ func TestResponseBlockChain_Execute(t *testing.T) {
 		mPeer.AssertExpectations(t)
 	})
 
-	// Test if own chain is behind by more than one
-	t.Run("Own chain is behind by more than one", func(t *testing.T) {
-		receivedBlocks := []*block.Block{{Index: 2, PrevBlockHash: "abc"}}
-		latestBlock := &block.Block{Index: 0, BlockHash: "asdf"}
+	// Test block received without its parent
+	t.Run("Block received without its parent", func(t *testing.T) {
+		receivedBlocks := []*block.Block{{Index: 3, BlockHeader: block.BlockHeader{PrevBlockHash: "abc"},
+			BlockHash: "ghi"}}
+		tip := &block.Block{Index: 1, BlockHash: "tip"}
 		mPeer := &MockPeer{}
-		mPeer.On("SendQueryAllMsg").Return(nil)
+		mPeer.On("SendGetBlocksMsg", []string{"tip", "genesis"}, "ghi").Return(nil)
 		mBlockChain := &MockBlockChain{}
-		mBlockChain.On("GetLatestBlock").Return(latestBlock)
+		mBlockChain.On("AddBlock", receivedBlocks[0]).Return(blockchain.ErrUnknownParent)
+		mBlockChain.On("GetLatestBlock").Return(tip)
+		mBlockChain.On("GetBlockLocator", "tip").Return([]string{"tip", "genesis"})
 		responseBlockChain.PeerMsgTask.Peer = mPeer
 		responseBlockChain.BlockChain = mBlockChain
 		responseBlockChain.PeerMsgTask.Msg.Data = receivedBlocks
@@ -264,12 +576,10 @@ func TestResponseBlockChain_Execute(t *testing.T) {
 	// Test if received chain is longer than own chain
 	t.Run("Received chain is longer than own chain", func(t *testing.T) {
 		receivedBlocks := []*block.Block{{Index: 0}, {Index: 1}, {Index: 2}}
-		latestBlock := &block.Block{Index: 0, BlockHash: "asdf"}
 		mPeer := &MockPeer{}
 		mPeer.On("SendAckMsg").Return(nil)
 		mBlockChain := &MockBlockChain{}
-		mBlockChain.On("GetLatestBlock").Return(latestBlock)
-		mBlockChain.On("ReplaceChain", mock.AnythingOfType("*blockchain.BlockChainIml")).Return(nil)
+		mBlockChain.On("ReplaceChain", receivedBlocks).Return(nil)
 		responseBlockChain.PeerMsgTask.Peer = mPeer
 		responseBlockChain.BlockChain = mBlockChain
 		responseBlockChain.PeerMsgTask.Msg.Data = receivedBlocks
@@ -280,3 +590,263 @@ func TestResponseBlockChain_Execute(t *testing.T) {
 		mPeer.AssertExpectations(t)
 	})
 }
+
+func TestResponseTransaction_Execute(t *testing.T) {
+	valid := &transaction.Transaction{Id: "valid"}
+	invalid := &transaction.Transaction{Id: "invalid"}
+	mPeer := &MockPeer{}
+	mPeer.On("SendAckMsg").Return(nil)
+	mMempool := &MockMempool{}
+	mMempool.On("AddTransaction", valid).Return(nil)
+	mMempool.On("AddTransaction", invalid).Return(transaction.ErrInvalidSignature)
+
+	responseTransaction := &ResponseTransaction{
+		PeerMsgTask: &PeerMsgTask{
+			Msg:  &tcp.PeerMsg{Type: tcp.RESPONSE_TRANSACTION, Transactions: []*transaction.Transaction{invalid, valid}},
+			Peer: mPeer,
+		},
+		Mempool: mMempool,
+	}
+	err := responseTransaction.Execute()
+
+	assert.Nil(t, err, "An invalid transaction from a peer should not fail the task")
+	mMempool.AssertExpectations(t)
+	mPeer.AssertExpectations(t)
+}
+
+func TestConsensusMsg_Execute(t *testing.T) {
+	testMsg := &consensus.BFTMessage{Type: consensus.PREVOTE, Height: 1}
+	mPeer := &MockPeer{}
+	mPeer.On("SendAckMsg").Return(nil)
+	mHandler := &MockConsensusHandler{}
+	mHandler.On("HandleMessage", testMsg).Return(consensus.ErrInvalidMessage)
+
+	consensusMsg := &ConsensusMsg{
+		PeerMsgTask: &PeerMsgTask{
+			Msg:  &tcp.PeerMsg{Type: tcp.PREVOTE, Consensus: testMsg},
+			Peer: mPeer,
+		},
+		Consensus: mHandler,
+	}
+	err := consensusMsg.Execute()
+
+	assert.Nil(t, err, "An invalid consensus msg from a peer should not fail the task")
+	mHandler.AssertExpectations(t)
+	mPeer.AssertExpectations(t)
+
+	consensusMsg.Consensus = nil
+	assert.Nil(t, consensusMsg.Execute(), "Nodes that are not validators should ignore consensus msgs")
+}
+
+// testNode is a BFT validator of an in-process network
+type testNode struct {
+	address    string
+	blockChain *blockchain.BlockChainIml
+	engine     *consensus.BFT
+	miner      *miner.MinerIml
+}
+
+// startBFTNetwork starts a node for each of `n` validators connected over a tcp.PipeNetwork, except for the ones in
+// `offline` that never come online
+func startBFTNetwork(n int, offline ...int) []*testNode {
+	network := tcp.CreatePipeNetwork()
+	wallets := make([]*wallet.Wallet, n)
+	validators := make([]string, n)
+	connInfo := make([]*database.PeerConnInfo, n)
+	for i := range wallets {
+		wallets[i], _ = wallet.CreateWallet()
+		validators[i] = wallets[i].GetAddress()
+		connInfo[i] = &database.PeerConnInfo{Ip: "10.0.0.1", Port: 3000 + i}
+	}
+	isOffline := map[int]bool{}
+	for _, i := range offline {
+		isOffline[i] = true
+	}
+
+	var nodes []*testNode
+	for i, w := range wallets {
+		if isOffline[i] {
+			continue
+		}
+		pc := make(chan tcp.Peer)
+		self := i
+		transport := &tcp.ConsensusTransport{
+			GetPeerConnInfo: func() ([]*database.PeerConnInfo, error) {
+				var peers []*database.PeerConnInfo
+				for j, info := range connInfo {
+					if j != self {
+						peers = append(peers, info)
+					}
+				}
+				return peers, nil
+			},
+			Dialer: network,
+			Pc:     pc,
+		}
+		engine := consensus.CreateBFT(blockchain.DefaultGenesis().ChainId, validators, w, transport, 100*time.Millisecond)
+		bc := blockchain.CreateBlockChainWithParams(blockchain.DefaultChainParams(), &clock.SystemClock{}, engine)
+		mp := mempool.CreateMempool(bc, &clock.SystemClock{}, mempool.DefaultConfig())
+		engine.Chain = bc
+
+		network.Listen(fmt.Sprintf("%s:%d", connInfo[i].Ip, connInfo[i].Port), pc, nil)
+		go StartTasks(pc, bc, mp, engine, nil)
+		nodes = append(nodes, &testNode{
+			address:    w.GetAddress(),
+			blockChain: bc,
+			engine:     engine,
+			miner:      miner.CreateMiner(bc, mp, w.GetAddress(), nil),
+		})
+	}
+	for _, node := range nodes {
+		node.engine.Start()
+		_ = node.miner.Start()
+	}
+	return nodes
+}
+
+func stopBFTNetwork(nodes []*testNode) {
+	for _, node := range nodes {
+		_ = node.miner.Stop()
+		node.engine.Stop()
+	}
+}
+
+// assertFinalized waits for every node to finalize `height` blocks and checks that they finalized the same ones
+func assertFinalized(t *testing.T, nodes []*testNode, height int) {
+	assert.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.blockChain.GetLatestBlock().Index < height {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond, "Every node should finalize %d blocks", height)
+
+	expected := nodes[0].blockChain.GetBlocks().ToSlice()[:height+1]
+	for _, node := range nodes[1:] {
+		actual := node.blockChain.GetBlocks().ToSlice()[:height+1]
+		for i := range expected {
+			assert.Equal(t, expected[i].BlockHash, actual[i].BlockHash, "Nodes should agree on block %d", i)
+		}
+	}
+	for _, b := range expected[1:] {
+		assert.NotNil(t, b.Commit, "Block %d should carry the commit that finalized it", b.Index)
+	}
+}
+
+func TestBFTNetwork(t *testing.T) {
+	nodes := startBFTNetwork(4)
+	defer stopBFTNetwork(nodes)
+
+	assertFinalized(t, nodes, 3)
+}
+
+func TestBFTNetwork_OneValidatorOffline(t *testing.T) {
+	nodes := startBFTNetwork(4, 2)
+	defer stopBFTNetwork(nodes)
+
+	assertFinalized(t, nodes, 3)
+
+	finalized := nodes[0].blockChain.GetBlocks().ToSlice()
+	skippedRound := false
+	for _, b := range finalized[1:] {
+		skippedRound = skippedRound || b.Commit.Round > 0
+	}
+	assert.True(t, skippedRound, "Heights proposed by the offline validator should be finalized in a later round")
+}
+
+func TestOrphanBlocks_QueryMissingAncestors(t *testing.T) {
+	network := tcp.CreatePipeNetwork()
+	sender, receiver := blockchain.CreateBlockChain(), blockchain.CreateBlockChain()
+	for i := 0; i < 3; i++ {
+		b, _ := sender.MineBlock(context.Background(), "miner", nil)
+		assert.Nil(t, sender.AddBlock(b))
+	}
+	senderPc, receiverPc := make(chan tcp.Peer), make(chan tcp.Peer)
+	network.Listen("10.0.0.2:3000", receiverPc, nil)
+	go StartTasks(senderPc, sender, mempool.CreateMempool(sender, &clock.SystemClock{}, mempool.DefaultConfig()), nil, nil)
+	go StartTasks(receiverPc, receiver,
+		mempool.CreateMempool(receiver, &clock.SystemClock{}, mempool.DefaultConfig()), nil, nil)
+
+	peers, _ := tcp.GetPeers([]*database.PeerConnInfo{{Ip: "10.0.0.2", Port: 3000}}, network, nil)
+	tcp.BroadCastBlockToPeers(sender.GetLatestBlock(), peers, senderPc)
+
+	assert.Eventually(t, func() bool {
+		return receiver.GetLatestBlock().BlockHash == sender.GetLatestBlock().BlockHash
+	}, 5*time.Second, 10*time.Millisecond, "Receiver should ask for the missing blocks and add its orphans")
+	assert.Equal(t, 0, receiver.Orphans.Len())
+}
+
+func TestGetBlocks_SyncFromForkPoint(t *testing.T) {
+	network := tcp.CreatePipeNetwork()
+	sender, receiver := blockchain.CreateBlockChain(), blockchain.CreateBlockChain()
+	for i := 0; i < 5; i++ {
+		b, _ := sender.MineBlock(context.Background(), "miner", nil)
+		assert.Nil(t, sender.AddBlock(b))
+		if i < 2 {
+			assert.Nil(t, receiver.AddBlock(b))
+		}
+	}
+	// The receiver mined a block of its own on top of the blocks both chains share
+	b, _ := receiver.MineBlock(context.Background(), "other miner", nil)
+	assert.Nil(t, receiver.AddBlock(b))
+	senderPc, receiverPc := make(chan tcp.Peer), make(chan tcp.Peer)
+	network.Listen("10.0.0.2:3000", receiverPc, nil)
+	go StartTasks(senderPc, sender, mempool.CreateMempool(sender, &clock.SystemClock{}, mempool.DefaultConfig()), nil, nil)
+	go StartTasks(receiverPc, receiver,
+		mempool.CreateMempool(receiver, &clock.SystemClock{}, mempool.DefaultConfig()), nil, nil)
+
+	peers, _ := tcp.GetPeers([]*database.PeerConnInfo{{Ip: "10.0.0.2", Port: 3000}}, network, nil)
+	tcp.BroadCastBlockToPeers(sender.GetLatestBlock(), peers, senderPc)
+
+	assert.Eventually(t, func() bool {
+		return receiver.GetLatestBlock().BlockHash == sender.GetLatestBlock().BlockHash
+	}, 5*time.Second, 10*time.Millisecond, "Receiver should get the blocks after the fork point and reorganize")
+	assert.Equal(t, sender.GetRange(0, 6), receiver.GetRange(0, 6))
+	assert.NotNil(t, receiver.GetBlockByHash(b.BlockHash), "Receiver should keep its own block on a side branch")
+}
+
+func TestSessions_BroadcastBlocks(t *testing.T) {
+	network := tcp.CreatePipeNetwork()
+	sender, receiver := blockchain.CreateBlockChain(), blockchain.CreateBlockChain()
+	senderPc, receiverPc := make(chan tcp.Peer), make(chan tcp.Peer)
+	genesisHash := sender.GetGenesisBlock().BlockHash
+	senderNode := tcp.CreateNodeInfo("test", genesisHash, func() int {
+		return sender.GetLatestBlock().Index
+	})
+	receiverNode := tcp.CreateNodeInfo("test", genesisHash, func() int {
+		return receiver.GetLatestBlock().Index
+	})
+	receiverNode.Sessions = tcp.DefaultSessionConfig()
+	network.Listen("10.0.0.2:3000", receiverPc, receiverNode)
+	go StartTasks(senderPc, sender, mempool.CreateMempool(sender, &clock.SystemClock{}, mempool.DefaultConfig()), nil,
+		nil)
+	go StartTasks(receiverPc, receiver,
+		mempool.CreateMempool(receiver, &clock.SystemClock{}, mempool.DefaultConfig()), nil, nil)
+	sessions := tcp.CreateSessionManager(senderPc, tcp.DefaultSessionConfig(), senderNode)
+	sessions.GetPeerConnInfo = func() ([]*database.PeerConnInfo, error) {
+		return []*database.PeerConnInfo{{Ip: "10.0.0.2", Port: 3000}}, nil
+	}
+	sessions.Dialer = network
+	sessions.Start()
+	defer sessions.Stop()
+	assert.Eventually(t, func() bool {
+		status := sessions.GetStatus()
+		return len(status) == 1 && status[0].Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	session, _ := sessions.GetPeers()
+
+	// Every block goes over the same session, which outlives the ACKs ending each exchange
+	for i := 0; i < 3; i++ {
+		b, _ := sender.MineBlock(context.Background(), "miner", nil)
+		assert.Nil(t, sender.AddBlock(b))
+		tcp.BroadCastBlockToRegisteredPeers(b, sessions, senderPc)
+
+		assert.Eventually(t, func() bool {
+			return receiver.GetLatestBlock().BlockHash == b.BlockHash
+		}, 5*time.Second, 10*time.Millisecond, "Receiver should get block %d over the session", b.Index)
+	}
+	peers, _ := sessions.GetPeers()
+	assert.Same(t, session[0], peers[0])
+	assert.False(t, peers[0].IsClosed())
+}
@@ -0,0 +1,141 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Layout of a frame header. Every PeerMsg is sent as a frame header followed by the payload. All integers are
+// little-endian.
+const (
+	magicOffset     = 0                  // 4 bytes
+	commandOffset   = magicOffset + 4    // 12 bytes, the name of the msg type padded with zeros
+	lengthOffset    = commandOffset + 12 // uint32, size of the payload
+	checksumOffset  = lengthOffset + 4   // 4 bytes, start of the SHA256 of the payload
+	FrameHeaderSize = checksumOffset + 4 // Size of a frame header in bytes
+)
+
+// MaxPayloadSize bounds the payload of a frame, so a peer can't make the node allocate more than this for one msg
+const MaxPayloadSize = 32 * 1024 * 1024
+
+var (
+	ErrInvalidMagic     = errors.New("frame does not start with the network magic")
+	ErrUnknownCommand   = errors.New("frame has an unknown command")
+	ErrPayloadTooLarge  = errors.New("frame payload is too large")
+	ErrChecksumMismatch = errors.New("frame payload does not match its checksum")
+)
+
+// Magic starts every frame, so a stream that is not made of frames of this protocol is noticed at the first one
+var Magic = [4]byte{'b', 'c', 'g', 'o'}
+
+// msgCommands maps each PeerMsgType to the command naming it in frame headers
+var msgCommands = map[PeerMsgType]string{
+	ACK:                  "ack",
+	QUERY_LATEST:         "querylatest",
+	QUERY_ALL:            "queryall",
+	RESPONSE_BLOCKCHAIN:  "blocks",
+	RESPONSE_TRANSACTION: "tx",
+	PROPOSAL:             "proposal",
+	PREVOTE:              "prevote",
+	PRECOMMIT:            "precommit",
+	QUERY_BLOCK:          "queryblock",
+	VERSION:              "version",
+	VERACK:               "verack",
+	DISCONNECT:           "disconnect",
+	GET_BLOCKS:           "getblocks",
+	RESPONSE_BLOCKS:      "blockbatch",
+	GET_HEADERS:          "getheaders",
+	RESPONSE_HEADERS:     "headers",
+	GET_DATA:             "getdata",
+	PING:                 "ping",
+	PONG:                 "pong",
+}
+
+// encodeCommand returns the command field of the frame header of `msgType`
+func encodeCommand(msgType PeerMsgType) ([12]byte, error) {
+	var command [12]byte
+	name, ok := msgCommands[msgType]
+	if !ok {
+		return command, fmt.Errorf("%w: msg type %d", ErrUnknownCommand, msgType)
+	}
+	copy(command[:], name)
+	return command, nil
+}
+
+// decodeCommand returns the PeerMsgType named by the command field of a frame header
+func decodeCommand(command []byte) (PeerMsgType, error) {
+	name := string(bytes.TrimRight(command, "\x00"))
+	for msgType, msgName := range msgCommands {
+		if name == msgName {
+			return msgType, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownCommand, name)
+}
+
+// checksum returns the first 4 bytes of the SHA256 of the payload
+func checksum(payload []byte) [4]byte {
+	sum := sha256.Sum256(payload)
+	var c [4]byte
+	copy(c[:], sum[:4])
+	return c
+}
+
+// WriteFrame writes the frame of a msg of `msgType` carrying `payload` to `w`. The frame is left in the buffer of `w`
+// until it is flushed.
+func WriteFrame(w *bufio.Writer, msgType PeerMsgType, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(payload))
+	}
+	command, err := encodeCommand(msgType)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, FrameHeaderSize)
+	copy(header[magicOffset:], Magic[:])
+	copy(header[commandOffset:], command[:])
+	binary.LittleEndian.PutUint32(header[lengthOffset:], uint32(len(payload)))
+	sum := checksum(payload)
+	copy(header[checksumOffset:], sum[:])
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// ReadFrame reads the next frame from `r` and returns the type of its msg and its payload. io.EOF is returned when the
+// stream ends between frames, and io.ErrUnexpectedEOF when it ends within one.
+func ReadFrame(r *bufio.Reader) (PeerMsgType, []byte, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(header[magicOffset:commandOffset], Magic[:]) {
+		return 0, nil, fmt.Errorf("%w: %x", ErrInvalidMagic, header[magicOffset:commandOffset])
+	}
+	msgType, err := decodeCommand(header[commandOffset:lengthOffset])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[lengthOffset:])
+	if length > MaxPayloadSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, length)
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if sum := checksum(payload); !bytes.Equal(header[checksumOffset:], sum[:]) {
+		return 0, nil, ErrChecksumMismatch
+	}
+	return msgType, payload, nil
+}
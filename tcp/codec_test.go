@@ -0,0 +1,95 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// writeTestFrames writes the frame of each payload, as msgs of `msgType`, to a buffer
+func writeTestFrames(msgType PeerMsgType, payloads ...[]byte) []byte {
+	data := &bytes.Buffer{}
+	w := bufio.NewWriter(data)
+	for _, payload := range payloads {
+		_ = WriteFrame(w, msgType, payload)
+	}
+	_ = w.Flush()
+	return data.Bytes()
+}
+
+func TestReadFrame(t *testing.T) {
+	payloads := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{'\n'}, 5000)}
+	data := writeTestFrames(RESPONSE_BLOCKCHAIN, payloads...)
+	assert.Equal(t, Magic[:], data[:4])
+	assert.Equal(t, "blocks\x00\x00\x00\x00\x00\x00", string(data[commandOffset:lengthOffset]))
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	for _, expected := range payloads {
+		msgType, payload, err := ReadFrame(r)
+		assert.Nil(t, err)
+		assert.Equal(t, RESPONSE_BLOCKCHAIN, msgType)
+		assert.Equal(t, expected, payload)
+	}
+	_, _, err := ReadFrame(r)
+	assert.Equal(t, io.EOF, err, "Stream ending between frames should be a clean end")
+}
+
+func TestReadFrame_Invalid(t *testing.T) {
+	frame := writeTestFrames(QUERY_ALL, []byte("payload"))
+	corrupt := func(offset int, b byte) []byte {
+		data := append([]byte{}, frame...)
+		data[offset] = b
+		return data
+	}
+	tooLarge := append([]byte{}, frame...)
+	tooLarge[lengthOffset+3] = 0xff
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"wrong magic", corrupt(magicOffset, 'x'), ErrInvalidMagic},
+		{"unknown command", corrupt(commandOffset, 'x'), ErrUnknownCommand},
+		{"payload too large", tooLarge, ErrPayloadTooLarge},
+		{"checksum mismatch", corrupt(FrameHeaderSize, 'x'), ErrChecksumMismatch},
+		{"truncated header", frame[:FrameHeaderSize-1], io.ErrUnexpectedEOF},
+		{"truncated payload", frame[:FrameHeaderSize], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := ReadFrame(bufio.NewReader(bytes.NewReader(test.data)))
+
+			assert.ErrorIs(t, err, test.err)
+		})
+	}
+}
+
+func TestWriteFrame_Invalid(t *testing.T) {
+	w := bufio.NewWriter(&bytes.Buffer{})
+
+	assert.ErrorIs(t, WriteFrame(w, PeerMsgType(-1), nil), ErrUnknownCommand)
+	assert.ErrorIs(t, WriteFrame(w, ACK, make([]byte, MaxPayloadSize+1)), ErrPayloadTooLarge)
+	assert.Equal(t, 0, w.Buffered(), "Nothing should be written for an invalid frame")
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(writeTestFrames(ACK, []byte{}))
+	f.Add(writeTestFrames(RESPONSE_BLOCKCHAIN, []byte("first"), []byte("second")))
+	f.Add([]byte("bcgo"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		read := 0
+		for {
+			msgType, payload, err := ReadFrame(r)
+			if err != nil {
+				return
+			}
+			// A frame that was read must be written back the same way
+			frame := writeTestFrames(msgType, payload)
+			assert.Equal(t, data[read:read+len(frame)], frame)
+			read += len(frame)
+		}
+	})
+}
@@ -0,0 +1,371 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"io"
+)
+
+var ErrMalformedPayload = errors.New("malformed msg payload")
+
+// Flags telling how a string was encoded
+const (
+	rawString = 0 // The string follows as is
+	hexString = 1 // The string is lowercase hex, and the bytes it encodes follow
+)
+
+// encoder builds the compact binary payload of a PeerMsg. Integers are varints, and strings and lists are prefixed
+// with their length. Hashes, addresses and signatures are hex encoded strings, which are written as the bytes they
+// encode to take half the space.
+type encoder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (e *encoder) putUvarint(v uint64) {
+	e.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) putVarint(v int) {
+	e.buf.Write(binary.AppendVarint(nil, int64(v)))
+}
+
+func (e *encoder) putBool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) putBytes(b []byte) {
+	e.putUvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) putString(s string) {
+	if decoded, err := hex.DecodeString(s); err == nil && hex.EncodeToString(decoded) == s {
+		e.buf.WriteByte(hexString)
+		e.putBytes(decoded)
+		return
+	}
+	e.buf.WriteByte(rawString)
+	e.putBytes([]byte(s))
+}
+
+func (e *encoder) putHeader(h *block.BlockHeader) {
+	header, err := h.MarshalBinary()
+	if err != nil {
+		e.err = fmt.Errorf("block header: %w", err)
+		return
+	}
+	// The signatures are not part of the encoded header
+	e.buf.Write(header)
+	e.putString(h.Signature)
+	e.putBool(h.Commit != nil)
+	if h.Commit != nil {
+		e.putVarint(h.Commit.Round)
+		e.putUvarint(uint64(len(h.Commit.Precommits)))
+		for _, precommit := range h.Commit.Precommits {
+			e.putString(precommit.Validator)
+			e.putString(precommit.Signature)
+		}
+	}
+}
+
+func (e *encoder) putBlock(b *block.Block) {
+	// The block hash is left out since it is the hash of the encoded header
+	e.putHeader(&b.BlockHeader)
+	e.putVarint(b.Index)
+	e.putUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.putTransaction(tx)
+	}
+}
+
+func (e *encoder) putTransaction(tx *transaction.Transaction) {
+	e.putString(tx.Id)
+	e.putUvarint(uint64(len(tx.TxIns)))
+	for _, txIn := range tx.TxIns {
+		e.putString(txIn.TxOutId)
+		e.putVarint(txIn.TxOutIndex)
+		e.putString(txIn.Signature)
+	}
+	e.putUvarint(uint64(len(tx.TxOuts)))
+	for _, txOut := range tx.TxOuts {
+		e.putString(txOut.Address)
+		e.putVarint(txOut.Amount)
+	}
+}
+
+func (e *encoder) putConsensusMsg(msg *consensus.BFTMessage) {
+	e.putVarint(int(msg.Type))
+	e.putVarint(msg.Height)
+	e.putVarint(msg.Round)
+	e.putString(msg.BlockHash)
+	e.putBool(msg.Block != nil)
+	if msg.Block != nil {
+		e.putBlock(msg.Block)
+	}
+	e.putVarint(msg.ValidRound)
+	e.putString(msg.Validator)
+	e.putString(msg.Signature)
+}
+
+func (e *encoder) putVersionMsg(msg *VersionMsg) {
+	e.putVarint(msg.ProtocolVersion)
+	e.putString(msg.ChainId)
+	e.putString(msg.GenesisHash)
+	e.putVarint(msg.BestHeight)
+	e.putString(msg.NodeId)
+	e.putString(msg.UserAgent)
+}
+
+// EncodePeerMsg encodes every field of the msg but its type, which is the command of the frame carrying it
+func EncodePeerMsg(msg *PeerMsg) ([]byte, error) {
+	e := &encoder{}
+	e.putUvarint(uint64(len(msg.Data)))
+	for _, b := range msg.Data {
+		e.putBlock(b)
+	}
+	e.putUvarint(uint64(len(msg.Transactions)))
+	for _, tx := range msg.Transactions {
+		e.putTransaction(tx)
+	}
+	e.putBool(msg.Consensus != nil)
+	if msg.Consensus != nil {
+		e.putConsensusMsg(msg.Consensus)
+	}
+	e.putString(msg.BlockHash)
+	e.putBool(msg.Version != nil)
+	if msg.Version != nil {
+		e.putVersionMsg(msg.Version)
+	}
+	e.putString(msg.Reason)
+	e.putUvarint(uint64(len(msg.Locator)))
+	for _, hash := range msg.Locator {
+		e.putString(hash)
+	}
+	e.putString(msg.StopHash)
+	e.putUvarint(uint64(len(msg.Headers)))
+	for _, header := range msg.Headers {
+		e.putHeader(header)
+	}
+	e.putUvarint(uint64(len(msg.Hashes)))
+	for _, hash := range msg.Hashes {
+		e.putString(hash)
+	}
+	e.putUvarint(msg.Nonce)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// decoder reads a payload written by encoder. The first malformed field stops decoding, and every read after it
+// returns a zero value.
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *decoder) fail(format string, a ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformedPayload, fmt.Sprintf(format, a...))
+	}
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail("bad varint")
+	}
+	return v
+}
+
+func (d *decoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail("bad varint")
+	}
+	return int(v)
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	b, err := d.r.ReadByte()
+	if err != nil || b > 1 {
+		d.fail("bad bool")
+	}
+	return b == 1
+}
+
+// count reads the length of a list or string, which can't be more than the bytes left since every item takes at
+// least one, so a peer can't make the decoder allocate more than the payload size
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(d.r.Len()) {
+		d.fail("length %d is more than the %d bytes left", n, d.r.Len())
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, _ = d.r.Read(b)
+	return b
+}
+
+func (d *decoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+	flag, err := d.r.ReadByte()
+	if err != nil {
+		d.fail("missing string")
+		return ""
+	}
+	b := d.bytes()
+	switch flag {
+	case rawString:
+		return string(b)
+	case hexString:
+		return hex.EncodeToString(b)
+	}
+	d.fail("bad string flag %d", flag)
+	return ""
+}
+
+func (d *decoder) header() *block.BlockHeader {
+	if d.err != nil {
+		return nil
+	}
+	data := make([]byte, block.HeaderSize)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		d.fail("missing block header")
+		return nil
+	}
+	h := &block.BlockHeader{}
+	if err := h.UnmarshalBinary(data); err != nil {
+		d.fail("block header: %s", err)
+		return nil
+	}
+	h.Signature = d.string()
+	if d.bool() {
+		h.Commit = &block.Commit{Round: d.varint()}
+		for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+			h.Commit.Precommits = append(h.Commit.Precommits,
+				&block.CommitSignature{Validator: d.string(), Signature: d.string()})
+		}
+	}
+	return h
+}
+
+func (d *decoder) block() *block.Block {
+	header := d.header()
+	if header == nil {
+		return nil
+	}
+	b := &block.Block{BlockHeader: *header}
+	b.Index = d.varint()
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		b.Transactions = append(b.Transactions, d.transaction())
+	}
+	b.BlockHash = b.CalculateBlockHash()
+	return b
+}
+
+func (d *decoder) transaction() *transaction.Transaction {
+	tx := &transaction.Transaction{Id: d.string()}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		tx.TxIns = append(tx.TxIns, &transaction.TxIn{TxOutId: d.string(), TxOutIndex: d.varint(), Signature: d.string()})
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		tx.TxOuts = append(tx.TxOuts, &transaction.TxOut{Address: d.string(), Amount: d.varint()})
+	}
+	return tx
+}
+
+func (d *decoder) consensusMsg() *consensus.BFTMessage {
+	msg := &consensus.BFTMessage{
+		Type:      consensus.BFTMessageType(d.varint()),
+		Height:    d.varint(),
+		Round:     d.varint(),
+		BlockHash: d.string(),
+	}
+	if d.bool() {
+		msg.Block = d.block()
+	}
+	msg.ValidRound = d.varint()
+	msg.Validator = d.string()
+	msg.Signature = d.string()
+	return msg
+}
+
+func (d *decoder) versionMsg() *VersionMsg {
+	return &VersionMsg{
+		ProtocolVersion: d.varint(),
+		ChainId:         d.string(),
+		GenesisHash:     d.string(),
+		BestHeight:      d.varint(),
+		NodeId:          d.string(),
+		UserAgent:       d.string(),
+	}
+}
+
+// DecodePeerMsg decodes the payload of a frame carrying a msg of `msgType`. Empty lists are decoded as nil.
+func DecodePeerMsg(msgType PeerMsgType, payload []byte) (*PeerMsg, error) {
+	d := &decoder{r: bytes.NewReader(payload)}
+	msg := &PeerMsg{Type: msgType}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		msg.Data = append(msg.Data, d.block())
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		msg.Transactions = append(msg.Transactions, d.transaction())
+	}
+	if d.bool() {
+		msg.Consensus = d.consensusMsg()
+	}
+	msg.BlockHash = d.string()
+	if d.bool() {
+		msg.Version = d.versionMsg()
+	}
+	msg.Reason = d.string()
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		msg.Locator = append(msg.Locator, d.string())
+	}
+	msg.StopHash = d.string()
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		msg.Headers = append(msg.Headers, d.header())
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		msg.Hashes = append(msg.Hashes, d.string())
+	}
+	msg.Nonce = d.uvarint()
+	if d.err == nil && d.r.Len() > 0 {
+		d.fail("%d bytes left over", d.r.Len())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
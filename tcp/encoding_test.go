@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"encoding/json"
+	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestBlocks creates a chain of `n` blocks holding a coinbase and a payment each. Timestamps have the
+// millisecond precision of encoded headers.
+func createTestBlocks(n int) []*block.Block {
+	blocks := make([]*block.Block, 0, n)
+	prevHash := strings.Repeat("00", 32)
+	for i := 0; i < n; i++ {
+		address := strings.Repeat("ab", 32)
+		coinbase := transaction.CreateCoinbaseTransaction(address, 50, i)
+		payment := transaction.CreateTransaction(
+			[]*transaction.TxIn{{TxOutId: coinbase.Id, TxOutIndex: 0, Signature: strings.Repeat("cd", 64)}},
+			[]*transaction.TxOut{{Address: "not a hex address", Amount: 10}, {Address: address, Amount: 40}},
+		)
+		b := &block.Block{
+			BlockHeader: block.BlockHeader{
+				Version:       block.BlockVersion,
+				PrevBlockHash: prevHash,
+				Timestamp:     time.UnixMilli(1672531200000 + int64(i)*1000),
+				Difficulty:    i,
+				Nonce:         -i,
+			},
+			Transactions: []*transaction.Transaction{coinbase, payment},
+			Index:        i,
+		}
+		b.MerkleRoot = b.CalculateMerkleRoot()
+		b.BlockHash = b.CalculateBlockHash()
+		prevHash = b.BlockHash
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func TestEncodePeerMsg(t *testing.T) {
+	blocks := createTestBlocks(3)
+	signed := *blocks[2]
+	signed.Signer = strings.Repeat("ef", 32)
+	signed.BlockHash = signed.CalculateBlockHash()
+	signed.Signature = strings.Repeat("01", 64)
+	signed.Commit = &block.Commit{Round: 2, Precommits: []*block.CommitSignature{
+		{Validator: strings.Repeat("ef", 32), Signature: strings.Repeat("02", 64)},
+	}}
+	tests := []struct {
+		name string
+		msg  *PeerMsg
+	}{
+		{"empty msg", &PeerMsg{Type: QUERY_ALL}},
+		{"blocks", &PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: blocks}},
+		{"signed block", &PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: []*block.Block{&signed}}},
+		{"transactions", &PeerMsg{Type: RESPONSE_TRANSACTION, Transactions: blocks[0].Transactions}},
+		{"proposal", &PeerMsg{Type: PROPOSAL, Consensus: &consensus.BFTMessage{Type: consensus.PROPOSAL,
+			Height: 3, Round: 1, BlockHash: signed.BlockHash, Block: &signed, ValidRound: -1,
+			Validator: signed.Signer, Signature: signed.Signature}}},
+		{"prevote", &PeerMsg{Type: PREVOTE, Consensus: &consensus.BFTMessage{Type: consensus.PREVOTE, Height: 3,
+			ValidRound: -1, Validator: "validator"}}},
+		{"block query", &PeerMsg{Type: QUERY_BLOCK, BlockHash: blocks[1].BlockHash}},
+		{"version", &PeerMsg{Type: VERSION, Version: &VersionMsg{ProtocolVersion: ProtocolVersion,
+			ChainId: "testnet", GenesisHash: blocks[0].BlockHash, BestHeight: 7, NodeId: "0a1b", UserAgent: UserAgent}}},
+		{"disconnect", &PeerMsg{Type: DISCONNECT, Reason: ErrChainIdMismatch.Error()}},
+		{"get blocks", &PeerMsg{Type: GET_BLOCKS, Locator: []string{blocks[2].BlockHash, blocks[0].BlockHash},
+			StopHash: blocks[2].BlockHash}},
+		{"block batch", &PeerMsg{Type: RESPONSE_BLOCKS, Data: blocks[1:], StopHash: blocks[2].BlockHash}},
+		{"headers", &PeerMsg{Type: RESPONSE_HEADERS, Headers: []*block.BlockHeader{&blocks[0].BlockHeader,
+			&signed.BlockHeader}}},
+		{"get data", &PeerMsg{Type: GET_DATA, Hashes: []string{blocks[0].BlockHash, blocks[1].BlockHash}}},
+		{"ping", &PeerMsg{Type: PING, Nonce: 1<<64 - 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := EncodePeerMsg(test.msg)
+			assert.Nil(t, err)
+
+			msg, err := DecodePeerMsg(test.msg.Type, payload)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.msg, msg)
+		})
+	}
+}
+
+func TestEncodePeerMsg_Compact(t *testing.T) {
+	msg := &PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: createTestBlocks(10)}
+
+	payload, _ := EncodePeerMsg(msg)
+	jsonPayload, _ := json.Marshal(msg)
+
+	assert.Less(t, 2*len(payload), len(jsonPayload), "Binary encoding should take less than half the space of JSON")
+}
+
+func TestEncodePeerMsg_InvalidHeader(t *testing.T) {
+	b := createTestBlocks(1)[0]
+	b.PrevBlockHash = "not a hash"
+
+	_, err := EncodePeerMsg(&PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: []*block.Block{b}})
+
+	assert.ErrorIs(t, err, block.ErrInvalidHeader)
+}
+
+func TestDecodePeerMsg_Malformed(t *testing.T) {
+	payload, _ := EncodePeerMsg(&PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: createTestBlocks(2)})
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated", payload[:len(payload)-1]},
+		{"truncated header", payload[:block.HeaderSize/2]},
+		{"trailing bytes", append(append([]byte{}, payload...), 0)},
+		{"too many blocks", append([]byte{0xff, 0xff, 0x03}, payload[1:]...)},
+		{"bad varint", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := DecodePeerMsg(RESPONSE_BLOCKCHAIN, test.payload)
+
+			assert.ErrorIs(t, err, ErrMalformedPayload)
+			assert.Nil(t, msg)
+		})
+	}
+}
+
+func FuzzDecodePeerMsg(f *testing.F) {
+	blocks := createTestBlocks(2)
+	for _, msg := range []*PeerMsg{
+		{Type: QUERY_ALL},
+		{Type: RESPONSE_BLOCKCHAIN, Data: blocks},
+		{Type: RESPONSE_TRANSACTION, Transactions: blocks[1].Transactions},
+		{Type: PROPOSAL, Consensus: &consensus.BFTMessage{Type: consensus.PROPOSAL, Block: blocks[1]}},
+		{Type: VERSION, Version: &VersionMsg{ProtocolVersion: ProtocolVersion, ChainId: "testnet"}},
+		{Type: GET_BLOCKS, Locator: []string{blocks[1].BlockHash, blocks[0].BlockHash}},
+		{Type: RESPONSE_HEADERS, Headers: []*block.BlockHeader{&blocks[0].BlockHeader, &blocks[1].BlockHeader}},
+		{Type: PONG, Nonce: 42},
+	} {
+		payload, _ := EncodePeerMsg(msg)
+		f.Add(int(msg.Type), payload)
+	}
+	f.Fuzz(func(t *testing.T, msgType int, payload []byte) {
+		msg, err := DecodePeerMsg(PeerMsgType(msgType), payload)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrMalformedPayload)
+			return
+		}
+		// Whatever decodes must encode back to a payload that decodes to the same msg
+		encoded, err := EncodePeerMsg(msg)
+		assert.Nil(t, err)
+		decoded, err := DecodePeerMsg(PeerMsgType(msgType), encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, decoded)
+	})
+}
@@ -0,0 +1,198 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+)
+
+const (
+	ProtocolVersion = 5 // Version of the peer protocol this node speaks
+	// MinProtocolVersion is the oldest version of the peer protocol this node still speaks. It is the first version
+	// only ever sent as frames, since nodes speaking version 2 may send newline delimited JSON instead.
+	MinProtocolVersion = 3
+	UserAgent          = "blockchain-go"
+)
+
+var (
+	ErrChainIdMismatch    = errors.New("peer follows a different chain")
+	ErrGenesisMismatch    = errors.New("peer follows a chain with a different genesis block")
+	ErrUnsupportedVersion = errors.New("peer speaks an unsupported protocol version")
+	ErrSelfConnection     = errors.New("connected to self")
+	ErrUnexpectedMsg      = errors.New("unexpected msg during handshake")
+	ErrPeerDisconnected   = errors.New("peer disconnected")
+)
+
+// msgMinVersions maps the PeerMsgTypes added after MinProtocolVersion to the version that added them. Peers never send
+// each other messages their negotiated version does not have.
+var msgMinVersions = map[PeerMsgType]int{
+	GET_HEADERS:      4,
+	RESPONSE_HEADERS: 4,
+	GET_DATA:         4,
+	PING:             5,
+	PONG:             5,
+}
+
+// VersionMsg describes a node to a peer at the start of a connection
+type VersionMsg struct {
+	ProtocolVersion int
+	ChainId         string
+	GenesisHash     string
+	BestHeight      int
+	NodeId          string
+	UserAgent       string
+}
+
+// NodeInfo describes this node in the VERSION messages it sends. It is passed to the server and to the functions
+// dialing peers, which make the handshake with it. Where none is passed no handshake is made, and peers are assumed to
+// speak ProtocolVersion.
+type NodeInfo struct {
+	ChainId       string
+	GenesisHash   string
+	NodeId        string // Random id telling this node apart from its peers, so it never connects to itself
+	GetBestHeight func() int
+	// Sessions is the config of the accepted connections kept open as sessions once their peer pings them. Accepted
+	// connections are closed after every exchange while it is nil.
+	Sessions *SessionConfig
+}
+
+// CreateNodeInfo creates the NodeInfo of a node following the chain with `chainId` and `genesisHash` with a new random
+// node id
+func CreateNodeInfo(chainId string, genesisHash string, getBestHeight func() int) *NodeInfo {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &NodeInfo{
+		ChainId:       chainId,
+		GenesisHash:   genesisHash,
+		NodeId:        hex.EncodeToString(id),
+		GetBestHeight: getBestHeight,
+	}
+}
+
+// createVersionMsg creates the VERSION message describing the node
+func (n *NodeInfo) createVersionMsg() *VersionMsg {
+	return &VersionMsg{
+		ProtocolVersion: ProtocolVersion,
+		ChainId:         n.ChainId,
+		GenesisHash:     n.GenesisHash,
+		BestHeight:      n.GetBestHeight(),
+		NodeId:          n.NodeId,
+		UserAgent:       UserAgent,
+	}
+}
+
+// checkVersion checks that the node can talk to the peer described by `remote`
+func (n *NodeInfo) checkVersion(remote *VersionMsg) error {
+	if remote.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, remote.ProtocolVersion)
+	} else if remote.ChainId != n.ChainId {
+		return fmt.Errorf("%w: %q", ErrChainIdMismatch, remote.ChainId)
+	} else if remote.GenesisHash != n.GenesisHash {
+		return fmt.Errorf("%w: %q", ErrGenesisMismatch, remote.GenesisHash)
+	} else if remote.NodeId == n.NodeId {
+		return ErrSelfConnection
+	}
+	return nil
+}
+
+// Handshake introduces the node described by `local` to the peer it dialed. The node sends VERSION, the peer answers
+// with its own VERSION, and each side acknowledges the other's with VERACK in turn, so only one side writes at a
+// time. A peer the node can't talk to is sent a DISCONNECT with the reason and closed.
+func (pc *PeerConn) Handshake(local *NodeInfo) error {
+	err := pc.sendHandshakeMsg(&PeerMsg{Type: VERSION, Version: local.createVersionMsg()})
+	if err != nil {
+		return err
+	}
+	remote, err := pc.receiveHandshakeMsg(VERSION)
+	if err != nil {
+		return err
+	}
+	if err = pc.negotiate(local, remote.Version); err != nil {
+		return err
+	}
+	if err = pc.sendHandshakeMsg(&PeerMsg{Type: VERACK}); err != nil {
+		return err
+	}
+	_, err = pc.receiveHandshakeMsg(VERACK)
+	return err
+}
+
+// AcceptHandshake is the side of Handshake of the node described by `local` accepting a connection
+func (pc *PeerConn) AcceptHandshake(local *NodeInfo) error {
+	remote, err := pc.receiveHandshakeMsg(VERSION)
+	if err != nil {
+		return err
+	}
+	if err = pc.negotiate(local, remote.Version); err != nil {
+		return err
+	}
+	if err = pc.sendHandshakeMsg(&PeerMsg{Type: VERSION, Version: local.createVersionMsg()}); err != nil {
+		return err
+	}
+	if _, err = pc.receiveHandshakeMsg(VERACK); err != nil {
+		return err
+	}
+	return pc.sendHandshakeMsg(&PeerMsg{Type: VERACK})
+}
+
+// negotiate checks the VERSION of the peer and settles on the highest protocol version both sides speak. The peer is
+// disconnected if the node can't talk to it.
+func (pc *PeerConn) negotiate(local *NodeInfo, remote *VersionMsg) error {
+	if remote == nil {
+		return pc.Disconnect(ErrUnexpectedMsg)
+	}
+	if err := local.checkVersion(remote); err != nil {
+		return pc.Disconnect(err)
+	}
+	pc.Remote = remote
+	pc.Version = ProtocolVersion
+	if remote.ProtocolVersion < pc.Version {
+		pc.Version = remote.ProtocolVersion
+	}
+	log.Printf("Connected to node %s (%s) at height %d speaking protocol version %d\n", remote.NodeId,
+		remote.UserAgent, remote.BestHeight, pc.Version)
+	return nil
+}
+
+// Disconnect sends the peer a DISCONNECT with `reason` and closes the connection. The reason is returned.
+func (pc *PeerConn) Disconnect(reason error) error {
+	log.Println("Disconnecting peer: " + reason.Error())
+	_ = pc.SendResp(&PeerMsg{Type: DISCONNECT, Reason: reason.Error()})
+	_ = pc.ClosePeer()
+	return reason
+}
+
+// sendHandshakeMsg sends a handshake msg, closing the peer if it can't be sent
+func (pc *PeerConn) sendHandshakeMsg(msg *PeerMsg) error {
+	err := pc.SendResp(msg)
+	if err != nil {
+		_ = pc.ClosePeer()
+	}
+	return err
+}
+
+// receiveHandshakeMsg receives the next handshake msg, which must be of `msgType`
+func (pc *PeerConn) receiveHandshakeMsg(msgType PeerMsgType) (*PeerMsg, error) {
+	msg, err := pc.ReceiveMsg()
+	if err != nil {
+		_ = pc.ClosePeer()
+		return nil, err
+	} else if msg == nil {
+		_ = pc.ClosePeer()
+		return nil, fmt.Errorf("%w: connection closed during handshake", ErrPeerDisconnected)
+	} else if msg.Type != msgType {
+		return nil, pc.Disconnect(fmt.Errorf("%w: got %d instead of %d", ErrUnexpectedMsg, msg.Type, msgType))
+	}
+	return msg, nil
+}
+
+// Supports checks if the protocol version negotiated with the peer has messages of `msgType`
+func (pc *PeerConn) Supports(msgType PeerMsgType) bool {
+	version := pc.Version
+	if version == 0 {
+		version = ProtocolVersion
+	}
+	return msgMinVersions[msgType] <= version
+}
@@ -0,0 +1,130 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// createTestNodeInfo creates the NodeInfo of a node at height 7 of the chain with `chainId`
+func createTestNodeInfo(chainId string) *NodeInfo {
+	return CreateNodeInfo(chainId, "genesis", func() int { return 7 })
+}
+
+// handshake makes the handshake between a node described by `local` dialing a node described by `remote` and returns
+// both ends with the errors each side got
+func handshake(local *NodeInfo, remote *NodeInfo) (*PeerConn, error, *PeerConn, error) {
+	clientConn, serverConn := net.Pipe()
+	client, server := &PeerConn{Conn: clientConn}, &PeerConn{Conn: serverConn}
+	serverErr := make(chan error)
+	go func() {
+		serverErr <- server.AcceptHandshake(remote)
+	}()
+	clientErr := client.Handshake(local)
+	return client, clientErr, server, <-serverErr
+}
+
+func TestPeerConn_Handshake(t *testing.T) {
+	local, remote := createTestNodeInfo("testnet"), createTestNodeInfo("testnet")
+
+	client, clientErr, server, serverErr := handshake(local, remote)
+
+	assert.Nil(t, clientErr)
+	assert.Nil(t, serverErr)
+	assert.Equal(t, ProtocolVersion, client.Version)
+	assert.Equal(t, ProtocolVersion, server.Version)
+	assert.Equal(t, &VersionMsg{ProtocolVersion: ProtocolVersion, ChainId: "testnet", GenesisHash: "genesis",
+		BestHeight: 7, NodeId: remote.NodeId, UserAgent: UserAgent}, client.Remote)
+	assert.Equal(t, local.NodeId, server.Remote.NodeId)
+
+	go func() {
+		_ = client.SendQueryBlockMsg("abc")
+	}()
+	msg, err := server.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", msg.BlockHash, "Msgs should be exchanged after the handshake")
+}
+
+func TestPeerConn_Handshake_Incompatible(t *testing.T) {
+	local := createTestNodeInfo("testnet")
+	otherGenesis := createTestNodeInfo("testnet")
+	otherGenesis.GenesisHash = "other genesis"
+	tests := []struct {
+		name   string
+		remote *NodeInfo
+		err    error
+	}{
+		{"different chain", createTestNodeInfo("mainnet"), ErrChainIdMismatch},
+		{"different genesis block", otherGenesis, ErrGenesisMismatch},
+		{"self connection", local, ErrSelfConnection},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, clientErr, server, serverErr := handshake(local, test.remote)
+
+			assert.ErrorIs(t, serverErr, test.err, "Accepting side should refuse the peer")
+			assert.ErrorIs(t, clientErr, ErrPeerDisconnected, "Dialing side should be told it was refused")
+			assert.Contains(t, clientErr.Error(), test.err.Error(), "Disconnect should carry the reason")
+			assert.True(t, client.IsClosed())
+			assert.True(t, server.IsClosed())
+		})
+	}
+}
+
+func TestPeerConn_Handshake_OldVersion(t *testing.T) {
+	local := createTestNodeInfo("testnet")
+	clientConn, serverConn := net.Pipe()
+	client, server := &PeerConn{Conn: clientConn}, &PeerConn{Conn: serverConn}
+	go func() {
+		// A peer speaking the oldest protocol version, which has no headers first download
+		_, _ = server.ReceiveMsg()
+		version := &VersionMsg{ProtocolVersion: MinProtocolVersion, ChainId: "testnet", GenesisHash: "genesis",
+			NodeId: "old"}
+		_ = server.SendResp(&PeerMsg{Type: VERSION, Version: version})
+		_, _ = server.ReceiveMsg()
+		_ = server.SendResp(&PeerMsg{Type: VERACK})
+		_ = server.SendResp(&PeerMsg{Type: GET_HEADERS})
+		_, _ = server.ReceiveMsg()
+	}()
+
+	assert.Nil(t, client.Handshake(local))
+	assert.Equal(t, MinProtocolVersion, client.Version, "Lowest version of both sides should be negotiated")
+	assert.False(t, client.Supports(GET_HEADERS))
+	assert.True(t, client.Supports(GET_BLOCKS))
+	assert.ErrorIs(t, client.SendGetHeadersMsg([]string{"abc"}, ""), ErrUnsupportedMsg)
+	_, err := client.ReceiveMsg()
+	assert.ErrorIs(t, err, ErrUnsupportedMsg, "Msgs the negotiated version does not have should be refused")
+	assert.True(t, client.IsClosed())
+
+	clientConn, serverConn = net.Pipe()
+	client, server = &PeerConn{Conn: clientConn}, &PeerConn{Conn: serverConn}
+	go func() {
+		// Version 2 nodes may not speak frames at all
+		_ = server.SendResp(&PeerMsg{Type: VERSION, Version: &VersionMsg{ProtocolVersion: 2, ChainId: "testnet",
+			GenesisHash: "genesis", NodeId: "older"}})
+		_, _ = server.ReceiveMsg()
+	}()
+	assert.ErrorIs(t, client.AcceptHandshake(local), ErrUnsupportedVersion)
+}
+
+func TestPipeNetwork_Dial_Handshake(t *testing.T) {
+	network := CreatePipeNetwork()
+	pc := make(chan Peer, 1)
+	network.Listen("1.1.1.1:42", pc, createTestNodeInfo("testnet"))
+
+	conn, _ := network.Dial("1.1.1.1:42")
+	client := &PeerConn{Conn: conn}
+	assert.Nil(t, client.Handshake(createTestNodeInfo("testnet")))
+	server := (<-pc).(*PeerConn)
+	assert.Equal(t, ProtocolVersion, server.Version, "Accepted peer should be handed over after the handshake")
+
+	conn, _ = network.Dial("1.1.1.1:42")
+	client = &PeerConn{Conn: conn}
+	assert.ErrorIs(t, client.Handshake(createTestNodeInfo("mainnet")), ErrPeerDisconnected)
+	select {
+	case <-pc:
+		assert.Fail(t, "Refused peer should not be handed over")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,55 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrNoListener = errors.New("no peer is listening on the address")
+
+// PipeNetwork is a NetDialer that connects nodes in the same process over net.Pipe, so a network of peers can run
+// without opening sockets
+type PipeNetwork struct {
+	listeners map[string]*pipeListener
+	mu        sync.Mutex
+}
+
+// pipeListener is the node listening on an address of a PipeNetwork
+type pipeListener struct {
+	pc    chan Peer
+	local *NodeInfo
+}
+
+func CreatePipeNetwork() *PipeNetwork {
+	return &PipeNetwork{listeners: map[string]*pipeListener{}}
+}
+
+// Listen places a Peer in the Peer channel for every connection dialed to `address`, accepted as the node `local`
+// like StartServer does for TCP connections
+func (n *PipeNetwork) Listen(address string, pc chan Peer, local *NodeInfo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.listeners[address] = &pipeListener{pc: pc, local: local}
+}
+
+// Close stops listening on `address`
+func (n *PipeNetwork) Close(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.listeners, address)
+}
+
+func (n *PipeNetwork) Dial(address string) (net.Conn, error) {
+	n.mu.Lock()
+	listener, ok := n.listeners[address]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: %w", address, ErrNoListener)
+	}
+	client, server := net.Pipe()
+	// Accept the connection without waiting for the listener to take it from the channel
+	go acceptPeer(server, listener.pc, listener.local)
+	return client, nil
+}
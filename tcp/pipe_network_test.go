@@ -0,0 +1,47 @@
+package tcp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPipeNetwork_Dial(t *testing.T) {
+	network := CreatePipeNetwork()
+	pc := make(chan Peer)
+	network.Listen("1.1.1.1:42", pc, nil)
+
+	conn, err := network.Dial("1.1.1.1:42")
+	assert.Nil(t, err)
+	client := &PeerConn{Conn: conn}
+	server := <-pc
+
+	go func() {
+		_ = client.SendQueryAllMsg()
+	}()
+	msg, err := server.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, &PeerMsg{Type: QUERY_ALL}, msg)
+
+	go func() {
+		_ = server.SendAckMsg()
+	}()
+	msg, err = client.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, ACK, msg.Type)
+
+	_ = client.ClosePeer()
+	msg, err = server.ReceiveMsg()
+	assert.Nil(t, msg, "Closing one end should end the connection on the other")
+	assert.Nil(t, err)
+}
+
+func TestPipeNetwork_Dial_NoListener(t *testing.T) {
+	network := CreatePipeNetwork()
+	network.Listen("1.1.1.1:42", make(chan Peer), nil)
+	network.Close("1.1.1.1:42")
+
+	_, err := network.Dial("1.1.1.1:42")
+	assert.ErrorIs(t, err, ErrNoListener)
+	_, err = network.Dial("2.2.2.2:99")
+	assert.ErrorIs(t, err, ErrNoListener)
+}
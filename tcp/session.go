@@ -0,0 +1,367 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/database"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrSessionUnsupported = errors.New("peer speaks a protocol version without sessions")
+
+// SessionConfig controls how sessions with peers are kept alive and reopened
+type SessionConfig struct {
+	PingInterval time.Duration // Time between the PINGs sent to the peer
+	IdleTimeout  time.Duration // A session the peer sent nothing on for this long is closed
+	WriteTimeout time.Duration // A session the peer takes no msg from for this long is closed
+	MinBackoff   time.Duration // Time before reconnecting to a peer after a failure
+	MaxBackoff   time.Duration // Bound of the time before reconnecting, which doubles after every failure
+}
+
+// DefaultSessionConfig returns the settings used when none are configured
+func DefaultSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		PingInterval: 30 * time.Second,
+		IdleTimeout:  90 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		MinBackoff:   time.Second,
+		MaxBackoff:   5 * time.Minute,
+	}
+}
+
+// session is the keepalive state of a connection kept open as a session
+type session struct {
+	config   *SessionConfig
+	nonce    uint64        // Nonce of the last PING sent
+	pingSent time.Time     // Time the last PING was sent, zero once it was answered
+	latency  time.Duration // Round trip time of the last PING answered
+	mu       sync.Mutex
+}
+
+// ping records a new PING and returns its nonce
+func (s *session) ping() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce++
+	s.pingSent = time.Now()
+	return s.nonce
+}
+
+// pong records the PONG with `nonce`. PONGs of older PINGs are ignored.
+func (s *session) pong(nonce uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nonce == s.nonce && !s.pingSent.IsZero() {
+		s.latency = time.Since(s.pingSent)
+		s.pingSent = time.Time{}
+	}
+}
+
+// StartSession keeps the connection open as a session with the peer. The node pings the peer right away, which tells
+// a peer that accepted the connection to keep it open too, and every config.PingInterval after that. ACKs end an
+// exchange of msgs instead of the connection, and the connection is closed once the peer stops answering.
+func (pc *PeerConn) StartSession(config *SessionConfig) {
+	pc.mu.Lock()
+	pc.session = &session{config: config}
+	pc.mu.Unlock()
+	go pc.keepAlive(config.PingInterval)
+}
+
+// acceptSession keeps the connection open as a session once the peer that dialed it pinged it, if it was accepted by
+// a node with a session config
+func (pc *PeerConn) acceptSession() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.session != nil || pc.sessionConfig == nil {
+		return
+	}
+	pc.session = &session{config: pc.sessionConfig}
+	go pc.keepAlive(pc.sessionConfig.PingInterval)
+}
+
+// getSession returns the keepalive state of the connection, or nil if it is not kept open as a session
+func (pc *PeerConn) getSession() *session {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.session
+}
+
+// keepAlive pings the peer every `interval` until the connection is closed
+func (pc *PeerConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := pc.SendResp(&PeerMsg{Type: PING, Nonce: pc.getSession().ping()})
+		if err != nil {
+			log.Printf("Failed to ping peer: %s\n", err)
+			_ = pc.ClosePeer()
+			return
+		}
+		select {
+		case <-pc.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsPersistent returns if the connection is kept open as a session
+func (pc *PeerConn) IsPersistent() bool {
+	return pc.getSession() != nil
+}
+
+// GetLatency returns the round trip time of the last PING the peer answered, or 0 if it answered none
+func (pc *PeerConn) GetLatency() time.Duration {
+	s := pc.getSession()
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latency
+}
+
+// SessionStatus describes the session with a registered peer
+type SessionStatus struct {
+	Address   string
+	Connected bool
+	NodeId    string  // Id of the node in the handshake of the session
+	LatencyMs float64 // Round trip time of the last PING the peer answered
+	Failures  int     // Connection attempts failed since the last session
+	// Unsupported is set once the peer turned out to speak a protocol version without sessions. It is not dialed
+	// again to keep a session, only for each msg.
+	Unsupported bool
+}
+
+// SessionManager keeps a session open with every registered peer, and reconnects to a peer with exponential backoff
+// when its session ends. Msgs are broadcast over its sessions.
+type SessionManager struct {
+	GetPeerConnInfo func() ([]*database.PeerConnInfo, error)
+	Dialer          NetDialer
+	Config          *SessionConfig
+	Local           *NodeInfo // Node making the handshakes of the sessions, nil to make none
+	// Pc is where new sessions are placed, so the msgs of their peers are answered
+	Pc       chan Peer
+	sessions map[string]*managedSession // Sessions by the address of their peer
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+}
+
+// managedSession is the session a SessionManager keeps with one peer
+type managedSession struct {
+	conn        *PeerConn // Open connection, nil while reconnecting
+	failures    int
+	unsupported bool // The peer speaks a protocol version without sessions
+}
+
+// CreateSessionManager creates a SessionManager of the sessions the node `local` keeps with the peers registered in
+// the database
+func CreateSessionManager(pc chan Peer, config *SessionConfig, local *NodeInfo) *SessionManager {
+	return &SessionManager{
+		GetPeerConnInfo: database.GetAllPeerConnInfo,
+		Dialer:          CreateTcpDialer(),
+		Config:          config,
+		Local:           local,
+		Pc:              pc,
+		sessions:        map[string]*managedSession{},
+		stop:            make(chan struct{}),
+	}
+}
+
+// Start opens a session with every registered peer in new goroutines. Peers registered later get a session after the
+// next ping interval.
+func (sm *SessionManager) Start() {
+	go func() {
+		ticker := time.NewTicker(sm.Config.PingInterval)
+		defer ticker.Stop()
+		for {
+			sm.connect()
+			select {
+			case <-sm.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop closes every session and stops reconnecting. Stopping a stopped manager does nothing.
+func (sm *SessionManager) Stop() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stopOnce.Do(func() {
+		close(sm.stop)
+	})
+	for _, s := range sm.sessions {
+		if s.conn != nil {
+			_ = s.conn.ClosePeer()
+		}
+	}
+}
+
+// connect starts keeping a session with the registered peers that have none
+func (sm *SessionManager) connect() {
+	peerConnList, err := sm.GetPeerConnInfo()
+	if err != nil {
+		log.Println("Failed to get peers: " + err.Error())
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, info := range peerConnList {
+		address := fmt.Sprintf("%s:%d", info.Ip, info.Port)
+		if _, ok := sm.sessions[address]; !ok {
+			sm.sessions[address] = &managedSession{}
+			go sm.keepSession(address)
+		}
+	}
+}
+
+// keepSession opens a session with the peer at `address`, and opens a new one whenever it ends until the manager is
+// stopped. The time before reconnecting doubles after every failed attempt and every session that ended before the
+// idle timeout, so a peer that is down is dialed less and less often. A peer speaking a protocol version without
+// sessions is not dialed again, since it would never keep one open.
+func (sm *SessionManager) keepSession(address string) {
+	var backoff time.Duration
+	for {
+		if backoff > 0 {
+			select {
+			case <-sm.stop:
+				return
+			case <-time.After(backoff):
+			}
+		}
+		peer, err := sm.dial(address)
+		if errors.Is(err, ErrSessionUnsupported) {
+			log.Printf("Not keeping a session with peer %s: %s\n", address, err)
+			sm.setUnsupported(address)
+			return
+		} else if err != nil {
+			log.Printf("Could not open session with peer %s: %s\n", address, err)
+			sm.setConn(address, nil, true)
+			backoff = nextBackoff(backoff, sm.Config)
+			continue
+		}
+
+		opened := time.Now()
+		sm.setConn(address, peer, false)
+		select {
+		case <-sm.stop:
+			_ = peer.ClosePeer()
+			return
+		case sm.Pc <- peer:
+		}
+		select {
+		case <-sm.stop:
+			_ = peer.ClosePeer()
+			return
+		case <-peer.Done():
+		}
+		log.Printf("Session with peer %s ended\n", address)
+		sm.setConn(address, nil, false)
+		if time.Since(opened) < sm.Config.IdleTimeout {
+			backoff = nextBackoff(backoff, sm.Config)
+		} else {
+			backoff = sm.Config.MinBackoff
+		}
+	}
+}
+
+// nextBackoff returns the time to wait before reconnecting after waiting `backoff` the last time
+func nextBackoff(backoff time.Duration, config *SessionConfig) time.Duration {
+	if backoff < config.MinBackoff {
+		return config.MinBackoff
+	} else if 2*backoff > config.MaxBackoff {
+		return config.MaxBackoff
+	}
+	return 2 * backoff
+}
+
+// dial connects to the peer at `address` and starts a session with it
+func (sm *SessionManager) dial(address string) (*PeerConn, error) {
+	conn, err := sm.Dialer.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	peer := &PeerConn{Conn: conn}
+	if sm.Local != nil {
+		if err = peer.Handshake(sm.Local); err != nil {
+			_ = peer.ClosePeer()
+			return nil, err
+		}
+	}
+	if !peer.Supports(PING) {
+		_ = peer.ClosePeer()
+		return nil, fmt.Errorf("%w: %d", ErrSessionUnsupported, peer.Version)
+	}
+	peer.StartSession(sm.Config)
+	return peer, nil
+}
+
+// setConn records the connection of the session with the peer at `address`, and whether an attempt to open it failed
+func (sm *SessionManager) setConn(address string, conn *PeerConn, failed bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s := sm.sessions[address]
+	s.conn = conn
+	if failed {
+		s.failures++
+	} else if conn != nil {
+		s.failures = 0
+	}
+}
+
+// setUnsupported records that the peer at `address` speaks a protocol version without sessions
+func (sm *SessionManager) setUnsupported(address string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.sessions[address].unsupported = true
+}
+
+// GetPeers returns the open sessions with the registered peers, and peers dialed for the registered peers without one
+func (sm *SessionManager) GetPeers() ([]Peer, error) {
+	peerConnList, err := sm.GetPeerConnInfo()
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	var unconnected []*database.PeerConnInfo
+	sm.mu.Lock()
+	for _, info := range peerConnList {
+		s := sm.sessions[fmt.Sprintf("%s:%d", info.Ip, info.Port)]
+		if s != nil && s.conn != nil && !s.conn.IsClosed() {
+			peers = append(peers, s.conn)
+		} else {
+			unconnected = append(unconnected, info)
+		}
+	}
+	sm.mu.Unlock()
+	dialed, err := GetPeers(unconnected, sm.Dialer, sm.Local)
+	return append(peers, dialed...), err
+}
+
+// GetStatus describes the session with every registered peer, sorted by address
+func (sm *SessionManager) GetStatus() []*SessionStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	statuses := make([]*SessionStatus, 0, len(sm.sessions))
+	for address, s := range sm.sessions {
+		status := &SessionStatus{Address: address, Failures: s.failures, Unsupported: s.unsupported}
+		if s.conn != nil && !s.conn.IsClosed() {
+			status.Connected = true
+			status.LatencyMs = float64(s.conn.GetLatency()) / float64(time.Millisecond)
+			if remote := s.conn.GetRemote(); remote != nil {
+				status.NodeId = remote.NodeId
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
@@ -0,0 +1,220 @@
+package tcp
+
+import (
+	"github.com/defaziom/blockchain-go/database"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestSessionConfig creates a SessionConfig with short enough times for tests
+func createTestSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		PingInterval: 20 * time.Millisecond,
+		IdleTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		MinBackoff:   10 * time.Millisecond,
+		MaxBackoff:   40 * time.Millisecond,
+	}
+}
+
+// oldPeerDialer is a NetDialer of peers speaking protocol version 4, which has no sessions
+type oldPeerDialer struct {
+	dials int32
+}
+
+func (d *oldPeerDialer) Dial(string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		server := &PeerConn{Conn: serverConn}
+		_, _ = server.ReceiveMsg()
+		_ = server.SendResp(&PeerMsg{Type: VERSION, Version: &VersionMsg{ProtocolVersion: 4, ChainId: "testnet",
+			GenesisHash: "genesis", NodeId: "older"}})
+		_, _ = server.ReceiveMsg()
+		_ = server.SendResp(&PeerMsg{Type: VERACK})
+		_, _ = server.ReceiveMsg()
+	}()
+	return clientConn, nil
+}
+
+// receiveAll passes the msgs `peer` receives to `received` until it is closed
+func receiveAll(peer Peer, received chan *PeerMsg) {
+	for {
+		msg, err := peer.ReceiveMsg()
+		if err != nil || msg == nil {
+			return
+		}
+		received <- msg
+	}
+}
+
+func TestPeerConn_StartSession(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := &PeerConn{Conn: clientConn}
+	server := &PeerConn{Conn: serverConn, sessionConfig: createTestSessionConfig()}
+	clientMsgs, serverMsgs := make(chan *PeerMsg, 1), make(chan *PeerMsg, 1)
+	go receiveAll(client, clientMsgs)
+	go receiveAll(server, serverMsgs)
+	assert.False(t, server.IsPersistent())
+
+	client.StartSession(createTestSessionConfig())
+
+	assert.Eventually(t, func() bool {
+		return client.GetLatency() > 0 && server.GetLatency() > 0
+	}, time.Second, 10*time.Millisecond, "Both sides should measure the latency of the session")
+	assert.True(t, client.IsPersistent())
+	assert.True(t, server.IsPersistent(), "Peer should keep the session open once it is pinged")
+
+	// PINGs and PONGs are not passed on
+	assert.Nil(t, client.SendQueryAllMsg())
+	assert.Equal(t, &PeerMsg{Type: QUERY_ALL}, <-serverMsgs)
+	assert.Empty(t, clientMsgs)
+
+	// The session ends with the connection
+	_ = client.ClosePeer()
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "Session should be closed once the peer closed it")
+	}
+}
+
+func TestPeerConn_StartSession_NotAccepted(t *testing.T) {
+	// A node without a session config answers the PINGs but keeps closing the connection after every exchange
+	clientConn, serverConn := net.Pipe()
+	client, server := &PeerConn{Conn: clientConn}, &PeerConn{Conn: serverConn}
+	go receiveAll(server, make(chan *PeerMsg, 1))
+	go receiveAll(client, make(chan *PeerMsg, 1))
+
+	client.StartSession(createTestSessionConfig())
+
+	assert.Eventually(t, func() bool {
+		return client.GetLatency() > 0
+	}, time.Second, 10*time.Millisecond, "Peer should answer the PINGs")
+	assert.False(t, server.IsPersistent())
+	_ = client.ClosePeer()
+}
+
+func TestPeerConn_StartSession_Timeout(t *testing.T) {
+	config := createTestSessionConfig()
+	config.PingInterval = time.Hour
+	config.IdleTimeout = 50 * time.Millisecond
+	config.WriteTimeout = 50 * time.Millisecond
+
+	// A peer that reads but never answers is closed after the idle timeout
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, serverConn)
+	}()
+	client := &PeerConn{Conn: clientConn}
+	client.StartSession(config)
+
+	msg, err := client.ReceiveMsg()
+
+	assert.Nil(t, msg)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.True(t, client.IsClosed())
+
+	// A peer that does not read is closed after the write timeout
+	clientConn, _ = net.Pipe()
+	client = &PeerConn{Conn: clientConn}
+	client.StartSession(config)
+
+	assert.Eventually(t, client.IsClosed, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionManager(t *testing.T) {
+	network := CreatePipeNetwork()
+	serverPc, clientPc := make(chan Peer), make(chan Peer)
+	server := createTestNodeInfo("testnet")
+	server.Sessions = createTestSessionConfig()
+	network.Listen("10.0.0.2:3000", serverPc, server)
+	servers := make(chan Peer, 10)
+	go func() {
+		for peer := range serverPc {
+			servers <- peer
+			go receiveAll(peer, make(chan *PeerMsg, 10))
+		}
+	}()
+	go func() {
+		for peer := range clientPc {
+			go receiveAll(peer, make(chan *PeerMsg, 10))
+		}
+	}()
+	sm := CreateSessionManager(clientPc, createTestSessionConfig(), createTestNodeInfo("testnet"))
+	sm.GetPeerConnInfo = func() ([]*database.PeerConnInfo, error) {
+		return []*database.PeerConnInfo{{Ip: "10.0.0.2", Port: 3000}}, nil
+	}
+	sm.Dialer = network
+	connected := func() bool {
+		status := sm.GetStatus()
+		return len(status) == 1 && status[0].Connected && status[0].LatencyMs > 0 && status[0].NodeId != ""
+	}
+
+	sm.Start()
+	defer sm.Stop()
+
+	assert.Eventually(t, connected, time.Second, 10*time.Millisecond,
+		"Manager should open a session with the registered peer")
+	peers, err := sm.GetPeers()
+	assert.Nil(t, err)
+	assert.Len(t, peers, 1)
+	assert.True(t, peers[0].IsPersistent(), "Msgs should be broadcast over the session")
+
+	// A session that ends is reopened
+	_ = (<-servers).ClosePeer()
+	select {
+	case <-servers:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Manager should reconnect to the peer")
+	}
+	assert.Eventually(t, connected, time.Second, 10*time.Millisecond)
+
+	// And the peer is dialed again and again while it is down
+	network.Close("10.0.0.2:3000")
+	peers, _ = sm.GetPeers()
+	_ = peers[0].ClosePeer()
+	assert.Eventually(t, func() bool {
+		status := sm.GetStatus()
+		return !status[0].Connected && status[0].Failures >= 2
+	}, time.Second, 10*time.Millisecond, "Manager should keep trying to reconnect")
+
+	// Stopping a stopped manager does nothing
+	sm.Stop()
+	assert.NotPanics(t, sm.Stop)
+}
+
+func TestSessionManager_Unsupported(t *testing.T) {
+	dialer := &oldPeerDialer{}
+	sm := CreateSessionManager(make(chan Peer), createTestSessionConfig(), createTestNodeInfo("testnet"))
+	sm.GetPeerConnInfo = func() ([]*database.PeerConnInfo, error) {
+		return []*database.PeerConnInfo{{Ip: "10.0.0.2", Port: 3000}}, nil
+	}
+	sm.Dialer = dialer
+
+	sm.Start()
+	defer sm.Stop()
+
+	assert.Eventually(t, func() bool {
+		status := sm.GetStatus()
+		return len(status) == 1 && status[0].Unsupported
+	}, time.Second, 10*time.Millisecond, "Manager should find out the peer has no sessions")
+	// Several ping intervals and backoffs
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dialer.dials), "Peer without sessions should not be dialed again")
+	assert.False(t, sm.GetStatus()[0].Connected)
+}
+
+func TestNextBackoff(t *testing.T) {
+	config := createTestSessionConfig()
+
+	assert.Equal(t, 10*time.Millisecond, nextBackoff(0, config))
+	assert.Equal(t, 20*time.Millisecond, nextBackoff(10*time.Millisecond, config))
+	assert.Equal(t, 40*time.Millisecond, nextBackoff(20*time.Millisecond, config))
+	assert.Equal(t, 40*time.Millisecond, nextBackoff(40*time.Millisecond, config), "Backoff should be bounded")
+}
@@ -1,26 +1,75 @@
 package tcp
 
 import (
-	"encoding/json"
+	"bufio"
 	"errors"
+	"fmt"
 	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
+	"github.com/defaziom/blockchain-go/transaction"
 	"io"
+	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 type PeerMsgType int
 
 const (
-	ACK                 PeerMsgType = iota // Signals end of communication with a Peer
-	QUERY_LATEST                           // Asks for the latest block held by a Peer
-	QUERY_ALL                              // Ask for the entire blockchain held by a Peer
-	RESPONSE_BLOCKCHAIN                    // Contains a single block, or an entire blockchain
+	ACK                  PeerMsgType = iota // Signals end of communication with a Peer
+	QUERY_LATEST                            // Asks for the latest block held by a Peer
+	QUERY_ALL                               // Ask for the entire blockchain held by a Peer
+	RESPONSE_BLOCKCHAIN                     // Contains a single block, or an entire blockchain
+	RESPONSE_TRANSACTION                    // Contains transactions for the mempool
+	PROPOSAL                                // Contains a block proposed to the BFT validators
+	PREVOTE                                 // Contains a BFT validator's prevote
+	PRECOMMIT                               // Contains a BFT validator's precommit
+	QUERY_BLOCK                             // Asks for the block with a hash held by a Peer
+	VERSION                                 // Describes a node at the start of a connection
+	VERACK                                  // Acknowledges the VERSION of a Peer
+	DISCONNECT                              // Tells a Peer why it is being disconnected
+	GET_BLOCKS                              // Asks for the blocks after the fork point with a block locator
+	RESPONSE_BLOCKS                         // Contains a batch of blocks answering GET_BLOCKS or GET_DATA
+	GET_HEADERS                             // Asks for the headers after the fork point with a block locator
+	RESPONSE_HEADERS                        // Contains a batch of headers answering GET_HEADERS
+	GET_DATA                                // Asks for the blocks with a list of hashes
+	PING                                    // Checks that a Peer is alive, and measures the latency of the session
+	PONG                                    // Answers a PING with its nonce
 )
 
+const (
+	// MaxBlocksPerBatch bounds the blocks sent in answer to one GET_BLOCKS or GET_DATA. A full batch answering
+	// GET_BLOCKS tells the peer to ask for more.
+	MaxBlocksPerBatch = 500
+	// MaxHeadersPerBatch bounds the headers sent in answer to one GET_HEADERS. A full batch tells the peer to ask for
+	// more.
+	MaxHeadersPerBatch = 2000
+)
+
+var ErrUnsupportedMsg = errors.New("msg type is not supported by the negotiated protocol version")
+
+// consensusMsgTypes maps each consensus.BFTMessageType to the PeerMsgType it is sent as
+var consensusMsgTypes = map[consensus.BFTMessageType]PeerMsgType{
+	consensus.PROPOSAL:  PROPOSAL,
+	consensus.PREVOTE:   PREVOTE,
+	consensus.PRECOMMIT: PRECOMMIT,
+}
+
 // PeerMsg is a message from a blockchain peer
 type PeerMsg struct {
-	Type PeerMsgType
-	Data []*block.Block
+	Type         PeerMsgType
+	Data         []*block.Block
+	Transactions []*transaction.Transaction `json:",omitempty"`
+	Consensus    *consensus.BFTMessage      `json:",omitempty"`
+	BlockHash    string                     `json:",omitempty"`
+	Version      *VersionMsg                `json:",omitempty"`
+	Reason       string                     `json:",omitempty"`
+	Locator      []string                   `json:",omitempty"` // Block locator of the branch of the sender
+	StopHash     string                     `json:",omitempty"` // Hash of the last block to sync, empty to sync all
+	Headers      []*block.BlockHeader       `json:",omitempty"`
+	Hashes       []string                   `json:",omitempty"` // Hashes of the blocks asked for
+	Nonce        uint64                     `json:",omitempty"` // Nonce of a PING, echoed by its PONG
 }
 
 // Peer represents a blockchain peer with methods to interact with
@@ -29,91 +78,159 @@ type Peer interface {
 	IsClosed() bool
 	ReceiveMsg() (*PeerMsg, error)
 	SendResponseBlockChainMsg(blocks []*block.Block) error
+	SendTransactionMsg(txs []*transaction.Transaction) error
 	SendQueryAllMsg() error
+	SendQueryBlockMsg(hash string) error
+	SendGetBlocksMsg(locator []string, stopHash string) error
+	SendBlocksMsg(blocks []*block.Block, stopHash string) error
+	SendGetHeadersMsg(locator []string, stopHash string) error
+	SendHeadersMsg(headers []*block.BlockHeader) error
+	SendGetDataMsg(hashes []string) error
 	SendAckMsg() error
+	SendConsensusMsg(msg *consensus.BFTMessage) error
+	Supports(msgType PeerMsgType) bool
+	GetRemote() *VersionMsg
+	IsPersistent() bool
 }
 
 // PeerConn is a Peer with an underlying TCP connection
 type PeerConn struct {
-	Conn   net.Conn
-	Closed bool
+	Conn    net.Conn
+	Closed  bool
+	Version int         // Protocol version negotiated in the handshake, 0 if there was none
+	Remote  *VersionMsg // VERSION the peer sent in the handshake
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	session *session      // Keepalive state while the connection is kept open as a session, nil otherwise
+	done    chan struct{} // Closed once the connection is
+	mu      sync.Mutex    // Guards Closed and done
+	writeMu sync.Mutex    // Serializes the msgs of tasks, broadcasts and pings sharing a session
+	// sessionConfig is the config of the session the connection is kept open as once the peer pings it, nil to never
+	// keep it open
+	sessionConfig *SessionConfig
 }
 
-const readBufferSizeBytes = 1024
-
-// ReadData reads data from a TCP connection until it receives a '\n' and returns it.
-func ReadData(conn net.Conn) ([]byte, error) {
-
-	buf := make([]byte, readBufferSizeBytes)
-	data := make([]byte, 0)
-
-	bytesRx, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
+// ClosePeer closes the underlying net.Conn. Closing a closed Peer does nothing.
+func (pc *PeerConn) ClosePeer() error {
+	pc.mu.Lock()
+	if pc.Closed {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.Closed = true
+	if pc.done != nil {
+		close(pc.done)
 	}
-	data = append(data, buf[:bytesRx]...)
+	pc.mu.Unlock()
+	return pc.Conn.Close()
+}
 
-	// Keep reading until we get a \n char
-	for data[len(data)-1] != '\n' {
-		bytesRx, err = conn.Read(buf)
-		if err != nil {
-			return nil, err
+// Done returns a channel that is closed once the Peer is
+func (pc *PeerConn) Done() <-chan struct{} {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.done == nil {
+		pc.done = make(chan struct{})
+		if pc.Closed {
+			close(pc.done)
 		}
-		data = append(data, buf[:bytesRx]...)
 	}
-
-	return data, nil
+	return pc.done
 }
 
-// ClosePeer closes the underlying net.Conn
-func (pc *PeerConn) ClosePeer() error {
-	err := pc.Conn.Close()
-	pc.Closed = true
-	if err != nil {
-		return err
-	}
-	return nil
+// GetRemote returns the VERSION the peer sent in the handshake, or nil if there was none
+func (pc *PeerConn) GetRemote() *VersionMsg {
+	return pc.Remote
 }
 
 // IsClosed returns if the Peer connection has been closed
 func (pc *PeerConn) IsClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
 	return pc.Closed
 }
 
-// ReceiveMsg reads data from the TCP connection and unmarshals it into a PeerMsg
+// ReceiveMsg reads the next frame from the TCP connection and decodes it into a PeerMsg. PINGs are answered and PONGs
+// recorded without being returned. A session is closed when reading from it fails, including when the peer sent
+// nothing for the idle timeout.
 func (pc *PeerConn) ReceiveMsg() (*PeerMsg, error) {
-	data, err := ReadData(pc.Conn)
+	if pc.reader == nil {
+		pc.reader = bufio.NewReader(pc.Conn)
+	}
+	for {
+		s := pc.getSession()
+		if s != nil {
+			_ = pc.Conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		}
+		msgType, payload, err := ReadFrame(pc.reader)
+		if err != nil {
+			if s != nil {
+				_ = pc.ClosePeer()
+			}
+			if errors.Is(err, io.EOF) {
+				// Connection has been closed gracefully
+				return nil, nil
+			} else {
+				return nil, err
+			}
+		}
 
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			// Connection has been closed gracefully
-			return nil, nil
-		} else {
+		msg, err := DecodePeerMsg(msgType, payload)
+		if err != nil {
 			return nil, err
 		}
-	}
+		if msg.Type == DISCONNECT {
+			log.Println("Disconnected by peer: " + msg.Reason)
+			_ = pc.ClosePeer()
+			return nil, fmt.Errorf("%w: %s", ErrPeerDisconnected, msg.Reason)
+		} else if !pc.Supports(msg.Type) {
+			return nil, pc.Disconnect(fmt.Errorf("%w: %d", ErrUnsupportedMsg, msg.Type))
+		}
 
-	msg := &PeerMsg{}
-	err = json.Unmarshal(data, msg)
-	if err != nil {
-		return nil, err
+		switch msg.Type {
+		case PING:
+			pc.acceptSession()
+			// The PONG is not written by the reader, so two peers pinging each other at once don't wait on each other
+			go func() {
+				_ = pc.SendResp(&PeerMsg{Type: PONG, Nonce: msg.Nonce})
+			}()
+		case PONG:
+			if s != nil {
+				s.pong(msg.Nonce)
+			}
+		default:
+			return msg, nil
+		}
 	}
-
-	return msg, nil
 }
 
-// SendResp sends a PeerMsg to a Peer
+// SendResp sends a PeerMsg to a Peer. Msgs the protocol version negotiated with the peer does not have are refused.
+// A session is closed when writing to it fails, including when the peer takes no msg for the write timeout.
 func (pc *PeerConn) SendResp(msg *PeerMsg) error {
-	dataToSend, err := json.Marshal(msg)
-	if err != nil {
-		return err
+	if !pc.Supports(msg.Type) {
+		return fmt.Errorf("%w: %d", ErrUnsupportedMsg, msg.Type)
 	}
-	_, err = pc.Conn.Write(append(dataToSend, byte('\n')))
+	payload, err := EncodePeerMsg(msg)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	if pc.writer == nil {
+		pc.writer = bufio.NewWriter(pc.Conn)
+	}
+	s := pc.getSession()
+	if s != nil {
+		_ = pc.Conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+	err = WriteFrame(pc.writer, msg.Type, payload)
+	if err == nil {
+		err = pc.writer.Flush()
+	}
+	if err != nil && s != nil {
+		_ = pc.ClosePeer()
+	}
+	return err
 }
 
 func (pc *PeerConn) SendResponseBlockChainMsg(blocks []*block.Block) error {
@@ -123,16 +240,77 @@ func (pc *PeerConn) SendResponseBlockChainMsg(blocks []*block.Block) error {
 	})
 }
 
+func (pc *PeerConn) SendTransactionMsg(txs []*transaction.Transaction) error {
+	return pc.SendResp(&PeerMsg{
+		Type:         RESPONSE_TRANSACTION,
+		Transactions: txs,
+	})
+}
+
 func (pc *PeerConn) SendQueryAllMsg() error {
 	return pc.SendResp(&PeerMsg{
 		Type: QUERY_ALL,
-		Data: []*block.Block{},
+	})
+}
+
+func (pc *PeerConn) SendQueryBlockMsg(hash string) error {
+	return pc.SendResp(&PeerMsg{
+		Type:      QUERY_BLOCK,
+		BlockHash: hash,
+	})
+}
+
+func (pc *PeerConn) SendGetBlocksMsg(locator []string, stopHash string) error {
+	return pc.SendResp(&PeerMsg{
+		Type:     GET_BLOCKS,
+		Locator:  locator,
+		StopHash: stopHash,
+	})
+}
+
+func (pc *PeerConn) SendBlocksMsg(blocks []*block.Block, stopHash string) error {
+	return pc.SendResp(&PeerMsg{
+		Type:     RESPONSE_BLOCKS,
+		Data:     blocks,
+		StopHash: stopHash,
+	})
+}
+
+func (pc *PeerConn) SendGetHeadersMsg(locator []string, stopHash string) error {
+	return pc.SendResp(&PeerMsg{
+		Type:     GET_HEADERS,
+		Locator:  locator,
+		StopHash: stopHash,
+	})
+}
+
+func (pc *PeerConn) SendHeadersMsg(headers []*block.BlockHeader) error {
+	return pc.SendResp(&PeerMsg{
+		Type:    RESPONSE_HEADERS,
+		Headers: headers,
+	})
+}
+
+func (pc *PeerConn) SendGetDataMsg(hashes []string) error {
+	return pc.SendResp(&PeerMsg{
+		Type:   GET_DATA,
+		Hashes: hashes,
 	})
 }
 
 func (pc *PeerConn) SendAckMsg() error {
 	return pc.SendResp(&PeerMsg{
 		Type: ACK,
-		Data: []*block.Block{},
+	})
+}
+
+func (pc *PeerConn) SendConsensusMsg(msg *consensus.BFTMessage) error {
+	msgType, ok := consensusMsgTypes[msg.Type]
+	if !ok {
+		return errors.New("unknown consensus msg type")
+	}
+	return pc.SendResp(&PeerMsg{
+		Type:      msgType,
+		Consensus: msg,
 	})
 }
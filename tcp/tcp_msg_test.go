@@ -1,13 +1,11 @@
 package tcp
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
-	"github.com/defaziom/blockchain-go/block"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"net"
-	"strings"
 	"testing"
 )
 
@@ -22,28 +20,17 @@ func (m *MockConn) Read(b []byte) (n int, err error) {
 	return m.DataToBeRead.Read(b)
 }
 
-func TestReadData(t *testing.T) {
-	expectedData := "test\n"
-
-	mockConn := &MockConn{DataToBeRead: bytes.NewBufferString(expectedData)}
-	mockConn.On("Read").Return()
-
-	actualData, _ := ReadData(mockConn)
-	assert.Equal(t, expectedData, string(actualData))
-
-	expectedLongData := strings.Repeat("A", 2048) + "\n"
-	mockConn.DataToBeRead = bytes.NewBufferString(expectedLongData)
-	actualLongData, _ := ReadData(mockConn)
-	assert.Equal(t, expectedLongData, string(actualLongData))
-}
-
 func TestPeerConn_ReceiveMsg(t *testing.T) {
 	testMsg := &PeerMsg{
 		Type: QUERY_LATEST,
-		Data: []*block.Block{},
 	}
-	testData, _ := json.Marshal(testMsg)
-	mockConn := &MockConn{DataToBeRead: bytes.NewBuffer(append(testData, byte('\n')))}
+	payload, _ := EncodePeerMsg(testMsg)
+	data := &bytes.Buffer{}
+	w := bufio.NewWriter(data)
+	_ = WriteFrame(w, testMsg.Type, payload)
+	_ = WriteFrame(w, QUERY_BLOCK, payload)
+	_ = w.Flush()
+	mockConn := &MockConn{DataToBeRead: data}
 	mockConn.On("Read").Return()
 
 	testPeerConn := PeerConn{
@@ -57,4 +44,39 @@ func TestPeerConn_ReceiveMsg(t *testing.T) {
 	}
 
 	assert.Equal(t, *testMsg, *actualMsg)
+	actualMsg, err = testPeerConn.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, QUERY_BLOCK, actualMsg.Type, "Msgs arriving in one read should be received one at a time")
+	actualMsg, err = testPeerConn.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Nil(t, actualMsg, "End of the stream should mean the connection was closed")
+}
+
+func TestPeerConn_ReceiveMsg_Malformed(t *testing.T) {
+	data := bytes.NewBuffer(append([]byte("not a frame\n"), make([]byte, FrameHeaderSize)...))
+	mockConn := &MockConn{DataToBeRead: data}
+	mockConn.On("Read").Return()
+	testPeerConn := PeerConn{Conn: mockConn}
+
+	_, err := testPeerConn.ReceiveMsg()
+
+	assert.ErrorIs(t, err, ErrInvalidMagic)
+}
+
+func TestPeerConn_SendResp(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, server := &PeerConn{Conn: clientConn}, &PeerConn{Conn: serverConn}
+	blocks := createTestBlocks(3)
+
+	go func() {
+		_ = client.SendResponseBlockChainMsg(blocks)
+		_ = client.SendTransactionMsg(blocks[1].Transactions)
+	}()
+
+	msg, err := server.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, &PeerMsg{Type: RESPONSE_BLOCKCHAIN, Data: blocks}, msg)
+	msg, err = server.ReceiveMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, &PeerMsg{Type: RESPONSE_TRANSACTION, Transactions: blocks[1].Transactions}, msg)
 }
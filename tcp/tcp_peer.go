@@ -3,7 +3,9 @@ package tcp
 import (
 	"fmt"
 	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
 	"github.com/defaziom/blockchain-go/database"
+	"github.com/defaziom/blockchain-go/transaction"
 	"log"
 	"net"
 )
@@ -24,8 +26,9 @@ func CreateTcpDialer() *TcpDialer {
 }
 
 // GetPeers takes a list of database.PeerConnInfo and establishes a connection with the peer using the provided
-// NetDialer returning a list of Peer to interact with
-func GetPeers(peerConnInfoList []*database.PeerConnInfo, dialer NetDialer) ([]Peer, error) {
+// NetDialer returning a list of Peer to interact with. When `local` is set the handshake is made as that node with
+// every peer, and peers it fails with are left out.
+func GetPeers(peerConnInfoList []*database.PeerConnInfo, dialer NetDialer, local *NodeInfo) ([]Peer, error) {
 	var peers []Peer
 	for _, info := range peerConnInfoList {
 		conn, err := dialer.Dial(fmt.Sprintf("%s:%d", info.Ip, info.Port))
@@ -36,11 +39,26 @@ func GetPeers(peerConnInfoList []*database.PeerConnInfo, dialer NetDialer) ([]Pe
 		peerConn := &PeerConn{
 			Conn: conn,
 		}
+		if local != nil {
+			err = peerConn.Handshake(local)
+			if err != nil {
+				log.Printf("Handshake with peer failed: %s\n", err)
+				continue
+			}
+		}
 		peers = append(peers, peerConn)
 	}
 	return peers, nil
 }
 
+// continueInteraction places a Peer a msg was sent to in the Peer channel, so its answers are processed. A session is
+// not placed in it again, since the job started when it was opened answers all of its msgs.
+func continueInteraction(peer Peer, pc chan Peer) {
+	if !peer.IsPersistent() {
+		pc <- peer
+	}
+}
+
 // BroadCastBlockToPeers sends a block.Block all peers in the list of Peer. After sending the block,
 // the Peer is placed in a Peer channel to continue the interaction.
 func BroadCastBlockToPeers(b *block.Block, peers []Peer, pc chan Peer) {
@@ -50,8 +68,101 @@ func BroadCastBlockToPeers(b *block.Block, peers []Peer, pc chan Peer) {
 		if err != nil {
 			log.Printf("Failed to send block to peer: %s\n", err)
 		} else {
-			// Place the peer in the channel to continue processing
-			pc <- peer
+			continueInteraction(peer, pc)
+		}
+	}
+}
+
+// BroadCastTransactionToPeers sends a transaction to all peers in the list of Peer. After sending the transaction,
+// the Peer is placed in a Peer channel to continue the interaction.
+func BroadCastTransactionToPeers(tx *transaction.Transaction, peers []Peer, pc chan Peer) {
+	log.Println("Sending transaction to peers")
+	for _, peer := range peers {
+		err := peer.SendTransactionMsg([]*transaction.Transaction{tx})
+		if err != nil {
+			log.Printf("Failed to send transaction to peer: %s\n", err)
+		} else {
+			continueInteraction(peer, pc)
+		}
+	}
+}
+
+// BroadCastConsensusMsgToPeers sends a consensus message to all peers in the list of Peer. After sending the message,
+// the Peer is placed in a Peer channel to continue the interaction.
+func BroadCastConsensusMsgToPeers(msg *consensus.BFTMessage, peers []Peer, pc chan Peer) {
+	for _, peer := range peers {
+		err := peer.SendConsensusMsg(msg)
+		if err != nil {
+			log.Printf("Failed to send consensus msg to peer: %s\n", err)
+		} else {
+			continueInteraction(peer, pc)
 		}
 	}
 }
+
+// ConsensusTransport is a consensus.BFTTransport that sends every message over the sessions of Sessions, or while it is
+// nil to the peers returned by GetPeerConnInfo dialed with Dialer as the node Local
+type ConsensusTransport struct {
+	GetPeerConnInfo func() ([]*database.PeerConnInfo, error)
+	Dialer          NetDialer
+	Local           *NodeInfo
+	Sessions        *SessionManager
+	Pc              chan Peer
+}
+
+// CreateConsensusTransport creates a ConsensusTransport that sends messages to every peer registered in the database
+func CreateConsensusTransport(pc chan Peer) *ConsensusTransport {
+	return &ConsensusTransport{
+		GetPeerConnInfo: database.GetAllPeerConnInfo,
+		Dialer:          CreateTcpDialer(),
+		Pc:              pc,
+	}
+}
+
+func (t *ConsensusTransport) Broadcast(msg *consensus.BFTMessage) {
+	var peers []Peer
+	var err error
+	if t.Sessions != nil {
+		peers, err = t.Sessions.GetPeers()
+	} else {
+		var peerConnList []*database.PeerConnInfo
+		if peerConnList, err = t.GetPeerConnInfo(); err == nil {
+			peers, err = GetPeers(peerConnList, t.Dialer, t.Local)
+		}
+	}
+	if err != nil {
+		log.Println("Failed to connect to peers: " + err.Error())
+		return
+	}
+	BroadCastConsensusMsgToPeers(msg, peers, t.Pc)
+}
+
+// BroadCastBlockToRegisteredPeers sends the block to every peer registered in the database over the sessions of `sm`
+func BroadCastBlockToRegisteredPeers(b *block.Block, sm *SessionManager, pc chan Peer) {
+	peers, err := sm.GetPeers()
+	if err != nil {
+		log.Println("Failed to get peers: " + err.Error())
+		return
+	}
+	BroadCastBlockToPeers(b, peers, pc)
+}
+
+// BroadCastTransactionToRegisteredPeers sends the transaction to every peer registered in the database over the
+// sessions of `sm`
+func BroadCastTransactionToRegisteredPeers(tx *transaction.Transaction, sm *SessionManager, pc chan Peer) {
+	peers, err := sm.GetPeers()
+	if err != nil {
+		log.Println("Failed to get peers: " + err.Error())
+		return
+	}
+	BroadCastTransactionToPeers(tx, peers, pc)
+}
+
+// GetRegisteredPeers connects to every peer registered in the database as the node `local`
+func GetRegisteredPeers(local *NodeInfo) ([]Peer, error) {
+	peerConnList, err := database.GetAllPeerConnInfo()
+	if err != nil {
+		return nil, err
+	}
+	return GetPeers(peerConnList, CreateTcpDialer(), local)
+}
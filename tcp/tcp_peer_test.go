@@ -2,7 +2,9 @@ package tcp
 
 import (
 	"github.com/defaziom/blockchain-go/block"
+	"github.com/defaziom/blockchain-go/consensus"
 	"github.com/defaziom/blockchain-go/database"
+	"github.com/defaziom/blockchain-go/transaction"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"net"
@@ -23,6 +25,16 @@ func (m *MockTcpDialer) Dial(address string) (net.Conn, error) {
 type MockPeer struct {
 	mock.Mock
 	Peer
+	Persistent bool
+}
+
+// Supports returns true, since the mock speaks the latest protocol version
+func (m *MockPeer) Supports(msgType PeerMsgType) bool {
+	return true
+}
+
+func (m *MockPeer) IsPersistent() bool {
+	return m.Persistent
 }
 
 func (m *MockPeer) SendResponseBlockChainMsg(blocks []*block.Block) error {
@@ -30,6 +42,16 @@ func (m *MockPeer) SendResponseBlockChainMsg(blocks []*block.Block) error {
 	return a.Error(0)
 }
 
+func (m *MockPeer) SendTransactionMsg(txs []*transaction.Transaction) error {
+	a := m.Called(txs)
+	return a.Error(0)
+}
+
+func (m *MockPeer) SendConsensusMsg(msg *consensus.BFTMessage) error {
+	a := m.Called(msg)
+	return a.Error(0)
+}
+
 func TestGetPeers(t *testing.T) {
 	testConnList := []*database.PeerConnInfo{{
 		Ip:   "1.1.1.1",
@@ -44,7 +66,7 @@ func TestGetPeers(t *testing.T) {
 	mTcpDialer := &MockTcpDialer{}
 	mTcpDialer.On("Dial").Return(mConn, nil)
 
-	peers, _ := GetPeers(testConnList, mTcpDialer)
+	peers, _ := GetPeers(testConnList, mTcpDialer, nil)
 	assert.Len(t, peers, len(testConnList))
 	mTcpDialer.AssertExpectations(t)
 	for _, p := range peers {
@@ -55,13 +77,15 @@ func TestGetPeers(t *testing.T) {
 
 func TestBroadCastBlockToPeers(t *testing.T) {
 	testBlock := &block.Block{
-		Timestamp:     time.Time{},
-		Data:          "test",
-		PrevBlockHash: "",
-		BlockHash:     "",
-		Index:         0,
-		Nonce:         0,
-		Difficulty:    0,
+		BlockHeader: block.BlockHeader{
+			Timestamp:     time.Time{},
+			PrevBlockHash: "",
+			Nonce:         0,
+			Difficulty:    0,
+		},
+		Transactions: []*transaction.Transaction{{Id: "test"}},
+		BlockHash:    "",
+		Index:        0,
 	}
 	mockPeer := &MockPeer{}
 	mockPeer.On("SendResponseBlockChainMsg").Return(nil)
@@ -74,3 +98,66 @@ func TestBroadCastBlockToPeers(t *testing.T) {
 	actualPeer := <-c
 	assert.Equal(t, mockPeer, actualPeer)
 }
+
+func TestBroadCastBlockToPeers_Session(t *testing.T) {
+	mockPeer := &MockPeer{Persistent: true}
+	mockPeer.On("SendResponseBlockChainMsg").Return(nil)
+	c := make(chan Peer, 1)
+
+	BroadCastBlockToPeers(&block.Block{}, []Peer{mockPeer}, c)
+
+	mockPeer.AssertExpectations(t)
+	assert.Empty(t, c, "A session should not be placed in the Peer channel again")
+}
+
+func TestBroadCastTransactionToPeers(t *testing.T) {
+	testTx := &transaction.Transaction{Id: "test"}
+	mockPeer := &MockPeer{}
+	mockPeer.On("SendTransactionMsg", []*transaction.Transaction{testTx}).Return(nil)
+	peers := []Peer{mockPeer}
+	c := make(chan Peer, 1)
+
+	BroadCastTransactionToPeers(testTx, peers, c)
+
+	mockPeer.AssertExpectations(t)
+	actualPeer := <-c
+	assert.Equal(t, mockPeer, actualPeer)
+}
+
+func TestBroadCastConsensusMsgToPeers(t *testing.T) {
+	testMsg := &consensus.BFTMessage{Type: consensus.PREVOTE, Height: 1}
+	mockPeer := &MockPeer{}
+	mockPeer.On("SendConsensusMsg", testMsg).Return(nil)
+	peers := []Peer{mockPeer}
+	c := make(chan Peer, 1)
+
+	BroadCastConsensusMsgToPeers(testMsg, peers, c)
+
+	mockPeer.AssertExpectations(t)
+	actualPeer := <-c
+	assert.Equal(t, mockPeer, actualPeer)
+}
+
+func TestConsensusTransport_Broadcast(t *testing.T) {
+	network := CreatePipeNetwork()
+	listener := make(chan Peer)
+	network.Listen("1.1.1.1:42", listener, nil)
+	pc := make(chan Peer, 2)
+	transport := &ConsensusTransport{
+		GetPeerConnInfo: func() ([]*database.PeerConnInfo, error) {
+			return []*database.PeerConnInfo{{Ip: "1.1.1.1", Port: 42}, {Ip: "2.2.2.2", Port: 99}}, nil
+		},
+		Dialer: network,
+		Pc:     pc,
+	}
+	testMsg := &consensus.BFTMessage{Type: consensus.PRECOMMIT, Height: 3, Round: 1, BlockHash: "abc"}
+
+	go transport.Broadcast(testMsg)
+	msg, err := (<-listener).ReceiveMsg()
+
+	assert.Nil(t, err)
+	assert.Equal(t, PRECOMMIT, msg.Type)
+	assert.Equal(t, testMsg, msg.Consensus)
+	assert.IsType(t, &PeerConn{}, <-pc, "Peer should be handed over to wait for the ACK")
+	assert.Len(t, pc, 0, "Peers that can't be reached should be skipped")
+}
@@ -6,7 +6,9 @@ import (
 	"net"
 )
 
-func StartServer(port int, pc chan Peer) {
+// StartServer accepts the connections peers open on `port` as the node `local`, and places their Peer in the Peer
+// channel
+func StartServer(port int, pc chan Peer, local *NodeInfo) {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Println("Error listening:", err.Error())
@@ -19,9 +21,23 @@ func StartServer(port int, pc chan Peer) {
 		if err != nil {
 			fmt.Println("Error accepting: ", err.Error())
 		}
-		peerConn := &PeerConn{
-			Conn: conn,
+		go acceptPeer(conn, pc, local)
+	}
+}
+
+// acceptPeer makes the handshake as `local` with the peer that opened `conn` when it is set, and places the Peer in the
+// Peer channel once it is done. Peers the handshake fails with are dropped.
+func acceptPeer(conn net.Conn, pc chan Peer, local *NodeInfo) {
+	peerConn := &PeerConn{
+		Conn: conn,
+	}
+	if local != nil {
+		err := peerConn.AcceptHandshake(local)
+		if err != nil {
+			log.Printf("Handshake with peer failed: %s\n", err)
+			return
 		}
-		pc <- peerConn
+		peerConn.sessionConfig = local.Sessions
 	}
+	pc <- peerConn
 }
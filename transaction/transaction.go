@@ -0,0 +1,208 @@
+package transaction
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidTransactionId = errors.New("invalid transaction id")
+	ErrNoTxIns              = errors.New("transaction has no inputs")
+	ErrNoTxOuts             = errors.New("transaction has no outputs")
+	ErrInvalidAmount        = errors.New("transaction output amount must be positive")
+	ErrMissingTxOut         = errors.New("referenced output does not exist or is already spent")
+	ErrDoubleSpend          = errors.New("output is spent more than once")
+	ErrInsufficientFunds    = errors.New("transaction outputs exceed inputs")
+	ErrDuplicateTransaction = errors.New("duplicate transaction")
+	ErrInvalidSignature     = errors.New("invalid input signature")
+	ErrMissingCoinbase      = errors.New("block does not start with a coinbase transaction")
+	ErrInvalidCoinbase      = errors.New("invalid coinbase transaction")
+)
+
+// TxIn spends an output of a previous transaction. The signature is made over the transaction id with the key of
+// the address the output is locked to.
+type TxIn struct {
+	TxOutId    string
+	TxOutIndex int
+	Signature  string
+}
+
+// TxOut locks an amount of coins to an address. The address is the hex encoded Ed25519 public key of the owner.
+type TxOut struct {
+	Address string
+	Amount  int
+}
+
+// Transaction transfers coins by consuming previous outputs and creating new ones
+type Transaction struct {
+	Id     string
+	TxIns  []*TxIn
+	TxOuts []*TxOut
+}
+
+// CreateTransaction creates a Transaction from the inputs and outputs and calculates its id
+func CreateTransaction(txIns []*TxIn, txOuts []*TxOut) *Transaction {
+	tx := &Transaction{
+		TxIns:  txIns,
+		TxOuts: txOuts,
+	}
+	tx.Id = tx.CalculateTransactionId()
+	return tx
+}
+
+// CreateCoinbaseTransaction creates the transaction that pays the block reward of the block at `height` to `address`.
+// Its single input spends nothing and carries the block height, which keeps coinbase ids unique across blocks.
+func CreateCoinbaseTransaction(address string, amount int, height int) *Transaction {
+	return CreateTransaction(
+		[]*TxIn{{TxOutId: "", TxOutIndex: height}},
+		[]*TxOut{{Address: address, Amount: amount}},
+	)
+}
+
+// IsCoinbase checks if the transaction has the shape of a coinbase transaction
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.TxIns) == 1 && tx.TxIns[0].TxOutId == ""
+}
+
+// CalculateTransactionId hashes the inputs and outputs of the transaction. Signatures are not part of the id since
+// they sign it.
+func (tx *Transaction) CalculateTransactionId() string {
+	h := sha256.New()
+	for _, txIn := range tx.TxIns {
+		_, _ = fmt.Fprintf(h, "in:%q:%d;", txIn.TxOutId, txIn.TxOutIndex)
+	}
+	for _, txOut := range tx.TxOuts {
+		_, _ = fmt.Fprintf(h, "out:%q:%d;", txOut.Address, txOut.Amount)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// CalculateWitnessHash hashes the whole transaction, signatures included. Unlike the id it changes when a signature
+// does, so it is what blocks commit to.
+func (tx *Transaction) CalculateWitnessHash() string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "id:%q;", tx.Id)
+	for _, txIn := range tx.TxIns {
+		_, _ = fmt.Fprintf(h, "in:%q:%d:%q;", txIn.TxOutId, txIn.TxOutIndex, txIn.Signature)
+	}
+	for _, txOut := range tx.TxOuts {
+		_, _ = fmt.Fprintf(h, "out:%q:%d;", txOut.Address, txOut.Amount)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// OutPoint returns the OutPoint of the output at `index` created by the transaction
+func (tx *Transaction) OutPoint(index int) OutPoint {
+	return OutPoint{TxOutId: tx.Id, TxOutIndex: index}
+}
+
+// OutPoint returns the OutPoint of the output spent by the input
+func (txIn *TxIn) OutPoint() OutPoint {
+	return OutPoint{TxOutId: txIn.TxOutId, TxOutIndex: txIn.TxOutIndex}
+}
+
+// IsTransactionStructureValid checks the transaction on its own, without looking at the outputs it spends
+func IsTransactionStructureValid(tx *Transaction) error {
+	if tx.Id != tx.CalculateTransactionId() {
+		return ErrInvalidTransactionId
+	}
+	if len(tx.TxIns) == 0 {
+		return ErrNoTxIns
+	}
+	if len(tx.TxOuts) == 0 {
+		return ErrNoTxOuts
+	}
+	for _, txOut := range tx.TxOuts {
+		if txOut.Amount <= 0 {
+			return ErrInvalidAmount
+		}
+	}
+	spent := make(map[OutPoint]bool, len(tx.TxIns))
+	for _, txIn := range tx.TxIns {
+		if spent[txIn.OutPoint()] {
+			return ErrDoubleSpend
+		}
+		spent[txIn.OutPoint()] = true
+	}
+	return nil
+}
+
+// IsCoinbaseTransactionValid checks that `tx` is a well-formed coinbase transaction for the block at `height`. The
+// amount it pays is a chain rule and is checked by the caller.
+func IsCoinbaseTransactionValid(tx *Transaction, height int) error {
+	if tx.Id != tx.CalculateTransactionId() {
+		return ErrInvalidTransactionId
+	}
+	if !tx.IsCoinbase() {
+		return ErrMissingCoinbase
+	}
+	if tx.TxIns[0].TxOutIndex != height {
+		return fmt.Errorf("%w: height %d does not match block %d", ErrInvalidCoinbase, tx.TxIns[0].TxOutIndex, height)
+	}
+	if len(tx.TxOuts) != 1 {
+		return fmt.Errorf("%w: must have exactly one output", ErrInvalidCoinbase)
+	}
+	if tx.TxOuts[0].Amount <= 0 {
+		return ErrInvalidAmount
+	}
+	return nil
+}
+
+// IsTxInSignatureValid checks that the input is signed by the owner of the output it spends
+func IsTxInSignatureValid(tx *Transaction, txIn *TxIn, uTxOut *UnspentTxOut) bool {
+	publicKey, err := hex.DecodeString(uTxOut.Address)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := hex.DecodeString(txIn.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, []byte(tx.Id), signature)
+}
+
+// ValidateTransaction checks that the transaction is well-formed and only spends outputs in the unspent set that it
+// holds the keys for
+func ValidateTransaction(tx *Transaction, unspent UnspentTxOutLookup) error {
+	_, err := validateTransaction(tx, unspent)
+	return err
+}
+
+// validateTransaction validates the transaction like ValidateTransaction and returns the fee it pays, which is
+// whatever its inputs hold beyond its outputs
+func validateTransaction(tx *Transaction, unspent UnspentTxOutLookup) (int, error) {
+	err := IsTransactionStructureValid(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	inputSum := 0
+	for _, txIn := range tx.TxIns {
+		uTxOut, ok := unspent.Get(txIn.OutPoint())
+		if !ok {
+			return 0, fmt.Errorf("%w: %s:%d", ErrMissingTxOut, txIn.TxOutId, txIn.TxOutIndex)
+		}
+		if !IsTxInSignatureValid(tx, txIn, uTxOut) {
+			return 0, fmt.Errorf("%w: %s:%d", ErrInvalidSignature, txIn.TxOutId, txIn.TxOutIndex)
+		}
+		inputSum += uTxOut.Amount
+		if inputSum < 0 {
+			return 0, ErrInvalidAmount
+		}
+	}
+
+	outputSum := 0
+	for _, txOut := range tx.TxOuts {
+		outputSum += txOut.Amount
+		if outputSum < 0 {
+			return 0, ErrInvalidAmount
+		}
+	}
+	if outputSum > inputSum {
+		return 0, ErrInsufficientFunds
+	}
+	return inputSum - outputSum, nil
+}
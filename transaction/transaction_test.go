@@ -0,0 +1,149 @@
+package transaction
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var alice = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+var bob = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+
+func testAddress(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// signTestTransaction signs input i of the transaction with keys[i]
+func signTestTransaction(tx *Transaction, keys ...ed25519.PrivateKey) *Transaction {
+	for i, txIn := range tx.TxIns {
+		txIn.Signature = hex.EncodeToString(ed25519.Sign(keys[i], []byte(tx.Id)))
+	}
+	return tx
+}
+
+func createTestUnspentTxOutSet() UnspentTxOutSet {
+	return UnspentTxOutSet{
+		OutPoint{TxOutId: "a", TxOutIndex: 0}: {TxOutId: "a", TxOutIndex: 0, Address: testAddress(alice), Amount: 10},
+		OutPoint{TxOutId: "a", TxOutIndex: 1}: {TxOutId: "a", TxOutIndex: 1, Address: testAddress(bob), Amount: 5},
+	}
+}
+
+func TestTransaction_CalculateTransactionId(t *testing.T) {
+	tx := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "bob", Amount: 10}})
+	assert.Len(t, tx.Id, 64, "Id must be valid SHA256")
+	assert.Equal(t, tx.Id, tx.CalculateTransactionId())
+
+	signTestTransaction(tx, alice)
+	assert.Equal(t, tx.Id, tx.CalculateTransactionId(), "Id must not depend on signatures")
+
+	tx.TxOuts[0].Amount = 11
+	assert.NotEqual(t, tx.Id, tx.CalculateTransactionId(), "Id must change when an output changes")
+	tx.TxOuts[0].Amount = 10
+
+	tx.TxIns[0].TxOutIndex = 1
+	assert.NotEqual(t, tx.Id, tx.CalculateTransactionId(), "Id must change when an input changes")
+}
+
+func TestTransaction_CalculateWitnessHash(t *testing.T) {
+	tx := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "bob", Amount: 10}})
+	hash := tx.CalculateWitnessHash()
+	assert.Len(t, hash, 64, "Witness hash must be valid SHA256")
+	assert.NotEqual(t, tx.Id, hash)
+
+	signTestTransaction(tx, alice)
+	signed := tx.CalculateWitnessHash()
+	assert.NotEqual(t, hash, signed, "Witness hash must cover signatures")
+
+	tx.TxIns[0].Signature = "00"
+	assert.NotEqual(t, signed, tx.CalculateWitnessHash(), "Witness hash must change when a signature changes")
+}
+
+func TestIsTransactionStructureValid(t *testing.T) {
+	valid := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "bob", Amount: 10}})
+	assert.Nil(t, IsTransactionStructureValid(valid))
+
+	badId := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "bob", Amount: 10}})
+	badId.Id = "abc"
+	assert.ErrorIs(t, IsTransactionStructureValid(badId), ErrInvalidTransactionId)
+
+	noIns := CreateTransaction([]*TxIn{}, []*TxOut{{Address: "bob", Amount: 10}})
+	assert.ErrorIs(t, IsTransactionStructureValid(noIns), ErrNoTxIns)
+
+	noOuts := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{})
+	assert.ErrorIs(t, IsTransactionStructureValid(noOuts), ErrNoTxOuts)
+
+	zeroAmount := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "bob", Amount: 0}})
+	assert.ErrorIs(t, IsTransactionStructureValid(zeroAmount), ErrInvalidAmount)
+
+	sameInput := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}, {TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "bob", Amount: 10}})
+	assert.ErrorIs(t, IsTransactionStructureValid(sameInput), ErrDoubleSpend)
+}
+
+func TestIsTxInSignatureValid(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	uTxOut := unspent[OutPoint{TxOutId: "a", TxOutIndex: 0}]
+
+	tx := CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}}, []*TxOut{{Address: "carol", Amount: 10}})
+	assert.False(t, IsTxInSignatureValid(tx, tx.TxIns[0], uTxOut), "Unsigned input should be invalid")
+
+	signTestTransaction(tx, bob)
+	assert.False(t, IsTxInSignatureValid(tx, tx.TxIns[0], uTxOut), "Input signed by another key should be invalid")
+
+	signTestTransaction(tx, alice)
+	assert.True(t, IsTxInSignatureValid(tx, tx.TxIns[0], uTxOut))
+
+	tx.Id = CreateTransaction(tx.TxIns, []*TxOut{{Address: "mallory", Amount: 10}}).Id
+	assert.False(t, IsTxInSignatureValid(tx, tx.TxIns[0], uTxOut), "Signature should not cover another transaction")
+}
+
+func TestValidateTransaction(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+
+	tx := signTestTransaction(CreateTransaction(
+		[]*TxIn{{TxOutId: "a", TxOutIndex: 0}, {TxOutId: "a", TxOutIndex: 1}},
+		[]*TxOut{{Address: "carol", Amount: 15}}), alice, bob)
+	assert.Nil(t, ValidateTransaction(tx, unspent))
+
+	withFee := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 9}}), alice)
+	assert.Nil(t, ValidateTransaction(withFee, unspent), "Outputs may be less than inputs")
+
+	overspend := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 11}}), alice)
+	assert.ErrorIs(t, ValidateTransaction(overspend, unspent), ErrInsufficientFunds)
+
+	missing := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "b", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 1}}), alice)
+	assert.ErrorIs(t, ValidateTransaction(missing, unspent), ErrMissingTxOut)
+
+	stolen := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 1}},
+		[]*TxOut{{Address: "carol", Amount: 5}}), alice)
+	assert.ErrorIs(t, ValidateTransaction(stolen, unspent), ErrInvalidSignature)
+}
+
+func TestIsCoinbaseTransactionValid(t *testing.T) {
+	coinbase := CreateCoinbaseTransaction("miner", 50, 7)
+	assert.True(t, coinbase.IsCoinbase())
+	assert.Nil(t, IsCoinbaseTransactionValid(coinbase, 7))
+
+	assert.ErrorIs(t, IsCoinbaseTransactionValid(coinbase, 8), ErrInvalidCoinbase, "Height must match the block")
+	assert.NotEqual(t, coinbase.Id, CreateCoinbaseTransaction("miner", 50, 8).Id,
+		"Coinbase ids should differ between blocks")
+
+	regular := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 10}}), alice)
+	assert.False(t, regular.IsCoinbase())
+	assert.ErrorIs(t, IsCoinbaseTransactionValid(regular, 0), ErrMissingCoinbase)
+
+	twoOutputs := CreateTransaction([]*TxIn{{TxOutId: "", TxOutIndex: 7}},
+		[]*TxOut{{Address: "miner", Amount: 25}, {Address: "miner", Amount: 25}})
+	assert.ErrorIs(t, IsCoinbaseTransactionValid(twoOutputs, 7), ErrInvalidCoinbase)
+
+	assert.ErrorIs(t, IsCoinbaseTransactionValid(CreateCoinbaseTransaction("miner", 0, 7), 7), ErrInvalidAmount)
+
+	coinbase.TxOuts[0].Amount = 5000
+	assert.ErrorIs(t, IsCoinbaseTransactionValid(coinbase, 7), ErrInvalidTransactionId)
+}
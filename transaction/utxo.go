@@ -0,0 +1,245 @@
+package transaction
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OutPoint identifies a single output of a transaction
+type OutPoint struct {
+	TxOutId    string
+	TxOutIndex int
+}
+
+// UnspentTxOut is a transaction output that has not been spent by any input yet
+type UnspentTxOut struct {
+	TxOutId    string
+	TxOutIndex int
+	Address    string
+	Amount     int
+}
+
+// UnspentTxOutSet holds every unspent output on the chain, keyed by the OutPoint it can be spent with
+type UnspentTxOutSet map[OutPoint]*UnspentTxOut
+
+// Copy returns a shallow copy of the set. The UnspentTxOut values are shared since they are never modified.
+func (set UnspentTxOutSet) Copy() UnspentTxOutSet {
+	c := make(UnspentTxOutSet, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// UnspentTxOutLookup finds the unspent output that can be spent with an OutPoint
+type UnspentTxOutLookup interface {
+	Get(outPoint OutPoint) (*UnspentTxOut, bool)
+}
+
+// unspentTxOuts is a set of unspent outputs that transactions are applied to in place, either an UnspentTxOutSet or
+// the top layer of an UnspentTxOutView
+type unspentTxOuts interface {
+	UnspentTxOutLookup
+	add(uTxOut *UnspentTxOut)
+	remove(outPoint OutPoint)
+}
+
+// Get returns the output spent with `outPoint`, if it is in the set
+func (set UnspentTxOutSet) Get(outPoint OutPoint) (*UnspentTxOut, bool) {
+	uTxOut, ok := set[outPoint]
+	return uTxOut, ok
+}
+
+func (set UnspentTxOutSet) add(uTxOut *UnspentTxOut) {
+	set[OutPoint{TxOutId: uTxOut.TxOutId, TxOutIndex: uTxOut.TxOutIndex}] = uTxOut
+}
+
+func (set UnspentTxOutSet) remove(outPoint OutPoint) {
+	delete(set, outPoint)
+}
+
+// ApplyTransactions validates the transactions in order against the set and returns the resulting set. Outputs
+// created by a transaction can be spent by the transactions after it. The receiver is never modified.
+func (set UnspentTxOutSet) ApplyTransactions(txs []*Transaction) (UnspentTxOutSet, error) {
+	updated := set.Copy()
+	_, err := applyTransactions(updated, txs)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// ApplyGenesisTransactions returns a copy of the set with the outputs of the genesis block's transactions added. They
+// create the initial allocations of the chain, so they are not validated.
+func (set UnspentTxOutSet) ApplyGenesisTransactions(txs []*Transaction) UnspentTxOutSet {
+	updated := set.Copy()
+	for _, tx := range txs {
+		addOutputs(updated, tx)
+	}
+	return updated
+}
+
+// CalculateFees validates the transactions like ApplyTransactions and returns the sum of the fees they pay
+func (set UnspentTxOutSet) CalculateFees(txs []*Transaction) (int, error) {
+	return applyTransactions(set.Copy(), txs)
+}
+
+// ApplyBlockTransactions validates the transactions of the block at `height` and returns the resulting set and the
+// fees paid by the block. The first transaction must be the coinbase, whose output is added to the set without
+// checking its amount since the reward is a chain rule.
+func (set UnspentTxOutSet) ApplyBlockTransactions(txs []*Transaction, height int) (UnspentTxOutSet, int, error) {
+	updated := set.Copy()
+	fees, err := applyBlockTransactions(updated, txs, height)
+	if err != nil {
+		return nil, 0, err
+	}
+	return updated, fees, nil
+}
+
+// GetSpentOutputs returns the outputs in the set that the transactions spend, in the order they are spent. Outputs
+// created and spent by the transactions themselves are not in the set and are left out.
+func (set UnspentTxOutSet) GetSpentOutputs(txs []*Transaction) []*UnspentTxOut {
+	return getSpentOutputs(set, txs)
+}
+
+// RevertTransactions undoes applying the transactions to a set by removing the outputs they created and restoring the
+// `spent` outputs returned by GetSpentOutputs before they were applied. The receiver is never modified.
+func (set UnspentTxOutSet) RevertTransactions(txs []*Transaction, spent []*UnspentTxOut) UnspentTxOutSet {
+	reverted := set.Copy()
+	revertTransactions(reverted, txs, spent)
+	return reverted
+}
+
+// ApplyTransaction validates `tx` against the set and applies it to the set in place, and returns the fee it pays.
+// The set is left unchanged when the transaction is invalid, so a working copy of the set can be built up one
+// transaction at a time without copying it for each of them.
+func (set UnspentTxOutSet) ApplyTransaction(tx *Transaction) (int, error) {
+	return applyTransaction(set, tx)
+}
+
+// applyTransaction is ApplyTransaction for any set of unspent outputs
+func applyTransaction(unspent unspentTxOuts, tx *Transaction) (int, error) {
+	fee, err := validateTransaction(tx, unspent)
+	if err != nil {
+		return 0, fmt.Errorf("transaction %s: %w", tx.Id, err)
+	}
+	for i := range tx.TxOuts {
+		if _, exists := unspent.Get(tx.OutPoint(i)); exists {
+			return 0, fmt.Errorf("%w: %s", ErrDuplicateTransaction, tx.Id)
+		}
+	}
+	for _, txIn := range tx.TxIns {
+		unspent.remove(txIn.OutPoint())
+	}
+	addOutputs(unspent, tx)
+	return fee, nil
+}
+
+// applyTransactions applies the transactions to `updated` in place and sums their fees. `updated` is left partly
+// applied when a transaction is invalid, so it must be a working set the caller drops on error.
+func applyTransactions(updated unspentTxOuts, txs []*Transaction) (int, error) {
+	seenTxIds := make(map[string]bool, len(txs))
+	spent := make(map[OutPoint]bool)
+	fees := 0
+
+	for _, tx := range txs {
+		if seenTxIds[tx.Id] {
+			return 0, fmt.Errorf("%w: %s", ErrDuplicateTransaction, tx.Id)
+		}
+		seenTxIds[tx.Id] = true
+
+		for _, txIn := range tx.TxIns {
+			if spent[txIn.OutPoint()] {
+				return 0, fmt.Errorf("%w: %s:%d", ErrDoubleSpend, txIn.TxOutId, txIn.TxOutIndex)
+			}
+		}
+		fee, err := applyTransaction(updated, tx)
+		if err != nil {
+			return 0, err
+		}
+		fees += fee
+		if fees < 0 {
+			return 0, ErrInvalidAmount
+		}
+		for _, txIn := range tx.TxIns {
+			spent[txIn.OutPoint()] = true
+		}
+	}
+	return fees, nil
+}
+
+// applyBlockTransactions applies the transactions of the block at `height` to `updated` in place like
+// applyTransactions, with the coinbase first
+func applyBlockTransactions(updated unspentTxOuts, txs []*Transaction, height int) (int, error) {
+	if len(txs) == 0 {
+		return 0, ErrMissingCoinbase
+	}
+	coinbase := txs[0]
+	err := IsCoinbaseTransactionValid(coinbase, height)
+	if err != nil {
+		return 0, fmt.Errorf("transaction %s: %w", coinbase.Id, err)
+	}
+	fees, err := applyTransactions(updated, txs[1:])
+	if err != nil {
+		return 0, err
+	}
+	if _, exists := updated.Get(coinbase.OutPoint(0)); exists {
+		return 0, fmt.Errorf("%w: %s", ErrDuplicateTransaction, coinbase.Id)
+	}
+	addOutputs(updated, coinbase)
+	return fees, nil
+}
+
+// getSpentOutputs is GetSpentOutputs for any set of unspent outputs
+func getSpentOutputs(unspent UnspentTxOutLookup, txs []*Transaction) []*UnspentTxOut {
+	var spent []*UnspentTxOut
+	for _, tx := range txs {
+		for _, txIn := range tx.TxIns {
+			if uTxOut, exists := unspent.Get(txIn.OutPoint()); exists {
+				spent = append(spent, uTxOut)
+			}
+		}
+	}
+	return spent
+}
+
+// revertTransactions is RevertTransactions applied to `reverted` in place
+func revertTransactions(reverted unspentTxOuts, txs []*Transaction, spent []*UnspentTxOut) {
+	for _, tx := range txs {
+		for i := range tx.TxOuts {
+			reverted.remove(tx.OutPoint(i))
+		}
+	}
+	for _, uTxOut := range spent {
+		reverted.add(uTxOut)
+	}
+}
+
+// addOutputs adds every output created by `tx` to the set
+func addOutputs(unspent unspentTxOuts, tx *Transaction) {
+	for i, txOut := range tx.TxOuts {
+		unspent.add(&UnspentTxOut{
+			TxOutId:    tx.Id,
+			TxOutIndex: i,
+			Address:    txOut.Address,
+			Amount:     txOut.Amount,
+		})
+	}
+}
+
+// FindByAddress returns the unspent outputs locked to the address, ordered by OutPoint
+func (set UnspentTxOutSet) FindByAddress(address string) []*UnspentTxOut {
+	var found []*UnspentTxOut
+	for _, uTxOut := range set {
+		if uTxOut.Address == address {
+			found = append(found, uTxOut)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].TxOutId != found[j].TxOutId {
+			return found[i].TxOutId < found[j].TxOutId
+		}
+		return found[i].TxOutIndex < found[j].TxOutIndex
+	})
+	return found
+}
@@ -0,0 +1,129 @@
+package transaction
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnspentTxOutSet_ApplyTransactions(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: testAddress(bob), Amount: 6}, {Address: testAddress(alice), Amount: 4}}), alice)
+	// tx2 spends an output created by tx1 in the same batch
+	tx2 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: tx1.Id, TxOutIndex: 0}},
+		[]*TxOut{{Address: "dave", Amount: 6}}), bob)
+
+	updated, err := unspent.ApplyTransactions([]*Transaction{tx1, tx2})
+	assert.Nil(t, err)
+	assert.Len(t, updated, 3)
+	assert.NotContains(t, updated, OutPoint{TxOutId: "a", TxOutIndex: 0})
+	assert.NotContains(t, updated, tx1.OutPoint(0))
+	assert.Equal(t, &UnspentTxOut{TxOutId: tx1.Id, TxOutIndex: 1, Address: testAddress(alice), Amount: 4},
+		updated[tx1.OutPoint(1)])
+	assert.Equal(t, &UnspentTxOut{TxOutId: tx2.Id, TxOutIndex: 0, Address: "dave", Amount: 6},
+		updated[tx2.OutPoint(0)])
+
+	assert.Len(t, unspent, 2, "The original set must not be modified")
+}
+
+func TestUnspentTxOutSet_ApplyTransactions_Invalid(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 10}}), alice)
+	tx2 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "dave", Amount: 10}}), alice)
+	_, err := unspent.ApplyTransactions([]*Transaction{tx1, tx2})
+	assert.ErrorIs(t, err, ErrDoubleSpend)
+
+	_, err = unspent.ApplyTransactions([]*Transaction{tx1, tx1})
+	assert.ErrorIs(t, err, ErrDuplicateTransaction)
+
+	missing := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "b", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 1}}), alice)
+	_, err = unspent.ApplyTransactions([]*Transaction{missing})
+	assert.ErrorIs(t, err, ErrMissingTxOut)
+}
+
+func TestUnspentTxOutSet_ApplyTransaction(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	tx := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 7}}), alice)
+
+	fee, err := unspent.ApplyTransaction(tx)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fee)
+	assert.Len(t, unspent, 2, "The set should be modified in place")
+	assert.NotContains(t, unspent, OutPoint{TxOutId: "a", TxOutIndex: 0})
+	assert.Contains(t, unspent, tx.OutPoint(0))
+
+	// A transaction that is not valid leaves the set unchanged
+	_, err = unspent.ApplyTransaction(tx)
+	assert.ErrorIs(t, err, ErrMissingTxOut)
+	stolen := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 1}},
+		[]*TxOut{{Address: "carol", Amount: 5}}), alice)
+	_, err = unspent.ApplyTransaction(stolen)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	assert.Len(t, unspent, 2)
+	assert.Contains(t, unspent, OutPoint{TxOutId: "a", TxOutIndex: 1})
+}
+
+func TestUnspentTxOutSet_ApplyBlockTransactions(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	coinbase := CreateCoinbaseTransaction("miner", 53, 1)
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 7}}), alice)
+
+	updated, fees, err := unspent.ApplyBlockTransactions([]*Transaction{coinbase, tx1}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fees, "Fees should be the inputs left over by the outputs")
+	assert.Equal(t, &UnspentTxOut{TxOutId: coinbase.Id, TxOutIndex: 0, Address: "miner", Amount: 53},
+		updated[coinbase.OutPoint(0)])
+	assert.Contains(t, updated, tx1.OutPoint(0))
+
+	fees, err = unspent.CalculateFees([]*Transaction{tx1})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fees)
+
+	_, _, err = unspent.ApplyBlockTransactions([]*Transaction{}, 1)
+	assert.ErrorIs(t, err, ErrMissingCoinbase)
+	_, _, err = unspent.ApplyBlockTransactions([]*Transaction{tx1}, 1)
+	assert.ErrorIs(t, err, ErrMissingCoinbase, "The coinbase must come first")
+	_, _, err = unspent.ApplyBlockTransactions([]*Transaction{coinbase, coinbase}, 1)
+	assert.ErrorIs(t, err, ErrMissingTxOut, "Only the first transaction can be a coinbase")
+}
+
+func TestUnspentTxOutSet_RevertTransactions(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	coinbase := CreateCoinbaseTransaction("miner", 50, 1)
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: testAddress(bob), Amount: 10}}), alice)
+	tx2 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: tx1.Id, TxOutIndex: 0}},
+		[]*TxOut{{Address: "dave", Amount: 10}}), bob)
+	txs := []*Transaction{coinbase, tx1, tx2}
+
+	spent := unspent.GetSpentOutputs(txs)
+	assert.Equal(t, []*UnspentTxOut{unspent[OutPoint{TxOutId: "a", TxOutIndex: 0}]}, spent,
+		"Outputs created by the transactions themselves should be left out")
+	updated, _, err := unspent.ApplyBlockTransactions(txs, 1)
+	assert.Nil(t, err)
+
+	reverted := updated.RevertTransactions(txs, spent)
+
+	assert.Equal(t, unspent, reverted, "Reverting should restore the set before the transactions were applied")
+	assert.Contains(t, updated, coinbase.OutPoint(0), "The receiver must not be modified")
+}
+
+func TestUnspentTxOutSet_FindByAddress(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	unspent[OutPoint{TxOutId: "0", TxOutIndex: 3}] = &UnspentTxOut{TxOutId: "0", TxOutIndex: 3,
+		Address: testAddress(alice), Amount: 1}
+
+	found := unspent.FindByAddress(testAddress(alice))
+	assert.Len(t, found, 2)
+	assert.Equal(t, "0", found[0].TxOutId, "Outputs should be ordered")
+	assert.Equal(t, "a", found[1].TxOutId, "Outputs should be ordered")
+	assert.Empty(t, unspent.FindByAddress("carol"))
+}
@@ -0,0 +1,138 @@
+package transaction
+
+import (
+	"sync/atomic"
+)
+
+// maxViewDepth is the number of layers a view can have on top of a flat set before it is flattened into one. Lookups
+// walk at most this many layers, and flattening copies the whole set once every this many blocks.
+const maxViewDepth = 64
+
+// UnspentTxOutView is an immutable set of unspent outputs stored as the outputs a block added and spent on top of the
+// view of its parent, so applying a block costs as much as the block rather than the whole set. Once a view has
+// maxViewDepth layers it is flattened into a set of its own, which keeps lookups fast and lets old layers be freed.
+type UnspentTxOutView struct {
+	parent *UnspentTxOutView
+	added  UnspentTxOutSet
+	spent  map[OutPoint]bool
+	depth  int
+	flat   atomic.Pointer[UnspentTxOutSet] // Every output in the view, set at the bottom or once it has been flattened
+}
+
+// CreateUnspentTxOutView creates a view holding the outputs of `set`. The set is shared with the view and must not be
+// modified afterwards.
+func CreateUnspentTxOutView(set UnspentTxOutSet) *UnspentTxOutView {
+	v := &UnspentTxOutView{}
+	v.flat.Store(&set)
+	return v
+}
+
+// Get returns the output spent with `outPoint`, if it is in the view
+func (v *UnspentTxOutView) Get(outPoint OutPoint) (*UnspentTxOut, bool) {
+	for layer := v; layer != nil; layer = layer.parent {
+		if flat := layer.flat.Load(); flat != nil {
+			uTxOut, ok := (*flat)[outPoint]
+			return uTxOut, ok
+		}
+		if uTxOut, ok := layer.added[outPoint]; ok {
+			return uTxOut, true
+		}
+		if layer.spent[outPoint] {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (v *UnspentTxOutView) add(uTxOut *UnspentTxOut) {
+	outPoint := OutPoint{TxOutId: uTxOut.TxOutId, TxOutIndex: uTxOut.TxOutIndex}
+	delete(v.spent, outPoint)
+	v.added[outPoint] = uTxOut
+}
+
+func (v *UnspentTxOutView) remove(outPoint OutPoint) {
+	if _, ok := v.added[outPoint]; ok {
+		delete(v.added, outPoint)
+		return
+	}
+	v.spent[outPoint] = true
+}
+
+// Extend returns an empty layer on top of the view that transactions can be applied to with ApplyTransaction. The
+// layer is a working set owned by the caller, and the view below it is never modified.
+func (v *UnspentTxOutView) Extend() *UnspentTxOutView {
+	parent := v
+	// A flattened view is the bottom of the new layer, so the layers below it can be freed
+	if flat := v.flat.Load(); flat != nil && v.parent != nil {
+		parent = CreateUnspentTxOutView(*flat)
+	}
+	return &UnspentTxOutView{
+		parent: parent,
+		added:  UnspentTxOutSet{},
+		spent:  map[OutPoint]bool{},
+		depth:  parent.depth + 1,
+	}
+}
+
+// seal returns the layer as an immutable view, flattened if it has too many layers below it
+func (v *UnspentTxOutView) seal() *UnspentTxOutView {
+	if v.depth < maxViewDepth {
+		return v
+	}
+	return CreateUnspentTxOutView(v.Flatten())
+}
+
+// ApplyTransaction validates `tx` against a layer returned by Extend and applies it to the layer in place like
+// UnspentTxOutSet.ApplyTransaction, and returns the fee it pays
+func (v *UnspentTxOutView) ApplyTransaction(tx *Transaction) (int, error) {
+	return applyTransaction(v, tx)
+}
+
+// ApplyBlockTransactions validates the transactions of the block at `height` like
+// UnspentTxOutSet.ApplyBlockTransactions and returns the view with the block applied and the fees paid by the block.
+// The receiver is never modified.
+func (v *UnspentTxOutView) ApplyBlockTransactions(txs []*Transaction, height int) (*UnspentTxOutView, int, error) {
+	updated := v.Extend()
+	fees, err := applyBlockTransactions(updated, txs, height)
+	if err != nil {
+		return nil, 0, err
+	}
+	return updated.seal(), fees, nil
+}
+
+// GetSpentOutputs returns the outputs in the view that the transactions spend like UnspentTxOutSet.GetSpentOutputs
+func (v *UnspentTxOutView) GetSpentOutputs(txs []*Transaction) []*UnspentTxOut {
+	return getSpentOutputs(v, txs)
+}
+
+// RevertTransactions returns the view with the transactions undone like UnspentTxOutSet.RevertTransactions. The
+// receiver is never modified.
+func (v *UnspentTxOutView) RevertTransactions(txs []*Transaction, spent []*UnspentTxOut) *UnspentTxOutView {
+	reverted := v.Extend()
+	revertTransactions(reverted, txs, spent)
+	return reverted.seal()
+}
+
+// Flatten returns every output in the view as one set. The set is built once and shared by every caller, so it must
+// not be modified.
+func (v *UnspentTxOutView) Flatten() UnspentTxOutSet {
+	if flat := v.flat.Load(); flat != nil {
+		return *flat
+	}
+	var layers []*UnspentTxOutView
+	bottom := v
+	for ; bottom.flat.Load() == nil; bottom = bottom.parent {
+		layers = append(layers, bottom)
+	}
+	flat := bottom.flat.Load().Copy()
+	for i := len(layers) - 1; i >= 0; i-- {
+		for outPoint := range layers[i].spent {
+			delete(flat, outPoint)
+		}
+		for outPoint, uTxOut := range layers[i].added {
+			flat[outPoint] = uTxOut
+		}
+	}
+	v.flat.Store(&flat)
+	return flat
+}
@@ -0,0 +1,93 @@
+package transaction
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnspentTxOutView_ApplyBlockTransactions(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	view := CreateUnspentTxOutView(unspent)
+	coinbase := CreateCoinbaseTransaction("miner", 50, 1)
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: testAddress(bob), Amount: 10}}), alice)
+	tx2 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: tx1.Id, TxOutIndex: 0}},
+		[]*TxOut{{Address: "dave", Amount: 10}}), bob)
+	txs := []*Transaction{coinbase, tx1, tx2}
+
+	updated, fees, err := view.ApplyBlockTransactions(txs, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, fees)
+	expected, _, _ := unspent.ApplyBlockTransactions(txs, 1)
+	assert.Equal(t, expected, updated.Flatten(), "A view should hold the same outputs as a set")
+	assert.Len(t, updated.added, 2, "Only the outputs the block left should be added to the layer")
+	assert.Len(t, updated.spent, 1, "Only the outputs the block spent from the set should be marked")
+	_, ok := updated.Get(OutPoint{TxOutId: "a", TxOutIndex: 0})
+	assert.False(t, ok)
+	uTxOut, ok := updated.Get(OutPoint{TxOutId: "a", TxOutIndex: 1})
+	assert.True(t, ok)
+	assert.Equal(t, unspent[OutPoint{TxOutId: "a", TxOutIndex: 1}], uTxOut)
+	assert.Equal(t, createTestUnspentTxOutSet(), unspent, "The set below the view must not be modified")
+
+	_, _, err = updated.ApplyBlockTransactions([]*Transaction{CreateCoinbaseTransaction("miner", 50, 2), tx1}, 2)
+	assert.ErrorIs(t, err, ErrMissingTxOut)
+	assert.Equal(t, expected, updated.Flatten(), "The receiver must not be modified")
+}
+
+func TestUnspentTxOutView_RevertTransactions(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	view := CreateUnspentTxOutView(unspent)
+	coinbase := CreateCoinbaseTransaction("miner", 50, 1)
+	tx1 := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 10}}), alice)
+	txs := []*Transaction{coinbase, tx1}
+
+	spent := view.GetSpentOutputs(txs)
+	assert.Equal(t, unspent.GetSpentOutputs(txs), spent)
+	updated, _, err := view.ApplyBlockTransactions(txs, 1)
+	assert.Nil(t, err)
+
+	reverted := updated.RevertTransactions(txs, spent)
+
+	assert.Equal(t, unspent, reverted.Flatten(), "Reverting should restore the outputs before the block")
+	assert.Contains(t, updated.Flatten(), coinbase.OutPoint(0), "The receiver must not be modified")
+}
+
+func TestUnspentTxOutView_Flatten(t *testing.T) {
+	unspent := createTestUnspentTxOutSet()
+	view := CreateUnspentTxOutView(unspent)
+	for height := 1; height < maxViewDepth; height++ {
+		var err error
+		view, _, err = view.ApplyBlockTransactions([]*Transaction{CreateCoinbaseTransaction("miner", 50, height)},
+			height)
+		assert.Nil(t, err)
+		assert.Equal(t, height, view.depth)
+	}
+
+	view, _, _ = view.ApplyBlockTransactions([]*Transaction{CreateCoinbaseTransaction("miner", 50, maxViewDepth)},
+		maxViewDepth)
+
+	assert.Nil(t, view.parent, "The view should be flattened once it has too many layers")
+	assert.Equal(t, 0, view.depth)
+	assert.Len(t, view.Flatten(), len(unspent)+maxViewDepth)
+	assert.Len(t, unspent, 2, "The set below the view must not be modified")
+}
+
+func TestUnspentTxOutView_Extend(t *testing.T) {
+	view, _, _ := CreateUnspentTxOutView(createTestUnspentTxOutSet()).ApplyBlockTransactions(
+		[]*Transaction{CreateCoinbaseTransaction("miner", 50, 1)}, 1)
+	flat := view.Flatten()
+	tx := signTestTransaction(CreateTransaction([]*TxIn{{TxOutId: "a", TxOutIndex: 0}},
+		[]*TxOut{{Address: "carol", Amount: 7}}), alice)
+
+	working := view.Extend()
+	fee, err := working.ApplyTransaction(tx)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fee)
+	assert.Nil(t, working.parent.parent, "A flattened view should be the bottom of the layers on top of it")
+	assert.Contains(t, working.Flatten(), tx.OutPoint(0))
+	assert.NotContains(t, working.Flatten(), OutPoint{TxOutId: "a", TxOutIndex: 0})
+	assert.Equal(t, flat, view.Flatten(), "The view below the layer must not be modified")
+	assert.Contains(t, view.Flatten(), OutPoint{TxOutId: "a", TxOutIndex: 0})
+}
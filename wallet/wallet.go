@@ -0,0 +1,159 @@
+package wallet
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/defaziom/blockchain-go/transaction"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNotOwner          = errors.New("output is not owned by the wallet")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// Wallet holds an Ed25519 key pair used to own and spend transaction outputs
+type Wallet struct {
+	PrivateKey ed25519.PrivateKey
+}
+
+// CreateWallet generates a new random key pair
+func CreateWallet() (*Wallet, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{PrivateKey: privateKey}, nil
+}
+
+// LoadWallet reads a wallet saved with Save from `path`
+func LoadWallet(path string) (*Wallet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet file: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid wallet file: wrong key size")
+	}
+	return &Wallet{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// LoadOrCreateWallet loads the wallet at `path`, or creates and saves a new one if the file does not exist
+func LoadOrCreateWallet(path string) (*Wallet, error) {
+	w, err := LoadWallet(path)
+	if err == nil {
+		return w, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	w, err = CreateWallet()
+	if err != nil {
+		return nil, err
+	}
+	return w, w.Save(path)
+}
+
+// Save writes the private key seed hex encoded to `path`. The file is only readable by the owner.
+func (w *Wallet) Save(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(w.PrivateKey.Seed())), 0600)
+}
+
+// GetPublicKey returns the public key of the wallet
+func (w *Wallet) GetPublicKey() ed25519.PublicKey {
+	return w.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// GetAddress returns the address outputs are locked to when sent to this wallet
+func (w *Wallet) GetAddress() string {
+	return hex.EncodeToString(w.GetPublicKey())
+}
+
+// Sign returns the hex encoded signature of `data` made with the wallet's private key
+func (w *Wallet) Sign(data []byte) string {
+	return hex.EncodeToString(ed25519.Sign(w.PrivateKey, data))
+}
+
+// VerifySignature checks that `signature` is a hex encoded signature of `data` made by the owner of `address`
+func VerifySignature(address string, data []byte, signature string) bool {
+	publicKey, err := hex.DecodeString(address)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, data, sig)
+}
+
+// GetBalance returns the sum of the unspent outputs owned by the wallet
+func (w *Wallet) GetBalance(unspent transaction.UnspentTxOutSet) int {
+	balance := 0
+	for _, uTxOut := range unspent.FindByAddress(w.GetAddress()) {
+		balance += uTxOut.Amount
+	}
+	return balance
+}
+
+// SignTransaction signs every input of the transaction. All the outputs spent by the transaction must be owned by
+// the wallet.
+func (w *Wallet) SignTransaction(tx *transaction.Transaction, unspent transaction.UnspentTxOutSet) error {
+	for _, txIn := range tx.TxIns {
+		uTxOut, ok := unspent[txIn.OutPoint()]
+		if !ok {
+			return fmt.Errorf("%w: %s:%d", transaction.ErrMissingTxOut, txIn.TxOutId, txIn.TxOutIndex)
+		}
+		if uTxOut.Address != w.GetAddress() {
+			return fmt.Errorf("%w: %s:%d", ErrNotOwner, txIn.TxOutId, txIn.TxOutIndex)
+		}
+		txIn.Signature = w.Sign([]byte(tx.Id))
+	}
+	return nil
+}
+
+// CreateTransaction creates a signed transaction sending `amount` to `receiver`. Inputs are taken from the outputs
+// owned by the wallet and any leftover amount is sent back to the wallet.
+func (w *Wallet) CreateTransaction(receiver string, amount int, unspent transaction.UnspentTxOutSet) (
+	*transaction.Transaction, error) {
+	if amount <= 0 {
+		return nil, transaction.ErrInvalidAmount
+	}
+
+	var txIns []*transaction.TxIn
+	total := 0
+	for _, uTxOut := range unspent.FindByAddress(w.GetAddress()) {
+		if total >= amount {
+			break
+		}
+		txIns = append(txIns, &transaction.TxIn{TxOutId: uTxOut.TxOutId, TxOutIndex: uTxOut.TxOutIndex})
+		total += uTxOut.Amount
+	}
+	if total < amount {
+		return nil, ErrInsufficientFunds
+	}
+
+	txOuts := []*transaction.TxOut{{Address: receiver, Amount: amount}}
+	if change := total - amount; change > 0 {
+		txOuts = append(txOuts, &transaction.TxOut{Address: w.GetAddress(), Amount: change})
+	}
+
+	tx := transaction.CreateTransaction(txIns, txOuts)
+	err := w.SignTransaction(tx, unspent)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
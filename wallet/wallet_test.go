@@ -0,0 +1,101 @@
+package wallet
+
+import (
+	"github.com/defaziom/blockchain-go/transaction"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createFundedWallet(t *testing.T, amounts ...int) (*Wallet, transaction.UnspentTxOutSet) {
+	w, err := CreateWallet()
+	assert.Nil(t, err)
+	unspent := transaction.UnspentTxOutSet{}
+	for i, amount := range amounts {
+		unspent[transaction.OutPoint{TxOutId: "funding", TxOutIndex: i}] = &transaction.UnspentTxOut{
+			TxOutId: "funding", TxOutIndex: i, Address: w.GetAddress(), Amount: amount}
+	}
+	return w, unspent
+}
+
+func TestWallet_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet", "private_key")
+	w, err := CreateWallet()
+	assert.Nil(t, err)
+
+	assert.Nil(t, w.Save(path))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Wallet file should only be readable by the owner")
+
+	loaded, err := LoadWallet(path)
+	assert.Nil(t, err)
+	assert.Equal(t, w.GetAddress(), loaded.GetAddress())
+}
+
+func TestLoadOrCreateWallet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "private_key")
+
+	created, err := LoadOrCreateWallet(path)
+	assert.Nil(t, err)
+	loaded, err := LoadOrCreateWallet(path)
+	assert.Nil(t, err)
+	assert.Equal(t, created.GetAddress(), loaded.GetAddress(), "Existing wallet should be loaded")
+
+	assert.Nil(t, os.WriteFile(path, []byte("not a key"), 0600))
+	_, err = LoadOrCreateWallet(path)
+	assert.NotNil(t, err, "Corrupt wallet file should not be overwritten")
+}
+
+func TestWallet_GetAddress(t *testing.T) {
+	w, _ := CreateWallet()
+	other, _ := CreateWallet()
+	assert.Len(t, w.GetAddress(), 64, "Address should be the hex encoded public key")
+	assert.NotEqual(t, w.GetAddress(), other.GetAddress())
+}
+
+func TestWallet_Sign(t *testing.T) {
+	w, _ := CreateWallet()
+	other, _ := CreateWallet()
+	data := []byte("data")
+
+	signature := w.Sign(data)
+
+	assert.True(t, VerifySignature(w.GetAddress(), data, signature))
+	assert.False(t, VerifySignature(other.GetAddress(), data, signature), "Signature should only verify for the signer")
+	assert.False(t, VerifySignature(w.GetAddress(), []byte("other data"), signature))
+	assert.False(t, VerifySignature(w.GetAddress(), data, "not a signature"))
+	assert.False(t, VerifySignature("not an address", data, signature))
+}
+
+func TestWallet_SignTransaction(t *testing.T) {
+	w, unspent := createFundedWallet(t, 10)
+	other, _ := CreateWallet()
+
+	tx := transaction.CreateTransaction([]*transaction.TxIn{{TxOutId: "funding", TxOutIndex: 0}},
+		[]*transaction.TxOut{{Address: other.GetAddress(), Amount: 10}})
+
+	assert.ErrorIs(t, other.SignTransaction(tx, unspent), ErrNotOwner)
+	assert.Nil(t, w.SignTransaction(tx, unspent))
+	assert.Nil(t, transaction.ValidateTransaction(tx, unspent))
+}
+
+func TestWallet_CreateTransaction(t *testing.T) {
+	w, unspent := createFundedWallet(t, 10, 5, 20)
+	receiver, _ := CreateWallet()
+
+	assert.Equal(t, 35, w.GetBalance(unspent))
+
+	tx, err := w.CreateTransaction(receiver.GetAddress(), 12, unspent)
+	assert.Nil(t, err)
+	assert.Nil(t, transaction.ValidateTransaction(tx, unspent))
+
+	updated, err := unspent.ApplyTransactions([]*transaction.Transaction{tx})
+	assert.Nil(t, err)
+	assert.Equal(t, 12, receiver.GetBalance(updated))
+	assert.Equal(t, 23, w.GetBalance(updated), "Change should be sent back to the wallet")
+
+	_, err = w.CreateTransaction(receiver.GetAddress(), 36, unspent)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+}